@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// limiterSweepSize is the number of tracked keys after which expired ones are swept
+const limiterSweepSize = 10000
+
+// LoginLimiter locks out a key, such as a client address and username, after too many failed logins
+// within a window
+type LoginLimiter struct {
+	maxFailures int
+	window      time.Duration
+	lock        sync.Mutex
+	failures    map[string][]time.Time
+}
+
+// NewLoginLimiter allows maxFailures failed logins per key within window
+func NewLoginLimiter(maxFailures int, window time.Duration) *LoginLimiter {
+	return &LoginLimiter{
+		maxFailures: maxFailures,
+		window:      window,
+		failures:    make(map[string][]time.Time),
+	}
+}
+
+// recent drops the failures of key that fell out of the window. The caller must hold the lock.
+func (limiter *LoginLimiter) recent(key string, now time.Time) []time.Time {
+	failures := limiter.failures[key]
+	for len(failures) > 0 && now.Sub(failures[0]) >= limiter.window {
+		failures = failures[1:]
+	}
+	if len(failures) == 0 {
+		delete(limiter.failures, key)
+		return nil
+	}
+	limiter.failures[key] = failures
+	return failures
+}
+
+// Blocked reports whether any of keys is locked out, and for how long
+func (limiter *LoginLimiter) Blocked(keys ...string) (bool, time.Duration) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		failures := limiter.recent(key, now)
+		if len(failures) >= limiter.maxFailures {
+			if remaining := limiter.window - now.Sub(failures[0]); remaining > wait {
+				wait = remaining
+			}
+		}
+	}
+	return wait > 0, wait
+}
+
+// Fail records a failed login against every key
+func (limiter *LoginLimiter) Fail(keys ...string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := time.Now()
+
+	// Sweep keys that were never retried, so a flood of addresses cannot grow the map forever
+	if len(limiter.failures) >= limiterSweepSize {
+		for key := range limiter.failures {
+			limiter.recent(key, now)
+		}
+	}
+
+	for _, key := range keys {
+		limiter.failures[key] = append(limiter.recent(key, now), now)
+	}
+}
+
+// Reset forgets the failures of every key after a successful login
+func (limiter *LoginLimiter) Reset(keys ...string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	for _, key := range keys {
+		delete(limiter.failures, key)
+	}
+}
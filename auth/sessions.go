@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSessionTTL is how long a dashboard login lasts when no lifetime is configured
+const DefaultSessionTTL = 12 * time.Hour
+
+var (
+	ErrInvalidSession = errors.New("invalid session")
+	ErrSessionExpired = errors.New("session expired")
+)
+
+// Session is a dashboard login, carried in a cookie signed with the session secret
+type Session struct {
+	User    string `json:"u"`
+	Expires int64  `json:"e"`
+	Nonce   string `json:"n"`
+	Stamp   string `json:"s"` // Fingerprint of the user's password hash and role when they logged in
+}
+
+// SessionManager issues and verifies signed session cookies. Sessions are stateless apart from the
+// ones that were logged out before they expired.
+type SessionManager struct {
+	secret  []byte
+	ttl     time.Duration
+	lock    sync.Mutex
+	revoked map[string]int64
+}
+
+// NewSessionManager signs sessions with secret. An empty secret is replaced with a random one, which
+// logs everyone out whenever the server restarts.
+func NewSessionManager(secret string, ttl time.Duration) (*SessionManager, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+
+	return &SessionManager{secret: key, ttl: ttl, revoked: make(map[string]int64)}, nil
+}
+
+// TTL returns how long a new session lasts
+func (manager *SessionManager) TTL() time.Duration {
+	return manager.ttl
+}
+
+func (manager *SessionManager) sign(purpose string, data []byte) []byte {
+	mac := hmac.New(sha256.New, manager.secret)
+	mac.Write([]byte(purpose))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// stamp fingerprints the credentials and role of a user as stored, so a session can tell whether
+// they changed since it was issued
+func (manager *SessionManager) stamp(user User) string {
+	return hex.EncodeToString(manager.sign("user", []byte(user.Username+"\x00"+user.Password+"\x00"+user.Role))[:16])
+}
+
+// Issue starts a session for user, as stored with its password hash, and returns the cookie value
+// that carries it
+func (manager *SessionManager) Issue(user User) (string, Session, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", Session{}, err
+	}
+
+	session := Session{
+		User:    user.Username,
+		Expires: time.Now().Add(manager.ttl).Unix(),
+		Nonce:   hex.EncodeToString(nonce),
+		Stamp:   manager.stamp(user),
+	}
+
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	value := base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(manager.sign("session", payload))
+	return value, session, nil
+}
+
+// Verify checks the signature and expiry of a session cookie
+func (manager *SessionManager) Verify(value string) (Session, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(value, ".")
+	if !ok {
+		return Session{}, ErrInvalidSession
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return Session{}, ErrInvalidSession
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, manager.sign("session", payload)) {
+		return Session{}, ErrInvalidSession
+	}
+
+	var session Session
+	if err := json.Unmarshal(payload, &session); err != nil {
+		return Session{}, ErrInvalidSession
+	}
+	if time.Now().Unix() >= session.Expires {
+		return Session{}, ErrSessionExpired
+	}
+
+	manager.lock.Lock()
+	_, revoked := manager.revoked[session.Nonce]
+	manager.lock.Unlock()
+	if revoked {
+		return Session{}, ErrSessionExpired
+	}
+
+	return session, nil
+}
+
+// Current reports whether session was issued to user as it is stored now. Changing a user's password
+// or role, or removing and adding them again, ends every session they had.
+func (manager *SessionManager) Current(session Session, user User) bool {
+	return session.User == user.Username && hmac.Equal([]byte(session.Stamp), []byte(manager.stamp(user)))
+}
+
+// Revoke ends a session before it expires
+func (manager *SessionManager) Revoke(session Session) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	now := time.Now().Unix()
+	for nonce, expires := range manager.revoked {
+		if expires <= now {
+			delete(manager.revoked, nonce)
+		}
+	}
+	manager.revoked[session.Nonce] = session.Expires
+}
+
+// CSRFToken returns the anti-forgery token that forms and scripts must send back within session
+func (manager *SessionManager) CSRFToken(session Session) string {
+	return hex.EncodeToString(manager.sign("csrf", []byte(session.Nonce)))
+}
+
+// CheckCSRF reports whether token is the anti-forgery token of session
+func (manager *SessionManager) CheckCSRF(session Session, token string) bool {
+	return hmac.Equal([]byte(token), []byte(manager.CSRFToken(session)))
+}
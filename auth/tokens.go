@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"CyberDefenseEd/QuadDB/util"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Verbs a token can be granted on a collection. Each verb implies the ones before it.
+const (
+	VerbRead  = "read"
+	VerbWrite = "write"
+	VerbAdmin = "admin"
+)
+
+// AnyCollection grants a scope on every collection, and is what routes without a collection ask for
+const AnyCollection = "*"
+
+// tokenPrefix marks API tokens so they are easy to recognise in logs and secret scanners
+const tokenPrefix = "qdb_"
+
+var verbRank = map[string]int{
+	VerbRead:  1,
+	VerbWrite: 2,
+	VerbAdmin: 3,
+}
+
+var ErrTokenNotFound = errors.New("token not found")
+
+// Scope grants a set of verbs on one collection, or on every collection with AnyCollection
+type Scope struct {
+	Collection string   `json:"collection"`
+	Verbs      []string `json:"verbs"`
+}
+
+// Token is an API token as stored in the tokens file. Only a SHA-256 hash of the secret is kept.
+type Token struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash,omitempty"`
+	Scopes  []Scope   `json:"scopes"`
+	Created time.Time `json:"created"`
+}
+
+// Allows reports whether the token grants verb on collection
+func (token *Token) Allows(collection, verb string) bool {
+	for _, scope := range token.Scopes {
+		if scope.Collection != AnyCollection && scope.Collection != collection {
+			continue
+		}
+		for _, granted := range scope.Verbs {
+			if verbRank[granted] >= verbRank[verb] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidateScopes checks that every scope names a collection and only known verbs
+func ValidateScopes(scopes []Scope) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if scope.Collection == "" {
+			return errors.New("scope collection is required, use \"*\" for every collection")
+		}
+		if len(scope.Verbs) == 0 {
+			return fmt.Errorf("scope for '%s' has no verbs", scope.Collection)
+		}
+		for _, verb := range scope.Verbs {
+			if _, ok := verbRank[verb]; !ok {
+				return fmt.Errorf("unknown verb '%s', expected read, write or admin", verb)
+			}
+		}
+	}
+	return nil
+}
+
+// HashToken returns the hex SHA-256 of a token secret, as stored in the tokens file
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenStore holds the API tokens from a JSON file, which is reloaded whenever it changes on disk
+type TokenStore struct {
+	path    string
+	lock    sync.RWMutex
+	tokens  []*Token
+	byHash  map[string]*Token
+	modTime time.Time
+}
+
+// LoadTokens reads the tokens file at path. A missing file is an empty store.
+func LoadTokens(path string) (*TokenStore, error) {
+	store := &TokenStore{path: path, byHash: make(map[string]*Token)}
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// reload rereads the tokens file if it changed since it was last read
+func (store *TokenStore) reload() error {
+	info, err := os.Stat(store.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	store.lock.RLock()
+	unchanged := info.ModTime().Equal(store.modTime)
+	store.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		return err
+	}
+
+	var tokens []*Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		store.skip(info.ModTime())
+		return fmt.Errorf("invalid tokens file '%s': %v", store.path, err)
+	}
+
+	byHash := make(map[string]*Token, len(tokens))
+	for _, token := range tokens {
+		if err := ValidateScopes(token.Scopes); err != nil {
+			store.skip(info.ModTime())
+			return fmt.Errorf("invalid token '%s' in '%s': %v", token.ID, store.path, err)
+		}
+		byHash[token.Hash] = token
+	}
+
+	store.lock.Lock()
+	store.tokens = tokens
+	store.byHash = byHash
+	store.modTime = info.ModTime()
+	store.lock.Unlock()
+
+	return nil
+}
+
+// skip remembers a broken version of the tokens file, so it is only reported once
+func (store *TokenStore) skip(modTime time.Time) {
+	store.lock.Lock()
+	store.modTime = modTime
+	store.lock.Unlock()
+}
+
+// save writes the tokens back to the tokens file. The caller must hold the write lock.
+func (store *TokenStore) save() error {
+	data, err := json.MarshalIndent(store.tokens, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err := util.WriteFileAtomic(store.path, data, 0600, ""); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(store.path); err == nil {
+		store.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Authenticate returns the token matching secret
+func (store *TokenStore) Authenticate(secret string) (*Token, bool) {
+	if err := store.reload(); err != nil {
+		util.Warn(fmt.Sprintf("Keeping the previous API tokens: %v", err))
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	token, ok := store.byHash[HashToken(secret)]
+	return token, ok
+}
+
+// Create adds a token with the given scopes and returns its secret, which is not stored anywhere
+func (store *TokenStore) Create(name string, scopes []Scope) (string, Token, error) {
+	if err := ValidateScopes(scopes); err != nil {
+		return "", Token{}, err
+	}
+	if err := store.reload(); err != nil {
+		return "", Token{}, err
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", Token{}, err
+	}
+	secret := tokenPrefix + hex.EncodeToString(random)
+
+	token := &Token{
+		ID:      uuid.New().String(),
+		Name:    name,
+		Hash:    HashToken(secret),
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.tokens = append(store.tokens, token)
+	if err := store.save(); err != nil {
+		store.tokens = store.tokens[:len(store.tokens)-1]
+		return "", Token{}, err
+	}
+	store.byHash[token.Hash] = token
+
+	result := *token
+	result.Hash = ""
+	return secret, result, nil
+}
+
+// Revoke removes the token with the given id
+func (store *TokenStore) Revoke(id string) error {
+	if err := store.reload(); err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for i, token := range store.tokens {
+		if token.ID != id {
+			continue
+		}
+
+		tokens := append(append([]*Token{}, store.tokens[:i]...), store.tokens[i+1:]...)
+		previous := store.tokens
+		store.tokens = tokens
+		if err := store.save(); err != nil {
+			store.tokens = previous
+			return err
+		}
+		delete(store.byHash, token.Hash)
+		return nil
+	}
+
+	return ErrTokenNotFound
+}
+
+// List returns every token without its hash
+func (store *TokenStore) List() []Token {
+	if err := store.reload(); err != nil {
+		util.Warn(fmt.Sprintf("Keeping the previous API tokens: %v", err))
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	tokens := make([]Token, 0, len(store.tokens))
+	for _, token := range store.tokens {
+		listed := *token
+		listed.Hash = ""
+		tokens = append(tokens, listed)
+	}
+	return tokens
+}
+
+// Empty reports whether the store holds no tokens at all
+func (store *TokenStore) Empty() bool {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return len(store.tokens) == 0
+}
@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"CyberDefenseEd/QuadDB/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles a user can have. Each role implies the ones after it.
+const (
+	RoleAdmin     = "admin"
+	RoleReadWrite = "read-write"
+	RoleReadOnly  = "read-only"
+)
+
+// minPasswordLength is the shortest password a user can be given
+const minPasswordLength = 8
+
+// passwordCost is the bcrypt cost for new password hashes
+const passwordCost = 12
+
+var roleVerbs = map[string]string{
+	RoleAdmin:     VerbAdmin,
+	RoleReadWrite: VerbWrite,
+	RoleReadOnly:  VerbRead,
+}
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+	ErrLastAdmin    = errors.New("cannot remove or demote the last admin")
+)
+
+// dummyHash is compared against when a login names an unknown user, so both cases take as long
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a password"), passwordCost)
+	return hash
+})
+
+// User is a dashboard account as stored in the users file
+type User struct {
+	Username string `json:"-"`
+	Password string `json:"password,omitempty"`
+	Role     string `json:"role"`
+}
+
+// Scopes returns the API access that the user's role grants on every collection
+func (user User) Scopes() []Scope {
+	return []Scope{{Collection: AnyCollection, Verbs: []string{roleVerbs[user.Role]}}}
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	_, ok := roleVerbs[role]
+	return ok
+}
+
+// UserStore holds the dashboard users from a JSON file, which is reloaded whenever it changes on disk
+type UserStore struct {
+	path    string
+	lock    sync.RWMutex
+	users   map[string]User
+	modTime time.Time
+}
+
+// LoadUsers reads the users file at path. A missing file is an empty store.
+func LoadUsers(path string) (*UserStore, error) {
+	store := &UserStore{path: path, users: make(map[string]User)}
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// parseUsers decodes a users file. Files from before roles mapped usernames straight to password
+// hashes; those users are admins, as every dashboard user used to be.
+func parseUsers(data []byte) (map[string]User, error) {
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]User, len(entries))
+	for username, entry := range entries {
+		var user User
+
+		var hash string
+		if err := json.Unmarshal(entry, &hash); err == nil {
+			user = User{Password: hash, Role: RoleAdmin}
+		} else if err := json.Unmarshal(entry, &user); err != nil {
+			return nil, fmt.Errorf("user '%s': %v", username, err)
+		}
+
+		if !ValidRole(user.Role) {
+			return nil, fmt.Errorf("user '%s' has unknown role '%s'", username, user.Role)
+		}
+
+		user.Username = username
+		users[username] = user
+	}
+
+	return users, nil
+}
+
+// reload rereads the users file if it changed since it was last read
+func (store *UserStore) reload() error {
+	info, err := os.Stat(store.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	store.lock.RLock()
+	unchanged := info.ModTime().Equal(store.modTime)
+	store.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		return err
+	}
+
+	users, err := parseUsers(data)
+	if err != nil {
+		store.skip(info.ModTime())
+		return fmt.Errorf("invalid users file '%s': %v", store.path, err)
+	}
+
+	store.lock.Lock()
+	store.users = users
+	store.modTime = info.ModTime()
+	store.lock.Unlock()
+
+	return nil
+}
+
+// skip remembers a broken version of the users file, so it is only reported once
+func (store *UserStore) skip(modTime time.Time) {
+	store.lock.Lock()
+	store.modTime = modTime
+	store.lock.Unlock()
+}
+
+// refresh reloads the users file, keeping the users already loaded if it is broken
+func (store *UserStore) refresh() {
+	if err := store.reload(); err != nil {
+		util.Warn(fmt.Sprintf("Keeping the previous users: %v", err))
+	}
+}
+
+// save writes the users back to the users file. The caller must hold the write lock.
+func (store *UserStore) save(users map[string]User) error {
+	data, err := json.MarshalIndent(users, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err := util.WriteFileAtomic(store.path, data, 0600, ""); err != nil {
+		return err
+	}
+
+	store.users = users
+	if info, err := os.Stat(store.path); err == nil {
+		store.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// update applies change to a copy of the users under the write lock and saves the result
+func (store *UserStore) update(change func(users map[string]User) error) error {
+	if err := store.reload(); err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	users := make(map[string]User, len(store.users))
+	for username, user := range store.users {
+		users[username] = user
+	}
+
+	if err := change(users); err != nil {
+		return err
+	}
+
+	return store.save(users)
+}
+
+// hashPassword checks a new password and returns its bcrypt hash
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// countAdmins returns the number of admins in users
+func countAdmins(users map[string]User) int {
+	count := 0
+	for _, user := range users {
+		if user.Role == RoleAdmin {
+			count++
+		}
+	}
+	return count
+}
+
+// Authenticate returns the user with the given credentials
+func (store *UserStore) Authenticate(username, password string) (User, bool) {
+	user, exists := store.Get(username)
+
+	hash := []byte(user.Password)
+	if !exists {
+		hash = dummyHash()
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !exists {
+		return User{}, false
+	}
+
+	user.Password = ""
+	return user, true
+}
+
+// Get returns the user called username
+func (store *UserStore) Get(username string) (User, bool) {
+	store.refresh()
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	user, exists := store.users[username]
+	return user, exists
+}
+
+// List returns every user, without password hashes, sorted by name
+func (store *UserStore) List() []User {
+	store.refresh()
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	users := make([]User, 0, len(store.users))
+	for _, user := range store.users {
+		user.Password = ""
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+// Add creates a user
+func (store *UserStore) Add(username, password, role string) error {
+	if !usernamePattern.MatchString(username) {
+		return errors.New("usernames may only contain letters, digits and . _ @ -, up to 64 characters")
+	}
+	if !ValidRole(role) {
+		return fmt.Errorf("unknown role '%s', expected admin, read-write or read-only", role)
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return store.update(func(users map[string]User) error {
+		if _, exists := users[username]; exists {
+			return ErrUserExists
+		}
+		users[username] = User{Username: username, Password: hash, Role: role}
+		return nil
+	})
+}
+
+// Remove deletes a user
+func (store *UserStore) Remove(username string) error {
+	return store.update(func(users map[string]User) error {
+		user, exists := users[username]
+		if !exists {
+			return ErrUserNotFound
+		}
+		if user.Role == RoleAdmin && countAdmins(users) == 1 {
+			return ErrLastAdmin
+		}
+		delete(users, username)
+		return nil
+	})
+}
+
+// SetPassword changes a user's password
+func (store *UserStore) SetPassword(username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return store.update(func(users map[string]User) error {
+		user, exists := users[username]
+		if !exists {
+			return ErrUserNotFound
+		}
+		user.Password = hash
+		users[username] = user
+		return nil
+	})
+}
+
+// SetRole changes a user's role
+func (store *UserStore) SetRole(username, role string) error {
+	if !ValidRole(role) {
+		return fmt.Errorf("unknown role '%s', expected admin, read-write or read-only", role)
+	}
+
+	return store.update(func(users map[string]User) error {
+		user, exists := users[username]
+		if !exists {
+			return ErrUserNotFound
+		}
+		if user.Role == RoleAdmin && role != RoleAdmin && countAdmins(users) == 1 {
+			return ErrLastAdmin
+		}
+		user.Role = role
+		users[username] = user
+		return nil
+	})
+}
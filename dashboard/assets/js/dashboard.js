@@ -1,6 +1,9 @@
 let page = 1;
 let totalPages = 0;
 
+// The API accepts the dashboard session cookie, but only with the page's CSRF token on writes
+const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+
 function fetchData(collectionName, count, currentPage = 1) {
     page = currentPage;
 
@@ -80,9 +83,15 @@ function fetchData(collectionName, count, currentPage = 1) {
         });
 }
 
+// Revision of the document being edited, sent back as If-Match so concurrent edits are not overwritten
+let documentETag = null;
+
 function fetchDocumentDetails(collectionName, documentId) {
     fetch(`/api/v1/docs/${collectionName}/${documentId}`)
-        .then(response => response.json())
+        .then(response => {
+            documentETag = response.headers.get('ETag');
+            return response.json();
+        })
         .then(data => {
             const collectionContent = document.getElementById('collectionContent');
 
@@ -113,14 +122,28 @@ function validateAndPost(collectionName, documentId) {
         fetch(`/api/v1/docs/${collectionName}/${documentId}`, {
                 method: 'PUT',
                 headers: {
-                    'Content-Type': 'application/json'
+                    'Content-Type': 'application/json',
+                    'X-CSRF-Token': csrfToken,
+                    ...(documentETag ? { 'If-Match': documentETag } : {})
                 },
                 body: JSON.stringify(parsedJSON)
             })
             .then(response => {
+                if (response.status === 412) {
+                    new Notify({
+                        title: 'Collection Update Error',
+                        text: 'Someone else changed this document, reload it before saving.',
+                        backgroundColor: 'var(--accent-error)',
+                        position: 'right bottom',
+                        autoclose: true,
+                        autotimeout: 5000
+                    });
+                    throw new Error('Document changed since it was loaded');
+                }
                 if (!response.ok) {
                     throw new Error('Network response was not ok');
                 }
+                documentETag = response.headers.get('ETag');
                 return response.json();
             })
             .then(data => {
@@ -148,7 +171,7 @@ function validateAndPost(collectionName, documentId) {
     }
 }
 
-fetch('/api/v1/docs/collections')
+fetch('/api/v1/collections')
     .then(response => response.json())
     .then(data => {
         const collectionsElement = document.getElementById('collections');
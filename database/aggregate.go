@@ -0,0 +1,934 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidPipeline is returned for aggregation pipelines that cannot be parsed
+var ErrInvalidPipeline = errors.New("invalid pipeline")
+
+// Pipeline is a parsed aggregation pipeline. Pipelines are JSON arrays of stages in the style of
+// MongoDB, which each transform the documents the stage before them produced:
+//
+//	[{"$match": {"status": "open"}}, {"$group": {"_id": "$severity", "count": {"$sum": 1}}}, {"$sort": {"count": -1}}]
+//
+// Documents enter the pipeline ordered by key, with their key as "_id" unless they have an "_id"
+// field of their own. Documents that are not JSON objects are left out.
+type Pipeline struct {
+	match  matcher // Leading $match stage, answered from the indexes where it allows; nil if none
+	stages []stage
+}
+
+// stage is a compiled stage of a pipeline
+type stage interface {
+	run(documents []interface{}) []interface{}
+}
+
+// ParsePipeline parses a JSON aggregation pipeline
+func ParsePipeline(data []byte) (*Pipeline, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%w: a pipeline must be an array of stages", ErrInvalidPipeline)
+	}
+
+	pipeline := &Pipeline{}
+	for i, rawStage := range raw {
+		var operators map[string]json.RawMessage
+		if err := json.Unmarshal(rawStage, &operators); err != nil || len(operators) != 1 {
+			return nil, fmt.Errorf("%w: stage %d must be an object with a single stage operator", ErrInvalidPipeline, i+1)
+		}
+
+		for name, operand := range operators {
+			parsed, err := parseStage(name, operand)
+			if err != nil {
+				return nil, fmt.Errorf("%w: stage %d (%s): %v", ErrInvalidPipeline, i+1, name, err)
+			}
+
+			if match, ok := parsed.(matchStage); ok && i == 0 {
+				pipeline.match = match.matcher
+				continue
+			}
+			pipeline.stages = append(pipeline.stages, parsed)
+		}
+	}
+	return pipeline, nil
+}
+
+// parseStage compiles a single stage
+func parseStage(name string, operand json.RawMessage) (stage, error) {
+	switch name {
+	case "$sort":
+		return parseSortStage(operand)
+	}
+
+	value, err := decodeJSON(operand)
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "$match":
+		m, err := parseFilter(value)
+		if err != nil {
+			return nil, err
+		}
+		return matchStage{m}, nil
+	case "$group":
+		return parseGroupStage(value)
+	case "$limit":
+		number, ok := value.(json.Number)
+		limit, err := strconv.Atoi(number.String())
+		if !ok || err != nil || limit <= 0 {
+			return nil, errors.New("takes a positive integer")
+		}
+		return limitStage(limit), nil
+	case "$project":
+		return parseProjectStage(value)
+	case "$unwind":
+		return parseUnwindStage(value)
+	}
+	return nil, errors.New("unknown stage")
+}
+
+// Aggregate runs a pipeline over the documents of the collection and returns what its last stage
+// produces. Only the leading $match stage reads the stored documents, and it is answered from the
+// declared indexes where the filter allows it.
+func (db *Database) Aggregate(pipeline *Pipeline) ([]interface{}, QueryPlan, error) {
+	documents, plan, err := db.pipelineInput(pipeline.match)
+	if err != nil {
+		return nil, QueryPlan{}, err
+	}
+
+	for _, stage := range pipeline.stages {
+		documents = stage.run(documents)
+	}
+	if documents == nil {
+		documents = []interface{}{}
+	}
+	return documents, plan, nil
+}
+
+// pipelineInput decodes the documents matching the leading $match stage of a pipeline, or every
+// document if it has none, so the rest of the pipeline can run without holding the locks
+func (db *Database) pipelineInput(match matcher) ([]interface{}, QueryPlan, error) {
+	db.docsLock.RLock()
+	defer db.docsLock.RUnlock()
+
+	if db.loadErr != nil {
+		return nil, QueryPlan{}, db.loadErr
+	}
+
+	plan := QueryPlan{Indexes: []string{}}
+	var candidates map[string]bool
+	indexed := false
+	if match != nil {
+		indexes := make(map[string]bool)
+		db.indexLock.RLock()
+		candidates, indexed = db.candidates(match, indexes)
+		db.indexLock.RUnlock()
+
+		for name := range indexes {
+			plan.Indexes = append(plan.Indexes, name)
+		}
+		sort.Strings(plan.Indexes)
+	}
+
+	var keys []string
+	if indexed {
+		keys = make([]string, 0, len(candidates))
+		for key := range candidates {
+			keys = append(keys, key)
+		}
+	} else {
+		keys = make([]string, 0, len(db.documents))
+		for key := range db.documents {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var documents []interface{}
+	for _, key := range keys {
+		data, exists := db.document(key)
+		if !exists {
+			continue
+		}
+
+		plan.Examined++
+		decoded, ok := decodedDocument(data)
+		document, isObject := decoded.(map[string]interface{})
+		if !ok || !isObject {
+			continue
+		}
+		if _, hasID := document["_id"]; !hasID {
+			document["_id"] = key
+		}
+		if match == nil || match.match(document) {
+			documents = append(documents, document)
+		}
+	}
+	return documents, plan, nil
+}
+
+// matchStage keeps the documents matching a query filter
+type matchStage struct {
+	matcher
+}
+
+func (s matchStage) run(documents []interface{}) []interface{} {
+	var matched []interface{}
+	for _, document := range documents {
+		if s.match(document) {
+			matched = append(matched, document)
+		}
+	}
+	return matched
+}
+
+// limitStage keeps the first documents
+type limitStage int
+
+func (s limitStage) run(documents []interface{}) []interface{} {
+	if len(documents) > int(s) {
+		return documents[:s]
+	}
+	return documents
+}
+
+// sortStage orders documents, keeping the order they came in for documents that sort alike
+type sortStage []SortField
+
+// parseSortStage reads a sort order given as an object, {"count": -1, "_id": 1}, whose fields are
+// sorted on in the order they are written, or as a string the way ParseSort reads it
+func parseSortStage(operand json.RawMessage) (stage, error) {
+	var text string
+	if json.Unmarshal(operand, &text) == nil {
+		fields, err := ParseSort(text)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			return nil, errors.New("takes at least one field")
+		}
+		return sortStage(fields), nil
+	}
+
+	// Decoding into a map would lose the order of the fields, so read the object token by token
+	decoder := json.NewDecoder(bytes.NewReader(operand))
+	decoder.UseNumber()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, errors.New("takes an object of fields and directions")
+	}
+
+	var fields []SortField
+	seen := make(map[string]bool)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		path, _ := token.(string)
+		var direction json.Number
+		if err := decoder.Decode(&direction); err != nil || (direction != "1" && direction != "-1") {
+			return nil, fmt.Errorf("direction of '%s' must be 1 or -1", path)
+		}
+		if err := validatePath(path); err != nil {
+			return nil, err
+		}
+		if seen[path] {
+			return nil, fmt.Errorf("'%s' is sorted on more than once", path)
+		}
+		seen[path] = true
+		fields = append(fields, SortField{Path: path, Descending: direction == "-1"})
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("takes at least one field")
+	}
+	return sortStage(fields), nil
+}
+
+func (s sortStage) run(documents []interface{}) []interface{} {
+	fields := []SortField(s)
+	positions := make([]sortPosition, len(documents))
+	for i, document := range documents {
+		positions[i] = sortPosition{values: sortValues(document, fields)}
+	}
+
+	order := make([]int, len(documents))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return comparePositions(positions[order[i]], positions[order[j]], fields) < 0
+	})
+
+	sorted := make([]interface{}, len(documents))
+	for i, index := range order {
+		sorted[i] = documents[index]
+	}
+	return sorted
+}
+
+// unwindStage emits a document for every element of an array field, holding that element in
+// place of the array
+type unwindStage struct {
+	segments []string
+	preserve bool // Keep documents whose field is missing, null or an empty array
+}
+
+// parseUnwindStage reads "$path" or {"path": "$path", "preserveNullAndEmptyArrays": true}
+func parseUnwindStage(value interface{}) (stage, error) {
+	path, isPath := value.(string)
+	var preserve interface{} = false
+	if options, ok := value.(map[string]interface{}); ok {
+		path, isPath = options["path"].(string)
+		if option, ok := options["preserveNullAndEmptyArrays"]; ok {
+			preserve = option
+		}
+	}
+	if !isPath || !strings.HasPrefix(path, "$") {
+		return nil, errors.New("takes a field path starting with $")
+	}
+	keep, ok := preserve.(bool)
+	if !ok {
+		return nil, errors.New("preserveNullAndEmptyArrays takes true or false")
+	}
+	if err := validatePath(path[1:]); err != nil {
+		return nil, err
+	}
+	return unwindStage{segments: strings.Split(path[1:], "."), preserve: keep}, nil
+}
+
+func (s unwindStage) run(documents []interface{}) []interface{} {
+	var unwound []interface{}
+	for _, document := range documents {
+		value, found := objectPath(document, s.segments)
+		elements, isArray := value.([]interface{})
+
+		switch {
+		case !found || value == nil || (isArray && len(elements) == 0):
+			if s.preserve {
+				unwound = append(unwound, document)
+			}
+		case !isArray:
+			unwound = append(unwound, document)
+		default:
+			for _, element := range elements {
+				unwound = append(unwound, setPath(document, s.segments, element))
+			}
+		}
+	}
+	return unwound
+}
+
+// projectStage reshapes documents, keeping the fields it includes and adding computed ones, or
+// dropping the fields it excludes
+type projectStage struct {
+	include  [][]string
+	exclude  [][]string
+	computed []computedField
+	hideID   bool
+}
+
+// computedField is a field a $project stage sets to the value of an expression
+type computedField struct {
+	segments   []string
+	expression expression
+}
+
+// parseProjectStage reads {"field": 1} to include a field, {"field": 0} to exclude one and
+// {"field": <expression>} to compute one. Fields cannot be both included and excluded, except that
+// "_id", which is kept by default, may be excluded either way.
+func parseProjectStage(value interface{}) (stage, error) {
+	fields, ok := value.(map[string]interface{})
+	if !ok || len(fields) == 0 {
+		return nil, errors.New("takes a non-empty object of fields")
+	}
+
+	paths := make([]string, 0, len(fields))
+	for path := range fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	project := projectStage{}
+	for _, path := range paths {
+		if err := validatePath(path); err != nil {
+			return nil, err
+		}
+		segments := strings.Split(path, ".")
+
+		switch flag := projectFlag(fields[path]); {
+		case flag == 0 && path == "_id":
+			project.hideID = true
+		case flag == 0:
+			project.exclude = append(project.exclude, segments)
+		case flag == 1:
+			project.include = append(project.include, segments)
+		default:
+			compiled, err := parseExpression(fields[path])
+			if err != nil {
+				return nil, fmt.Errorf("'%s': %v", path, err)
+			}
+			project.computed = append(project.computed, computedField{segments: segments, expression: compiled})
+		}
+	}
+
+	if len(project.exclude) > 0 && (len(project.include) > 0 || len(project.computed) > 0) {
+		return nil, errors.New("cannot both exclude fields and include or compute others")
+	}
+	return project, nil
+}
+
+// projectFlag returns 1 for a value that includes a field, 0 for one that excludes it and -1 for
+// an expression
+func projectFlag(value interface{}) int {
+	switch value := value.(type) {
+	case bool:
+		if value {
+			return 1
+		}
+		return 0
+	case json.Number:
+		if number, err := value.Float64(); err == nil {
+			if number == 0 {
+				return 0
+			}
+			return 1
+		}
+	}
+	return -1
+}
+
+func (s projectStage) run(documents []interface{}) []interface{} {
+	projected := make([]interface{}, 0, len(documents))
+	for _, document := range documents {
+		object, ok := document.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if len(s.include) == 0 && len(s.computed) == 0 {
+			// Exclusion keeps everything else
+			for _, segments := range s.exclude {
+				object = removePath(object, segments)
+			}
+			if s.hideID {
+				object = removePath(object, []string{"_id"})
+			}
+			projected = append(projected, object)
+			continue
+		}
+
+		result := make(map[string]interface{})
+		if id, ok := object["_id"]; ok && !s.hideID {
+			result["_id"] = id
+		}
+		for _, segments := range s.include {
+			projectPath(object, result, segments)
+		}
+		for _, field := range s.computed {
+			if value, ok := field.expression.eval(object); ok {
+				result = setPath(result, field.segments, value)
+			}
+		}
+		projected = append(projected, result)
+	}
+	return projected
+}
+
+// groupStage combines documents with the same "_id" expression into one document per group,
+// holding the group's "_id" and a field for each accumulator
+type groupStage struct {
+	id           expression
+	fields       []string
+	accumulators []accumulator
+}
+
+// accumulator computes a field of a group from the documents in it
+type accumulator struct {
+	op         string
+	expression expression
+}
+
+// parseGroupStage reads {"_id": <expression>, "field": {"$sum": <expression>}, ...}. The
+// accumulators are $sum, $avg, $min, $max, $count, $first, $last and $push.
+func parseGroupStage(value interface{}) (stage, error) {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("takes an object")
+	}
+	rawID, ok := fields["_id"]
+	if !ok {
+		return nil, errors.New("needs an _id expression to group by, which may be null")
+	}
+	id, err := parseExpression(rawID)
+	if err != nil {
+		return nil, fmt.Errorf("_id: %v", err)
+	}
+
+	group := groupStage{id: id}
+	for field := range fields {
+		if field != "_id" {
+			group.fields = append(group.fields, field)
+		}
+	}
+	sort.Strings(group.fields)
+
+	for _, field := range group.fields {
+		if strings.Contains(field, ".") || strings.HasPrefix(field, "$") {
+			return nil, fmt.Errorf("'%s' is not a valid field name", field)
+		}
+		operators, ok := fields[field].(map[string]interface{})
+		if !ok || len(operators) != 1 {
+			return nil, fmt.Errorf("'%s' takes an object with a single accumulator", field)
+		}
+
+		for op, operand := range operators {
+			acc := accumulator{op: op}
+			switch op {
+			case "$count":
+				if object, ok := operand.(map[string]interface{}); !ok || len(object) != 0 {
+					return nil, fmt.Errorf("$count of '%s' takes an empty object", field)
+				}
+			case "$sum", "$avg", "$min", "$max", "$first", "$last", "$push":
+				acc.expression, err = parseExpression(operand)
+				if err != nil {
+					return nil, fmt.Errorf("'%s': %v", field, err)
+				}
+			default:
+				return nil, fmt.Errorf("unknown accumulator '%s' for '%s'", op, field)
+			}
+			group.accumulators = append(group.accumulators, acc)
+		}
+	}
+	return group, nil
+}
+
+// groupState is what an accumulator has gathered of a group so far
+type groupState struct {
+	sum     float64
+	count   int  // Documents for $count, numbers for $sum and $avg
+	found   bool // A value was seen, for $min, $max, $first and $last
+	value   interface{}
+	ordered indexValue
+	values  []interface{}
+}
+
+func (s groupStage) run(documents []interface{}) []interface{} {
+	type group struct {
+		id     interface{}
+		states []groupState
+	}
+
+	// Groups are returned in the order their first document came in
+	var order []*group
+	groups := make(map[string]*group)
+	for _, document := range documents {
+		id, ok := s.id.eval(document)
+		if !ok {
+			id = nil
+		}
+		key := groupKey(id)
+
+		g := groups[key]
+		if g == nil {
+			g = &group{id: id, states: make([]groupState, len(s.accumulators))}
+			groups[key] = g
+			order = append(order, g)
+		}
+		for i, acc := range s.accumulators {
+			acc.add(&g.states[i], document)
+		}
+	}
+
+	results := make([]interface{}, 0, len(order))
+	for _, g := range order {
+		result := map[string]interface{}{"_id": g.id}
+		for i, acc := range s.accumulators {
+			result[s.fields[i]] = acc.result(&g.states[i])
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// groupKey returns a string that is the same for two group ids exactly when they are equal
+func groupKey(id interface{}) string {
+	if value, ok := newIndexValue(id); ok {
+		return value.encode()
+	}
+	data, _ := encodeJSON(id)
+	return string(data)
+}
+
+// add gathers a document into the state of a group
+func (acc accumulator) add(state *groupState, document interface{}) {
+	if acc.op == "$count" {
+		state.count++
+		return
+	}
+
+	value, ok := acc.expression.eval(document)
+	switch acc.op {
+	case "$sum", "$avg":
+		if number, isNumber := numberOf(value); ok && isNumber {
+			state.sum += number
+			state.count++
+		}
+	case "$min", "$max":
+		// Like MongoDB, missing fields and nulls are left out, and values of different types
+		// compare in the order index entries sort in
+		ordered, scalar := newIndexValue(value)
+		if !ok || !scalar || ordered.kind == kindNull {
+			return
+		}
+		order := ordered.compare(state.ordered)
+		if !state.found || (acc.op == "$min" && order < 0) || (acc.op == "$max" && order > 0) {
+			state.found, state.value, state.ordered = true, value, ordered
+		}
+	case "$first":
+		if !state.found {
+			state.found, state.value = true, value
+		}
+	case "$last":
+		state.found, state.value = true, value
+	case "$push":
+		if ok {
+			state.values = append(state.values, value)
+		}
+	}
+}
+
+// result returns the value of an accumulator for a group
+func (acc accumulator) result(state *groupState) interface{} {
+	switch acc.op {
+	case "$count":
+		return json.Number(strconv.Itoa(state.count))
+	case "$sum":
+		return numberValue(state.sum)
+	case "$avg":
+		if state.count == 0 {
+			return nil
+		}
+		return numberValue(state.sum / float64(state.count))
+	case "$push":
+		if state.values == nil {
+			return []interface{}{}
+		}
+		return state.values
+	}
+	return state.value
+}
+
+// numberOf returns the value of a JSON number
+func numberOf(value interface{}) (float64, bool) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	parsed, err := number.Float64()
+	return parsed, err == nil
+}
+
+// numberValue returns a computed number as a JSON number, or null if it is out of range
+func numberValue(number float64) interface{} {
+	if math.IsInf(number, 0) || math.IsNaN(number) {
+		return nil
+	}
+	return json.Number(strconv.FormatFloat(number, 'f', -1, 64))
+}
+
+// expression computes a value from a document; ok is false if the value is missing
+type expression interface {
+	eval(document interface{}) (value interface{}, ok bool)
+}
+
+// fieldExpression is the value at a path, "$owner.team". A path through an array of objects gives
+// the array of their values.
+type fieldExpression []string
+
+// literalExpression is a constant
+type literalExpression struct {
+	value interface{}
+}
+
+// objectExpression builds an object from expressions, {"severity": "$severity", "team": "$owner.team"}
+type objectExpression map[string]expression
+
+// arrayExpression builds an array from expressions
+type arrayExpression []expression
+
+// dateToStringExpression formats a timestamp, {"$dateToString": {"format": "%Y-%m-%d", "date": "$created"}}
+type dateToStringExpression struct {
+	format   string
+	date     expression
+	location *time.Location
+}
+
+// parseExpression compiles an expression: a "$path", a literal, an object or array of expressions,
+// or an operator object, which is {"$literal": value} or {"$dateToString": {...}}
+func parseExpression(value interface{}) (expression, error) {
+	switch value := value.(type) {
+	case string:
+		if !strings.HasPrefix(value, "$") {
+			return literalExpression{value}, nil
+		}
+		if err := validatePath(value[1:]); err != nil {
+			return nil, err
+		}
+		return fieldExpression(strings.Split(value[1:], ".")), nil
+	case []interface{}:
+		elements := make(arrayExpression, len(value))
+		for i, element := range value {
+			compiled, err := parseExpression(element)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = compiled
+		}
+		return elements, nil
+	case map[string]interface{}:
+		if len(value) == 1 {
+			for name, operand := range value {
+				switch name {
+				case "$literal":
+					return literalExpression{operand}, nil
+				case "$dateToString":
+					return parseDateToString(operand)
+				}
+			}
+		}
+
+		object := make(objectExpression, len(value))
+		for name, member := range value {
+			if strings.HasPrefix(name, "$") {
+				return nil, fmt.Errorf("unknown expression operator '%s'", name)
+			}
+			compiled, err := parseExpression(member)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = compiled
+		}
+		return object, nil
+	}
+	return literalExpression{value}, nil
+}
+
+func (e fieldExpression) eval(document interface{}) (interface{}, bool) {
+	return fieldPathValue(document, e)
+}
+
+// fieldPathValue walks a path through objects, and through arrays by collecting the values of
+// their elements
+func fieldPathValue(value interface{}, segments []string) (interface{}, bool) {
+	if len(segments) == 0 {
+		return value, true
+	}
+
+	switch container := value.(type) {
+	case map[string]interface{}:
+		child, ok := container[segments[0]]
+		if !ok {
+			return nil, false
+		}
+		return fieldPathValue(child, segments[1:])
+	case []interface{}:
+		values := []interface{}{}
+		for _, element := range container {
+			if found, ok := fieldPathValue(element, segments); ok {
+				values = append(values, found)
+			}
+		}
+		return values, true
+	}
+	return nil, false
+}
+
+func (e literalExpression) eval(interface{}) (interface{}, bool) {
+	return e.value, true
+}
+
+func (e objectExpression) eval(document interface{}) (interface{}, bool) {
+	object := make(map[string]interface{}, len(e))
+	for name, member := range e {
+		if value, ok := member.eval(document); ok {
+			object[name] = value
+		}
+	}
+	return object, true
+}
+
+func (e arrayExpression) eval(document interface{}) (interface{}, bool) {
+	values := make([]interface{}, len(e))
+	for i, element := range e {
+		values[i], _ = element.eval(document)
+	}
+	return values, true
+}
+
+// dateSpecifiers are the strftime-style specifiers $dateToString understands
+const dateSpecifiers = "YmdHMSLjz%"
+
+// parseDateToString reads {"format": "%Y-%m-%d", "date": <expression>, "timezone": "Europe/Berlin"}.
+// The format defaults to ISO 8601 and the time zone to UTC.
+func parseDateToString(operand interface{}) (expression, error) {
+	options, ok := operand.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("$dateToString takes an object")
+	}
+	rawDate, ok := options["date"]
+	if !ok {
+		return nil, errors.New("$dateToString needs a date")
+	}
+	date, err := parseExpression(rawDate)
+	if err != nil {
+		return nil, err
+	}
+
+	format := "%Y-%m-%dT%H:%M:%S.%LZ"
+	if rawFormat, ok := options["format"]; ok {
+		if format, ok = rawFormat.(string); !ok {
+			return nil, errors.New("$dateToString format must be a string")
+		}
+	}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		if i+1 == len(format) || !strings.ContainsRune(dateSpecifiers, rune(format[i+1])) {
+			return nil, fmt.Errorf("$dateToString format has an unknown specifier at %d", i)
+		}
+		i++
+	}
+
+	location := time.UTC
+	if rawZone, ok := options["timezone"]; ok {
+		zone, ok := rawZone.(string)
+		if !ok {
+			return nil, errors.New("$dateToString timezone must be a string")
+		}
+		if location, err = time.LoadLocation(zone); err != nil {
+			return nil, fmt.Errorf("$dateToString timezone: %v", err)
+		}
+	}
+
+	return dateToStringExpression{format: format, date: date, location: location}, nil
+}
+
+// timestampLayouts are the formats a date string may be in
+var timestampLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+func (e dateToStringExpression) eval(document interface{}) (interface{}, bool) {
+	value, ok := e.date.eval(document)
+	text, isString := value.(string)
+	if !ok || !isString {
+		return nil, ok
+	}
+
+	for _, layout := range timestampLayouts {
+		if timestamp, err := time.Parse(layout, text); err == nil {
+			return formatDate(timestamp.In(e.location), e.format), true
+		}
+	}
+	return nil, true
+}
+
+// formatDate formats a time with a format parseDateToString has checked
+func formatDate(t time.Time, format string) string {
+	var text strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			text.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'Y':
+			fmt.Fprintf(&text, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&text, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&text, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&text, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&text, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&text, "%02d", t.Second())
+		case 'L':
+			fmt.Fprintf(&text, "%03d", t.Nanosecond()/int(time.Millisecond))
+		case 'j':
+			fmt.Fprintf(&text, "%03d", t.YearDay())
+		case 'z':
+			text.WriteString(t.Format("-0700"))
+		case '%':
+			text.WriteByte('%')
+		}
+	}
+	return text.String()
+}
+
+// objectPath returns the value at a path that leads through objects only
+func objectPath(value interface{}, segments []string) (interface{}, bool) {
+	for _, segment := range segments {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[segment]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// setPath returns a copy of a document with value at a path, creating the objects it leads
+// through. Only the objects on the path are copied, so documents sharing the rest stay intact.
+func setPath(document interface{}, segments []string, value interface{}) map[string]interface{} {
+	source, _ := document.(map[string]interface{})
+	object := make(map[string]interface{}, len(source)+1)
+	for name, member := range source {
+		object[name] = member
+	}
+
+	if len(segments) == 1 {
+		object[segments[0]] = value
+	} else {
+		object[segments[0]] = setPath(object[segments[0]], segments[1:], value)
+	}
+	return object
+}
+
+// removePath returns a copy of a document without the value at a path, copying only the objects
+// on the path
+func removePath(document map[string]interface{}, segments []string) map[string]interface{} {
+	child, ok := document[segments[0]]
+	if !ok {
+		return document
+	}
+	nested, isObject := child.(map[string]interface{})
+	if len(segments) > 1 && !isObject {
+		return document
+	}
+
+	object := make(map[string]interface{}, len(document))
+	for name, member := range document {
+		object[name] = member
+	}
+	if len(segments) == 1 {
+		delete(object, segments[0])
+	} else {
+		object[segments[0]] = removePath(nested, segments[1:])
+	}
+	return object
+}
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// aggregateDocuments are incidents with missing fields, a null, an "_id" of their own and a
+// document that is not an object, which pipelines leave out
+var aggregateDocuments = map[string]string{
+	"i1": `{"status":"open","severity":"high","hours":4,"team":"red","created":"2024-03-01T10:00:00Z","tags":["phishing","email"]}`,
+	"i2": `{"status":"closed","severity":"low","hours":1,"team":"blue","created":"2024-03-01T15:30:00Z","tags":[]}`,
+	"i3": `{"status":"open","severity":"high","hours":10,"team":"blue","created":"2024-03-02T08:00:00Z","tags":["malware"]}`,
+	"i4": `{"status":"open","severity":"medium","team":"red","created":"2024-03-02T09:00:00Z"}`,
+	"i5": `{"status":"open","severity":"low","hours":2.5,"team":"red","created":"2024-03-03T12:00:00Z","tags":["phishing"]}`,
+	"i6": `{"_id":"custom","status":"closed","severity":"high","hours":null,"team":"green","created":"2024-03-03"}`,
+	"i7": `[1,2]`,
+}
+
+// aggregateCollection returns a collection holding aggregateDocuments
+func aggregateCollection(t *testing.T) *Database {
+	t.Helper()
+
+	db := LoadDB(filepath.Join(t.TempDir(), "incidents.qdb"), testKeys("secret"))
+	for key, data := range aggregateDocuments {
+		if err := db.CreateDocument(key, json.RawMessage(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline string
+		want     string
+	}{
+		{
+			name:     "$match keeps matching documents in key order with their key as _id",
+			pipeline: `[{"$match":{"status":"closed"}}]`,
+			want: `[{"_id":"i2","status":"closed","severity":"low","hours":1,"team":"blue","created":"2024-03-01T15:30:00Z","tags":[]},
+				{"_id":"custom","status":"closed","severity":"high","hours":null,"team":"green","created":"2024-03-03"}]`,
+		},
+		{
+			name:     "$match after another stage",
+			pipeline: `[{"$project":{"severity":1,"hours":1}},{"$match":{"hours":{"$gte":4}}}]`,
+			want:     `[{"_id":"i1","severity":"high","hours":4},{"_id":"i3","severity":"high","hours":10}]`,
+		},
+		{
+			name: "$group accumulators",
+			pipeline: `[{"$group":{"_id":"$severity","count":{"$count":{}},"total":{"$sum":"$hours"},"avg":{"$avg":"$hours"},
+				"min":{"$min":"$hours"},"max":{"$max":"$hours"},"first":{"$first":"$team"},"last":{"$last":"$team"},"teams":{"$push":"$team"}}}]`,
+			want: `[{"_id":"high","count":3,"total":14,"avg":7,"min":4,"max":10,"first":"red","last":"green","teams":["red","blue","green"]},
+				{"_id":"low","count":2,"total":3.5,"avg":1.75,"min":1,"max":2.5,"first":"blue","last":"red","teams":["blue","red"]},
+				{"_id":"medium","count":1,"total":0,"avg":null,"min":null,"max":null,"first":"red","last":"red","teams":["red"]}]`,
+		},
+		{
+			name:     "$group into a single group",
+			pipeline: `[{"$match":{"status":"open"}},{"$group":{"_id":null,"incidents":{"$sum":1},"hours":{"$sum":"$hours"}}}]`,
+			want:     `[{"_id":null,"incidents":4,"hours":16.5}]`,
+		},
+		{
+			name:     "$group by a missing field",
+			pipeline: `[{"$group":{"_id":"$assignee","incidents":{"$sum":1}}}]`,
+			want:     `[{"_id":null,"incidents":6}]`,
+		},
+		{
+			name:     "$group by a computed day",
+			pipeline: `[{"$group":{"_id":{"$dateToString":{"format":"%Y-%m-%d","date":"$created"}},"incidents":{"$sum":1}}},{"$sort":{"_id":-1}}]`,
+			want:     `[{"_id":"2024-03-03","incidents":2},{"_id":"2024-03-02","incidents":2},{"_id":"2024-03-01","incidents":2}]`,
+		},
+		{
+			name:     "$group by an object",
+			pipeline: `[{"$group":{"_id":{"team":"$team","status":"$status"},"incidents":{"$sum":1}}},{"$match":{"_id.team":"red"}}]`,
+			want:     `[{"_id":{"team":"red","status":"open"},"incidents":3}]`,
+		},
+		{
+			name:     "$sort on several fields",
+			pipeline: `[{"$sort":{"team":1,"hours":-1}},{"$project":{"hours":1}}]`,
+			want:     `[{"_id":"i3","hours":10},{"_id":"i2","hours":1},{"_id":"custom","hours":null},{"_id":"i1","hours":4},{"_id":"i5","hours":2.5},{"_id":"i4"}]`,
+		},
+		{
+			name:     "$sort keeps ties in order",
+			pipeline: `[{"$sort":"status:-1"},{"$project":{"_id":1}}]`,
+			want:     `[{"_id":"i1"},{"_id":"i3"},{"_id":"i4"},{"_id":"i5"},{"_id":"i2"},{"_id":"custom"}]`,
+		},
+		{
+			name:     "$limit",
+			pipeline: `[{"$sort":{"hours":-1}},{"$limit":2},{"$project":{"_id":0,"hours":1}}]`,
+			want:     `[{"hours":10},{"hours":4}]`,
+		},
+		{
+			name:     "$limit above the number of documents",
+			pipeline: `[{"$match":{"severity":"low"}},{"$limit":10},{"$project":{"_id":1}}]`,
+			want:     `[{"_id":"i2"},{"_id":"i5"}]`,
+		},
+		{
+			name:     "$project computes fields",
+			pipeline: `[{"$match":{"severity":"medium"}},{"$project":{"who":"$team","level":{"name":"$severity","raw":{"$literal":"$severity"}},"kind":"incident","gone":"$nothing"}}]`,
+			want:     `[{"_id":"i4","who":"red","level":{"name":"medium","raw":"$severity"},"kind":"incident"}]`,
+		},
+		{
+			name:     "$project excludes fields",
+			pipeline: `[{"$match":{"status":"closed"}},{"$project":{"created":0,"tags":0,"_id":0}}]`,
+			want:     `[{"status":"closed","severity":"low","hours":1,"team":"blue"},{"status":"closed","severity":"high","hours":null,"team":"green"}]`,
+		},
+		{
+			name:     "$unwind",
+			pipeline: `[{"$unwind":"$tags"},{"$project":{"tags":1}}]`,
+			want:     `[{"_id":"i1","tags":"phishing"},{"_id":"i1","tags":"email"},{"_id":"i3","tags":"malware"},{"_id":"i5","tags":"phishing"}]`,
+		},
+		{
+			name:     "$unwind keeping documents without elements",
+			pipeline: `[{"$unwind":{"path":"$tags","preserveNullAndEmptyArrays":true}},{"$group":{"_id":"$tags","incidents":{"$sum":1}}}]`,
+			want:     `[{"_id":"phishing","incidents":2},{"_id":"email","incidents":1},{"_id":[],"incidents":1},{"_id":"malware","incidents":1},{"_id":null,"incidents":2}]`,
+		},
+		{
+			name:     "empty result",
+			pipeline: `[{"$match":{"status":"archived"}},{"$group":{"_id":null,"incidents":{"$sum":1}}}]`,
+			want:     `[]`,
+		},
+	}
+
+	db := aggregateCollection(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pipeline, err := ParsePipeline([]byte(test.pipeline))
+			if err != nil {
+				t.Fatalf("ParsePipeline: %v", err)
+			}
+			documents, _, err := db.Aggregate(pipeline)
+			if err != nil {
+				t.Fatalf("Aggregate: %v", err)
+			}
+
+			want, err := decodeJSON([]byte(test.want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalValues([]interface{}(documents), want) {
+				got, _ := encodeJSON(documents)
+				t.Errorf("Aggregate = %s\nwant %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAggregatePlan(t *testing.T) {
+	db := aggregateCollection(t)
+	if _, err := db.CreateIndex(IndexSpec{Fields: []string{"status"}, CaseSensitive: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only a leading $match is answered from the indexes
+	tests := []struct {
+		pipeline string
+		indexes  []string
+		examined int
+	}{
+		{`[{"$match":{"status":"closed"}}]`, []string{"status"}, 2},
+		{`[{"$match":{"team":"red"}}]`, []string{}, 7},
+		{`[{"$limit":1},{"$match":{"status":"closed"}}]`, []string{}, 7},
+	}
+
+	for _, test := range tests {
+		pipeline, err := ParsePipeline([]byte(test.pipeline))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, plan, err := db.Aggregate(pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(plan.Indexes, test.indexes) || plan.Examined != test.examined {
+			t.Errorf("%s used %v and examined %d, want %v and %d", test.pipeline, plan.Indexes, plan.Examined, test.indexes, test.examined)
+		}
+	}
+}
+
+func TestParsePipelineErrors(t *testing.T) {
+	tests := map[string]string{
+		"not an array":                    `{"$match":{}}`,
+		"two operators in a stage":        `[{"$match":{},"$limit":1}]`,
+		"empty stage":                     `[{}]`,
+		"unknown stage":                   `[{"$out":"elsewhere"}]`,
+		"invalid filter":                  `[{"$match":{"hours":{"$near":1}}}]`,
+		"group without _id":               `[{"$group":{"count":{"$sum":1}}}]`,
+		"unknown accumulator":             `[{"$group":{"_id":null,"median":{"$median":"$hours"}}}]`,
+		"two accumulators in a field":     `[{"$group":{"_id":null,"n":{"$sum":1,"$avg":"$hours"}}}]`,
+		"$count with an operand":          `[{"$group":{"_id":null,"n":{"$count":"$hours"}}}]`,
+		"dotted group field":              `[{"$group":{"_id":null,"a.b":{"$sum":1}}}]`,
+		"unknown expression operator":     `[{"$group":{"_id":{"$concat":["$team","$status"]}}}]`,
+		"bad date format":                 `[{"$group":{"_id":{"$dateToString":{"format":"%Q","date":"$created"}}}}]`,
+		"zero limit":                      `[{"$limit":0}]`,
+		"fractional limit":                `[{"$limit":1.5}]`,
+		"limit as a string":               `[{"$limit":"3"}]`,
+		"sort direction":                  `[{"$sort":{"hours":2}}]`,
+		"empty sort":                      `[{"$sort":{}}]`,
+		"project including and excluding": `[{"$project":{"team":1,"hours":0}}]`,
+		"empty project":                   `[{"$project":{}}]`,
+		"unwind without a path":           `[{"$unwind":"tags"}]`,
+		"unwind option":                   `[{"$unwind":{"path":"$tags","preserveNullAndEmptyArrays":"yes"}}]`,
+	}
+
+	for name, pipeline := range tests {
+		if _, err := ParsePipeline([]byte(pipeline)); !errors.Is(err, ErrInvalidPipeline) {
+			t.Errorf("%s: ParsePipeline(%s) failed with %v, want %v", name, pipeline, err, ErrInvalidPipeline)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Operations a bulk write can mix
+const (
+	BulkInsert  = "insert"
+	BulkUpsert  = "upsert"
+	BulkReplace = "replace"
+	BulkDelete  = "delete"
+)
+
+// BulkOp is a single write of a bulk write
+type BulkOp struct {
+	Op       string
+	Key      string // Generated for inserts and upserts that leave it empty
+	Data     json.RawMessage
+	Revision uint64 // Only write if the document is at this revision, unless it is 0
+}
+
+// BulkResult is the outcome of a single BulkOp
+type BulkResult struct {
+	Key      string
+	Revision uint64 // Revision the document is at after a successful write, 0 after a delete
+	Created  bool   // Whether an insert or upsert created the document
+	Err      error
+}
+
+// bulkState tracks what a document looks like after the bulk operations checked so far
+type bulkState struct {
+	exists   bool
+	revision uint64
+}
+
+// BulkWrite applies a list of inserts, upserts, replaces and deletes, each of which succeeds or fails
+// on its own. Every operation sees the effect of the ones before it. When ordered is true, the first
+// failure stops the operations after it, which are left out of the results.
+//
+// All successful writes are persisted together as a single log record, so a bulk write costs one
+// disk sync rather than one per document. An error is returned, and nothing is written, only if
+// that record cannot be persisted.
+func (db *Database) BulkWrite(ops []BulkOp, ordered bool) ([]BulkResult, error) {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return nil, db.loadErr
+	}
+
+	states := make(map[string]bulkState)
+	written := make(map[string]json.RawMessage) // What the successful ops put, nil for deletes
+	state := func(key string) bulkState {
+		if current, ok := states[key]; ok {
+			return current
+		}
+		if _, exists := db.document(key); exists {
+			return bulkState{exists: true, revision: db.revision(key)}
+		}
+		return bulkState{}
+	}
+
+	// Unique indexes are checked op by op, so a duplicate fails only the op that causes it
+	check := db.newUniqueCheck()
+
+	results := make([]BulkResult, 0, len(ops))
+	var records []walRecord
+	for _, op := range ops {
+		key := op.Key
+		if key == "" && (op.Op == BulkInsert || op.Op == BulkUpsert) {
+			key = uuid.New().String()
+		}
+
+		result := BulkResult{Key: key}
+		current := state(key)
+
+		switch {
+		case op.Op != BulkInsert && op.Op != BulkUpsert && op.Op != BulkReplace && op.Op != BulkDelete:
+			result.Err = fmt.Errorf("unknown bulk operation '%s'", op.Op)
+		case op.Op == BulkInsert && current.exists:
+			result.Err = fmt.Errorf("%w: '%s'", ErrDocumentExists, key)
+		case (op.Op == BulkReplace || op.Op == BulkDelete) && !current.exists:
+			result.Err = fmt.Errorf("%w: '%s'", ErrDocumentNotFound, key)
+		case op.Revision != 0 && current.revision != op.Revision:
+			result.Err = fmt.Errorf("%w: '%s' is at revision %d, not %d", ErrRevisionMismatch, key, current.revision, op.Revision)
+		case op.Op != BulkDelete && !json.Valid(op.Data):
+			result.Err = fmt.Errorf("document '%s' is not valid JSON", key)
+		}
+
+		record := walRecord{Op: walOpDelete, Key: key}
+		if op.Op != BulkDelete {
+			record = walRecord{Op: walOpPut, Key: key, Data: op.Data, Rev: current.revision + 1}
+		}
+		if result.Err == nil {
+			result.Err = db.prepareWrite(&record, written)
+		}
+		if result.Err == nil {
+			db.indexLock.RLock()
+			result.Err = check.add(record)
+			db.indexLock.RUnlock()
+		}
+
+		if result.Err != nil {
+			results = append(results, result)
+			if ordered {
+				break
+			}
+			continue
+		}
+
+		records = append(records, record)
+		written[key] = record.Data
+		if op.Op == BulkDelete {
+			states[key] = bulkState{}
+		} else {
+			result.Revision = record.Rev
+			result.Created = !current.exists
+			states[key] = bulkState{exists: true, revision: result.Revision}
+		}
+		results = append(results, result)
+	}
+
+	if len(records) > 0 {
+		if err := db.writeBatch(records); err != nil {
+			return nil, err
+		}
+		LastUpdateTime = time.Now()
+	}
+
+	return results, nil
+}
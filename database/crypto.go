@@ -0,0 +1,362 @@
+package database
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// formatVersion is the current .qdb layout, sealed with a per-collection data key that is stored
+	// wrapped in the header. Version 2 files are sealed directly with a key derived from the
+	// passphrase, and version 1 is the legacy headerless AES-CBC file.
+	formatVersion   = 3
+	formatVersionV2 = 2
+
+	cipherAES256GCM = 1
+
+	dataKeySize = 32
+)
+
+// fileMagic prefixes every versioned .qdb file
+var fileMagic = []byte("QDB\x00")
+
+// dataKeyAAD binds wrapped data keys to their purpose
+var dataKeyAAD = []byte("QuadDB data key")
+
+var (
+	// ErrBadKey is returned when a collection is opened with a key other than the one it was written with
+	ErrBadKey = errors.New("wrong encryption key")
+	// ErrCorrupted is returned when a collection fails authentication with the right key
+	ErrCorrupted = errors.New("database file is corrupted or has been tampered with")
+)
+
+// fileHeader is stored in plaintext at the start of a .qdb file. A versioned file is laid out as
+// magic, version byte, little-endian uint16 header length, msgpack header, GCM nonce and sealed payload.
+type fileHeader struct {
+	Cipher     uint8     `msgpack:"cipher"`
+	KDF        kdfParams `msgpack:"kdf"`
+	KeyCheck   []byte    `msgpack:"check,omitempty"` // Version 2 only
+	WrappedKey []byte    `msgpack:"wrapped_key,omitempty"`
+	Generation uint64    `msgpack:"gen"`
+}
+
+// kdfParams records how the key encryption key was derived from the master key
+type kdfParams struct {
+	Algorithm uint8  `msgpack:"alg"`
+	Salt      []byte `msgpack:"salt,omitempty"`
+	Time      uint32 `msgpack:"time,omitempty"`
+	Memory    uint32 `msgpack:"memory,omitempty"`
+	Threads   uint8  `msgpack:"threads,omitempty"`
+}
+
+// keyCheck returns a short MAC of a fixed string, letting a wrong key be told apart from a corrupted version 2 file
+func keyCheck(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("QuadDB key check"))
+	return mac.Sum(nil)[:16]
+}
+
+// newDataKey generates a random collection data key
+func newDataKey() ([]byte, error) {
+	key := make([]byte, dataKeySize)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// wrapKey seals a data key under the key encryption key derived with kdf
+func wrapKey(keys *Keyring, kdf kdfParams, dataKey []byte) ([]byte, error) {
+	kek, err := keys.derive(kdf)
+	if err != nil {
+		return nil, err
+	}
+
+	return encrypt(kek, dataKey, dataKeyAAD)
+}
+
+// unwrapKey opens a data key wrapped by wrapKey; a key that fails to open means the master key is wrong
+func unwrapKey(keys *Keyring, kdf kdfParams, wrappedKey []byte) ([]byte, error) {
+	kek, err := keys.derive(kdf)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := decrypt(kek, wrappedKey, dataKeyAAD)
+	if err != nil {
+		return nil, ErrBadKey
+	}
+
+	return dataKey, nil
+}
+
+// encodeHeader returns the plaintext prefix of a .qdb file up to the sealed payload
+func encodeHeader(version uint8, header fileHeader) ([]byte, error) {
+	encodedHeader, err := msgpack.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := append([]byte{}, fileMagic...)
+	prefix = append(prefix, version)
+	prefix = binary.LittleEndian.AppendUint16(prefix, uint16(len(encodedHeader)))
+	return append(prefix, encodedHeader...), nil
+}
+
+// decodeHeader parses the plaintext prefix of a versioned .qdb file, returning the format version,
+// the header and the offset of the sealed payload
+func decodeHeader(data []byte) (uint8, *fileHeader, int, error) {
+	offset := len(fileMagic)
+	if len(data) < offset+3 {
+		return 0, nil, 0, fmt.Errorf("%w: truncated header", ErrCorrupted)
+	}
+
+	version := data[offset]
+	if version != formatVersion && version != formatVersionV2 {
+		return 0, nil, 0, fmt.Errorf("unsupported .qdb format version %d", version)
+	}
+
+	headerLen := int(binary.LittleEndian.Uint16(data[offset+1 : offset+3]))
+	offset += 3
+	if len(data) < offset+headerLen {
+		return 0, nil, 0, fmt.Errorf("%w: truncated header", ErrCorrupted)
+	}
+
+	var header fileHeader
+	if err := msgpack.Unmarshal(data[offset:offset+headerLen], &header); err != nil {
+		return 0, nil, 0, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+
+	if header.Cipher != cipherAES256GCM {
+		return 0, nil, 0, fmt.Errorf("unsupported cipher id %d", header.Cipher)
+	}
+
+	return version, &header, offset + headerLen, nil
+}
+
+// payloadAAD returns the additional data the payload of a current format file is sealed with. It
+// leaves out the key envelope, so that the data key can be rewrapped without touching the payload.
+func payloadAAD(header *fileHeader) []byte {
+	aad := append([]byte{}, fileMagic...)
+	aad = append(aad, formatVersion, header.Cipher)
+	return binary.LittleEndian.AppendUint64(aad, header.Generation)
+}
+
+// sealFile encrypts a .qdb payload with the collection data key behind a versioned header for the
+// given generation. The data key is stored wrapped under the key encryption key derived with kdf.
+func sealFile(plaintext []byte, generation uint64, kdf kdfParams, wrappedKey, dataKey []byte) ([]byte, error) {
+	header := fileHeader{
+		Cipher:     cipherAES256GCM,
+		KDF:        kdf,
+		WrappedKey: wrappedKey,
+		Generation: generation,
+	}
+
+	prefix, err := encodeHeader(formatVersion, header)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := encrypt(dataKey, plaintext, payloadAAD(&header))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(prefix, sealed...), nil
+}
+
+// openFile authenticates and decrypts the contents of a .qdb file, unwrapping its data key with keys.
+// It returns the key the payload was sealed with; the header is nil for legacy AES-CBC files.
+func openFile(keys *Keyring, data []byte) ([]byte, *fileHeader, []byte, error) {
+	if !bytes.HasPrefix(data, fileMagic) {
+		key, err := keys.derive(kdfParams{Algorithm: kdfSHA256})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		plaintext, err := decryptLegacy(key, data)
+		return plaintext, nil, key, err
+	}
+
+	version, header, offset, err := decodeHeader(data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var key, additionalData []byte
+	if version == formatVersionV2 {
+		// Version 2 files are sealed with the derived key itself and authenticate the whole header
+		key, err = keys.derive(header.KDF)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !hmac.Equal(header.KeyCheck, keyCheck(key)) {
+			return nil, nil, nil, ErrBadKey
+		}
+		additionalData = data[:offset]
+	} else {
+		key, err = unwrapKey(keys, header.KDF, header.WrappedKey)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		additionalData = payloadAAD(header)
+	}
+
+	plaintext, err := decrypt(key, data[offset:], additionalData)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if version == formatVersionV2 {
+		// Nothing is wrapped yet; the next write gives the collection a data key of its own
+		header.WrappedKey = nil
+	}
+
+	return plaintext, header, key, nil
+}
+
+// isEnvelopeFile reports whether data is a current format .qdb file with a wrapped data key
+func isEnvelopeFile(data []byte) bool {
+	return bytes.HasPrefix(data, fileMagic) && len(data) > len(fileMagic) && data[len(fileMagic)] == formatVersion
+}
+
+// rewrapFile moves the data key of a current format .qdb file from oldKeys to newKeys, leaving the
+// payload untouched. It returns nil if the key is already wrapped under newKeys.
+func rewrapFile(data []byte, oldKeys, newKeys *Keyring) ([]byte, error) {
+	if !bytes.HasPrefix(data, fileMagic) {
+		return nil, fmt.Errorf("legacy files have no data key to rewrap")
+	}
+
+	version, header, offset, err := decodeHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if version != formatVersion {
+		return nil, fmt.Errorf("format version %d files have no data key to rewrap", version)
+	}
+
+	if _, err := unwrapKey(newKeys, header.KDF, header.WrappedKey); err == nil {
+		return nil, nil
+	}
+
+	dataKey, err := unwrapKey(oldKeys, header.KDF, header.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header.KDF, err = newKeys.newKDF()
+	if err != nil {
+		return nil, err
+	}
+	header.WrappedKey, err = wrapKey(newKeys, header.KDF, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := encodeHeader(formatVersion, *header)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(prefix, data[offset:]...), nil
+}
+
+// encrypt seals data with AES-256-GCM, returning the random nonce followed by the ciphertext
+func encrypt(key, data, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(data)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, additionalData), nil
+}
+
+// decrypt opens data sealed by encrypt
+func decrypt(key, ciphertext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("%w: ciphertext too short", ErrCorrupted)
+	}
+
+	nonce := ciphertext[:gcm.NonceSize()]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// decryptLegacy decrypts data written by the original AES-CBC format, which has no header or MAC
+func decryptLegacy(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < 2*aes.BlockSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	if len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("ciphertext is not a multiple of the block size")
+	}
+
+	iv := ciphertext[:aes.BlockSize]
+	plaintext := make([]byte, len(ciphertext)-aes.BlockSize)
+
+	mode := cipher.NewCBCDecrypter(block, iv)
+	mode.CryptBlocks(plaintext, ciphertext[aes.BlockSize:])
+
+	// Without a MAC, invalid padding is the only sign of a wrong key
+	plaintext, ok := unpadData(plaintext, aes.BlockSize)
+	if !ok {
+		return nil, ErrBadKey
+	}
+
+	return plaintext, nil
+}
+
+// unpadData strips and validates PKCS#7 padding
+func unpadData(data []byte, blockSize int) ([]byte, bool) {
+	length := len(data)
+	if length == 0 {
+		return nil, false
+	}
+
+	padding := int(data[length-1])
+	if padding == 0 || padding > blockSize || padding > length {
+		return nil, false
+	}
+	for _, b := range data[length-padding:] {
+		if int(b) != padding {
+			return nil, false
+		}
+	}
+
+	return data[:length-padding], true
+}
@@ -0,0 +1,224 @@
+package database
+
+import (
+	"CyberDefenseEd/QuadDB/util"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// legacyIV is the IV test files are written with in the legacy format. Keeping it fixed makes what
+// a wrong key decrypts them to, and so the outcome, the same on every run.
+var legacyIV = bytes.Repeat([]byte{0x42}, aes.BlockSize)
+
+// writeLegacyFile writes documents the way QuadDB did before file headers existed: the msgpack
+// documents map, compressed and encrypted with AES-CBC under a SHA-256 of the passphrase
+func writeLegacyFile(t *testing.T, filename, passphrase string, documents map[string]json.RawMessage) {
+	t.Helper()
+
+	plaintext := compressedPayload(t, documents)
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, legacyIV).CryptBlocks(ciphertext, plaintext)
+
+	if err := os.WriteFile(filename, append(append([]byte{}, legacyIV...), ciphertext...), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeV2File writes documents in format version 2, sealed with the Argon2id key derived from the
+// passphrase and a key check in the header
+func writeV2File(t *testing.T, filename, passphrase string, documents map[string]json.RawMessage) {
+	t.Helper()
+
+	keys := testKeys(passphrase)
+	kdf, err := keys.newKDF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := keys.derive(kdf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix, err := encodeHeader(formatVersionV2, fileHeader{Cipher: cipherAES256GCM, KDF: kdf, KeyCheck: keyCheck(key), Generation: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := encrypt(key, compressedPayload(t, snapshot{Documents: documents}), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filename, append(prefix, sealed...), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeV3File writes documents in the current format by creating them through a Database
+func writeV3File(t *testing.T, filename, passphrase string, documents map[string]json.RawMessage) {
+	t.Helper()
+
+	db := LoadDB(filename, testKeys(passphrase))
+	for key, data := range documents {
+		if err := db.CreateDocument(key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// compressedPayload encodes and compresses the payload of a .qdb file
+func compressedPayload(t *testing.T, value interface{}) []byte {
+	t.Helper()
+
+	data, err := msgpack.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := util.Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compressed
+}
+
+// fileVersion returns the format version of a .qdb file, 1 for the headerless legacy format
+func fileVersion(t *testing.T, filename string) uint8 {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, fileMagic) {
+		return 1
+	}
+	return data[len(fileMagic)]
+}
+
+func TestFormatMigration(t *testing.T) {
+	documents := map[string]json.RawMessage{
+		"alice": json.RawMessage(`{"name":"Alice","age":31}`),
+		"bob":   json.RawMessage(`{"name":"Bob","tags":["red","blue"]}`),
+	}
+
+	tests := []struct {
+		name    string
+		write   func(t *testing.T, filename, passphrase string, documents map[string]json.RawMessage)
+		version uint8
+	}{
+		{"legacy AES-CBC", writeLegacyFile, 1},
+		{"version 2", writeV2File, formatVersionV2},
+		{"version 3", writeV3File, formatVersion},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "people.qdb")
+			test.write(t, filename, "correct horse", documents)
+			if got := fileVersion(t, filename); got != test.version {
+				t.Fatalf("written file is version %d, want %d", got, test.version)
+			}
+
+			want := map[string]string{}
+			for key, data := range documents {
+				want[key] = string(data)
+			}
+
+			db := LoadDB(filename, testKeys("correct horse"))
+			if db.loadErr != nil {
+				t.Fatalf("LoadDB: %v", db.loadErr)
+			}
+			if got := mustDocuments(t, db); !reflect.DeepEqual(got, want) {
+				t.Fatalf("documents = %v, want %v", got, want)
+			}
+
+			// The first write moves the file to the current format with a data key of its own
+			if err := db.CreateDocument("carol", json.RawMessage(`{"name":"Carol"}`)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			want["carol"] = `{"name":"Carol"}`
+			if err := db.close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := fileVersion(t, filename); got != formatVersion {
+				t.Fatalf("file is version %d after a write, want %d", got, formatVersion)
+			}
+
+			migrated := LoadDB(filename, testKeys("correct horse"))
+			if migrated.loadErr != nil {
+				t.Fatalf("LoadDB after migration: %v", migrated.loadErr)
+			}
+			if migrated.legacy || migrated.wrappedKey == nil {
+				t.Errorf("migrated file has legacy = %v and a wrapped key = %v, want false and true", migrated.legacy, migrated.wrappedKey != nil)
+			}
+			if got := mustDocuments(t, migrated); !reflect.DeepEqual(got, want) {
+				t.Errorf("documents after migration = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestBadKey(t *testing.T) {
+	documents := map[string]json.RawMessage{"alice": json.RawMessage(`{"name":"Alice"}`)}
+
+	tests := []struct {
+		name  string
+		write func(t *testing.T, filename, passphrase string, documents map[string]json.RawMessage)
+	}{
+		{"legacy AES-CBC", writeLegacyFile},
+		{"version 2", writeV2File},
+		{"version 3", writeV3File},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "people.qdb")
+			test.write(t, filename, "correct horse", documents)
+			before, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db := LoadDB(filename, testKeys("battery staple"))
+			if !errors.Is(db.loadErr, ErrBadKey) {
+				t.Fatalf("LoadDB with the wrong key failed with %v, want %v", db.loadErr, ErrBadKey)
+			}
+
+			// A collection opened with the wrong key must not be written over
+			if err := db.CreateDocument("mallory", json.RawMessage(`{}`)); !errors.Is(err, ErrBadKey) {
+				t.Errorf("write with the wrong key failed with %v, want %v", err, ErrBadKey)
+			}
+			after, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(before, after) {
+				t.Error("file changed after opening it with the wrong key")
+			}
+
+			if db := LoadDB(filename, testKeys("correct horse")); db.loadErr != nil {
+				t.Errorf("LoadDB with the right key after the wrong one: %v", db.loadErr)
+			}
+		})
+	}
+}
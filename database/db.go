@@ -2,12 +2,9 @@ package database
 
 import (
 	"CyberDefenseEd/QuadDB/util"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"sort"
 	"strings"
@@ -18,81 +15,344 @@ import (
 	"github.com/vmihailenco/msgpack/v5"
 )
 
+var (
+	ErrDocumentExists   = errors.New("document already exists")
+	ErrDocumentNotFound = errors.New("document not found")
+	ErrRevisionMismatch = errors.New("document revision does not match")
+)
+
 type Document struct {
 	Id   string          `json:"id"`
 	Data json.RawMessage `json:"data"`
 }
 
+// snapshot is the payload of a versioned .qdb file
+type snapshot struct {
+	Documents map[string]json.RawMessage `msgpack:"documents"`
+	Created   time.Time                  `msgpack:"created,omitempty"`
+	Revisions map[string]uint64          `msgpack:"revisions,omitempty"`
+	Indexes   []IndexSpec                `msgpack:"indexes,omitempty"`
+	TextIndex *TextIndexSpec             `msgpack:"text_index,omitempty"`
+	Schema    json.RawMessage            `msgpack:"schema,omitempty"`
+	TTL       time.Duration              `msgpack:"ttl,omitempty"`
+}
+
 type Database struct {
 	filename   string
-	aesKey     []byte
-	fieldIndex map[string]map[string][]string
-	indexLock  sync.RWMutex
+	keys       *Keyring
+	dataKey    []byte    // key the .qdb and .wal contents are sealed with, nil until the file is opened or first written
+	wrappedKey []byte    // dataKey as stored in the file header, nil for files from before envelope encryption
+	keyEpoch   uint64    // master key epoch wrappedKey was checked against
+	kdf        kdfParams // how the key wrapping dataKey was derived
+	documents  map[string]json.RawMessage
+	revisions  map[string]uint64    // revision of each document, missing for documents from before revisions
+	expiries   map[string]time.Time // when each document with an expires_at expires
+	loadErr    error
+	generation uint64 // checkpoint counter of the loaded .qdb file
+	legacy     bool   // the .qdb file is in the legacy AES-CBC format
+	fromBackup bool   // documents were recovered from the .bak file
+	created    time.Time
+	docsLock   sync.RWMutex
+	indexes    map[string]*declaredIndex // declared indexes by name, added and removed holding both docsLock and indexLock
+	indexLock  sync.RWMutex              // guards the entries of the indexes
+	textIndex  *textIndex                // full-text index, nil if none is declared; set like indexes
+	schema     *collectionSchema         // JSON Schema documents must match, nil if none; guarded by docsLock
+	ttl        time.Duration             // default lifetime of documents created without an expires_at, 0 if none
 }
 
-// LoadDB initializes a new Database instance
-func LoadDB(filename string, aesKey []byte) *Database {
+// LoadDB initializes a new Database instance and loads its documents into memory
+func LoadDB(filename string, keys *Keyring) *Database {
 	db := &Database{
-		filename:   filename,
-		aesKey:     aesKey,
-		fieldIndex: make(map[string]map[string][]string), // Ensure fieldIndex is initialized
-		indexLock:  sync.RWMutex{},                       // Ensure indexLock is initialized
+		filename:  filename,
+		keys:      keys,
+		documents: make(map[string]json.RawMessage),
+		revisions: make(map[string]uint64),
+		expiries:  make(map[string]time.Time),
+		docsLock:  sync.RWMutex{},
+		indexes:   make(map[string]*declaredIndex), // Ensure indexes is initialized
+		indexLock: sync.RWMutex{},                  // Ensure indexLock is initialized
+	}
+
+	// Load existing documents once; every later read is served from memory
+	lock := fileLock(filename)
+	lock.Lock()
+	documents, err := db.readDocuments()
+	lock.Unlock()
+	if err != nil {
+		// Keep the error around so writes cannot overwrite a file we failed to read
+		db.loadErr = err
+		util.Error(fmt.Sprintf("Failed to load '%s': %v", filename, err))
+		return db
+	}
+	db.documents = documents
+	db.loadExpiries()
+
+	// Files from before creation times were recorded get the time they were last written
+	if db.created.IsZero() {
+		db.created = time.Now().UTC()
+		if info, err := os.Stat(filename); err == nil {
+			db.created = info.ModTime().UTC()
+		}
 	}
 
-	// Load existing documents and build indexes
-	err := db.buildIndex()
+	err = db.buildIndex()
 	if err != nil {
-		fmt.Printf("Error building index: %v\n", err)
+		util.Error(fmt.Sprintf("Failed to build the indexes of '%s': %v", filename, err))
 	}
 
 	return db
 }
 
-// buildIndex builds the index for all documents based on their fields
-func (db *Database) buildIndex() error {
-	documents, err := db.LoadDocuments()
-	if err != nil {
-		return err
+// close folds the write-ahead log into the .qdb file and stops serving the collection
+func (db *Database) close() error {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return nil
+	}
+	db.loadErr = ErrClosed
+
+	if _, err := os.Stat(db.walPath()); err != nil {
+		return nil
+	}
+
+	lock := fileLock(db.filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return db.checkpoint(db.documents)
+}
+
+// retire stops serving the collection without touching its files
+func (db *Database) retire() {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	db.loadErr = ErrClosed
+}
+
+// useKeys switches the collection to another keyring for the same master key, such as the one a
+// finished key rotation leaves the registry with; its data key is wrapped afresh on the next write
+func (db *Database) useKeys(keys *Keyring) {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	db.keys = keys
+}
+
+// reopen serves the collection again after a close that failed to checkpoint
+func (db *Database) reopen() {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr == ErrClosed {
+		db.loadErr = nil
+	}
+}
+
+// persist writes the .qdb file of a collection that only exists in memory so far
+func (db *Database) persist() error {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return db.loadErr
 	}
 
+	lock := fileLock(db.filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return db.checkpoint(db.documents)
+}
+
+// Created returns when the collection was created
+func (db *Database) Created() time.Time {
+	return db.created
+}
+
+// buildIndex rebuilds every declared index from the documents
+func (db *Database) buildIndex() error {
+	db.docsLock.RLock()
+	defer db.docsLock.RUnlock()
+
 	db.indexLock.Lock()
 	defer db.indexLock.Unlock()
 
-	for key, rawMessage := range documents {
-		var docMap map[string]interface{}
-		err := json.Unmarshal(rawMessage, &docMap)
-		if err != nil {
-			return err
+	for name, index := range db.indexes {
+		db.indexes[name] = newDeclaredIndex(index.spec)
+	}
+	textIndex := db.textIndex
+	db.textIndex = nil
+
+	// Documents that are not valid JSON have no fields to index; skipping them rather than stopping
+	// keeps the indexes complete for the query planner
+	var skipped int
+	for key, rawMessage := range db.documents {
+		if db.indexDocument(key, rawMessage) != nil {
+			skipped++
 		}
+	}
 
-		for fieldPath := range docMap {
-			fieldValue, found := traverseNestedFields(strings.Split(fieldPath, "."), docMap)
-			if found {
-				lowerFieldPath := strings.ToLower(fieldPath)
-				lowerFieldValue := strings.ToLower(fieldValue)
+	// The text index is kept in a file of its own, which only needs the changes since it was written
+	if textIndex != nil {
+		db.loadTextIndex(textIndex.Spec)
+	}
 
-				if db.fieldIndex[lowerFieldPath] == nil {
-					db.fieldIndex[lowerFieldPath] = make(map[string][]string)
-				}
-				db.fieldIndex[lowerFieldPath][lowerFieldValue] = append(db.fieldIndex[lowerFieldPath][lowerFieldValue], key)
-			}
-		}
+	if skipped > 0 {
+		return fmt.Errorf("%d documents are not valid JSON and were not indexed", skipped)
+	}
+	return nil
+}
+
+// indexDocument adds a document to every index; the caller must hold indexLock
+func (db *Database) indexDocument(key string, data json.RawMessage) error {
+	if db.textIndex != nil {
+		db.textIndex.add(key, data)
 	}
 
+	document, err := decodeJSON(data)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range db.indexes {
+		index.add(key, document)
+	}
 	return nil
 }
 
-// LoadDocuments reads and decrypts the database file, returning the documents as a map
+// unindexDocument removes a document from every index; the caller must hold indexLock
+func (db *Database) unindexDocument(key string, data json.RawMessage) {
+	if db.textIndex != nil {
+		db.textIndex.remove(key, data)
+	}
+
+	document, ok := decodedDocument(data)
+	if !ok {
+		return
+	}
+
+	for _, index := range db.indexes {
+		index.drop(key, document)
+	}
+}
+
+// reindexFields moves a document from its previous entries to its current ones in the indexes that
+// cover any of the given top-level fields; the caller must hold indexLock
+func (db *Database) reindexFields(key string, previous, data json.RawMessage, fields []string) {
+	previousDocument, hadPrevious := decodedDocument(previous)
+	document, ok := decodedDocument(data)
+
+	if db.textIndex != nil && db.textIndex.touches(fields) {
+		db.textIndex.remove(key, previous)
+		db.textIndex.add(key, data)
+	}
+
+	for _, index := range db.indexes {
+		if !index.touches(fields) {
+			continue
+		}
+		if hadPrevious {
+			index.drop(key, previousDocument)
+		}
+		if ok {
+			index.add(key, document)
+		}
+	}
+}
+
+// LoadDocuments returns a copy of the documents held in memory
 func (db *Database) LoadDocuments() (map[string]json.RawMessage, error) {
+	db.docsLock.RLock()
+	defer db.docsLock.RUnlock()
+
+	if db.loadErr != nil {
+		return nil, db.loadErr
+	}
+
+	live := db.liveDocuments()
+	documents := make(map[string]json.RawMessage, len(live))
+	for key, data := range live {
+		documents[key] = data
+	}
+
+	return documents, nil
+}
+
+// readDocuments reads and decrypts the database file and replays its write-ahead log; the caller must hold the file lock
+func (db *Database) readDocuments() (map[string]json.RawMessage, error) {
+	documents, err := db.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.replayWAL(documents)
+	if err != nil {
+		return nil, err
+	}
+
+	return documents, nil
+}
+
+// loadSnapshot reads and decrypts the database file as of its last checkpoint. If the file is missing
+// or cannot be decrypted, the previous generation kept in the .bak file is used instead.
+func (db *Database) loadSnapshot() (map[string]json.RawMessage, error) {
+	db.revisions = make(map[string]uint64)
+
 	data, err := os.ReadFile(db.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		documents, err := db.decodeSnapshot(data)
+		if err == nil || errors.Is(err, ErrBadKey) {
+			return documents, err
+		}
+
+		backup, backupErr := db.loadBackup()
+		if backupErr != nil {
+			// Report the primary error; a missing or equally broken backup says nothing new
+			return nil, err
+		}
+		util.Warn(fmt.Sprintf("Failed to open '%s' (%v), recovered the previous generation from '%s'", db.filename, err, db.backupPath()))
+		return backup, nil
+	}
+
+	// A crash between rotating the backup and renaming the new file into place leaves only the backup
+	backup, err := db.loadBackup()
 	if err != nil {
 		if os.IsNotExist(err) {
 			return make(map[string]json.RawMessage), nil
 		}
 		return nil, err
 	}
+	util.Warn(fmt.Sprintf("'%s' is missing, recovered the previous generation from '%s'", db.filename, db.backupPath()))
+	return backup, nil
+}
 
-	decryptedData, err := db.decrypt(data)
+// loadBackup reads and decrypts the previous generation of the database file
+func (db *Database) loadBackup() (map[string]json.RawMessage, error) {
+	data, err := os.ReadFile(db.backupPath())
+	if err != nil {
+		return nil, err
+	}
+
+	documents, err := db.decodeSnapshot(data)
+	if err != nil {
+		return nil, err
+	}
+
+	db.fromBackup = true
+	return documents, nil
+}
+
+// decodeSnapshot decrypts, decompresses and decodes the contents of a database file, recording
+// its format and generation on db
+func (db *Database) decodeSnapshot(data []byte) (map[string]json.RawMessage, error) {
+	decryptedData, header, key, err := openFile(db.keys, data)
 	if err != nil {
 		return nil, err
 	}
@@ -102,21 +362,64 @@ func (db *Database) LoadDocuments() (map[string]json.RawMessage, error) {
 		return nil, err
 	}
 
-	var documents map[string]json.RawMessage
-	err = msgpack.Unmarshal(decompressedData, &documents)
+	var contents snapshot
+	if header == nil {
+		// Legacy files hold the bare documents map
+		err = msgpack.Unmarshal(decompressedData, &contents.Documents)
+	} else {
+		err = msgpack.Unmarshal(decompressedData, &contents)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if contents.Documents == nil {
+		contents.Documents = make(map[string]json.RawMessage)
+	}
+	if contents.Revisions == nil {
+		contents.Revisions = make(map[string]uint64)
+	}
 
-	return documents, nil
+	db.created = contents.Created
+	db.revisions = contents.Revisions
+	db.indexes = make(map[string]*declaredIndex, len(contents.Indexes))
+	for _, spec := range contents.Indexes {
+		db.indexes[spec.Name] = newDeclaredIndex(spec)
+	}
+	db.textIndex = nil
+	if contents.TextIndex != nil {
+		db.textIndex = newTextIndex(*contents.TextIndex)
+	}
+	db.loadSchema(contents.Schema)
+	db.ttl = contents.TTL
+	db.dataKey = key
+	db.wrappedKey = nil
+	db.keyEpoch = db.keys.currentEpoch()
+	db.legacy = header == nil
+	db.generation = 0
+	db.kdf = kdfParams{Algorithm: kdfSHA256}
+	if header != nil {
+		db.wrappedKey = header.WrappedKey
+		db.generation = header.Generation
+		db.kdf = header.KDF
+	}
+
+	return contents.Documents, nil
+}
+
+// backupPath returns the path the previous generation of the database file is kept under
+func (db *Database) backupPath() string {
+	return db.filename + ".bak"
 }
 
-// LoadDocumentsPaginated reads and decrypts the database file and returns a paginated subset of documents
+// LoadDocumentsPaginated returns a paginated subset of documents, ordered by key
 func (db *Database) LoadDocumentsPaginated(offset, limit int) (map[string]json.RawMessage, error) {
-	documents, err := db.LoadDocuments()
-	if err != nil {
-		return nil, err
+	db.docsLock.RLock()
+	defer db.docsLock.RUnlock()
+
+	if db.loadErr != nil {
+		return nil, db.loadErr
 	}
+	documents := db.liveDocuments()
 
 	paginatedDocuments := make(map[string]json.RawMessage)
 	keys := make([]string, 0, len(documents))
@@ -143,9 +446,10 @@ func (db *Database) LoadDocumentsPaginated(offset, limit int) (map[string]json.R
 	return paginatedDocuments, nil
 }
 
-// saveDocuments compresses, encrypts, and writes the documents map to the database file
+// saveDocuments compresses, encrypts, and atomically replaces the database file with the documents map
+// as the next generation, keeping the generation it replaces as the .bak file
 func (db *Database) saveDocuments(documents map[string]json.RawMessage) error {
-	data, err := msgpack.Marshal(documents)
+	data, err := msgpack.Marshal(snapshot{Documents: documents, Created: db.created, Revisions: db.revisions, Indexes: db.indexSpecs(), TextIndex: db.textIndexSpec(), Schema: db.schemaData(), TTL: db.ttl})
 	if err != nil {
 		return err
 	}
@@ -155,38 +459,177 @@ func (db *Database) saveDocuments(documents map[string]json.RawMessage) error {
 		return err
 	}
 
-	encryptedData, err := db.encrypt(compressedData)
+	// New collections and files from before envelope encryption get a data key of their own
+	dataKey, wrappedKey, kdf := db.dataKey, db.wrappedKey, db.kdf
+	if wrappedKey == nil {
+		dataKey, err = newDataKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Wrap it afresh when it is new, the master key was rotated or the key derivation cost has changed
+	epoch := db.keys.currentEpoch()
+	if wrappedKey == nil || db.keyEpoch != epoch || db.keys.outdated(kdf) {
+		kdf, err = db.keys.newKDF()
+		if err != nil {
+			return err
+		}
+		wrappedKey, err = wrapKey(db.keys, kdf, dataKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	generation := db.generation + 1
+	encryptedData, err := sealFile(compressedData, generation, kdf, wrappedKey, dataKey)
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(db.filename, encryptedData, 0644)
+	// A primary that failed to open must not replace the good backup we recovered from
+	backup := db.backupPath()
+	if db.fromBackup {
+		backup = ""
+	}
+
+	err = util.WriteFileAtomic(db.filename, encryptedData, 0644, backup)
 	if err != nil {
 		return err
 	}
+	db.fromBackup = false
+	db.legacy = false
+	db.generation = generation
+	db.kdf = kdf
+	db.dataKey = dataKey
+	db.wrappedKey = wrappedKey
+	db.keyEpoch = epoch
+
+	// The text index can always be rebuilt from the documents, so failing to write it is not fatal
+	if err := db.saveTextIndex(); err != nil {
+		util.Warn(fmt.Sprintf("Failed to save text index of '%s': %v", db.filename, err))
+	}
 
 	return nil
 }
 
-// CreateDocument adds a new document with a unique key; generates a UUID if the key is empty
-func (db *Database) CreateDocument(key string, data json.RawMessage) error {
-	documents, err := db.LoadDocuments()
+// write applies a mutation to the in-memory documents and persists it; the caller must hold docsLock
+func (db *Database) write(record walRecord) error {
+	if db.loadErr != nil {
+		return db.loadErr
+	}
+
+	db.stampRevisions(&record)
+	if err := db.checkUnique(record); err != nil {
+		return err
+	}
+
+	undo := db.undoRecord(record)
+	applyWALRecord(db.documents, db.revisions, record)
+	db.trackExpiries(record)
+
+	err := db.commit(record)
 	if err != nil {
+		// Undo the in-memory change so memory never runs ahead of the file
+		applyWALRecord(db.documents, db.revisions, undo)
+		db.trackExpiries(undo)
 		return err
 	}
 
+	return nil
+}
+
+// revision returns the revision of a stored document. Documents from before revisions are at 1.
+// The caller must hold docsLock.
+func (db *Database) revision(key string) uint64 {
+	if revision := db.revisions[key]; revision > 0 {
+		return revision
+	}
+	return 1
+}
+
+// stampRevisions gives every put in record that has no revision yet the one after the revision it
+// replaces. Records replayed from a transaction's intent file keep the revisions they were given.
+// The caller must hold docsLock.
+func (db *Database) stampRevisions(record *walRecord) {
+	records := []*walRecord{record}
+	if record.Op == walOpBatch {
+		records = records[:0]
+		for i := range record.Records {
+			records = append(records, &record.Records[i])
+		}
+	}
+
+	next := make(map[string]uint64, len(records))
+	for _, changed := range records {
+		revision, seen := next[changed.Key]
+		if !seen {
+			revision = 1
+			if _, exists := db.documents[changed.Key]; exists {
+				revision = db.revision(changed.Key) + 1
+			}
+		}
+
+		switch changed.Op {
+		case walOpPut:
+			if changed.Rev == 0 {
+				changed.Rev = revision
+			}
+			next[changed.Key] = changed.Rev + 1
+		case walOpDelete:
+			next[changed.Key] = 1
+		}
+	}
+}
+
+// undoRecord returns a batch that restores every document record is about to change; the caller
+// must hold docsLock
+func (db *Database) undoRecord(record walRecord) walRecord {
+	records := []walRecord{record}
+	if record.Op == walOpBatch {
+		records = record.Records
+	}
+
+	undo := walRecord{Op: walOpBatch}
+	seen := make(map[string]bool, len(records))
+	for _, changed := range records {
+		if seen[changed.Key] {
+			continue
+		}
+		seen[changed.Key] = true
+
+		if previous, existed := db.documents[changed.Key]; existed {
+			undo.Records = append(undo.Records, walRecord{Op: walOpPut, Key: changed.Key, Data: previous, Rev: db.revision(changed.Key)})
+		} else {
+			undo.Records = append(undo.Records, walRecord{Op: walOpDelete, Key: changed.Key})
+		}
+	}
+
+	return undo
+}
+
+// CreateDocument adds a new document with a unique key; generates a UUID if the key is empty
+func (db *Database) CreateDocument(key string, data json.RawMessage) error {
 	if key == "" {
 		key = uuid.New().String()
 	}
 
-	if _, exists := documents[key]; exists {
-		return fmt.Errorf("document with key '%s' already exists", key)
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	// An expired document the reaper has not removed yet is replaced
+	previous, exists := db.documents[key]
+	if exists && !db.expired(key, time.Now()) {
+		return fmt.Errorf("%w: '%s'", ErrDocumentExists, key)
 	}
 
-	documents[key] = data
 	LastUsedDB = key
 
-	err = db.saveDocuments(documents)
+	record := walRecord{Op: walOpPut, Key: key, Data: data}
+	if err := db.prepareWrite(&record, nil); err != nil {
+		return err
+	}
+	err := db.write(record)
 	if err != nil {
 		return err
 	}
@@ -194,151 +637,136 @@ func (db *Database) CreateDocument(key string, data json.RawMessage) error {
 	// Update the index
 	db.indexLock.Lock()
 	defer db.indexLock.Unlock()
-	var docMap map[string]interface{}
-	err = json.Unmarshal(data, &docMap)
-	if err != nil {
-		return err
-	}
-	for fieldPath := range docMap {
-		fieldValue, found := traverseNestedFields(strings.Split(fieldPath, "."), docMap)
-		if found {
-			if db.fieldIndex[fieldPath] == nil {
-				db.fieldIndex[fieldPath] = make(map[string][]string)
-			}
-			db.fieldIndex[fieldPath][fieldValue] = append(db.fieldIndex[fieldPath][fieldValue], key)
-		}
-	}
 
-	return nil
+	if exists {
+		db.unindexDocument(key, previous)
+	}
+	return db.indexDocument(key, record.Data)
 }
 
 // ReadDocument retrieves a document by key
 func (db *Database) ReadDocument(key string) (json.RawMessage, error) {
-	documents, err := db.LoadDocuments()
-	if err != nil {
-		return nil, err
+	data, _, err := db.ReadDocumentRevision(key)
+	return data, err
+}
+
+// ReadDocumentRevision retrieves a document by key along with its revision
+func (db *Database) ReadDocumentRevision(key string) (json.RawMessage, uint64, error) {
+	db.docsLock.RLock()
+	defer db.docsLock.RUnlock()
+
+	if db.loadErr != nil {
+		return nil, 0, db.loadErr
 	}
 
-	data, exists := documents[key]
+	data, exists := db.document(key)
 	if !exists {
-		return nil, fmt.Errorf("document with key '%s' not found", key)
+		return nil, 0, fmt.Errorf("%w: '%s'", ErrDocumentNotFound, key)
 	}
 
 	LastUsedDB = db.filename
 	LastUpdateTime = time.Now()
 
-	return data, nil
+	return data, db.revision(key), nil
 }
 
-// UpdateDocument modifies an existing document by key
-func (db *Database) UpdateDocument(key string, data json.RawMessage) error {
-	documents, err := db.LoadDocuments()
-	if err != nil {
-		return err
-	}
+// UpdateDocument modifies an existing document by key and returns its new revision
+func (db *Database) UpdateDocument(key string, data json.RawMessage) (uint64, error) {
+	return db.updateDocument(key, data, 0)
+}
 
-	if _, exists := documents[key]; !exists {
-		return fmt.Errorf("document with key '%s' not found", key)
+// CompareAndSwap replaces a document only if it is still at the given revision, and returns its new
+// revision. It fails with ErrRevisionMismatch if the document was changed in the meantime.
+func (db *Database) CompareAndSwap(key string, revision uint64, data json.RawMessage) (uint64, error) {
+	if revision == 0 {
+		return 0, fmt.Errorf("%w: '%s' has no revision 0", ErrRevisionMismatch, key)
 	}
+	return db.updateDocument(key, data, revision)
+}
 
-	documents[key] = data
-	LastUpdateTime = time.Now()
+// updateDocument replaces a document that is at the given revision, or at any revision if it is 0
+func (db *Database) updateDocument(key string, data json.RawMessage, revision uint64) (uint64, error) {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
 
-	err = db.saveDocuments(documents)
-	if err != nil {
-		return err
+	previous, exists := db.document(key)
+	if !exists {
+		return 0, fmt.Errorf("%w: '%s'", ErrDocumentNotFound, key)
 	}
-
-	// Update the index
-	db.buildIndex()
-
-	return nil
-}
-
-// DeleteDocument removes a document by key
-func (db *Database) DeleteDocument(key string) error {
-	documents, err := db.LoadDocuments()
-	if err != nil {
-		return err
+	if current := db.revision(key); revision != 0 && current != revision {
+		return 0, fmt.Errorf("%w: '%s' is at revision %d, not %d", ErrRevisionMismatch, key, current, revision)
 	}
 
-	if _, exists := documents[key]; !exists {
-		return fmt.Errorf("document with key '%s' not found", key)
+	record := walRecord{Op: walOpPut, Key: key, Data: data}
+	if err := db.prepareWrite(&record, nil); err != nil {
+		return 0, err
 	}
 
-	delete(documents, key)
+	LastUpdateTime = time.Now()
 
-	err = db.saveDocuments(documents)
+	err := db.write(record)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Update the index
-	db.buildIndex()
+	db.indexLock.Lock()
+	defer db.indexLock.Unlock()
 
-	return nil
+	db.unindexDocument(key, previous)
+	return db.revision(key), db.indexDocument(key, record.Data)
 }
 
-// CountDocuments returns the number of documents in the database
-func (db *Database) CountDocuments() (int, error) {
-	documents, err := db.LoadDocuments()
-	if err != nil {
-		return 0, err
-	}
-	return len(documents), nil
+// DeleteDocument removes a document by key
+func (db *Database) DeleteDocument(key string) error {
+	return db.deleteDocument(key, 0)
 }
 
-// encrypt encrypts data using AES in CBC mode
-func (db *Database) encrypt(data []byte) ([]byte, error) {
-	block, err := aes.NewCipher(db.aesKey)
-	if err != nil {
-		return nil, err
+// CompareAndDelete removes a document only if it is still at the given revision. It fails with
+// ErrRevisionMismatch if the document was changed in the meantime.
+func (db *Database) CompareAndDelete(key string, revision uint64) error {
+	if revision == 0 {
+		return fmt.Errorf("%w: '%s' has no revision 0", ErrRevisionMismatch, key)
 	}
+	return db.deleteDocument(key, revision)
+}
 
-	data = util.PadData(data, block.BlockSize())
+// deleteDocument removes a document that is at the given revision, or at any revision if it is 0
+func (db *Database) deleteDocument(key string, revision uint64) error {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
 
-	ciphertext := make([]byte, aes.BlockSize+len(data))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return nil, err
+	previous, exists := db.document(key)
+	if !exists {
+		return fmt.Errorf("%w: '%s'", ErrDocumentNotFound, key)
 	}
-
-	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(ciphertext[aes.BlockSize:], data)
-
-	return ciphertext, nil
-}
-
-// decrypt decrypts data using AES in CBC mode
-func (db *Database) decrypt(ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(db.aesKey)
-	if err != nil {
-		return nil, err
+	if current := db.revision(key); revision != 0 && current != revision {
+		return fmt.Errorf("%w: '%s' is at revision %d, not %d", ErrRevisionMismatch, key, current, revision)
 	}
 
-	if len(ciphertext) < aes.BlockSize {
-		return nil, fmt.Errorf("ciphertext too short")
+	err := db.write(walRecord{Op: walOpDelete, Key: key})
+	if err != nil {
+		return err
 	}
 
-	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
-
-	mode := cipher.NewCBCDecrypter(block, iv)
-	mode.CryptBlocks(ciphertext, ciphertext)
+	// Update the index
+	db.indexLock.Lock()
+	defer db.indexLock.Unlock()
 
-	ciphertext = db.unpadData(ciphertext)
+	db.unindexDocument(key, previous)
 
-	return ciphertext, nil
+	return nil
 }
 
-// unpadData removes padding from the decrypted data
-func (db *Database) unpadData(data []byte) []byte {
-	length := len(data)
-	unpadding := int(data[length-1])
-	if unpadding > length {
-		return nil
+// CountDocuments returns the number of documents in the database
+func (db *Database) CountDocuments() (int, error) {
+	db.docsLock.RLock()
+	defer db.docsLock.RUnlock()
+
+	if db.loadErr != nil {
+		return 0, db.loadErr
 	}
-	return data[:(length - unpadding)]
+	return len(db.liveDocuments()), nil
 }
 
 // WHAT THE FUCK IS A KOLOMITORRR 🦅🦅
@@ -348,41 +776,38 @@ func (db *Database) FetchDocumentsByFieldValues(fieldValues map[string]string) (
 	if db == nil {
 		return nil, fmt.Errorf("database instance is nil")
 	}
-	if db.fieldIndex == nil {
-		return nil, fmt.Errorf("fieldIndex map is not initialized")
-	}
 
-	db.indexLock.RLock()
-	defer db.indexLock.RUnlock()
+	db.docsLock.RLock()
+	defer db.docsLock.RUnlock()
 
-	matchingKeys := make(map[string]int) // Map to count matching fields
+	if db.loadErr != nil {
+		return nil, db.loadErr
+	}
 
-	for fieldPath, value := range fieldValues {
-		lowerFieldPath := strings.ToLower(fieldPath)
-		lowerValue := strings.ToLower(value)
+	matchingKeys := make(map[string]int) // Map to count matching fields
 
-		keys, exists := db.fieldIndex[lowerFieldPath][lowerValue]
-		if !exists {
-			// If any field does not match, no need to proceed further
-			return nil, nil
+	// Search compares field names and values case-insensitively, which no index holds, so every
+	// document is checked
+	for key, data := range db.liveDocuments() {
+		var docMap map[string]interface{}
+		if decoded, ok := decodedDocument(data); ok {
+			docMap, _ = decoded.(map[string]interface{})
 		}
 
-		for _, key := range keys {
-			matchingKeys[key]++
+		for fieldPath, value := range fieldValues {
+			if searchMatches(docMap, fieldPath, value) {
+				matchingKeys[key]++
+			}
 		}
 	}
 
 	// Filter out keys that matched all field-value pairs
 	expectedMatches := len(fieldValues)
-	documents, err := db.LoadDocuments()
-	if err != nil {
-		return nil, err
-	}
 
 	matchingDocuments := make(map[string]json.RawMessage)
 	for key, matchCount := range matchingKeys {
 		if matchCount == expectedMatches {
-			if data, exists := documents[key]; exists {
+			if data, exists := db.documents[key]; exists {
 				matchingDocuments[key] = data
 			}
 		}
@@ -391,35 +816,40 @@ func (db *Database) FetchDocumentsByFieldValues(fieldValues map[string]string) (
 	return matchingDocuments, nil
 }
 
-// traverseNestedFields retrieves a nested field value from a document map (returns string and is case-insensitive)
-func traverseNestedFields(fields []string, docMap map[string]interface{}) (string, bool) {
-	fieldValue := interface{}(docMap)
-
-	for _, field := range fields {
-		switch v := fieldValue.(type) {
-		case map[string]interface{}:
-			var found bool
-			fieldValue, found = v[field]
-			if !found {
-				return "", false
-			}
-		case []interface{}:
-			var sliceValues []string
-			for _, elem := range v {
-				if elemMap, ok := elem.(map[string]interface{}); ok {
-					if val, ok := elemMap[field]; ok {
-						sliceValues = append(sliceValues, fmt.Sprintf("%v", val))
-					}
-				}
-			}
-			if len(sliceValues) > 0 {
-				return strings.Join(sliceValues, ","), true
+// searchMatches reports whether a top-level field of a document, whose name is compared
+// case-insensitively, holds a scalar that reads as value regardless of case
+func searchMatches(docMap map[string]interface{}, fieldPath, value string) bool {
+	for field := range docMap {
+		if !strings.EqualFold(field, fieldPath) {
+			continue
+		}
+		for _, found := range pathValues(docMap, []string{field}, false) {
+			if strings.EqualFold(found.String(), value) {
+				return true
 			}
-			return "", false
-		default:
-			return "", false
 		}
 	}
+	return false
+}
+
+// searchMatcher matches documents the way FetchDocumentsByFieldValues does
+type searchMatcher map[string]string
+
+func (m searchMatcher) match(document interface{}) bool {
+	docMap, ok := document.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for fieldPath, value := range m {
+		if !searchMatches(docMap, fieldPath, value) {
+			return false
+		}
+	}
+	return true
+}
 
-	return fmt.Sprintf("%v", fieldValue), true
+// NewSearchQuery returns a query matching the documents FetchDocumentsByFieldValues returns, so
+// search results can be sorted and paged with Find
+func NewSearchQuery(fieldValues map[string]string) *Query {
+	return &Query{root: searchMatcher(fieldValues)}
 }
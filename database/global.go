@@ -1,7 +1,6 @@
 package database
 
 import (
-	"encoding/json"
 	"time"
 )
 
@@ -9,5 +8,4 @@ var (
 	LastUsedDB      string
 	LastUpdateTime  time.Time
 	LastAddedRecord string
-	LastReadRecord  json.RawMessage
 )
\ No newline at end of file
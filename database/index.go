@@ -0,0 +1,297 @@
+package database
+
+import (
+	"encoding/json"
+	"math/big"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Kinds of values an ordered index holds, in the order they sort in
+const (
+	kindNull = iota
+	kindBool
+	kindNumber
+	kindString
+)
+
+// maxIndexLevel caps the height of an index's skiplist, which is plenty for billions of values
+const maxIndexLevel = 32
+
+// indexValue is a JSON scalar as held by an ordered index. Values sort by kind first, so null sorts
+// before booleans, booleans before numbers and numbers before strings. Numbers compare by value,
+// so 1 and 1.0 are the same entry, and strings compare byte by byte, which keeps ISO 8601 dates in
+// the same time zone in chronological order.
+type indexValue struct {
+	kind    int
+	boolean bool
+	number  *big.Float
+	text    string
+}
+
+// newIndexValue converts a value decoded with decodeJSON; ok is false for arrays and objects
+func newIndexValue(value interface{}) (indexValue, bool) {
+	switch value := value.(type) {
+	case nil:
+		return indexValue{kind: kindNull}, true
+	case bool:
+		return indexValue{kind: kindBool, boolean: value}, true
+	case json.Number:
+		number, ok := new(big.Float).SetString(value.String())
+		if !ok {
+			return indexValue{}, false
+		}
+		return indexValue{kind: kindNumber, number: number}, true
+	case string:
+		return indexValue{kind: kindString, text: value}, true
+	}
+	return indexValue{}, false
+}
+
+// compare orders two index values
+func (a indexValue) compare(b indexValue) int {
+	if a.kind != b.kind {
+		if a.kind < b.kind {
+			return -1
+		}
+		return 1
+	}
+
+	switch a.kind {
+	case kindBool:
+		switch {
+		case a.boolean == b.boolean:
+			return 0
+		case b.boolean:
+			return -1
+		default:
+			return 1
+		}
+	case kindNumber:
+		return a.number.Cmp(b.number)
+	case kindString:
+		return strings.Compare(a.text, b.text)
+	}
+	return 0
+}
+
+// String formats the value the way it is written in JSON, without quotes around strings
+func (a indexValue) String() string {
+	switch a.kind {
+	case kindBool:
+		return strconv.FormatBool(a.boolean)
+	case kindNumber:
+		return a.number.Text('g', -1)
+	case kindString:
+		return a.text
+	}
+	return "null"
+}
+
+// minValue returns the value of a kind that sorts before every other value of that kind
+func minValue(kind int) indexValue {
+	switch kind {
+	case kindNumber:
+		return indexValue{kind: kindNumber, number: new(big.Float).SetInf(true)}
+	}
+	return indexValue{kind: kind}
+}
+
+// encode returns a string that is the same for two values exactly when they compare equal
+func (a indexValue) encode() string {
+	if a.kind == kindString {
+		return strconv.Quote(a.text)
+	}
+	return strconv.Itoa(a.kind) + ":" + a.String()
+}
+
+// indexTuple is an entry of an ordered index, holding one value per indexed field
+type indexTuple []indexValue
+
+// compare orders two tuples of the same index field by field
+func (t indexTuple) compare(other indexTuple) int {
+	for i := range t {
+		if order := t[i].compare(other[i]); order != 0 {
+			return order
+		}
+	}
+	return 0
+}
+
+// encode returns a string that is the same for two tuples exactly when they compare equal
+func (t indexTuple) encode() string {
+	parts := make([]string, len(t))
+	for i, value := range t {
+		parts[i] = value.encode()
+	}
+	return strings.Join(parts, ",")
+}
+
+// String formats the tuple for error messages
+func (t indexTuple) String() string {
+	parts := make([]string, len(t))
+	for i, value := range t {
+		parts[i] = value.String()
+		if value.kind == kindString {
+			parts[i] = strconv.Quote(value.text)
+		}
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+// indexNode is a distinct entry in an ordered index along with the documents holding it
+type indexNode struct {
+	tuple indexTuple
+	keys  map[string]bool
+	next  []*indexNode
+}
+
+// orderedIndex is a skiplist of the entries an index holds across a collection, kept in the order
+// of indexTuple.compare so it can be scanned by range and by prefix
+type orderedIndex struct {
+	head   *indexNode
+	length int // Number of distinct entries
+}
+
+// newOrderedIndex returns an empty ordered index
+func newOrderedIndex() *orderedIndex {
+	return &orderedIndex{head: &indexNode{next: make([]*indexNode, maxIndexLevel)}}
+}
+
+// path returns the last node before tuple on each level of the skiplist
+func (index *orderedIndex) path(tuple indexTuple) []*indexNode {
+	path := make([]*indexNode, maxIndexLevel)
+	node := index.head
+	for level := maxIndexLevel - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].tuple.compare(tuple) < 0 {
+			node = node.next[level]
+		}
+		path[level] = node
+	}
+	return path
+}
+
+// insert records that the document key holds tuple
+func (index *orderedIndex) insert(tuple indexTuple, key string) {
+	path := index.path(tuple)
+	if node := path[0].next[0]; node != nil && node.tuple.compare(tuple) == 0 {
+		node.keys[key] = true
+		return
+	}
+
+	// Each level holds about half the nodes of the one below it
+	height := 1
+	for height < maxIndexLevel && rand.Intn(2) == 0 {
+		height++
+	}
+
+	node := &indexNode{tuple: tuple, keys: map[string]bool{key: true}, next: make([]*indexNode, height)}
+	for level := 0; level < height; level++ {
+		node.next[level] = path[level].next[level]
+		path[level].next[level] = node
+	}
+	index.length++
+}
+
+// remove forgets that the document key holds tuple, dropping the entry once no document holds it
+func (index *orderedIndex) remove(tuple indexTuple, key string) {
+	path := index.path(tuple)
+	node := path[0].next[0]
+	if node == nil || node.tuple.compare(tuple) != 0 {
+		return
+	}
+
+	delete(node.keys, key)
+	if len(node.keys) > 0 {
+		return
+	}
+	for level := range node.next {
+		path[level].next[level] = node.next[level]
+	}
+	index.length--
+}
+
+// lookup returns the documents holding tuple
+func (index *orderedIndex) lookup(tuple indexTuple) map[string]bool {
+	path := index.path(tuple)
+	if node := path[0].next[0]; node != nil && node.tuple.compare(tuple) == 0 {
+		return node.keys
+	}
+	return nil
+}
+
+// indexBound is one end of a range scan
+type indexBound struct {
+	value     indexValue
+	inclusive bool
+}
+
+// scan calls visit with the documents of every entry that starts with the values of prefix, and
+// whose value after those is not before start and is accepted by within. Entries are visited in
+// order, and the scan stops at the first one within rejects, so it must accept a leading run of
+// the values from start on. start and within may be nil to visit every entry with the prefix.
+func (index *orderedIndex) scan(prefix indexTuple, start *indexBound, within func(indexValue) bool, visit func(keys map[string]bool)) {
+	n := len(prefix)
+
+	node := index.head
+	for level := maxIndexLevel - 1; level >= 0; level-- {
+		for next := node.next[level]; next != nil; next = node.next[level] {
+			order := next.tuple[:n].compare(prefix)
+			if order == 0 && start != nil {
+				order = next.tuple[n].compare(start.value)
+				if order == 0 && !start.inclusive {
+					order = -1
+				}
+			}
+			if order >= 0 {
+				break
+			}
+			node = next
+		}
+	}
+
+	for node = node.next[0]; node != nil && node.tuple[:n].compare(prefix) == 0; node = node.next[0] {
+		if within != nil && !within(node.tuple[n]) {
+			return
+		}
+		visit(node.keys)
+	}
+}
+
+// scanRange calls visit with the documents of every entry that starts with the values of prefix
+// and whose value after those lies between lower and upper, either of which may be nil for an open
+// end. Only values of the same kind as the bounds are visited, the way comparisons in queries never
+// hold between a number and a string.
+func (index *orderedIndex) scanRange(prefix indexTuple, lower, upper *indexBound, visit func(keys map[string]bool)) {
+	if lower == nil && upper == nil {
+		index.scan(prefix, nil, nil, visit)
+		return
+	}
+
+	start := lower
+	if start == nil {
+		start = &indexBound{value: minValue(upper.value.kind), inclusive: true}
+	}
+	kind := start.value.kind
+
+	index.scan(prefix, start, func(value indexValue) bool {
+		if value.kind != kind {
+			return false
+		}
+		if upper == nil {
+			return true
+		}
+		order := value.compare(upper.value)
+		return order < 0 || (order == 0 && upper.inclusive)
+	}, visit)
+}
+
+// scanPrefix calls visit with the documents of every entry that starts with the values of prefix
+// and whose value after those is a string starting with text
+func (index *orderedIndex) scanPrefix(prefix indexTuple, text string, visit func(keys map[string]bool)) {
+	start := &indexBound{value: indexValue{kind: kindString, text: text}, inclusive: true}
+	index.scan(prefix, start, func(value indexValue) bool {
+		return value.kind == kindString && strings.HasPrefix(value.text, text)
+	}, visit)
+}
@@ -0,0 +1,359 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidIndex    = errors.New("invalid index")
+	ErrIndexExists     = errors.New("index already exists")
+	ErrIndexNotFound   = errors.New("index not found")
+	ErrUniqueViolation = errors.New("unique index violation")
+)
+
+// IndexSpec declares an index of a collection. Only declared indexes are kept in memory, and they
+// are stored in the .qdb file along with the documents.
+type IndexSpec struct {
+	Name          string   `msgpack:"name" json:"name"`
+	Fields        []string `msgpack:"fields" json:"fields"`                 // Dotted paths; more than one make a compound index
+	Unique        bool     `msgpack:"unique" json:"unique"`                 // No two documents may hold the same entry
+	Sparse        bool     `msgpack:"sparse" json:"sparse"`                 // Leave out documents with none of the fields rather than indexing them as null
+	CaseSensitive bool     `msgpack:"case_sensitive" json:"case_sensitive"` // Index strings as they are rather than lowercased
+}
+
+// declaredIndex is a declared index along with its entries
+type declaredIndex struct {
+	spec     IndexSpec
+	segments [][]string
+	entries  *orderedIndex
+}
+
+// newDeclaredIndex returns an empty index for a spec that has been validated
+func newDeclaredIndex(spec IndexSpec) *declaredIndex {
+	index := &declaredIndex{spec: spec, entries: newOrderedIndex()}
+	for _, field := range spec.Fields {
+		index.segments = append(index.segments, strings.Split(field, "."))
+	}
+	return index
+}
+
+// validateIndexSpec checks the fields of a spec and names it after them if it has no name
+func validateIndexSpec(spec *IndexSpec) error {
+	if len(spec.Fields) == 0 {
+		return fmt.Errorf("%w: at least one field is required", ErrInvalidIndex)
+	}
+
+	seen := make(map[string]bool, len(spec.Fields))
+	for _, field := range spec.Fields {
+		for _, segment := range strings.Split(field, ".") {
+			if segment == "" || strings.HasPrefix(segment, "$") {
+				return fmt.Errorf("%w: '%s' is not a field path", ErrInvalidIndex, field)
+			}
+		}
+		if seen[field] {
+			return fmt.Errorf("%w: '%s' is listed more than once", ErrInvalidIndex, field)
+		}
+		seen[field] = true
+	}
+
+	if spec.Name == "" {
+		spec.Name = strings.Join(spec.Fields, "_")
+	}
+	if strings.TrimSpace(spec.Name) != spec.Name || len(spec.Name) > 128 {
+		return fmt.Errorf("%w: '%s' is not a valid index name", ErrInvalidIndex, spec.Name)
+	}
+	return nil
+}
+
+// pathValues returns the distinct scalars found at a path of a document, the way a query condition
+// on the path sees them: the elements of an array are looked at one by one, and objects, and arrays
+// inside arrays, cannot be compared with a scalar and are left out. Strings are lowercased if fold
+// is true.
+func pathValues(document interface{}, segments []string, fold bool) []indexValue {
+	found := lookupPath(document, segments)
+	candidates := found
+	for _, value := range found {
+		if elements, ok := value.([]interface{}); ok {
+			candidates = append(candidates, elements...)
+		}
+	}
+
+	var values []indexValue
+	seen := make(map[string]bool)
+	for _, candidate := range candidates {
+		value, ok := newIndexValue(candidate)
+		if !ok {
+			continue
+		}
+		if fold && value.kind == kindString {
+			value.text = strings.ToLower(value.text)
+		}
+
+		if encoded := value.encode(); !seen[encoded] {
+			seen[encoded] = true
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// tuples returns the entries a decoded document adds to the index. A document holding several
+// values in a field, through an array, adds an entry for each, and one holding several values in
+// more than one field of a compound index adds an entry for every combination of them.
+func (index *declaredIndex) tuples(document interface{}) []indexTuple {
+	fields := make([][]indexValue, len(index.segments))
+	present := false
+	for i, segments := range index.segments {
+		fields[i] = pathValues(document, segments, !index.spec.CaseSensitive)
+		if len(fields[i]) > 0 {
+			present = true
+		} else {
+			fields[i] = []indexValue{{kind: kindNull}}
+		}
+	}
+	if !present && index.spec.Sparse {
+		return nil
+	}
+
+	tuples := []indexTuple{{}}
+	for _, values := range fields {
+		combined := make([]indexTuple, 0, len(tuples)*len(values))
+		for _, tuple := range tuples {
+			for _, value := range values {
+				combined = append(combined, append(append(indexTuple{}, tuple...), value))
+			}
+		}
+		tuples = combined
+	}
+	return tuples
+}
+
+// touches reports whether the index covers any of the given top-level fields
+func (index *declaredIndex) touches(fields []string) bool {
+	for _, segments := range index.segments {
+		for _, field := range fields {
+			if segments[0] == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// add inserts the entries of a decoded document
+func (index *declaredIndex) add(key string, document interface{}) {
+	for _, tuple := range index.tuples(document) {
+		index.entries.insert(tuple, key)
+	}
+}
+
+// drop removes the entries of a decoded document
+func (index *declaredIndex) drop(key string, document interface{}) {
+	for _, tuple := range index.tuples(document) {
+		index.entries.remove(tuple, key)
+	}
+}
+
+// Indexes returns the indexes declared on the collection, sorted by name
+func (db *Database) Indexes() []IndexSpec {
+	db.indexLock.RLock()
+	defer db.indexLock.RUnlock()
+
+	return db.indexSpecs()
+}
+
+// indexSpecs returns the declared indexes sorted by name; the caller must hold docsLock or indexLock
+func (db *Database) indexSpecs() []IndexSpec {
+	specs := make([]IndexSpec, 0, len(db.indexes))
+	for _, index := range db.indexes {
+		specs = append(specs, index.spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Name < specs[j].Name
+	})
+	return specs
+}
+
+// CreateIndex declares an index and builds it from the documents, returning the spec as stored.
+// A unique index cannot be created while documents hold duplicate entries.
+func (db *Database) CreateIndex(spec IndexSpec) (IndexSpec, error) {
+	if err := validateIndexSpec(&spec); err != nil {
+		return IndexSpec{}, err
+	}
+
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return IndexSpec{}, db.loadErr
+	}
+	if _, exists := db.indexes[spec.Name]; exists {
+		return IndexSpec{}, fmt.Errorf("%w: '%s'", ErrIndexExists, spec.Name)
+	}
+
+	index := newDeclaredIndex(spec)
+	for key, data := range db.documents {
+		document, ok := decodedDocument(data)
+		if !ok {
+			continue
+		}
+
+		if spec.Unique {
+			for _, tuple := range index.tuples(document) {
+				for holder := range index.entries.lookup(tuple) {
+					if holder != key {
+						return IndexSpec{}, fmt.Errorf("%w: '%s' and '%s' both hold %s", ErrUniqueViolation, holder, key, tuple)
+					}
+				}
+			}
+		}
+		index.add(key, document)
+	}
+
+	db.indexLock.Lock()
+	db.indexes[spec.Name] = index
+	db.indexLock.Unlock()
+
+	if err := db.saveSettings(); err != nil {
+		db.indexLock.Lock()
+		delete(db.indexes, spec.Name)
+		db.indexLock.Unlock()
+		return IndexSpec{}, err
+	}
+
+	return spec, nil
+}
+
+// DropIndex removes a declared index along with its entries
+func (db *Database) DropIndex(name string) error {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return db.loadErr
+	}
+	index, exists := db.indexes[name]
+	if !exists {
+		return fmt.Errorf("%w: '%s'", ErrIndexNotFound, name)
+	}
+
+	db.indexLock.Lock()
+	delete(db.indexes, name)
+	db.indexLock.Unlock()
+
+	if err := db.saveSettings(); err != nil {
+		db.indexLock.Lock()
+		db.indexes[name] = index
+		db.indexLock.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// saveSettings persists a change to the indexes or the schema by folding the log into the .qdb
+// file, which holds them. The caller must hold docsLock.
+func (db *Database) saveSettings() error {
+	lock := fileLock(db.filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return db.checkpoint(db.documents)
+}
+
+// uniqueCheck follows the entries that writes which are not applied yet give the unique indexes
+// of a collection, so each write can be checked against the documents and the writes before it.
+// The caller must hold docsLock and indexLock while it is in use.
+type uniqueCheck struct {
+	db      *Database
+	changed map[string]bool                // Documents whose stored entries the writes replace
+	pending map[string]map[string]string   // Entries of the writes by index, and the document holding each
+	entries map[string]map[string][]string // Entries of the writes by document and index
+}
+
+// newUniqueCheck starts checking writes against the documents as they are
+func (db *Database) newUniqueCheck() *uniqueCheck {
+	return &uniqueCheck{
+		db:      db,
+		changed: make(map[string]bool),
+		pending: make(map[string]map[string]string),
+		entries: make(map[string]map[string][]string),
+	}
+}
+
+// add checks a write and, if it keeps every unique index free of duplicates, records its entries.
+// A batch that fails partway leaves the check unusable.
+func (check *uniqueCheck) add(record walRecord) error {
+	if record.Op == walOpBatch {
+		for _, nested := range record.Records {
+			if err := check.add(nested); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	entries := make(map[string][]string)
+	if document, ok := decodedDocument(record.Data); ok && record.Op == walOpPut {
+		for name, index := range check.db.indexes {
+			if !index.spec.Unique {
+				continue
+			}
+			for _, tuple := range index.tuples(document) {
+				encoded := tuple.encode()
+				if holder, ok := check.pending[name][encoded]; ok && holder != record.Key {
+					return fmt.Errorf("%w: '%s' would hold %s in index '%s', which '%s' already holds", ErrUniqueViolation, record.Key, tuple, name, holder)
+				}
+				for holder := range index.entries.lookup(tuple) {
+					if holder != record.Key && !check.changed[holder] && !check.db.expired(holder, time.Now()) {
+						return fmt.Errorf("%w: '%s' would hold %s in index '%s', which '%s' already holds", ErrUniqueViolation, record.Key, tuple, name, holder)
+					}
+				}
+				entries[name] = append(entries[name], encoded)
+			}
+		}
+	}
+
+	// The write replaces whatever entries the document had so far
+	for name, encoded := range check.entries[record.Key] {
+		for _, entry := range encoded {
+			delete(check.pending[name], entry)
+		}
+	}
+	for name, encoded := range entries {
+		if check.pending[name] == nil {
+			check.pending[name] = make(map[string]string)
+		}
+		for _, entry := range encoded {
+			check.pending[name][entry] = record.Key
+		}
+	}
+	check.entries[record.Key] = entries
+	check.changed[record.Key] = true
+	return nil
+}
+
+// checkUnique fails with ErrUniqueViolation if applying record would give two documents the same
+// entry in a unique index; the caller must hold docsLock
+func (db *Database) checkUnique(record walRecord) error {
+	db.indexLock.RLock()
+	defer db.indexLock.RUnlock()
+
+	for _, index := range db.indexes {
+		if index.spec.Unique {
+			return db.newUniqueCheck().add(record)
+		}
+	}
+	return nil
+}
+
+// decodedDocument decodes a document for indexing; documents that are not valid JSON are not indexed
+func decodedDocument(data json.RawMessage) (interface{}, bool) {
+	document, err := decodeJSON(data)
+	return document, err == nil
+}
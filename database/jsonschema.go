@@ -0,0 +1,904 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidSchema is returned for JSON Schemas that cannot be compiled
+var ErrInvalidSchema = errors.New("invalid schema")
+
+// schemaDialect is the only JSON Schema dialect understood, draft 2020-12
+const schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// maxSchemaDepth caps how deeply schemas may apply to a value, which only a $ref that loops back
+// to itself without descending into the value can exceed
+const maxSchemaDepth = 256
+
+// SchemaViolation is a reason a value does not match a schema
+type SchemaViolation struct {
+	InstancePath string `json:"instance_path"` // JSON Pointer to the offending part of the document, empty for the whole of it
+	SchemaPath   string `json:"schema_path"`   // JSON Pointer to the keyword that failed
+	Message      string `json:"message"`
+}
+
+// schemaNode is a compiled schema or subschema. Boolean schemas have boolean set and nothing else.
+type schemaNode struct {
+	location string // JSON Pointer to the schema within the root schema
+	boolean  *bool
+
+	ref     *schemaNode
+	refText string
+
+	types    []string
+	enum     []interface{}
+	constant *interface{}
+
+	multipleOf, maximum, exclusiveMaximum, minimum, exclusiveMinimum *schemaNumber
+
+	maxLength, minLength *int
+	pattern              *regexp.Regexp
+
+	maxItems, minItems       *int
+	uniqueItems              bool
+	prefixItems              []*schemaNode
+	items                    *schemaNode
+	contains                 *schemaNode
+	maxContains, minContains *int
+	unevaluatedItems         *schemaNode
+
+	maxProperties, minProperties *int
+	required                     []string
+	dependentRequired            map[string][]string
+	properties                   map[string]*schemaNode
+	patternProperties            []patternSchema
+	additionalProperties         *schemaNode
+	propertyNames                *schemaNode
+	dependentSchemas             map[string]*schemaNode
+	unevaluatedProperties        *schemaNode
+
+	allOf, anyOf, oneOf                   []*schemaNode
+	not, ifSchema, thenSchema, elseSchema *schemaNode
+}
+
+// schemaNumber is a number in a schema
+type schemaNumber struct {
+	value *big.Float
+	exact *big.Rat // The number as written, so multipleOf 0.01 works as written; nil if out of range
+	text  string
+}
+
+// maxExactExponent caps the exponent of numbers that are compared exactly, since the size of an
+// exact number grows with its exponent
+const maxExactExponent = 400
+
+// parseNumber reads a JSON number to compare it with others
+func parseNumber(text string) (*big.Float, bool) {
+	number, _, err := big.ParseFloat(text, 10, 256, big.ToNearestEven)
+	return number, err == nil
+}
+
+// exactNumber reads a JSON number exactly, unless its exponent is too large for that
+func exactNumber(text string) (*big.Rat, bool) {
+	if i := strings.IndexAny(text, "eE"); i >= 0 {
+		exponent, err := strconv.Atoi(strings.TrimPrefix(text[i+1:], "+"))
+		if err != nil || exponent > maxExactExponent || exponent < -maxExactExponent {
+			return nil, false
+		}
+	}
+	return new(big.Rat).SetString(text)
+}
+
+// patternSchema applies a schema to the properties whose names match a pattern
+type patternSchema struct {
+	pattern *regexp.Regexp
+	schema  *schemaNode
+}
+
+// schemaCompiler compiles a schema document and resolves the references within it
+type schemaCompiler struct {
+	id      string // $id of the root schema, which references may start with
+	nodes   map[string]*schemaNode
+	anchors map[string]*schemaNode
+	refs    []*schemaNode
+}
+
+// compileSchema compiles a JSON Schema. References are resolved within the schema itself; remote
+// references, $dynamicRef and vocabularies other than those of draft 2020-12 are not supported.
+func compileSchema(data []byte) (*schemaNode, error) {
+	value, err := decodeJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+
+	compiler := &schemaCompiler{nodes: make(map[string]*schemaNode), anchors: make(map[string]*schemaNode)}
+	if object, ok := value.(map[string]interface{}); ok {
+		if dialect, ok := object["$schema"]; ok && strings.TrimSuffix(fmt.Sprint(dialect), "#") != schemaDialect {
+			return nil, fmt.Errorf("%w: only draft 2020-12 (%s) is supported", ErrInvalidSchema, schemaDialect)
+		}
+		compiler.id, _ = object["$id"].(string)
+	}
+
+	root, err := compiler.compile(value, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range compiler.refs {
+		if node.ref, err = compiler.resolve(node.refText); err != nil {
+			return nil, fmt.Errorf("%w: %s/$ref: %v", ErrInvalidSchema, node.location, err)
+		}
+	}
+	return root, nil
+}
+
+// resolve finds the schema a reference points to
+func (compiler *schemaCompiler) resolve(ref string) (*schemaNode, error) {
+	if compiler.id != "" && strings.HasPrefix(ref, compiler.id) {
+		ref = strings.TrimPrefix(ref, compiler.id)
+	}
+	if ref != "" && !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("'%s' is not within the schema; only references within it are supported", ref)
+	}
+
+	fragment, err := url.PathUnescape(strings.TrimPrefix(ref, "#"))
+	if err != nil {
+		return nil, err
+	}
+	var node *schemaNode
+	if fragment == "" || strings.HasPrefix(fragment, "/") {
+		node = compiler.nodes[fragment]
+	} else {
+		node = compiler.anchors[fragment]
+	}
+	if node == nil {
+		return nil, fmt.Errorf("'%s' does not point to a schema", ref)
+	}
+	return node, nil
+}
+
+// compile compiles the schema at location
+func (compiler *schemaCompiler) compile(value interface{}, location string) (*schemaNode, error) {
+	node := &schemaNode{location: location}
+	compiler.nodes[location] = node
+
+	if boolean, ok := value.(bool); ok {
+		node.boolean = &boolean
+		return node, nil
+	}
+	schema, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %s: a schema must be an object or a boolean", ErrInvalidSchema, locationText(location))
+	}
+
+	invalid := func(keyword, message string) error {
+		return fmt.Errorf("%w: %s/%s: %s", ErrInvalidSchema, location, keyword, message)
+	}
+	subschema := func(keyword string) (*schemaNode, error) {
+		if value, ok := schema[keyword]; ok {
+			return compiler.compile(value, location+"/"+keyword)
+		}
+		return nil, nil
+	}
+	subschemas := func(keyword string) ([]*schemaNode, error) {
+		value, ok := schema[keyword]
+		if !ok {
+			return nil, nil
+		}
+		array, ok := value.([]interface{})
+		if !ok || len(array) == 0 {
+			return nil, invalid(keyword, "must be a non-empty array of schemas")
+		}
+		nodes := make([]*schemaNode, len(array))
+		for i, element := range array {
+			var err error
+			if nodes[i], err = compiler.compile(element, location+"/"+keyword+"/"+strconv.Itoa(i)); err != nil {
+				return nil, err
+			}
+		}
+		return nodes, nil
+	}
+	schemaMap := func(keyword string) (map[string]*schemaNode, error) {
+		value, ok := schema[keyword]
+		if !ok {
+			return nil, nil
+		}
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, invalid(keyword, "must be an object of schemas")
+		}
+		nodes := make(map[string]*schemaNode, len(object))
+		for name, member := range object {
+			var err error
+			if nodes[name], err = compiler.compile(member, location+"/"+keyword+"/"+escapePointer(name)); err != nil {
+				return nil, err
+			}
+		}
+		return nodes, nil
+	}
+	number := func(keyword string) (*schemaNumber, error) {
+		value, ok := schema[keyword]
+		if !ok {
+			return nil, nil
+		}
+		text, isNumber := value.(json.Number)
+		number, parsed := parseNumber(text.String())
+		if !isNumber || !parsed || number.IsInf() {
+			return nil, invalid(keyword, "must be a number")
+		}
+		exact, _ := exactNumber(text.String())
+		return &schemaNumber{value: number, exact: exact, text: text.String()}, nil
+	}
+	count := func(keyword string) (*int, error) {
+		value, ok := schema[keyword]
+		if !ok {
+			return nil, nil
+		}
+		text, _ := value.(json.Number)
+		number, parsed := parseNumber(text.String())
+		if !parsed || !number.IsInt() || number.Sign() < 0 || number.Cmp(big.NewFloat(1<<31)) > 0 {
+			return nil, invalid(keyword, "must be a non-negative integer")
+		}
+		n, _ := number.Int64()
+		result := int(n)
+		return &result, nil
+	}
+	pattern := func(keyword, text string) (*regexp.Regexp, error) {
+		compiled, err := regexp.Compile(text)
+		if err != nil {
+			return nil, invalid(keyword, err.Error())
+		}
+		return compiled, nil
+	}
+
+	var err error
+	if ref, ok := schema["$ref"]; ok {
+		if node.refText, ok = ref.(string); !ok {
+			return nil, invalid("$ref", "must be a string")
+		}
+		compiler.refs = append(compiler.refs, node)
+	}
+	for _, keyword := range []string{"$dynamicRef", "$recursiveRef"} {
+		if _, ok := schema[keyword]; ok {
+			return nil, invalid(keyword, "is not supported")
+		}
+	}
+	for _, keyword := range []string{"$anchor", "$dynamicAnchor"} {
+		if anchor, ok := schema[keyword]; ok {
+			name, ok := anchor.(string)
+			if !ok || name == "" {
+				return nil, invalid(keyword, "must be a non-empty string")
+			}
+			if compiler.anchors[name] != nil {
+				return nil, invalid(keyword, fmt.Sprintf("'%s' is defined more than once", name))
+			}
+			compiler.anchors[name] = node
+		}
+	}
+	for _, keyword := range []string{"$defs", "definitions"} {
+		if _, err := schemaMap(keyword); err != nil {
+			return nil, err
+		}
+	}
+
+	if value, ok := schema["type"]; ok {
+		names, isArray := value.([]interface{})
+		if !isArray {
+			names = []interface{}{value}
+		}
+		for _, name := range names {
+			text, _ := name.(string)
+			switch text {
+			case "null", "boolean", "object", "array", "number", "string", "integer":
+				node.types = append(node.types, text)
+			default:
+				return nil, invalid("type", fmt.Sprintf("'%v' is not a JSON Schema type", name))
+			}
+		}
+	}
+	if value, ok := schema["enum"]; ok {
+		if node.enum, ok = value.([]interface{}); !ok {
+			return nil, invalid("enum", "must be an array")
+		}
+	}
+	if value, ok := schema["const"]; ok {
+		node.constant = &value
+	}
+
+	if node.multipleOf, err = number("multipleOf"); err != nil {
+		return nil, err
+	}
+	if node.multipleOf != nil && node.multipleOf.value.Sign() <= 0 {
+		return nil, invalid("multipleOf", "must be greater than 0")
+	}
+	if node.maximum, err = number("maximum"); err != nil {
+		return nil, err
+	}
+	if node.exclusiveMaximum, err = number("exclusiveMaximum"); err != nil {
+		return nil, err
+	}
+	if node.minimum, err = number("minimum"); err != nil {
+		return nil, err
+	}
+	if node.exclusiveMinimum, err = number("exclusiveMinimum"); err != nil {
+		return nil, err
+	}
+
+	if node.maxLength, err = count("maxLength"); err != nil {
+		return nil, err
+	}
+	if node.minLength, err = count("minLength"); err != nil {
+		return nil, err
+	}
+	if value, ok := schema["pattern"]; ok {
+		text, ok := value.(string)
+		if !ok {
+			return nil, invalid("pattern", "must be a string")
+		}
+		if node.pattern, err = pattern("pattern", text); err != nil {
+			return nil, err
+		}
+	}
+
+	if node.maxItems, err = count("maxItems"); err != nil {
+		return nil, err
+	}
+	if node.minItems, err = count("minItems"); err != nil {
+		return nil, err
+	}
+	if value, ok := schema["uniqueItems"]; ok {
+		if node.uniqueItems, ok = value.(bool); !ok {
+			return nil, invalid("uniqueItems", "must be true or false")
+		}
+	}
+	if node.prefixItems, err = subschemas("prefixItems"); err != nil {
+		return nil, err
+	}
+	if _, ok := schema["items"].([]interface{}); ok {
+		return nil, invalid("items", "must be a schema; tuples are described with prefixItems since draft 2020-12")
+	}
+	if node.items, err = subschema("items"); err != nil {
+		return nil, err
+	}
+	if node.contains, err = subschema("contains"); err != nil {
+		return nil, err
+	}
+	if node.maxContains, err = count("maxContains"); err != nil {
+		return nil, err
+	}
+	if node.minContains, err = count("minContains"); err != nil {
+		return nil, err
+	}
+	if node.unevaluatedItems, err = subschema("unevaluatedItems"); err != nil {
+		return nil, err
+	}
+
+	if node.maxProperties, err = count("maxProperties"); err != nil {
+		return nil, err
+	}
+	if node.minProperties, err = count("minProperties"); err != nil {
+		return nil, err
+	}
+	if value, ok := schema["required"]; ok {
+		if node.required, ok = stringArray(value); !ok {
+			return nil, invalid("required", "must be an array of strings")
+		}
+	}
+	if value, ok := schema["dependentRequired"]; ok {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, invalid("dependentRequired", "must be an object of arrays of strings")
+		}
+		node.dependentRequired = make(map[string][]string, len(object))
+		for name, member := range object {
+			if node.dependentRequired[name], ok = stringArray(member); !ok {
+				return nil, invalid("dependentRequired", "must be an object of arrays of strings")
+			}
+		}
+	}
+	if node.properties, err = schemaMap("properties"); err != nil {
+		return nil, err
+	}
+	patterns, err := schemaMap("patternProperties")
+	if err != nil {
+		return nil, err
+	}
+	for text, schema := range patterns {
+		compiled, err := pattern("patternProperties", text)
+		if err != nil {
+			return nil, err
+		}
+		node.patternProperties = append(node.patternProperties, patternSchema{pattern: compiled, schema: schema})
+	}
+	sort.Slice(node.patternProperties, func(i, j int) bool {
+		return node.patternProperties[i].pattern.String() < node.patternProperties[j].pattern.String()
+	})
+	if node.additionalProperties, err = subschema("additionalProperties"); err != nil {
+		return nil, err
+	}
+	if node.propertyNames, err = subschema("propertyNames"); err != nil {
+		return nil, err
+	}
+	if node.dependentSchemas, err = schemaMap("dependentSchemas"); err != nil {
+		return nil, err
+	}
+	if node.unevaluatedProperties, err = subschema("unevaluatedProperties"); err != nil {
+		return nil, err
+	}
+
+	if node.allOf, err = subschemas("allOf"); err != nil {
+		return nil, err
+	}
+	if node.anyOf, err = subschemas("anyOf"); err != nil {
+		return nil, err
+	}
+	if node.oneOf, err = subschemas("oneOf"); err != nil {
+		return nil, err
+	}
+	if node.not, err = subschema("not"); err != nil {
+		return nil, err
+	}
+	if node.ifSchema, err = subschema("if"); err != nil {
+		return nil, err
+	}
+	if node.thenSchema, err = subschema("then"); err != nil {
+		return nil, err
+	}
+	if node.elseSchema, err = subschema("else"); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// stringArray converts a decoded array of strings
+func stringArray(value interface{}) ([]string, bool) {
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	strs := make([]string, len(array))
+	for i, element := range array {
+		if strs[i], ok = element.(string); !ok {
+			return nil, false
+		}
+	}
+	return strs, true
+}
+
+// escapePointer escapes a name for use as a JSON Pointer token
+func escapePointer(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
+
+// locationText names a schema location in error messages, where the root has an empty pointer
+func locationText(location string) string {
+	if location == "" {
+		return "the root schema"
+	}
+	return location
+}
+
+// schemaAnnotations are the properties and items of a value that a schema has evaluated, which
+// unevaluatedProperties and unevaluatedItems leave alone
+type schemaAnnotations struct {
+	properties map[string]bool
+	items      map[int]bool
+	allItems   bool
+}
+
+// merge adds the annotations of a subschema that matched
+func (a *schemaAnnotations) merge(other schemaAnnotations) {
+	for name := range other.properties {
+		if a.properties == nil {
+			a.properties = make(map[string]bool)
+		}
+		a.properties[name] = true
+	}
+	for index := range other.items {
+		if a.items == nil {
+			a.items = make(map[int]bool)
+		}
+		a.items[index] = true
+	}
+	a.allItems = a.allItems || other.allItems
+}
+
+// schemaValidator gathers the violations found while validating a value
+type schemaValidator struct {
+	violations []SchemaViolation
+	depth      int
+}
+
+// validateSchema returns the ways a decoded value does not match a compiled schema
+func validateSchema(root *schemaNode, value interface{}) []SchemaViolation {
+	validator := &schemaValidator{}
+	validator.validate(root, value, "")
+	return validator.violations
+}
+
+// try reports whether a value matches a schema without recording why it does not, for keywords
+// such as anyOf that only need to know
+func (v *schemaValidator) try(node *schemaNode, value interface{}, path string) (bool, schemaAnnotations) {
+	recorded := len(v.violations)
+	valid, annotations := v.validate(node, value, path)
+	v.violations = v.violations[:recorded]
+	return valid, annotations
+}
+
+// validate checks a value against a schema, recording every violation, and returns whether it
+// matches along with what the schema evaluated
+func (v *schemaValidator) validate(node *schemaNode, value interface{}, path string) (bool, schemaAnnotations) {
+	var annotations schemaAnnotations
+	valid := true
+	fail := func(keyword, message string) {
+		valid = false
+		v.violations = append(v.violations, SchemaViolation{InstancePath: path, SchemaPath: node.location + "/" + keyword, Message: message})
+	}
+
+	if node.boolean != nil {
+		if !*node.boolean {
+			valid = false
+			v.violations = append(v.violations, SchemaViolation{InstancePath: path, SchemaPath: node.location, Message: "is not allowed by the schema"})
+		}
+		return valid, annotations
+	}
+
+	v.depth++
+	defer func() { v.depth-- }()
+	if v.depth > maxSchemaDepth {
+		fail("$ref", "schema references nest too deeply")
+		return false, annotations
+	}
+
+	// apply validates against a subschema, keeping what it evaluated if it matches
+	apply := func(child *schemaNode, value interface{}, path string) bool {
+		ok, childAnnotations := v.validate(child, value, path)
+		if ok {
+			annotations.merge(childAnnotations)
+		} else {
+			valid = false
+		}
+		return ok
+	}
+
+	if node.ref != nil {
+		apply(node.ref, value, path)
+	}
+
+	actual := jsonType(value)
+	if len(node.types) > 0 {
+		matched := false
+		for _, name := range node.types {
+			matched = matched || name == actual || (name == "number" && actual == "integer")
+		}
+		if !matched {
+			fail("type", fmt.Sprintf("must be %s, not %s", strings.Join(node.types, " or "), actual))
+		}
+	}
+	if node.enum != nil {
+		matched := false
+		for _, option := range node.enum {
+			matched = matched || jsonEqual(value, option)
+		}
+		if !matched {
+			fail("enum", "must be one of the values listed in enum")
+		}
+	}
+	if node.constant != nil && !jsonEqual(value, *node.constant) {
+		fail("const", "must equal the const value")
+	}
+
+	switch value := value.(type) {
+	case json.Number:
+		v.validateNumber(node, value, fail)
+	case string:
+		length := utf8.RuneCountInString(value)
+		if node.maxLength != nil && length > *node.maxLength {
+			fail("maxLength", fmt.Sprintf("must be at most %d characters long", *node.maxLength))
+		}
+		if node.minLength != nil && length < *node.minLength {
+			fail("minLength", fmt.Sprintf("must be at least %d characters long", *node.minLength))
+		}
+		if node.pattern != nil && !node.pattern.MatchString(value) {
+			fail("pattern", fmt.Sprintf("must match the pattern '%s'", node.pattern))
+		}
+	case []interface{}:
+		v.validateArray(node, value, path, fail, apply, &annotations)
+	case map[string]interface{}:
+		v.validateObject(node, value, path, fail, apply, &annotations)
+	}
+
+	for _, child := range node.allOf {
+		apply(child, value, path)
+	}
+	if node.anyOf != nil {
+		matched := false
+		for _, child := range node.anyOf {
+			if ok, childAnnotations := v.try(child, value, path); ok {
+				matched = true
+				annotations.merge(childAnnotations)
+			}
+		}
+		if !matched {
+			fail("anyOf", "must match at least one of the schemas in anyOf")
+		}
+	}
+	if node.oneOf != nil {
+		matches := 0
+		var matchedAnnotations schemaAnnotations
+		for _, child := range node.oneOf {
+			if ok, childAnnotations := v.try(child, value, path); ok {
+				matches++
+				matchedAnnotations = childAnnotations
+			}
+		}
+		if matches == 1 {
+			annotations.merge(matchedAnnotations)
+		} else {
+			fail("oneOf", fmt.Sprintf("must match exactly one of the schemas in oneOf, but matches %d", matches))
+		}
+	}
+	if node.not != nil {
+		if ok, _ := v.try(node.not, value, path); ok {
+			fail("not", "must not match the schema in not")
+		}
+	}
+	if node.ifSchema != nil {
+		if ok, childAnnotations := v.try(node.ifSchema, value, path); ok {
+			annotations.merge(childAnnotations)
+			if node.thenSchema != nil {
+				apply(node.thenSchema, value, path)
+			}
+		} else if node.elseSchema != nil {
+			apply(node.elseSchema, value, path)
+		}
+	}
+
+	// unevaluated* see what every other keyword evaluated, so they come last
+	switch value := value.(type) {
+	case []interface{}:
+		if node.unevaluatedItems != nil && !annotations.allItems {
+			for i, element := range value {
+				if !annotations.items[i] {
+					apply(node.unevaluatedItems, element, path+"/"+strconv.Itoa(i))
+				}
+			}
+			annotations.allItems = true
+		}
+	case map[string]interface{}:
+		if node.unevaluatedProperties != nil {
+			for _, name := range sortedNames(value) {
+				if !annotations.properties[name] {
+					apply(node.unevaluatedProperties, value[name], path+"/"+escapePointer(name))
+				}
+			}
+			for name := range value {
+				annotations.merge(schemaAnnotations{properties: map[string]bool{name: true}})
+			}
+		}
+	}
+
+	return valid, annotations
+}
+
+// validateNumber applies the numeric keywords
+func (v *schemaValidator) validateNumber(node *schemaNode, value json.Number, fail func(keyword, message string)) {
+	number, ok := parseNumber(value.String())
+	if !ok {
+		return
+	}
+
+	if node.multipleOf != nil {
+		var multiple bool
+		if exact, ok := exactNumber(value.String()); ok && node.multipleOf.exact != nil {
+			multiple = new(big.Rat).Quo(exact, node.multipleOf.exact).IsInt()
+		} else {
+			multiple = new(big.Float).SetPrec(256).Quo(number, node.multipleOf.value).IsInt()
+		}
+		if !multiple {
+			fail("multipleOf", fmt.Sprintf("must be a multiple of %s", node.multipleOf.text))
+		}
+	}
+	if node.maximum != nil && number.Cmp(node.maximum.value) > 0 {
+		fail("maximum", fmt.Sprintf("must be at most %s", node.maximum.text))
+	}
+	if node.exclusiveMaximum != nil && number.Cmp(node.exclusiveMaximum.value) >= 0 {
+		fail("exclusiveMaximum", fmt.Sprintf("must be less than %s", node.exclusiveMaximum.text))
+	}
+	if node.minimum != nil && number.Cmp(node.minimum.value) < 0 {
+		fail("minimum", fmt.Sprintf("must be at least %s", node.minimum.text))
+	}
+	if node.exclusiveMinimum != nil && number.Cmp(node.exclusiveMinimum.value) <= 0 {
+		fail("exclusiveMinimum", fmt.Sprintf("must be greater than %s", node.exclusiveMinimum.text))
+	}
+}
+
+// validateArray applies the array keywords other than unevaluatedItems
+func (v *schemaValidator) validateArray(node *schemaNode, value []interface{}, path string, fail func(keyword, message string), apply func(*schemaNode, interface{}, string) bool, annotations *schemaAnnotations) {
+	if node.maxItems != nil && len(value) > *node.maxItems {
+		fail("maxItems", fmt.Sprintf("must have at most %d items", *node.maxItems))
+	}
+	if node.minItems != nil && len(value) < *node.minItems {
+		fail("minItems", fmt.Sprintf("must have at least %d items", *node.minItems))
+	}
+	if node.uniqueItems {
+	unique:
+		for i := range value {
+			for j := i + 1; j < len(value); j++ {
+				if jsonEqual(value[i], value[j]) {
+					fail("uniqueItems", fmt.Sprintf("items %d and %d must not be equal", i, j))
+					break unique
+				}
+			}
+		}
+	}
+
+	for i, child := range node.prefixItems {
+		if i >= len(value) {
+			break
+		}
+		apply(child, value[i], path+"/"+strconv.Itoa(i))
+		annotations.merge(schemaAnnotations{items: map[int]bool{i: true}})
+	}
+	if node.items != nil {
+		for i := len(node.prefixItems); i < len(value); i++ {
+			apply(node.items, value[i], path+"/"+strconv.Itoa(i))
+		}
+		annotations.allItems = true
+	}
+
+	if node.contains != nil {
+		matches := 0
+		for i, element := range value {
+			if ok, _ := v.try(node.contains, element, path+"/"+strconv.Itoa(i)); ok {
+				matches++
+				annotations.merge(schemaAnnotations{items: map[int]bool{i: true}})
+			}
+		}
+
+		minimum := 1
+		if node.minContains != nil {
+			minimum = *node.minContains
+		}
+		if matches < minimum {
+			fail("contains", fmt.Sprintf("must contain at least %d matching items, but contains %d", minimum, matches))
+		}
+		if node.maxContains != nil && matches > *node.maxContains {
+			fail("maxContains", fmt.Sprintf("must contain at most %d matching items, but contains %d", *node.maxContains, matches))
+		}
+	}
+}
+
+// validateObject applies the object keywords other than unevaluatedProperties
+func (v *schemaValidator) validateObject(node *schemaNode, value map[string]interface{}, path string, fail func(keyword, message string), apply func(*schemaNode, interface{}, string) bool, annotations *schemaAnnotations) {
+	if node.maxProperties != nil && len(value) > *node.maxProperties {
+		fail("maxProperties", fmt.Sprintf("must have at most %d properties", *node.maxProperties))
+	}
+	if node.minProperties != nil && len(value) < *node.minProperties {
+		fail("minProperties", fmt.Sprintf("must have at least %d properties", *node.minProperties))
+	}
+	for _, name := range node.required {
+		if _, ok := value[name]; !ok {
+			fail("required", fmt.Sprintf("is missing the required property '%s'", name))
+		}
+	}
+
+	names := sortedNames(value)
+	for _, name := range names {
+		for _, dependency := range node.dependentRequired[name] {
+			if _, ok := value[dependency]; !ok {
+				fail("dependentRequired", fmt.Sprintf("must have the property '%s' when it has '%s'", dependency, name))
+			}
+		}
+		if child := node.dependentSchemas[name]; child != nil {
+			apply(child, value, path)
+		}
+	}
+
+	evaluated := make(map[string]bool)
+	for _, name := range names {
+		childPath := path + "/" + escapePointer(name)
+		matched := false
+		if child, ok := node.properties[name]; ok {
+			apply(child, value[name], childPath)
+			matched = true
+		}
+		for _, pattern := range node.patternProperties {
+			if pattern.pattern.MatchString(name) {
+				apply(pattern.schema, value[name], childPath)
+				matched = true
+			}
+		}
+		if !matched && node.additionalProperties != nil {
+			apply(node.additionalProperties, value[name], childPath)
+			matched = true
+		}
+		if matched {
+			evaluated[name] = true
+		}
+		if node.propertyNames != nil {
+			apply(node.propertyNames, name, childPath)
+		}
+	}
+	annotations.merge(schemaAnnotations{properties: evaluated})
+}
+
+// sortedNames returns the property names of an object in order, so violations are reported in a
+// stable order
+func sortedNames(object map[string]interface{}) []string {
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// jsonType names the JSON Schema type of a decoded value, with integers told apart from other numbers
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if number, ok := parseNumber(value.String()); ok && number.IsInt() {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// jsonEqual reports whether two decoded values are equal as JSON Schema defines it: numbers by
+// value, arrays element by element and objects member by member
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, okA := parseNumber(a.String())
+		y, okB := parseNumber(b.String())
+		return okA && okB && x.Cmp(y) == 0
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for name, member := range a {
+			other, ok := b[name]
+			if !ok || !jsonEqual(member, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
@@ -0,0 +1,277 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// schemaFailures lists where a value fails a schema, as "instance path -> schema path"
+func schemaFailures(t *testing.T, schema, document string) []string {
+	t.Helper()
+
+	root, err := compileSchema([]byte(schema))
+	if err != nil {
+		t.Fatalf("compileSchema(%s): %v", schema, err)
+	}
+	value, err := decodeJSON([]byte(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures := []string{}
+	for _, violation := range validateSchema(root, value) {
+		failures = append(failures, violation.InstancePath+" -> "+violation.SchemaPath)
+	}
+	return failures
+}
+
+func TestValidateSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   string
+		document string
+		want     []string // Where the document fails the schema, empty if it matches
+	}{
+		{"true", `true`, `{"a":1}`, nil},
+		{"false", `false`, `1`, []string{" -> "}},
+		{"empty schema", `{}`, `[null]`, nil},
+
+		{"type", `{"type":"string"}`, `1`, []string{" -> /type"}},
+		{"type list", `{"type":["string","null"]}`, `null`, nil},
+		{"integer is a number", `{"type":"number"}`, `3`, nil},
+		{"integer written with a fraction", `{"type":"integer"}`, `3.0`, nil},
+		{"number is not an integer", `{"type":"integer"}`, `3.5`, []string{" -> /type"}},
+		{"enum", `{"enum":["low",2,{"a":[1]}]}`, `{"a":[1.0]}`, nil},
+		{"enum mismatch", `{"enum":["low",2]}`, `"2"`, []string{" -> /enum"}},
+		{"const", `{"const":{"a":null}}`, `{"a":false}`, []string{" -> /const"}},
+
+		{"multipleOf decimal", `{"multipleOf":0.01}`, `19.99`, nil},
+		{"multipleOf mismatch", `{"multipleOf":0.01}`, `19.999`, []string{" -> /multipleOf"}},
+		{"huge multiple", `{"multipleOf":0.5}`, `1e500`, nil},
+		{"maximum", `{"maximum":10}`, `10`, nil},
+		{"exclusiveMaximum", `{"exclusiveMaximum":10}`, `10`, []string{" -> /exclusiveMaximum"}},
+		{"minimum", `{"minimum":-1.5}`, `-2`, []string{" -> /minimum"}},
+		{"exclusiveMinimum", `{"exclusiveMinimum":0}`, `0.0001`, nil},
+		{"numeric keywords skip strings", `{"minimum":5}`, `"1"`, nil},
+
+		{"maxLength counts characters", `{"maxLength":5}`, `"naïve"`, nil},
+		{"minLength", `{"minLength":2}`, `"a"`, []string{" -> /minLength"}},
+		{"pattern is not anchored", `{"pattern":"[0-9]+"}`, `"CVE-2024"`, nil},
+		{"pattern mismatch", `{"pattern":"^[a-z]+$"}`, `"Abc"`, []string{" -> /pattern"}},
+
+		{"maxItems and minItems", `{"maxItems":1,"minItems":3}`, `[1,2]`, []string{" -> /maxItems", " -> /minItems"}},
+		{"uniqueItems", `{"uniqueItems":true}`, `[1,{"a":2},1.0]`, []string{" -> /uniqueItems"}},
+		{"prefixItems and items", `{"prefixItems":[{"type":"string"}],"items":{"type":"integer"}}`, `["a",1,"b",2.5]`,
+			[]string{"/2 -> /items/type", "/3 -> /items/type"}},
+		{"contains", `{"contains":{"const":"x"}}`, `["a","b"]`, []string{" -> /contains"}},
+		{"minContains 0", `{"contains":{"const":"x"},"minContains":0}`, `[]`, nil},
+		{"maxContains", `{"contains":{"type":"integer"},"maxContains":1}`, `[1,"a",2]`, []string{" -> /maxContains"}},
+		{"unevaluatedItems", `{"prefixItems":[true],"contains":{"type":"string"},"unevaluatedItems":false}`, `[1,"a",2]`,
+			[]string{"/2 -> /unevaluatedItems"}},
+
+		{"required", `{"required":["title","severity"]}`, `{"title":"x"}`, []string{" -> /required"}},
+		{"maxProperties and minProperties", `{"maxProperties":1,"minProperties":1}`, `{}`, []string{" -> /minProperties"}},
+		{"properties", `{"properties":{"severity":{"type":"integer"}}}`, `{"severity":"high","other":1}`,
+			[]string{"/severity -> /properties/severity/type"}},
+		{"patternProperties", `{"patternProperties":{"^x-":{"type":"string"}}}`, `{"x-a":"1","x-b":2,"y":3}`,
+			[]string{"/x-b -> /patternProperties/^x-/type"}},
+		{"additionalProperties", `{"properties":{"a":true},"patternProperties":{"^b":true},"additionalProperties":false}`, `{"a":1,"bc":2,"c":3}`,
+			[]string{"/c -> /additionalProperties"}},
+		{"propertyNames", `{"propertyNames":{"maxLength":3}}`, `{"abc":1,"abcd":2}`, []string{"/abcd -> /propertyNames/maxLength"}},
+		{"dependentRequired", `{"dependentRequired":{"card":["cvc"]}}`, `{"card":"4111"}`, []string{" -> /dependentRequired"}},
+		{"dependentSchemas", `{"dependentSchemas":{"card":{"required":["cvc"]}}}`, `{"card":"4111"}`, []string{" -> /dependentSchemas/card/required"}},
+		{"unevaluatedProperties through allOf", `{"allOf":[{"properties":{"a":true}}],"unevaluatedProperties":false}`, `{"a":1,"b":2}`,
+			[]string{"/b -> /unevaluatedProperties"}},
+		{"unevaluatedProperties ignores failed branches", `{"anyOf":[{"properties":{"a":{"type":"string"}}},true],"unevaluatedProperties":false}`, `{"a":1}`,
+			[]string{"/a -> /unevaluatedProperties"}},
+		{"escaped property names", `{"properties":{"a/b~c":{"type":"string"}}}`, `{"a/b~c":1}`, []string{"/a~1b~0c -> /properties/a~1b~0c/type"}},
+
+		{"allOf", `{"allOf":[{"type":"integer"},{"minimum":5}]}`, `3`, []string{" -> /allOf/1/minimum"}},
+		{"anyOf", `{"anyOf":[{"type":"string"},{"type":"null"}]}`, `1`, []string{" -> /anyOf"}},
+		{"oneOf with two matches", `{"oneOf":[{"type":"integer"},{"minimum":0}]}`, `1`, []string{" -> /oneOf"}},
+		{"oneOf", `{"oneOf":[{"type":"integer"},{"minimum":0}]}`, `0.5`, nil},
+		{"not", `{"not":{"type":"null"}}`, `null`, []string{" -> /not"}},
+		{"if then", `{"if":{"properties":{"status":{"const":"closed"}}},"then":{"required":["resolution"]},"else":{"required":["owner"]}}`,
+			`{"status":"closed"}`, []string{" -> /then/required"}},
+		{"if else", `{"if":{"properties":{"status":{"const":"closed"}}},"then":{"required":["resolution"]},"else":{"required":["owner"]}}`,
+			`{"status":"open"}`, []string{" -> /else/required"}},
+		{"every violation is reported", `{"properties":{"a":{"type":"string"},"b":{"type":"string"}},"required":["c"]}`, `{"a":1,"b":2}`,
+			[]string{" -> /required", "/a -> /properties/a/type", "/b -> /properties/b/type"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := schemaFailures(t, test.schema, test.document)
+			want := test.want
+			if want == nil {
+				want = []string{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s against %s failed at %q, want %q", test.document, test.schema, got, want)
+			}
+		})
+	}
+}
+
+func TestSchemaRef(t *testing.T) {
+	// A tree of incidents, where each may have child incidents
+	const tree = `{
+		"$id": "https://example.com/incident",
+		"$defs": {
+			"severity": {"$anchor": "severity", "enum": ["low", "high"]},
+			"incident": {
+				"type": "object",
+				"properties": {
+					"severity": {"$ref": "#severity"},
+					"children": {"type": "array", "items": {"$ref": "#/$defs/incident"}}
+				},
+				"required": ["severity"]
+			},
+			"a/b": {"type": "string"}
+		},
+		"$ref": "https://example.com/incident#/$defs/incident",
+		"properties": {"note": {"$ref": "#/$defs/a~1b"}}
+	}`
+
+	tests := []struct {
+		name     string
+		document string
+		want     []string
+	}{
+		{"valid", `{"severity":"low","note":"x","children":[{"severity":"high","children":[]}]}`, nil},
+		{"through an anchor", `{"severity":"medium"}`, []string{"/severity -> /$defs/severity/enum"}},
+		{"recursive", `{"severity":"low","children":[{"severity":"low","children":[{}]}]}`,
+			[]string{"/children/0/children/0 -> /$defs/incident/required"}},
+		{"escaped pointer", `{"severity":"low","note":1}`, []string{"/note -> /$defs/a~1b/type"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := schemaFailures(t, tree, test.document)
+			want := test.want
+			if want == nil {
+				want = []string{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("failed at %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSchemaDepth(t *testing.T) {
+	// References that loop without descending into the value stop at maxSchemaDepth
+	loops := []string{
+		`{"$ref":"#"}`,
+		`{"$defs":{"a":{"$ref":"#/$defs/b"},"b":{"$ref":"#/$defs/a"}},"$ref":"#/$defs/a"}`,
+		`{"anyOf":[{"$ref":"#"}]}`,
+	}
+	for _, schema := range loops {
+		if got := schemaFailures(t, schema, `{"a":1}`); len(got) == 0 {
+			t.Errorf("%s matched a value through a loop of references", schema)
+		}
+	}
+
+	root, err := compileSchema([]byte(`{"$ref":"#"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	violations := validateSchema(root, nil)
+	if len(violations) != 1 || violations[0].SchemaPath != "/$ref" || !strings.Contains(violations[0].Message, "too deeply") {
+		t.Errorf("looping reference reported %+v", violations)
+	}
+
+	// A recursive schema applies as deep as the value goes, up to the cap. Each level of this one
+	// takes two schemas: the root and the child property referring back to it.
+	nested := func(levels int) string {
+		return strings.Repeat(`{"child":`, levels) + `{}` + strings.Repeat(`}`, levels)
+	}
+	const recursive = `{"type":"object","properties":{"child":{"$ref":"#"}}}`
+	levels := (maxSchemaDepth - 1) / 2
+	if got := schemaFailures(t, recursive, nested(levels)); len(got) != 0 {
+		t.Errorf("value %d levels deep failed with %q", levels, got)
+	}
+	if got := schemaFailures(t, recursive, nested(levels+1)); len(got) != 1 {
+		t.Errorf("value %d levels deep failed with %q, want one violation", levels+1, got)
+	}
+}
+
+func TestCompileSchemaErrors(t *testing.T) {
+	tests := map[string]string{
+		"not JSON":                  `{`,
+		"not an object":             `"string"`,
+		"another dialect":           `{"$schema":"http://json-schema.org/draft-07/schema#"}`,
+		"unknown type":              `{"type":"date"}`,
+		"enum not an array":         `{"enum":"low"}`,
+		"multipleOf 0":              `{"multipleOf":0}`,
+		"maximum not a number":      `{"maximum":"10"}`,
+		"negative maxLength":        `{"maxLength":-1}`,
+		"fractional minItems":       `{"minItems":1.5}`,
+		"invalid pattern":           `{"pattern":"("}`,
+		"invalid patternProperties": `{"patternProperties":{"(":true}}`,
+		"items as an array":         `{"items":[true]}`,
+		"empty allOf":               `{"allOf":[]}`,
+		"subschema not a schema":    `{"not":1}`,
+		"required not strings":      `{"required":[1]}`,
+		"dependentRequired":         `{"dependentRequired":{"a":"b"}}`,
+		"properties not an object":  `{"properties":[]}`,
+		"uniqueItems not a boolean": `{"uniqueItems":1}`,
+		"missing reference":         `{"$ref":"#/$defs/missing"}`,
+		"missing anchor":            `{"$ref":"#nowhere"}`,
+		"remote reference":          `{"$ref":"https://example.com/other.json"}`,
+		"reference not a string":    `{"$ref":1}`,
+		"duplicate anchor":          `{"$defs":{"a":{"$anchor":"x"},"b":{"$anchor":"x"}}}`,
+		"$dynamicRef":               `{"$dynamicRef":"#x"}`,
+		"invalid $defs member":      `{"$defs":{"a":"b"}}`,
+	}
+
+	for name, schema := range tests {
+		if _, err := compileSchema([]byte(schema)); !errors.Is(err, ErrInvalidSchema) {
+			t.Errorf("%s: compileSchema(%s) failed with %v, want %v", name, schema, err, ErrInvalidSchema)
+		}
+	}
+}
+
+func TestSchemaIgnoresExpiry(t *testing.T) {
+	const schema = `{"type":"object","properties":{"title":{"type":"string"}},"required":["title"],"additionalProperties":false}`
+
+	db := LoadDB(filepath.Join(t.TempDir(), "alerts.qdb"), testKeys("secret"))
+	if err := db.SetSchema(json.RawMessage(schema)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTTL(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// The collection stamps expires_at on documents that do not match a schema allowing nothing
+	// but a title, and clients may set it themselves
+	writes := map[string]string{
+		"stamped": `{"title":"a"}`,
+		"set":     `{"title":"b","expires_at":"2099-01-01T00:00:00Z"}`,
+		"never":   `{"title":"c","expires_at":null}`,
+	}
+	for key, data := range writes {
+		if err := db.CreateDocument(key, json.RawMessage(data)); err != nil {
+			t.Errorf("writing %s: %v", data, err)
+		}
+	}
+	if report, err := db.ValidateDocuments(nil, 0); err != nil || report.Invalid != 0 {
+		t.Errorf("ValidateDocuments = %+v, %v, want no invalid documents", report, err)
+	}
+
+	// Only the top-level expires_at is left out
+	rejected := map[string]string{
+		"nested":   `{"title":"d","owner":{"expires_at":"2099-01-01T00:00:00Z"}}`,
+		"no title": `{"expires_at":"2099-01-01T00:00:00Z"}`,
+	}
+	for key, data := range rejected {
+		if err := db.CreateDocument(key, json.RawMessage(data)); !errors.Is(err, ErrSchemaViolation) {
+			t.Errorf("writing %s failed with %v, want %v", data, err, ErrSchemaViolation)
+		}
+	}
+}
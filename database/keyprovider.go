@@ -0,0 +1,183 @@
+package database
+
+import (
+	"CyberDefenseEd/QuadDB/util"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyProvider supplies the master key that collection data keys are wrapped with
+type KeyProvider interface {
+	MasterKey() ([]byte, error)
+}
+
+// KeyStore is a KeyProvider that can also keep a new master key, which online key rotation needs
+// so that the server starts with the key the collections were moved to. The new key is staged next
+// to the current one until every collection is under it.
+type KeyStore interface {
+	KeyProvider
+	// StageKey returns the staged master key, generating and storing a random one if none is staged
+	StageKey() (KeyProvider, error)
+	// StagedKey returns the staged master key of a rotation that has not finished, if there is one
+	StagedKey() (KeyProvider, bool, error)
+	// PromoteKey makes the staged master key the current one
+	PromoteKey() error
+}
+
+// StaticKey is a master key passed in directly, e.g. with --aes-key
+type StaticKey string
+
+func (k StaticKey) MasterKey() ([]byte, error) {
+	if k == "" {
+		return nil, fmt.Errorf("no master key configured")
+	}
+	return []byte(k), nil
+}
+
+// FileKey reads the master key from a file, ignoring surrounding whitespace
+type FileKey string
+
+func (k FileKey) MasterKey() ([]byte, error) {
+	return readKeyFile(string(k))
+}
+
+func (k FileKey) StageKey() (KeyProvider, error) {
+	return stageKey(string(k))
+}
+
+func (k FileKey) StagedKey() (KeyProvider, bool, error) {
+	return stagedKey(string(k))
+}
+
+func (k FileKey) PromoteKey() error {
+	return promoteKey(string(k))
+}
+
+// EnvKey reads the master key from an environment variable
+type EnvKey string
+
+func (k EnvKey) MasterKey() ([]byte, error) {
+	key := os.Getenv(string(k))
+	if key == "" {
+		return nil, fmt.Errorf("environment variable '%s' is not set", string(k))
+	}
+	return []byte(key), nil
+}
+
+// LocalKMS stands in for a key management service. It keeps a random hex-encoded master key in
+// master.key inside its directory, generating one on first use, so no passphrase has to be handled.
+type LocalKMS string
+
+func (k LocalKMS) MasterKey() ([]byte, error) {
+	key, err := readKeyFile(k.keyFile())
+	if os.IsNotExist(err) {
+		return createKeyFile(k.keyFile())
+	}
+	return key, err
+}
+
+func (k LocalKMS) StageKey() (KeyProvider, error) {
+	return stageKey(k.keyFile())
+}
+
+func (k LocalKMS) StagedKey() (KeyProvider, bool, error) {
+	return stagedKey(k.keyFile())
+}
+
+func (k LocalKMS) PromoteKey() error {
+	return promoteKey(k.keyFile())
+}
+
+// keyFile returns the path of the master key file
+func (k LocalKMS) keyFile() string {
+	return filepath.Join(string(k), "master.key")
+}
+
+// readKeyFile reads a master key from a file, ignoring surrounding whitespace
+func readKeyFile(keyFile string) ([]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return nil, fmt.Errorf("key file '%s' is empty", keyFile)
+	}
+	return []byte(key), nil
+}
+
+// createKeyFile writes a random hex-encoded master key to a new file, refusing to replace one that
+// appeared in the meantime
+func createKeyFile(keyFile string) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	encodedKey := hex.EncodeToString(key)
+	if _, err := file.WriteString(encodedKey); err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	if err := util.SyncDir(filepath.Dir(keyFile)); err != nil {
+		return nil, err
+	}
+
+	return []byte(encodedKey), nil
+}
+
+// stagedKeyFile returns where the next master key is kept while a rotation to it runs
+func stagedKeyFile(keyFile string) string {
+	return keyFile + ".next"
+}
+
+// stageKey returns the master key staged next to keyFile, staging a random one if there is none
+func stageKey(keyFile string) (KeyProvider, error) {
+	staged, ok, err := stagedKey(keyFile)
+	if err != nil || ok {
+		return staged, err
+	}
+
+	key, err := createKeyFile(stagedKeyFile(keyFile))
+	if err != nil {
+		return nil, err
+	}
+	return StaticKey(key), nil
+}
+
+// stagedKey returns the master key staged next to keyFile, if there is one
+func stagedKey(keyFile string) (KeyProvider, bool, error) {
+	key, err := readKeyFile(stagedKeyFile(keyFile))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return StaticKey(key), true, nil
+}
+
+// promoteKey moves the master key staged next to keyFile over it
+func promoteKey(keyFile string) error {
+	if err := os.Rename(stagedKeyFile(keyFile), keyFile); err != nil {
+		return err
+	}
+	return util.SyncDir(filepath.Dir(keyFile))
+}
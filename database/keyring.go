@@ -0,0 +1,163 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// kdfSHA256 marks keys derived with a single unsalted SHA-256 of the master key
+	kdfSHA256 = 1
+	// kdfArgon2id marks keys derived with Argon2id from the master key and a per-file salt
+	kdfArgon2id = 2
+
+	kdfSaltSize = 16
+)
+
+// KDFParams are the Argon2id cost parameters used when deriving new key encryption keys
+type KDFParams struct {
+	Time    uint32 // Number of passes over the memory
+	Memory  uint32 // Memory in KiB
+	Threads uint8
+}
+
+// DefaultKDFParams follows the RFC 9106 recommendation for memory-constrained environments
+var DefaultKDFParams = KDFParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// Keyring turns the master key from a KeyProvider into the per-collection key encryption keys that
+// wrap collection data keys. Derived keys are cached, as every collection has its own salt and
+// Argon2id is deliberately expensive.
+type Keyring struct {
+	provider KeyProvider
+	params   KDFParams
+	cache    map[string][]byte
+	epoch    uint64 // bumped whenever the master key changes
+	lock     sync.Mutex
+}
+
+// NewKeyring creates a Keyring for the master key supplied by provider, deriving new keys with params
+func NewKeyring(provider KeyProvider, params KDFParams) *Keyring {
+	if params.Time == 0 {
+		params.Time = DefaultKDFParams.Time
+	}
+	if params.Memory == 0 {
+		params.Memory = DefaultKDFParams.Memory
+	}
+	if params.Threads == 0 {
+		params.Threads = DefaultKDFParams.Threads
+	}
+
+	return &Keyring{
+		provider: provider,
+		params:   params,
+		cache:    make(map[string][]byte),
+	}
+}
+
+// WithProvider returns a Keyring for another master key with the same cost parameters
+func (k *Keyring) WithProvider(provider KeyProvider) *Keyring {
+	return NewKeyring(provider, k.params)
+}
+
+// Matches reports whether key is the current master key, in constant time
+func (k *Keyring) Matches(key string) bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	masterKey, err := k.provider.MasterKey()
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(masterKey, []byte(key)) == 1
+}
+
+// Provider returns where the master key comes from
+func (k *Keyring) Provider() KeyProvider {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.provider
+}
+
+// SetProvider switches the Keyring to a new master key, e.g. once every collection has been rotated to it
+func (k *Keyring) SetProvider(provider KeyProvider) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.provider = provider
+	k.cache = make(map[string][]byte)
+	k.epoch++
+}
+
+// currentEpoch identifies the master key in use, so wrapped keys can tell when they went stale
+func (k *Keyring) currentEpoch() uint64 {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.epoch
+}
+
+// newKDF returns key derivation parameters with a fresh random salt for a new key encryption key
+func (k *Keyring) newKDF() (kdfParams, error) {
+	salt := make([]byte, kdfSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return kdfParams{}, err
+	}
+
+	return kdfParams{
+		Algorithm: kdfArgon2id,
+		Salt:      salt,
+		Time:      k.params.Time,
+		Memory:    k.params.Memory,
+		Threads:   k.params.Threads,
+	}, nil
+}
+
+// outdated reports whether a key encryption key should be replaced on the next write, either because
+// it comes from the legacy SHA-256 derivation or because the configured cost has changed
+func (k *Keyring) outdated(kdf kdfParams) bool {
+	return kdf.Algorithm != kdfArgon2id ||
+		kdf.Time != k.params.Time ||
+		kdf.Memory != k.params.Memory ||
+		kdf.Threads != k.params.Threads
+}
+
+// derive returns the key described by kdf
+func (k *Keyring) derive(kdf kdfParams) ([]byte, error) {
+	cacheKey := fmt.Sprintf("%d:%d:%d:%d:%x", kdf.Algorithm, kdf.Time, kdf.Memory, kdf.Threads, kdf.Salt)
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if key, ok := k.cache[cacheKey]; ok {
+		return key, nil
+	}
+
+	masterKey, err := k.provider.MasterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	switch kdf.Algorithm {
+	case kdfSHA256:
+		// Compatibility path for files written before per-file salts existed
+		hash := sha256.Sum256(masterKey)
+		key = hash[:]
+	case kdfArgon2id:
+		if len(kdf.Salt) == 0 || kdf.Time == 0 || kdf.Memory == 0 || kdf.Threads == 0 {
+			return nil, fmt.Errorf("invalid Argon2id parameters in file header")
+		}
+		key = argon2.IDKey(masterKey, kdf.Salt, kdf.Time, kdf.Memory, kdf.Threads, 32)
+	default:
+		return nil, fmt.Errorf("unsupported key derivation id %d", kdf.Algorithm)
+	}
+
+	k.cache[cacheKey] = key
+	return key, nil
+}
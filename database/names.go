@@ -0,0 +1,35 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidCollectionName is returned for collection names that do not follow the naming policy
+var ErrInvalidCollectionName = errors.New("invalid collection name")
+
+// collectionNamePattern keeps names safe to use as file names on every platform: no separators, no
+// dots (so no "..") and nothing that could be mistaken for an option or a hidden file
+var collectionNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// reservedCollectionNames clash with API routes or with device names on Windows
+var reservedCollectionNames = map[string]bool{
+	"collections": true, "updates": true, "admin": true, "tx": true,
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// ValidateCollectionName checks a collection name against the naming policy. Every path to a
+// collection's files is built from a name that passed this check.
+func ValidateCollectionName(name string) error {
+	if !collectionNamePattern.MatchString(name) {
+		return fmt.Errorf("%w '%s': use 1 to 64 letters, digits, '_' or '-', starting with a letter or digit", ErrInvalidCollectionName, name)
+	}
+	if reservedCollectionNames[strings.ToLower(name)] {
+		return fmt.Errorf("%w '%s': the name is reserved", ErrInvalidCollectionName, name)
+	}
+	return nil
+}
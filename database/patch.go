@@ -0,0 +1,518 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrPatchFailed is returned when a patch cannot be applied to a document, such as when a JSON Patch
+// test fails or a path does not exist
+var ErrPatchFailed = errors.New("patch cannot be applied")
+
+// Patch is a partial update of a document
+type Patch interface {
+	// apply returns the document with the patch applied; document may be changed in the process
+	apply(document interface{}) (interface{}, error)
+	// fields returns the top-level fields the patch may change, or nil if it may change any of them
+	fields() []string
+}
+
+// mergePatch is an RFC 7386 JSON Merge Patch
+type mergePatch struct {
+	patch interface{}
+}
+
+// jsonPatchOp is a single operation of an RFC 6902 JSON Patch
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+
+	path, from []string
+	value      interface{}
+}
+
+// jsonPatch is an RFC 6902 JSON Patch
+type jsonPatch []jsonPatchOp
+
+// decodeJSON decodes a JSON value, keeping numbers as written
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	return value, nil
+}
+
+// encodeJSON encodes a value decoded by decodeJSON
+func encodeJSON(value interface{}) (json.RawMessage, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// NewMergePatch parses an RFC 7386 JSON Merge Patch
+func NewMergePatch(data []byte) (Patch, error) {
+	patch, err := decodeJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid merge patch: %v", err)
+	}
+	return mergePatch{patch: patch}, nil
+}
+
+func (patch mergePatch) apply(document interface{}) (interface{}, error) {
+	return mergeValue(document, patch.patch), nil
+}
+
+func (patch mergePatch) fields() []string {
+	members, ok := patch.patch.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	fields := make([]string, 0, len(members))
+	for field := range members {
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// mergeValue merges patch into target as described in RFC 7386
+func mergeValue(target, patch interface{}) interface{} {
+	members, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		object = make(map[string]interface{}, len(members))
+	}
+	for field, value := range members {
+		if value == nil {
+			delete(object, field)
+		} else {
+			object[field] = mergeValue(object[field], value)
+		}
+	}
+	return object
+}
+
+// NewJSONPatch parses an RFC 6902 JSON Patch
+func NewJSONPatch(data []byte) (Patch, error) {
+	var ops jsonPatch
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, fmt.Errorf("invalid JSON patch: %v", err)
+	}
+
+	for i := range ops {
+		op := &ops[i]
+		if op.Path == nil {
+			return nil, fmt.Errorf("invalid JSON patch: operation %d has no path", i)
+		}
+
+		var err error
+		if op.path, err = parsePointer(*op.Path); err != nil {
+			return nil, fmt.Errorf("invalid JSON patch: operation %d: %v", i, err)
+		}
+
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("invalid JSON patch: operation %d (%s) has no value", i, op.Op)
+			}
+			if op.value, err = decodeJSON(op.Value); err != nil {
+				return nil, fmt.Errorf("invalid JSON patch: operation %d: %v", i, err)
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, fmt.Errorf("invalid JSON patch: operation %d (%s) has no from", i, op.Op)
+			}
+			if op.from, err = parsePointer(*op.From); err != nil {
+				return nil, fmt.Errorf("invalid JSON patch: operation %d: %v", i, err)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("invalid JSON patch: operation %d has unknown op '%s'", i, op.Op)
+		}
+	}
+
+	return ops, nil
+}
+
+func (patch jsonPatch) apply(document interface{}) (interface{}, error) {
+	var err error
+	for i, op := range patch {
+		document, err = op.apply(document)
+		if err != nil {
+			return nil, fmt.Errorf("%w: operation %d (%s %s): %v", ErrPatchFailed, i, op.Op, *op.Path, err)
+		}
+	}
+	return document, nil
+}
+
+func (patch jsonPatch) fields() []string {
+	fields := []string{}
+	for _, op := range patch {
+		if op.Op == "test" {
+			continue
+		}
+		if len(op.path) == 0 || (op.Op == "move" && len(op.from) == 0) {
+			return nil
+		}
+
+		fields = append(fields, op.path[0])
+		if op.Op == "move" {
+			fields = append(fields, op.from[0])
+		}
+	}
+	return fields
+}
+
+// apply runs a single JSON Patch operation against document
+func (op jsonPatchOp) apply(document interface{}) (interface{}, error) {
+	switch op.Op {
+	case "add":
+		return addValue(document, op.path, copyValue(op.value))
+	case "remove":
+		document, _, err := removeValue(document, op.path)
+		return document, err
+	case "replace":
+		if len(op.path) == 0 {
+			return copyValue(op.value), nil
+		}
+		document, _, err := removeValue(document, op.path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(document, op.path, copyValue(op.value))
+	case "move":
+		if len(op.from) < len(op.path) && pointerHasPrefix(op.path, op.from) {
+			return nil, errors.New("cannot move a value into one of its own children")
+		}
+		document, value, err := removeValue(document, op.from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(document, op.path, value)
+	case "copy":
+		value, err := getValue(document, op.from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(document, op.path, copyValue(value))
+	case "test":
+		value, err := getValue(document, op.path)
+		if err != nil {
+			return nil, err
+		}
+		if !equalValues(value, op.value) {
+			return nil, errors.New("test failed")
+		}
+		return document, nil
+	}
+	return nil, fmt.Errorf("unknown op '%s'", op.Op)
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("path '%s' does not start with '/'", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// pointerHasPrefix reports whether the pointer tokens start with prefix
+func pointerHasPrefix(tokens, prefix []string) bool {
+	for i, token := range prefix {
+		if tokens[i] != token {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses an array index token. "-", the position after the last element, is only
+// allowed when appending.
+func arrayIndex(token string, length int, appending bool) (int, error) {
+	if token == "-" && appending {
+		return length, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index '%s'", token)
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid array index '%s'", token)
+	}
+
+	limit := length
+	if appending {
+		limit++
+	}
+	if index >= limit {
+		return 0, fmt.Errorf("array index %d is out of range", index)
+	}
+	return index, nil
+}
+
+// getValue returns the value a pointer refers to
+func getValue(document interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch container := document.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("member '%s' does not exist", token)
+			}
+			document = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			document = container[index]
+		default:
+			return nil, fmt.Errorf("cannot look up '%s' in a scalar", token)
+		}
+	}
+	return document, nil
+}
+
+// updateParent calls change on the container holding the value a pointer refers to, and returns
+// the document with the changed container in its place
+func updateParent(document interface{}, tokens []string, change func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return change(document, tokens[0])
+	}
+
+	child, err := getValue(document, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = updateParent(child, tokens[1:], change)
+	if err != nil {
+		return nil, err
+	}
+
+	switch container := document.(type) {
+	case map[string]interface{}:
+		container[tokens[0]] = child
+	case []interface{}:
+		index, _ := arrayIndex(tokens[0], len(container), false)
+		container[index] = child
+	}
+	return document, nil
+}
+
+// addValue adds or replaces an object member, or inserts an array element, as the JSON Patch add operation does
+func addValue(document interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	return updateParent(document, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch parent := container.(type) {
+		case map[string]interface{}:
+			parent[token] = value
+			return parent, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(parent), true)
+			if err != nil {
+				return nil, err
+			}
+			parent = append(parent, nil)
+			copy(parent[index+1:], parent[index:])
+			parent[index] = value
+			return parent, nil
+		default:
+			return nil, fmt.Errorf("cannot add '%s' to a scalar", token)
+		}
+	})
+}
+
+// removeValue removes the value a pointer refers to and returns it
+func removeValue(document interface{}, tokens []string) (interface{}, interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+
+	var removed interface{}
+	document, err := updateParent(document, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch parent := container.(type) {
+		case map[string]interface{}:
+			value, ok := parent[token]
+			if !ok {
+				return nil, fmt.Errorf("member '%s' does not exist", token)
+			}
+			removed = value
+			delete(parent, token)
+			return parent, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(parent), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = parent[index]
+			return append(parent[:index], parent[index+1:]...), nil
+		default:
+			return nil, fmt.Errorf("cannot remove '%s' from a scalar", token)
+		}
+	})
+	return document, removed, err
+}
+
+// copyValue returns a deep copy of a decoded JSON value
+func copyValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for field, member := range value {
+			object[field] = copyValue(member)
+		}
+		return object
+	case []interface{}:
+		array := make([]interface{}, len(value))
+		for i, element := range value {
+			array[i] = copyValue(element)
+		}
+		return array
+	default:
+		return value
+	}
+}
+
+// equalValues compares two decoded JSON values, treating numbers as equal when their values are
+func equalValues(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for field, member := range a {
+			other, ok := b[field]
+			if !ok || !equalValues(member, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equalValues(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, okA := new(big.Float).SetString(a.String())
+		y, okB := new(big.Float).SetString(b.String())
+		return okA && okB && x.Cmp(y) == 0
+	default:
+		return a == b
+	}
+}
+
+// PatchDocument applies a patch to a document that is at the given revision, or at any revision if
+// it is 0, and returns its new revision. The document is patched and written under the collection
+// lock, so no other write can come in between, and only the fields the patch touches are reindexed.
+// Like any update, a patch that removes expires_at leaves the document expiring when it did; only
+// a null expires_at stops it expiring.
+func (db *Database) PatchDocument(key string, patch Patch, revision uint64) (uint64, error) {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return 0, db.loadErr
+	}
+
+	previous, exists := db.document(key)
+	if !exists {
+		return 0, fmt.Errorf("%w: '%s'", ErrDocumentNotFound, key)
+	}
+	if current := db.revision(key); revision != 0 && current != revision {
+		return 0, fmt.Errorf("%w: '%s' is at revision %d, not %d", ErrRevisionMismatch, key, current, revision)
+	}
+
+	document, err := decodeJSON(previous)
+	if err != nil {
+		return 0, err
+	}
+	_, wasObject := document.(map[string]interface{})
+	document, err = patch.apply(document)
+	if err != nil {
+		return 0, err
+	}
+	data, err := encodeJSON(document)
+	if err != nil {
+		return 0, err
+	}
+
+	record := walRecord{Op: walOpPut, Key: key, Data: data}
+	if err := db.prepareWrite(&record, nil); err != nil {
+		return 0, err
+	}
+
+	// Index entries only follow top-level fields while the document stays an object, and a patch
+	// that removes expires_at gets the expiry put back, so in either case more than the fields the
+	// patch touches change
+	fields := patch.fields()
+	if _, isObject := document.(map[string]interface{}); !wasObject || !isObject {
+		fields = nil
+	}
+	if !bytes.Equal(record.Data, data) {
+		data, fields = record.Data, nil
+	}
+
+	LastUpdateTime = time.Now()
+
+	err = db.write(record)
+	if err != nil {
+		return 0, err
+	}
+
+	db.indexLock.Lock()
+	defer db.indexLock.Unlock()
+
+	if fields == nil {
+		db.unindexDocument(key, previous)
+		return db.revision(key), db.indexDocument(key, data)
+	}
+
+	db.reindexFields(key, previous, data, fields)
+	return db.revision(key), nil
+}
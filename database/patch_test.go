@@ -0,0 +1,155 @@
+package database
+
+import "testing"
+
+// TestJSONPatch runs the examples of RFC 6902 Appendix A. An empty want means the patch must fail.
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		patch    string
+		want     string
+	}{
+		{
+			name:     "A.1 adding an object member",
+			document: `{"foo":"bar"}`,
+			patch:    `[{"op":"add","path":"/baz","value":"qux"}]`,
+			want:     `{"baz":"qux","foo":"bar"}`,
+		},
+		{
+			name:     "A.2 adding an array element",
+			document: `{"foo":["bar","baz"]}`,
+			patch:    `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			want:     `{"foo":["bar","qux","baz"]}`,
+		},
+		{
+			name:     "A.3 removing an object member",
+			document: `{"baz":"qux","foo":"bar"}`,
+			patch:    `[{"op":"remove","path":"/baz"}]`,
+			want:     `{"foo":"bar"}`,
+		},
+		{
+			name:     "A.4 removing an array element",
+			document: `{"foo":["bar","qux","baz"]}`,
+			patch:    `[{"op":"remove","path":"/foo/1"}]`,
+			want:     `{"foo":["bar","baz"]}`,
+		},
+		{
+			name:     "A.5 replacing a value",
+			document: `{"baz":"qux","foo":"bar"}`,
+			patch:    `[{"op":"replace","path":"/baz","value":"boo"}]`,
+			want:     `{"baz":"boo","foo":"bar"}`,
+		},
+		{
+			name:     "A.6 moving a value",
+			document: `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			patch:    `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			want:     `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{
+			name:     "A.7 moving an array element",
+			document: `{"foo":["all","grass","cows","eat"]}`,
+			patch:    `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			want:     `{"foo":["all","cows","eat","grass"]}`,
+		},
+		{
+			name:     "A.8 testing a value: success",
+			document: `{"baz":"qux","foo":["a",2,"c"]}`,
+			patch:    `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			want:     `{"baz":"qux","foo":["a",2,"c"]}`,
+		},
+		{
+			name:     "A.9 testing a value: error",
+			document: `{"baz":"qux"}`,
+			patch:    `[{"op":"test","path":"/baz","value":"bar"}]`,
+		},
+		{
+			name:     "A.10 adding a nested member object",
+			document: `{"foo":"bar"}`,
+			patch:    `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`,
+			want:     `{"foo":"bar","child":{"grandchild":{}}}`,
+		},
+		{
+			name:     "A.11 ignoring unrecognized elements",
+			document: `{"foo":"bar"}`,
+			patch:    `[{"op":"add","path":"/baz","value":"qux","xyz":123}]`,
+			want:     `{"foo":"bar","baz":"qux"}`,
+		},
+		{
+			name:     "A.12 adding to a nonexistent target",
+			document: `{"foo":"bar"}`,
+			patch:    `[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+		},
+		{
+			name:     "A.13 invalid JSON Patch document",
+			document: `{"foo":"bar"}`,
+			patch:    `[{"op":"add","path":"/baz","value":"qux","op":"remove"}]`,
+		},
+		{
+			name:     "A.14 ~ escape ordering",
+			document: `{"/":9,"~1":10}`,
+			patch:    `[{"op":"test","path":"/~01","value":10}]`,
+			want:     `{"/":9,"~1":10}`,
+		},
+		{
+			name:     "A.15 comparing strings and numbers",
+			document: `{"/":9,"~1":10}`,
+			patch:    `[{"op":"test","path":"/~01","value":"10"}]`,
+		},
+		{
+			name:     "A.16 adding an array value",
+			document: `{"foo":["bar"]}`,
+			patch:    `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+			want:     `{"foo":["bar",["abc","def"]]}`,
+		},
+		{
+			name:     "replacing the whole document",
+			document: `{"foo":"bar"}`,
+			patch:    `[{"op":"replace","path":"","value":["baz"]}]`,
+			want:     `["baz"]`,
+		},
+		{
+			name:     "adding the whole document",
+			document: `["baz"]`,
+			patch:    `[{"op":"add","path":"","value":{"foo":"bar"}}]`,
+			want:     `{"foo":"bar"}`,
+		},
+		{
+			name:     "removing the whole document",
+			document: `{"foo":"bar"}`,
+			patch:    `[{"op":"remove","path":""}]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			document, err := decodeJSON([]byte(test.document))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			patch, err := NewJSONPatch([]byte(test.patch))
+			if err == nil {
+				document, err = patch.apply(document)
+			}
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("patch applied and gave %v, want an error", document)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("patch failed: %v", err)
+			}
+
+			want, err := decodeJSON([]byte(test.want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalValues(document, want) {
+				got, _ := encodeJSON(document)
+				t.Errorf("patched document = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// projection picks the fields of documents that query results return, or the fields they leave out
+type projection struct {
+	paths   [][]string
+	exclude bool // Whether the paths are left out rather than picked
+}
+
+// newProjection validates the dotted paths of a projection. Paths starting with "-" are left out of
+// documents and the others are picked, so a projection cannot mix the two. A path inside another
+// listed path adds nothing and is dropped.
+func newProjection(fields []string) (projection, error) {
+	paths := append([]string{}, fields...)
+	sort.Slice(paths, func(i, j int) bool {
+		return len(paths[i]) < len(paths[j])
+	})
+
+	var projected projection
+	kept := make(map[string]bool)
+	for i, path := range paths {
+		path, excluded := strings.CutPrefix(path, "-")
+		if i > 0 && excluded != projected.exclude {
+			return projection{}, fmt.Errorf("%w: fields cannot both be picked and left out", ErrInvalidQuery)
+		}
+		projected.exclude = excluded
+		if err := validatePath(path); err != nil {
+			return projection{}, err
+		}
+
+		segments := strings.Split(path, ".")
+		covered := false
+		for i := 1; i <= len(segments) && !covered; i++ {
+			covered = kept[strings.Join(segments[:i], ".")]
+		}
+		if !covered {
+			projected.paths = append(projected.paths, segments)
+			kept[path] = true
+		}
+	}
+	return projected, nil
+}
+
+// apply returns a document holding only the projected fields, keeping the objects they are nested
+// in, or one without the fields left out. A path through an array picks or leaves out the field of
+// every object in it. Documents that are not JSON objects are returned as they are.
+func (p projection) apply(data json.RawMessage) (json.RawMessage, error) {
+	document, ok := decodedDocument(data)
+	object, isObject := document.(map[string]interface{})
+	if !ok || !isObject {
+		return data, nil
+	}
+
+	projected := make(map[string]interface{})
+	if p.exclude {
+		projected = object
+	}
+	for _, segments := range p.paths {
+		if p.exclude {
+			projected = excludePath(projected, segments)
+		} else {
+			projectPath(object, projected, segments)
+		}
+	}
+
+	data, err := encodeJSON(projected)
+	if err != nil {
+		return nil, fmt.Errorf("failed to project document: %w", err)
+	}
+	return data, nil
+}
+
+// projectPath copies the value at a path of source into the same place in target
+func projectPath(source, target map[string]interface{}, segments []string) {
+	child, ok := source[segments[0]]
+	if !ok {
+		return
+	}
+	if len(segments) == 1 {
+		target[segments[0]] = child
+		return
+	}
+
+	switch child := child.(type) {
+	case map[string]interface{}:
+		nested, ok := target[segments[0]].(map[string]interface{})
+		if !ok {
+			nested = make(map[string]interface{})
+			target[segments[0]] = nested
+		}
+		projectPath(child, nested, segments[1:])
+	case []interface{}:
+		// Every path into the array keeps the same objects in the same order, so they line up
+		var objects []map[string]interface{}
+		for _, element := range child {
+			if object, ok := element.(map[string]interface{}); ok {
+				objects = append(objects, object)
+			}
+		}
+
+		elements, ok := target[segments[0]].([]interface{})
+		if !ok {
+			elements = make([]interface{}, len(objects))
+			for i := range elements {
+				elements[i] = make(map[string]interface{})
+			}
+			target[segments[0]] = elements
+		}
+		for i, object := range objects {
+			projectPath(object, elements[i].(map[string]interface{}), segments[1:])
+		}
+	}
+}
+
+// excludePath returns a copy of document without the value at a path, leaving document as it is
+func excludePath(document map[string]interface{}, segments []string) map[string]interface{} {
+	child, ok := document[segments[0]]
+	if !ok {
+		return document
+	}
+
+	object := make(map[string]interface{}, len(document))
+	for name, member := range document {
+		object[name] = member
+	}
+	if len(segments) == 1 {
+		delete(object, segments[0])
+		return object
+	}
+
+	switch child := child.(type) {
+	case map[string]interface{}:
+		object[segments[0]] = excludePath(child, segments[1:])
+	case []interface{}:
+		elements := make([]interface{}, len(child))
+		for i, element := range child {
+			elements[i] = element
+			if nested, ok := element.(map[string]interface{}); ok {
+				elements[i] = excludePath(nested, segments[1:])
+			}
+		}
+		object[segments[0]] = elements
+	}
+	return object
+}
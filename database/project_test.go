@@ -0,0 +1,114 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestProjection(t *testing.T) {
+	const document = `{"title":"Phishing","severity":3,"owner":{"team":"red","email":"a@example.com"},"notes":[{"by":"alice","text":"seen"},{"by":"bob","text":"closed"},"free text"]}`
+
+	tests := []struct {
+		name     string
+		fields   []string
+		document string
+		want     string // Empty when the projection must be rejected
+	}{
+		{
+			name:   "pick fields",
+			fields: []string{"title", "owner.team"},
+			want:   `{"title":"Phishing","owner":{"team":"red"}}`,
+		},
+		{
+			name:   "pick through an array",
+			fields: []string{"notes.by"},
+			want:   `{"notes":[{"by":"alice"},{"by":"bob"}]}`,
+		},
+		{
+			name:   "pick a path and a path inside it",
+			fields: []string{"owner.team", "owner"},
+			want:   `{"owner":{"team":"red","email":"a@example.com"}}`,
+		},
+		{
+			name:   "pick missing fields",
+			fields: []string{"missing", "owner.missing", "title.length"},
+			want:   `{"owner":{}}`,
+		},
+		{
+			name:   "leave out fields",
+			fields: []string{"-notes", "-owner.email"},
+			want:   `{"title":"Phishing","severity":3,"owner":{"team":"red"}}`,
+		},
+		{
+			name:   "leave out through an array",
+			fields: []string{"-notes.text", "-owner", "-severity"},
+			want:   `{"title":"Phishing","notes":[{"by":"alice"},{"by":"bob"},"free text"]}`,
+		},
+		{
+			name:   "leave out a path and a path inside it",
+			fields: []string{"-owner.email", "-owner"},
+			want:   `{"title":"Phishing","severity":3,"notes":[{"by":"alice","text":"seen"},{"by":"bob","text":"closed"},"free text"]}`,
+		},
+		{
+			name:   "leave out missing fields",
+			fields: []string{"-missing", "-title.length"},
+			want:   document,
+		},
+		{
+			name:     "document that is not an object",
+			fields:   []string{"title"},
+			document: `["title"]`,
+			want:     `["title"]`,
+		},
+		{name: "pick and leave out", fields: []string{"title", "-owner"}},
+		{name: "leave out and pick", fields: []string{"-owner.email", "owner.team"}},
+		{name: "operator", fields: []string{"$where"}},
+		{name: "empty segment", fields: []string{"-owner..team"}},
+		{name: "just a minus", fields: []string{"-"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			projected, err := newProjection(test.fields)
+			if test.want == "" {
+				if !errors.Is(err, ErrInvalidQuery) {
+					t.Errorf("newProjection(%q) failed with %v, want %v", test.fields, err, ErrInvalidQuery)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newProjection(%q): %v", test.fields, err)
+			}
+
+			input := test.document
+			if input == "" {
+				input = document
+			}
+			got, err := projected.apply(json.RawMessage(input))
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+
+			gotValue, err := decodeJSON(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantValue, err := decodeJSON([]byte(test.want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalValues(gotValue, wantValue) {
+				t.Errorf("projected %q to %s, want %s", test.fields, got, test.want)
+			}
+
+			// The stored document is never changed by leaving fields out of a copy
+			if test.document == "" {
+				again, err := projected.apply(json.RawMessage(document))
+				if err != nil || string(again) != string(got) {
+					t.Errorf("applying the projection again gave %s (%v), want %s", again, err, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,777 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidQuery is returned for query filters that cannot be parsed
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Query is a parsed query filter. Filters are JSON objects in the style of MongoDB:
+//
+//	{"status": "open", "severity": {"$gt": 3}, "$or": [{"owner.team": "red"}, {"tags": {"$in": ["urgent"]}}]}
+//
+// Field names are dotted paths into nested objects, and a condition on a path that leads through an
+// array holds if it holds for any of the array's elements.
+type Query struct {
+	root matcher
+}
+
+// QueryPlan describes how a query was run
+type QueryPlan struct {
+	Indexes  []string `json:"indexes"`  // Indexes the candidates were looked up in, empty for a full scan
+	Examined int      `json:"examined"` // Documents checked against the filter
+}
+
+// FindOptions orders, pages and projects the documents a query returns
+type FindOptions struct {
+	Sort   []SortField // Sort order, by key if empty; documents that sort alike are ordered by key
+	Fields []string    // Dotted paths to return of each document, or to leave out with a leading "-", or every field if empty
+	Cursor string      // Continue after the page that returned this cursor
+	Skip   int         // Number of documents to leave out before the page starts
+	Limit  int         // Maximum number of documents to return, or 0 for all of them
+}
+
+// FindResult is a page of the documents matching a query
+type FindResult struct {
+	Documents  []Document
+	Total      int    // Documents matching the query in all
+	NextCursor string // Cursor for the following page, empty on the last page
+	Plan       QueryPlan
+}
+
+// matcher is a compiled part of a query filter
+type matcher interface {
+	match(document interface{}) bool
+}
+
+type andMatcher []matcher
+
+type orMatcher []matcher
+
+type notMatcher struct {
+	matcher
+}
+
+// fieldMatcher tests the values found at a path with a single comparison operator
+type fieldMatcher struct {
+	path     string
+	segments []string
+	op       string
+	value    interface{}
+	values   []interface{}  // $in and $nin
+	pattern  *regexp.Regexp // $regex
+	prefix   string         // Literal text every string matching an anchored $regex starts with
+}
+
+func (m andMatcher) match(document interface{}) bool {
+	for _, child := range m {
+		if !child.match(document) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m orMatcher) match(document interface{}) bool {
+	for _, child := range m {
+		if child.match(document) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m notMatcher) match(document interface{}) bool {
+	return !m.matcher.match(document)
+}
+
+func (m fieldMatcher) match(document interface{}) bool {
+	found := lookupPath(document, m.segments)
+	if m.op == "$exists" {
+		return (len(found) > 0) == m.value.(bool)
+	}
+
+	// A condition holds for an array if it holds for the array itself or for any of its elements
+	candidates := found
+	for _, value := range found {
+		if elements, ok := value.([]interface{}); ok {
+			candidates = append(candidates, elements...)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if m.test(candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// test applies the operator to a single value
+func (m fieldMatcher) test(value interface{}) bool {
+	switch m.op {
+	case "$eq":
+		return equalValues(value, m.value)
+	case "$in":
+		for _, option := range m.values {
+			if equalValues(value, option) {
+				return true
+			}
+		}
+		return false
+	case "$gt", "$gte", "$lt", "$lte":
+		order, ok := compareValues(value, m.value)
+		if !ok {
+			return false
+		}
+		switch m.op {
+		case "$gt":
+			return order > 0
+		case "$gte":
+			return order >= 0
+		case "$lt":
+			return order < 0
+		default:
+			return order <= 0
+		}
+	case "$regex":
+		text, ok := value.(string)
+		return ok && m.pattern.MatchString(text)
+	}
+	return false
+}
+
+// lookupPath returns every value found at a dotted path. Numeric segments index into arrays, and
+// other segments are looked up in every object element of an array.
+func lookupPath(value interface{}, segments []string) []interface{} {
+	if len(segments) == 0 {
+		return []interface{}{value}
+	}
+
+	switch container := value.(type) {
+	case map[string]interface{}:
+		child, ok := container[segments[0]]
+		if !ok {
+			return nil
+		}
+		return lookupPath(child, segments[1:])
+	case []interface{}:
+		var found []interface{}
+		if index, err := strconv.Atoi(segments[0]); err == nil && index >= 0 && index < len(container) {
+			found = append(found, lookupPath(container[index], segments[1:])...)
+		}
+		for _, element := range container {
+			if _, ok := element.(map[string]interface{}); ok {
+				found = append(found, lookupPath(element, segments)...)
+			}
+		}
+		return found
+	}
+	return nil
+}
+
+// compareValues orders two numbers or two strings; values of other or mixed types are not ordered
+func compareValues(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return 0, false
+		}
+		x, okA := new(big.Float).SetString(a.String())
+		y, okB := new(big.Float).SetString(b.String())
+		if !okA || !okB {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	}
+	return 0, false
+}
+
+// ParseQuery parses a JSON query filter
+func ParseQuery(filter []byte) (*Query, error) {
+	value, err := decodeJSON(filter)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+
+	root, err := parseFilter(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	return &Query{root: root}, nil
+}
+
+// AllDocuments returns a query matching every document, including any that are not valid JSON
+func AllDocuments() *Query {
+	return &Query{root: andMatcher{}}
+}
+
+// Match reports whether a document matches the query
+func (query *Query) Match(data json.RawMessage) bool {
+	document, err := decodeJSON(data)
+	return query.matchDecoded(document, err == nil)
+}
+
+// matchDecoded reports whether a decoded document matches the query; valid is false for documents
+// that are not valid JSON, which only a query without conditions matches
+func (query *Query) matchDecoded(document interface{}, valid bool) bool {
+	if !valid {
+		conditions, ok := query.root.(andMatcher)
+		return ok && len(conditions) == 0
+	}
+	return query.root.match(document)
+}
+
+// parseFilter compiles a filter object, whose conditions must all hold
+func parseFilter(value interface{}) (matcher, error) {
+	filter, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("a filter must be an object")
+	}
+
+	// Sort the conditions so the same filter always compiles, and is planned, the same way
+	fields := make([]string, 0, len(filter))
+	for field := range filter {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var conditions andMatcher
+	for _, field := range fields {
+		condition := filter[field]
+
+		switch field {
+		case "$and", "$or":
+			filters, ok := condition.([]interface{})
+			if !ok || len(filters) == 0 {
+				return nil, fmt.Errorf("%s takes a non-empty array of filters", field)
+			}
+
+			children := make([]matcher, 0, len(filters))
+			for _, child := range filters {
+				compiled, err := parseFilter(child)
+				if err != nil {
+					return nil, err
+				}
+				children = append(children, compiled)
+			}
+
+			if field == "$and" {
+				conditions = append(conditions, andMatcher(children))
+			} else {
+				conditions = append(conditions, orMatcher(children))
+			}
+		case "$not":
+			compiled, err := parseFilter(condition)
+			if err != nil {
+				return nil, fmt.Errorf("$not: %v", err)
+			}
+			conditions = append(conditions, notMatcher{compiled})
+		default:
+			if strings.HasPrefix(field, "$") {
+				return nil, fmt.Errorf("unknown operator '%s'", field)
+			}
+			if field == "" {
+				return nil, errors.New("field paths cannot be empty")
+			}
+
+			compiled, err := parseCondition(field, condition)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, compiled)
+		}
+	}
+
+	return conditions, nil
+}
+
+// parseCondition compiles the condition on a single field. A value that is not an object of
+// operators is compared for equality.
+func parseCondition(path string, condition interface{}) (matcher, error) {
+	segments := strings.Split(path, ".")
+
+	operators, ok := condition.(map[string]interface{})
+	if !ok || !isOperatorObject(operators) {
+		return fieldMatcher{path: path, segments: segments, op: "$eq", value: condition}, nil
+	}
+
+	names := make([]string, 0, len(operators))
+	for name := range operators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var conditions andMatcher
+	for _, name := range names {
+		operand := operators[name]
+		field := fieldMatcher{path: path, segments: segments, op: name, value: operand}
+
+		switch name {
+		case "$eq", "$gt", "$gte", "$lt", "$lte":
+			conditions = append(conditions, field)
+		case "$ne":
+			field.op = "$eq"
+			conditions = append(conditions, notMatcher{field})
+		case "$in", "$nin":
+			values, ok := operand.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s on '%s' takes an array", name, path)
+			}
+			field.op, field.values = "$in", values
+			if name == "$nin" {
+				conditions = append(conditions, notMatcher{field})
+			} else {
+				conditions = append(conditions, field)
+			}
+		case "$exists":
+			if _, ok := operand.(bool); !ok {
+				return nil, fmt.Errorf("$exists on '%s' takes true or false", path)
+			}
+			conditions = append(conditions, field)
+		case "$regex":
+			pattern, ok := operand.(string)
+			if !ok {
+				return nil, fmt.Errorf("$regex on '%s' takes a string", path)
+			}
+			if options, ok := operators["$options"].(string); ok && options != "" {
+				if strings.Trim(options, "ims") != "" {
+					return nil, fmt.Errorf("$options on '%s' may only contain i, m and s", path)
+				}
+				pattern = "(?" + options + ")" + pattern
+			}
+
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("$regex on '%s': %v", path, err)
+			}
+			field.pattern = compiled
+
+			// Patterns anchored at the start of the text, with ^ matching nowhere else, can be
+			// answered with a prefix scan of the index
+			options, _ := operators["$options"].(string)
+			if strings.HasPrefix(pattern, "^") && !strings.ContainsAny(options, "im") {
+				field.prefix, _ = compiled.LiteralPrefix()
+			}
+			conditions = append(conditions, field)
+		case "$options":
+			if _, ok := operators["$regex"]; !ok {
+				return nil, fmt.Errorf("$options on '%s' needs $regex", path)
+			}
+		case "$not":
+			negated, ok := operand.(map[string]interface{})
+			if !ok || !isOperatorObject(negated) {
+				return nil, fmt.Errorf("$not on '%s' takes an object of operators", path)
+			}
+			compiled, err := parseCondition(path, negated)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, notMatcher{compiled})
+		default:
+			return nil, fmt.Errorf("unknown operator '%s' on '%s'", name, path)
+		}
+	}
+
+	return conditions, nil
+}
+
+// isOperatorObject reports whether every member of an object is an operator. Objects that mix
+// operators and plain fields are ambiguous and are treated as operators, so they fail to parse.
+func isOperatorObject(object map[string]interface{}) bool {
+	if len(object) == 0 {
+		return false
+	}
+	for name := range object {
+		if strings.HasPrefix(name, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeOps are the operators an ordered index answers with a range scan
+var rangeOps = map[string]bool{"$gt": true, "$gte": true, "$lt": true, "$lte": true}
+
+// fieldRange is the range of values a field is limited to by comparison operators
+type fieldRange struct {
+	lower, upper *indexBound
+	empty        bool // No value lies in the range
+}
+
+// limit narrows the range with a single comparison. Comparisons between different kinds of
+// values never hold, and neither do comparisons with values other than numbers and strings.
+func (r *fieldRange) limit(op string, operand interface{}) {
+	value, ok := newIndexValue(operand)
+	if !ok || (value.kind != kindNumber && value.kind != kindString) {
+		r.empty = true
+		return
+	}
+
+	bound := &indexBound{value: value, inclusive: op == "$gte" || op == "$lte"}
+	for _, other := range []*indexBound{r.lower, r.upper} {
+		if other != nil && other.value.kind != value.kind {
+			r.empty = true
+			return
+		}
+	}
+
+	if op == "$gt" || op == "$gte" {
+		if r.lower == nil || tighter(bound, r.lower, 1) {
+			r.lower = bound
+		}
+	} else if r.upper == nil || tighter(bound, r.upper, -1) {
+		r.upper = bound
+	}
+}
+
+// strings reports whether the range is bounded by strings
+func (r *fieldRange) strings() bool {
+	return (r.lower != nil && r.lower.value.kind == kindString) || (r.upper != nil && r.upper.value.kind == kindString)
+}
+
+// tighter reports whether bound a excludes more than b does, where direction is 1 for lower
+// bounds and -1 for upper bounds
+func tighter(a, b *indexBound, direction int) bool {
+	order := a.value.compare(b.value) * direction
+	return order > 0 || (order == 0 && !a.inclusive)
+}
+
+// maxIndexScans caps the number of index scans a query is broken into, which grows with the
+// product of the $in lists on the fields of a compound index
+const maxIndexScans = 1024
+
+// fieldConstraint collects the conditions of a filter on one path that an index can answer
+type fieldConstraint struct {
+	equal  []interface{} // Scalars the path equals one of, from $eq or $in
+	bounds *fieldRange
+	prefix string // Literal text strings at the path start with, from an anchored $regex
+}
+
+// indexPlan is a way of looking up the candidates of a filter in a declared index: entries whose
+// leading fields equal one of the values in equal, and whose next field is within bounds or starts
+// with prefix
+type indexPlan struct {
+	index  *declaredIndex
+	equal  [][]indexValue
+	bounds *fieldRange
+	prefix *string
+}
+
+// score is the number of fields of the index the plan narrows down
+func (plan indexPlan) score() int {
+	score := len(plan.equal)
+	if plan.bounds != nil || plan.prefix != nil {
+		score++
+	}
+	return score
+}
+
+// scans returns the number of separate scans the plan takes
+func (plan indexPlan) scans() int {
+	scans := 1
+	for _, values := range plan.equal {
+		scans *= len(values)
+	}
+	return scans
+}
+
+// flattenAnd lists the conditions that must all hold for m, looking into nested $and filters
+func flattenAnd(m matcher) []matcher {
+	and, ok := m.(andMatcher)
+	if !ok {
+		return []matcher{m}
+	}
+
+	var conditions []matcher
+	for _, child := range and {
+		conditions = append(conditions, flattenAnd(child)...)
+	}
+	return conditions
+}
+
+// candidates returns the keys of the documents that can match m according to the declared indexes,
+// which always include every document that does match. ok is false if no index can narrow m down.
+// The names of the indexes used are added to indexes. The caller must hold indexLock.
+func (db *Database) candidates(m matcher, indexes map[string]bool) (map[string]bool, bool) {
+	if or, ok := m.(orMatcher); ok {
+		keys := make(map[string]bool)
+		used := make(map[string]bool)
+		for _, child := range or {
+			childKeys, ok := db.candidates(child, used)
+			if !ok {
+				return nil, false
+			}
+			for key := range childKeys {
+				keys[key] = true
+			}
+		}
+		for name := range used {
+			indexes[name] = true
+		}
+		return keys, true
+	}
+
+	constraints := make(map[string]*fieldConstraint)
+	var alternatives []matcher
+	for _, condition := range flattenAnd(m) {
+		switch condition := condition.(type) {
+		case fieldMatcher:
+			constraint := constraints[condition.path]
+			if constraint == nil {
+				constraint = &fieldConstraint{}
+				constraints[condition.path] = constraint
+			}
+			constraint.add(condition)
+		case orMatcher:
+			alternatives = append(alternatives, condition)
+		}
+	}
+
+	var keys map[string]bool
+	intersect := func(found map[string]bool) {
+		if keys == nil {
+			keys = found
+			return
+		}
+		for key := range keys {
+			if !found[key] {
+				delete(keys, key)
+			}
+		}
+	}
+
+	if plan, ok := db.planIndex(constraints); ok {
+		indexes[plan.index.spec.Name] = true
+		intersect(plan.run())
+	}
+	for _, alternative := range alternatives {
+		if found, ok := db.candidates(alternative, indexes); ok {
+			intersect(found)
+		}
+	}
+	return keys, keys != nil
+}
+
+// add narrows the constraint down with a condition on its path
+func (c *fieldConstraint) add(m fieldMatcher) {
+	switch {
+	case m.op == "$eq" || m.op == "$in":
+		values := m.values
+		if m.op == "$eq" {
+			values = []interface{}{m.value}
+		}
+		for _, value := range values {
+			if _, ok := newIndexValue(value); !ok {
+				return
+			}
+		}
+		if c.equal == nil {
+			c.equal = values
+		}
+	case rangeOps[m.op]:
+		if c.bounds == nil {
+			c.bounds = &fieldRange{}
+		}
+		c.bounds.limit(m.op, m.value)
+	case m.op == "$regex" && m.prefix != "" && c.prefix == "":
+		c.prefix = m.prefix
+	}
+}
+
+// planIndex picks the declared index that narrows the constraints down the most, preferring
+// unique indexes and then the first by name. The caller must hold indexLock.
+func (db *Database) planIndex(constraints map[string]*fieldConstraint) (indexPlan, bool) {
+	var best indexPlan
+	for _, spec := range db.indexSpecs() {
+		index := db.indexes[spec.Name]
+		plan := indexPlan{index: index}
+		fold := !spec.CaseSensitive
+
+		for _, field := range spec.Fields {
+			constraint := constraints[field]
+			if constraint == nil {
+				break
+			}
+
+			if constraint.equal != nil {
+				values := make([]indexValue, len(constraint.equal))
+				for i, value := range constraint.equal {
+					values[i], _ = newIndexValue(value)
+					if fold && values[i].kind == kindString {
+						values[i].text = strings.ToLower(values[i].text)
+					}
+				}
+				plan.equal = append(plan.equal, values)
+				if plan.scans() > maxIndexScans {
+					plan.equal = plan.equal[:len(plan.equal)-1]
+					break
+				}
+				continue
+			}
+
+			// Lowercased strings are not in the order of the strings themselves, but numbers are
+			if constraint.bounds != nil && (!fold || !constraint.bounds.strings()) {
+				plan.bounds = constraint.bounds
+			} else if constraint.prefix != "" {
+				prefix := constraint.prefix
+				if fold {
+					prefix = strings.ToLower(prefix)
+				}
+				plan.prefix = &prefix
+			}
+			break
+		}
+
+		if plan.score() == 0 {
+			continue
+		}
+		if plan.score() > best.score() || (plan.score() == best.score() && spec.Unique && !best.index.spec.Unique) {
+			best = plan
+		}
+	}
+	return best, best.index != nil
+}
+
+// run looks up the documents the plan selects; the caller must hold indexLock
+func (plan indexPlan) run() map[string]bool {
+	keys := make(map[string]bool)
+	collect := func(found map[string]bool) {
+		for key := range found {
+			keys[key] = true
+		}
+	}
+	if plan.bounds != nil && plan.bounds.empty {
+		return keys
+	}
+
+	// Scan once for every combination of the values the leading fields may equal
+	prefixes := []indexTuple{{}}
+	for _, values := range plan.equal {
+		combined := make([]indexTuple, 0, len(prefixes)*len(values))
+		for _, prefix := range prefixes {
+			for _, value := range values {
+				combined = append(combined, append(append(indexTuple{}, prefix...), value))
+			}
+		}
+		prefixes = combined
+	}
+
+	for _, prefix := range prefixes {
+		switch {
+		case plan.bounds != nil:
+			plan.index.entries.scanRange(prefix, plan.bounds.lower, plan.bounds.upper, collect)
+		case plan.prefix != nil:
+			plan.index.entries.scanPrefix(prefix, *plan.prefix, collect)
+		default:
+			plan.index.entries.scan(prefix, nil, nil, collect)
+		}
+	}
+	return keys
+}
+
+// Find returns a page of the documents matching a query, in the order of options.Sort. Candidates
+// are looked up in the declared indexes where the filter allows it, and every document in the
+// collection is checked otherwise.
+func (db *Database) Find(query *Query, options FindOptions) (FindResult, error) {
+	projected, err := newProjection(options.Fields)
+	if err != nil {
+		return FindResult{}, err
+	}
+
+	db.docsLock.RLock()
+	defer db.docsLock.RUnlock()
+
+	if db.loadErr != nil {
+		return FindResult{}, db.loadErr
+	}
+
+	var after *sortPosition
+	if options.Cursor != "" {
+		position, err := decodeCursor(options.Cursor, options.Sort)
+		if err != nil {
+			return FindResult{}, err
+		}
+		after = &position
+	}
+
+	result := FindResult{Plan: QueryPlan{Indexes: []string{}}}
+	indexes := make(map[string]bool)
+
+	db.indexLock.RLock()
+	candidates, indexed := db.candidates(query.root, indexes)
+	db.indexLock.RUnlock()
+
+	if indexed {
+		for name := range indexes {
+			result.Plan.Indexes = append(result.Plan.Indexes, name)
+		}
+		sort.Strings(result.Plan.Indexes)
+	} else {
+		candidates = make(map[string]bool, len(db.documents))
+		for key := range db.documents {
+			candidates[key] = true
+		}
+	}
+
+	// Every match is needed to count them and to put them in order
+	var matches []sortPosition
+	for key := range candidates {
+		data, exists := db.document(key)
+		if !exists {
+			continue
+		}
+
+		result.Plan.Examined++
+		document, err := decodeJSON(data)
+		if !query.matchDecoded(document, err == nil) {
+			continue
+		}
+		matches = append(matches, sortPosition{values: sortValues(document, options.Sort), key: key})
+	}
+	sortPositions(matches, options.Sort)
+	result.Total = len(matches)
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(matches), func(i int) bool {
+			return comparePositions(matches[i], *after, options.Sort) > 0
+		})
+	}
+	start += options.Skip
+	if start > len(matches) {
+		start = len(matches)
+	}
+	end := len(matches)
+	if options.Limit > 0 && start+options.Limit < end {
+		end = start + options.Limit
+		result.NextCursor = encodeCursor(matches[end-1], options.Sort)
+	}
+
+	for _, match := range matches[start:end] {
+		data := db.documents[match.key]
+		if len(projected.paths) > 0 {
+			if data, err = projected.apply(data); err != nil {
+				return FindResult{}, err
+			}
+		}
+		result.Documents = append(result.Documents, Document{Id: match.key, Data: data})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// queryDocuments mixes types, missing fields, arrays and nested objects, so that indexes have to
+// order and compare values the way the query engine does
+var queryDocuments = map[string]string{
+	"d01": `{"name":"Alice","age":31,"team":"red","tags":["admin","ops"],"owner":{"team":"red"}}`,
+	"d02": `{"name":"bob","age":25,"team":"blue","tags":["dev"],"owner":{"team":"blue"}}`,
+	"d03": `{"name":"Carol","age":31.0,"team":"red","tags":[],"active":true}`,
+	"d04": `{"name":"dave","age":"31","team":"green","active":false}`,
+	"d05": `{"name":"Eve","age":47,"team":"blue","tags":["ops","dev"],"owner":{"team":"red"}}`,
+	"d06": `{"name":"Frank","age":null,"team":"red"}`,
+	"d07": `{"name":"grace","team":"blue","tags":"ops"}`,
+	"d08": `{"name":"Heidi","age":19.5,"team":["red","blue"],"active":true}`,
+	"d09": `{"name":"Ivan","age":-3,"owner":{"team":"green"}}`,
+	"d10": `{"age":1e2,"team":"RED"}`,
+	"d11": `[1,2,3]`,
+	"d12": `"just a string"`,
+}
+
+func TestFindMatchesScan(t *testing.T) {
+	tests := []struct {
+		filter  string
+		indexed bool // whether an index should narrow the candidates down
+	}{
+		{`{"age":31}`, true},
+		{`{"age":"31"}`, true},
+		{`{"age":null}`, true},
+		{`{"age":{"$gt":30}}`, true},
+		{`{"age":{"$gte":19.5,"$lt":47}}`, true},
+		{`{"age":{"$lte":0}}`, true},
+		{`{"age":{"$gt":"3"}}`, false}, // Strings are folded in the age index, so they cannot be ranged over
+		{`{"age":{"$in":[25,47,"31"]}}`, true},
+		{`{"age":{"$exists":true}}`, false},
+		{`{"age":{"$ne":31}}`, false},
+		{`{"age":{"$nin":[31,25]}}`, false},
+		{`{"age":{"$not":{"$gt":30}}}`, false},
+		{`{"name":"alice"}`, true},
+		{`{"name":"Alice"}`, true},
+		{`{"name":{"$regex":"^[A-D]"}}`, false},
+		{`{"name":{"$regex":"^Ca"}}`, true},
+		{`{"name":{"$regex":"^ca","$options":"i"}}`, false},
+		{`{"team":"red"}`, true},
+		{`{"team":"red","age":31}`, true},
+		{`{"team":"blue","age":{"$gt":20}}`, true},
+		{`{"team":{"$in":["red","blue"]},"age":{"$lt":40}}`, true},
+		{`{"tags":"ops"}`, true},
+		{`{"tags":{"$in":["dev","admin"]}}`, true},
+		{`{"tags.0":"ops"}`, false},
+		{`{"owner.team":"red"}`, true},
+		{`{"owner.team":{"$in":["green"]}}`, true},
+		{`{"$or":[{"age":{"$gt":40}},{"team":"green"}]}`, true},
+		{`{"$or":[{"age":{"$gt":40}},{"active":true}]}`, false},
+		{`{"$and":[{"team":"red"},{"active":true}]}`, true},
+		{`{"$and":[{"age":{"$gt":20}},{"age":{"$lt":30}}]}`, true},
+		{`{"active":{"$exists":false},"team":"red"}`, true},
+		{`{}`, false},
+	}
+
+	db := LoadDB(filepath.Join(t.TempDir(), "people.qdb"), testKeys("secret"))
+	for key, data := range queryDocuments {
+		if err := db.CreateDocument(key, json.RawMessage(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, spec := range []IndexSpec{
+		{Fields: []string{"age"}},
+		{Fields: []string{"name"}, CaseSensitive: true},
+		{Fields: []string{"team", "age"}, CaseSensitive: true},
+		{Fields: []string{"tags"}, Sparse: true, CaseSensitive: true},
+		{Fields: []string{"owner.team"}, CaseSensitive: true},
+	} {
+		if _, err := db.CreateIndex(spec); err != nil {
+			t.Fatalf("CreateIndex(%v): %v", spec.Fields, err)
+		}
+	}
+
+	// Changes after the indexes were built must reach them too
+	if _, err := db.UpdateDocument("d02", json.RawMessage(`{"name":"bob","age":26,"team":"blue","tags":["dev","ops"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteDocument("d07"); err != nil {
+		t.Fatal(err)
+	}
+	merge, err := NewMergePatch([]byte(`{"team":"green","age":32}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PatchDocument("d03", merge, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	documents, err := db.LoadDocuments()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			query, err := ParseQuery([]byte(test.filter))
+			if err != nil {
+				t.Fatalf("ParseQuery: %v", err)
+			}
+
+			want := []string{}
+			for key, data := range documents {
+				if query.Match(data) {
+					want = append(want, key)
+				}
+			}
+			sort.Strings(want)
+
+			result, err := db.Find(query, FindOptions{})
+			if err != nil {
+				t.Fatalf("Find: %v", err)
+			}
+			got := []string{}
+			for _, document := range result.Documents {
+				got = append(got, document.Id)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Find = %v, full scan = %v (indexes %v)", got, want, result.Plan.Indexes)
+			}
+			if indexed := len(result.Plan.Indexes) > 0; indexed != test.indexed {
+				t.Errorf("used indexes %v, want indexed = %v", result.Plan.Indexes, test.indexed)
+			}
+		})
+	}
+}
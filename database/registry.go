@@ -0,0 +1,450 @@
+package database
+
+import (
+	"CyberDefenseEd/QuadDB/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed             = errors.New("collection is closed")
+	ErrCollectionNotFound = errors.New("collection not found")
+	ErrCollectionExists   = errors.New("collection already exists")
+)
+
+// collectionSuffixes are the extensions of every file a collection keeps next to its name
+var collectionSuffixes = []string{".qdb", ".qdb.bak", ".qdb.wal", ".qdb.fts"}
+
+// CollectionInfo describes a collection and its files
+type CollectionInfo struct {
+	Name      string          `json:"name"`
+	Documents int             `json:"documents"`
+	Size      int64           `json:"size"`
+	Indexes   []IndexSpec     `json:"indexes"`
+	TextIndex *TextIndexSpec  `json:"text_index,omitempty"`
+	Schema    json.RawMessage `json:"schema,omitempty"`
+	TTL       string          `json:"ttl,omitempty"` // Default lifetime of documents, such as "24h0m0s"
+	Created   time.Time       `json:"created"`
+}
+
+// Registry owns the open collections of a data directory. Every collection is served by exactly one
+// *Database, so all writes to it are serialized by that Database's locks.
+type Registry struct {
+	dataDir string
+	keys    *Keyring
+	lock    sync.Mutex
+	open    map[string]*Database
+
+	// maintenance is held exclusively while a collection's files are rewritten underneath it, such
+	// as during a key rotation, and shared by everything that reads or writes collections
+	maintenance sync.RWMutex
+	nextKeys    *Keyring        // keyring a running or failed key rotation moves collections to
+	pending     map[string]bool // collections the rotation has not moved to nextKeys yet
+}
+
+// NewRegistry creates a registry for the collections in dataDir; nothing is opened until asked for
+func NewRegistry(dataDir string, keys *Keyring) *Registry {
+	return &Registry{
+		dataDir: dataDir,
+		keys:    keys,
+		open:    make(map[string]*Database),
+	}
+}
+
+// DataDir returns the directory the registry's collections are stored in
+func (registry *Registry) DataDir() string {
+	return registry.dataDir
+}
+
+// Keys returns the keyring the registry's collections are encrypted with
+func (registry *Registry) Keys() *Keyring {
+	return registry.keys
+}
+
+// path returns the .qdb file of a collection
+func (registry *Registry) path(name string) string {
+	return filepath.Join(registry.dataDir, name+".qdb")
+}
+
+// files returns the paths of every file a collection may have
+func (registry *Registry) files(name string) []string {
+	paths := make([]string, 0, len(collectionSuffixes))
+	for _, suffix := range collectionSuffixes {
+		paths = append(paths, filepath.Join(registry.dataDir, name+suffix))
+	}
+	return paths
+}
+
+// onDisk reports whether any file of a collection exists, including a backup or log left by a crash
+func (registry *Registry) onDisk(name string) bool {
+	for _, path := range registry.files(name) {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// load opens a collection and registers it. The caller must hold the registry lock.
+func (registry *Registry) load(name string) (*Database, error) {
+	// During a key rotation, collections it has moved, and new ones, are already under the new key
+	keys := registry.keys
+	if registry.nextKeys != nil && !registry.pending[name] {
+		keys = registry.nextKeys
+	}
+
+	db := LoadDB(registry.path(name), keys)
+	if db.loadErr != nil {
+		return nil, fmt.Errorf("could not open collection '%s': %w", name, db.loadErr)
+	}
+
+	registry.open[name] = db
+	return db, nil
+}
+
+// OpenAll completes any transaction that was interrupted and opens every collection found in the
+// data directory
+func (registry *Registry) OpenAll() error {
+	dbFiles, err := filepath.Glob(filepath.Join(registry.dataDir, "*.qdb"))
+	if err != nil {
+		return err
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	if err := registry.recoverTransactions(); err != nil {
+		util.Error(fmt.Sprintf("%v", err))
+	}
+
+	for _, dbFile := range dbFiles {
+		name := strings.TrimSuffix(filepath.Base(dbFile), ".qdb")
+		if _, open := registry.open[name]; open {
+			continue
+		}
+		if err := ValidateCollectionName(name); err != nil {
+			util.Warn(fmt.Sprintf("Skipping '%s': %v. Rename the file to make it available.", dbFile, err))
+			continue
+		}
+
+		if _, err := registry.load(name); err != nil {
+			util.Error(fmt.Sprintf("%v", err))
+			continue
+		}
+		util.Info(fmt.Sprintf("Imported Database - %s.qdb", name))
+	}
+
+	return nil
+}
+
+// Open returns the collection called name, creating it on its first write if it does not exist yet.
+// Until that write succeeds the collection has no files, and Get, Names and the rest of the registry
+// treat it as missing, so a rejected write leaves nothing behind.
+func (registry *Registry) Open(name string) (*Database, error) {
+	if err := ValidateCollectionName(name); err != nil {
+		return nil, err
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	if db, open := registry.open[name]; open {
+		return db, nil
+	}
+	return registry.load(name)
+}
+
+// Get returns the collection called name, or ErrCollectionNotFound if it does not exist
+func (registry *Registry) Get(name string) (*Database, error) {
+	if err := ValidateCollectionName(name); err != nil {
+		return nil, err
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	// A collection opened for a first write that has not succeeded yet does not exist
+	if !registry.onDisk(name) {
+		return nil, ErrCollectionNotFound
+	}
+	if db, open := registry.open[name]; open {
+		return db, nil
+	}
+	return registry.load(name)
+}
+
+// Create creates an empty collection and writes its .qdb file straight away
+func (registry *Registry) Create(name string) (*Database, error) {
+	if err := ValidateCollectionName(name); err != nil {
+		return nil, err
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	if registry.onDisk(name) {
+		return nil, ErrCollectionExists
+	}
+
+	// Reuse the collection if Open registered it for a write that never succeeded
+	db, open := registry.open[name]
+	if !open {
+		var err error
+		if db, err = registry.load(name); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.persist(); err != nil {
+		delete(registry.open, name)
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Drop shreds a collection and deletes whatever else is left of its files
+func (registry *Registry) Drop(name string) error {
+	if err := ValidateCollectionName(name); err != nil {
+		return err
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	if err := registry.shred(name); err != nil {
+		return err
+	}
+
+	lock := fileLock(registry.path(name))
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, path := range registry.files(name) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return util.SyncDir(registry.dataDir)
+}
+
+// Shred destroys the data key of a collection and removes its files, retiring it if it is open, so
+// that nothing left on the disk can be decrypted with the master key. Anyone still holding the
+// *Database gets ErrShredded from then on.
+func (registry *Registry) Shred(name string) error {
+	if err := ValidateCollectionName(name); err != nil {
+		return err
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	return registry.shred(name)
+}
+
+// shred shreds a collection whether it is open or not. The caller must hold the registry lock.
+func (registry *Registry) shred(name string) error {
+	if !registry.onDisk(name) {
+		return ErrCollectionNotFound
+	}
+
+	if db, open := registry.open[name]; open {
+		delete(registry.open, name)
+		return db.Shred()
+	}
+
+	lock := fileLock(registry.path(name))
+	lock.Lock()
+	defer lock.Unlock()
+
+	return shredFiles(registry.path(name))
+}
+
+// Rename moves a collection and all of its files to a new name
+func (registry *Registry) Rename(name, newName string) error {
+	if err := ValidateCollectionName(name); err != nil {
+		return err
+	}
+	if err := ValidateCollectionName(newName); err != nil {
+		return err
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	if !registry.onDisk(name) {
+		return ErrCollectionNotFound
+	}
+	if registry.onDisk(newName) {
+		return ErrCollectionExists
+	}
+	db, open := registry.open[name]
+
+	// Fold the log in first, so there are as few files to move as possible
+	if open {
+		delete(registry.open, name)
+		if err := db.close(); err != nil {
+			registry.open[name] = db
+			db.reopen()
+			return err
+		}
+	}
+
+	// A collection Open registered under the new name has no files yet. Retiring it waits for a
+	// first write in flight, and stops any later one from creating files the rename would clash with.
+	phantom, taken := registry.open[newName]
+	if taken {
+		phantom.retire()
+	}
+
+	if err := registry.moveFiles(name, newName); err != nil {
+		// That first write may have succeeded in the meantime, making the new name a collection of
+		// its own; both keep being served
+		if errors.Is(err, ErrCollectionExists) {
+			if taken {
+				phantom.reopen()
+			}
+			if open {
+				db.reopen()
+				registry.open[name] = db
+			}
+		}
+		return err
+	}
+	if taken {
+		delete(registry.open, newName)
+	}
+
+	// Serve the collection under its new name straight away, as it was under the old one
+	if open {
+		if _, err := registry.load(newName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveFiles renames the files of a collection under the file locks of both names, unless the new
+// name has files of its own. The caller must hold the registry lock.
+func (registry *Registry) moveFiles(name, newName string) error {
+	unlock := lockFiles(registry.path(name), registry.path(newName))
+	defer unlock()
+
+	if registry.onDisk(newName) {
+		return ErrCollectionExists
+	}
+
+	// Move the primary file last, so an interrupted rename leaves the collection under its old name
+	paths, newPaths := registry.files(name), registry.files(newName)
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := os.Rename(paths[i], newPaths[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return util.SyncDir(registry.dataDir)
+}
+
+// Describe returns the document count, size on disk, indexes and creation time of a collection
+func (registry *Registry) Describe(name string) (CollectionInfo, error) {
+	db, err := registry.Get(name)
+	if err != nil {
+		return CollectionInfo{}, err
+	}
+
+	count, err := db.CountDocuments()
+	if err != nil {
+		return CollectionInfo{}, err
+	}
+
+	info := CollectionInfo{
+		Name:      name,
+		Documents: count,
+		Indexes:   db.Indexes(),
+		TextIndex: db.TextIndex(),
+		Schema:    db.Schema(),
+		Created:   db.Created(),
+	}
+	if ttl := db.TTL(); ttl > 0 {
+		info.TTL = ttl.String()
+	}
+	for _, path := range registry.files(name) {
+		if stat, err := os.Stat(path); err == nil {
+			info.Size += stat.Size()
+		}
+	}
+
+	return info, nil
+}
+
+// Names returns the names of the collections in the data directory, whether they are open or not,
+// sorted
+func (registry *Registry) Names() []string {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	entries, err := os.ReadDir(registry.dataDir)
+	if err != nil && !os.IsNotExist(err) {
+		util.Warn(fmt.Sprintf("Failed to list collections in '%s': %v", registry.dataDir, err))
+	}
+
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, entry := range entries {
+		for _, suffix := range collectionSuffixes {
+			name, found := strings.CutSuffix(entry.Name(), suffix)
+			if !found || seen[name] || ValidateCollectionName(name) != nil {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close folds a collection's write-ahead log into its .qdb file and drops it from the registry.
+// Anyone still holding the *Database gets ErrClosed from then on.
+func (registry *Registry) Close(name string) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	db, open := registry.open[name]
+	if !open {
+		return nil
+	}
+
+	delete(registry.open, name)
+	return db.close()
+}
+
+// CloseAll closes every open collection, such as when the server shuts down
+func (registry *Registry) CloseAll() error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	var errs []error
+	for name, db := range registry.open {
+		if err := db.close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing '%s': %w", name, err))
+		}
+		delete(registry.open, name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Hold holds the maintenance lock shared, so no collection is rewritten underneath the request or
+// background write in progress, until release is called
+func (registry *Registry) Hold() (release func()) {
+	registry.maintenance.RLock()
+	return registry.maintenance.RUnlock
+}
@@ -0,0 +1,309 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// createCollection creates a collection holding documents, failing the test if it cannot
+func createCollection(t *testing.T, registry *Registry, name string, documents map[string]string) *Database {
+	t.Helper()
+
+	db, err := registry.Create(name)
+	if err != nil {
+		t.Fatalf("Create(%s): %v", name, err)
+	}
+	for key, data := range documents {
+		if err := db.CreateDocument(key, json.RawMessage(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestRegistryCreate(t *testing.T) {
+	dir := t.TempDir()
+	registry := NewRegistry(dir, testKeys("secret"))
+
+	if _, err := registry.Create("events"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := os.Stat(registry.path("events")); err != nil {
+		t.Errorf("an empty collection has no .qdb file: %v", err)
+	}
+	if _, err := registry.Create("events"); !errors.Is(err, ErrCollectionExists) {
+		t.Errorf("Create of an existing collection failed with %v, want %v", err, ErrCollectionExists)
+	}
+	if _, err := registry.Create("../events"); !errors.Is(err, ErrInvalidCollectionName) {
+		t.Errorf("Create of an invalid name failed with %v, want %v", err, ErrInvalidCollectionName)
+	}
+
+	// A collection opened for a write that never came does not exist until it is created
+	if _, err := registry.Open("pending"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Get("pending"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("Get of a collection without files failed with %v, want %v", err, ErrCollectionNotFound)
+	}
+	if got, want := registry.Names(), []string{"events"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names = %v, want %v", got, want)
+	}
+	if err := registry.Drop("pending"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("Drop of a collection without files failed with %v, want %v", err, ErrCollectionNotFound)
+	}
+	if _, err := registry.Create("pending"); err != nil {
+		t.Fatalf("Create after Open: %v", err)
+	}
+
+	restarted := NewRegistry(dir, testKeys("secret"))
+	if got, want := restarted.Names(), []string{"events", "pending"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names after a restart = %v, want %v", got, want)
+	}
+}
+
+func TestRegistryRename(t *testing.T) {
+	documents := map[string]string{"a": `{"v":1}`, "b": `{"v":2}`}
+
+	tests := []struct {
+		name    string
+		open    bool // whether the collection is open when it is renamed
+		target  func(t *testing.T, registry *Registry)
+		wantErr error
+	}{
+		{name: "open collection", open: true, target: func(t *testing.T, registry *Registry) {}},
+		{name: "closed collection", target: func(t *testing.T, registry *Registry) {}},
+		{
+			name: "over a collection without files",
+			open: true,
+			target: func(t *testing.T, registry *Registry) {
+				if _, err := registry.Open("renamed"); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "over an existing collection",
+			open: true,
+			target: func(t *testing.T, registry *Registry) {
+				createCollection(t, registry, "renamed", map[string]string{"c": `{"v":3}`})
+			},
+			wantErr: ErrCollectionExists,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			keys := testKeys("secret")
+			registry := NewRegistry(dir, keys)
+
+			db := createCollection(t, registry, "original", documents)
+			if !test.open {
+				if err := registry.Close("original"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			test.target(t, registry)
+
+			err := registry.Rename("original", "renamed")
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("Rename failed with %v, want %v", err, test.wantErr)
+				}
+				// Both collections are left as they were and stay writable
+				if err := db.CreateDocument("d", json.RawMessage(`{"v":4}`)); err != nil {
+					t.Errorf("write to the collection after a failed rename: %v", err)
+				}
+				if _, err := registry.Get("renamed"); err != nil {
+					t.Errorf("Get of the existing collection: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Rename: %v", err)
+			}
+
+			if _, err := registry.Get("original"); !errors.Is(err, ErrCollectionNotFound) {
+				t.Errorf("Get of the old name failed with %v, want %v", err, ErrCollectionNotFound)
+			}
+			for _, path := range registry.files("original") {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("%s is still there: %v", filepath.Base(path), err)
+				}
+			}
+
+			for _, registry := range []*Registry{registry, NewRegistry(dir, keys)} {
+				renamed, err := registry.Get("renamed")
+				if err != nil {
+					t.Fatalf("Get of the new name: %v", err)
+				}
+				if got := mustDocuments(t, renamed); !reflect.DeepEqual(got, documents) {
+					t.Errorf("documents = %v, want %v", got, documents)
+				}
+			}
+		})
+	}
+
+	registry := NewRegistry(t.TempDir(), testKeys("secret"))
+	if err := registry.Rename("missing", "renamed"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("Rename of a missing collection failed with %v, want %v", err, ErrCollectionNotFound)
+	}
+}
+
+func TestRenameRacesFirstWrite(t *testing.T) {
+	keys := testKeys("secret")
+
+	// A first write to the new name either lands before the rename, which then fails, or is
+	// refused, but never mixes its file with the renamed collection's
+	for i := 0; i < 20; i++ {
+		registry := NewRegistry(t.TempDir(), keys)
+		createCollection(t, registry, "original", map[string]string{"a": `{"v":1}`})
+		pending, err := registry.Open("renamed")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		var writeErr, renameErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			writeErr = pending.CreateDocument("b", json.RawMessage(`{"v":2}`))
+		}()
+		go func() {
+			defer wg.Done()
+			renameErr = registry.Rename("original", "renamed")
+		}()
+		wg.Wait()
+
+		want := map[string]string{"a": `{"v":1}`}
+		switch {
+		case writeErr == nil && errors.Is(renameErr, ErrCollectionExists):
+			want = map[string]string{"b": `{"v":2}`}
+		case errors.Is(writeErr, ErrClosed) && renameErr == nil:
+		default:
+			t.Fatalf("write failed with %v and rename with %v", writeErr, renameErr)
+		}
+
+		renamed, err := NewRegistry(registry.dataDir, keys).Get("renamed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mustDocuments(t, renamed); !reflect.DeepEqual(got, want) {
+			t.Fatalf("documents = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRegistryDescribe(t *testing.T) {
+	registry := NewRegistry(t.TempDir(), testKeys("secret"))
+
+	before := time.Now().Add(-time.Second)
+	db := createCollection(t, registry, "people", map[string]string{"a": `{"age":31}`, "b": `{"age":25}`, "c": `{"age":47}`})
+	if _, err := db.CreateIndex(IndexSpec{Fields: []string{"age"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTTL(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := registry.Describe("people")
+	if err != nil {
+		t.Fatalf("Describe: %v", err)
+	}
+	if info.Name != "people" || info.Documents != 3 || info.TTL != "24h0m0s" {
+		t.Errorf("Describe = %+v, want people with 3 documents and a TTL of 24h0m0s", info)
+	}
+	if len(info.Indexes) != 1 || !reflect.DeepEqual(info.Indexes[0].Fields, []string{"age"}) {
+		t.Errorf("indexes = %+v, want one on age", info.Indexes)
+	}
+	if info.Size <= 0 {
+		t.Errorf("size = %d, want the size of the collection's files", info.Size)
+	}
+	if info.Created.Before(before) || info.Created.After(time.Now()) {
+		t.Errorf("created = %v, want the time the collection was created", info.Created)
+	}
+
+	if _, err := registry.Describe("missing"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("Describe of a missing collection failed with %v, want %v", err, ErrCollectionNotFound)
+	}
+}
+
+func TestShred(t *testing.T) {
+	tests := []struct {
+		name string
+		open bool // whether the collection is open in the registry that shreds it
+		// shred removes the collection through the registry
+		shred func(registry *Registry, name string) error
+	}{
+		{"shred an open collection", true, (*Registry).Shred},
+		{"shred a closed collection", false, (*Registry).Shred},
+		{"drop an open collection", true, (*Registry).Drop},
+		{"drop a closed collection", false, (*Registry).Drop},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			keys := testKeys("secret")
+			registry := NewRegistry(dir, keys)
+
+			db, err := registry.Create("secrets")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"a", "b"} {
+				if err := db.CreateDocument(key, json.RawMessage(`{"v":1}`)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !test.open {
+				if err := registry.Close("secrets"); err != nil {
+					t.Fatal(err)
+				}
+				registry = NewRegistry(dir, keys)
+			}
+
+			// A hard link keeps the blocks of the .qdb file around, as a copy on the disk would
+			copied := filepath.Join(t.TempDir(), "copy.qdb")
+			if err := os.Link(registry.path("secrets"), copied); err != nil {
+				t.Skipf("hard links are not supported here: %v", err)
+			}
+
+			if err := test.shred(registry, "secrets"); err != nil {
+				t.Fatalf("shred: %v", err)
+			}
+
+			for _, path := range registry.files("secrets") {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("%s is still there: %v", filepath.Base(path), err)
+				}
+			}
+			if _, err := registry.Get("secrets"); !errors.Is(err, ErrCollectionNotFound) {
+				t.Errorf("Get after shred failed with %v, want %v", err, ErrCollectionNotFound)
+			}
+			if test.open {
+				if _, err := db.ReadDocument("a"); !errors.Is(err, ErrShredded) {
+					t.Errorf("read from the shredded collection failed with %v, want %v", err, ErrShredded)
+				}
+			}
+
+			if reloaded := LoadDB(copied, keys); reloaded.loadErr == nil {
+				t.Error("the old blocks of the .qdb file can still be decrypted")
+			}
+		})
+	}
+}
+
+func TestShredMissingCollection(t *testing.T) {
+	registry := NewRegistry(t.TempDir(), testKeys("secret"))
+	if err := registry.Shred("missing"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("Shred of a missing collection failed with %v, want %v", err, ErrCollectionNotFound)
+	}
+}
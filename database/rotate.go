@@ -0,0 +1,272 @@
+package database
+
+import (
+	"CyberDefenseEd/QuadDB/util"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrKeyNotStored is returned when a key rotation needs to store the new master key, but the key
+// comes from a source that cannot keep one, such as --aes-key or an environment variable
+var ErrKeyNotStored = errors.New("the master key source cannot store a new key")
+
+// RotationProgress reports how far a key rotation over a data directory has got
+type RotationProgress struct {
+	Total   int    `json:"total"`
+	Rotated int    `json:"rotated"`
+	Skipped int    `json:"skipped"` // Collections that were already under the new key
+	Current string `json:"current"`
+}
+
+// RotateKeys moves every collection in dataDir from the master key of oldKeys to that of newKeys,
+// calling progress after each file. Every file is rewritten atomically, and files that already open
+// with newKeys are skipped, so an interrupted rotation is resumed by running it again.
+func RotateKeys(dataDir string, oldKeys, newKeys *Keyring, progress func(RotationProgress)) error {
+	dbFiles, err := filepath.Glob(filepath.Join(dataDir, "*.qdb"))
+	if err != nil {
+		return err
+	}
+
+	state := RotationProgress{Total: len(dbFiles)}
+	for _, dbFile := range dbFiles {
+		state.Current = filepath.Base(dbFile)
+
+		rotated, err := rotateFile(dbFile, oldKeys, newKeys)
+		if err != nil {
+			return fmt.Errorf("failed to rotate '%s': %w", dbFile, err)
+		}
+		if rotated {
+			state.Rotated++
+		} else {
+			state.Skipped++
+		}
+
+		if progress != nil {
+			progress(state)
+		}
+	}
+
+	return nil
+}
+
+// RotateKeys moves every collection of the registry to the master key of provider while the server
+// keeps serving them. Collections are rotated one at a time, each holding the maintenance lock
+// exclusively only while its own files are rewritten, and collections already moved are opened
+// with the new key. The registry switches to the new key once every collection is under it; if
+// the rotation fails, those moved so far stay on the new key and running it again resumes it.
+func (registry *Registry) RotateKeys(provider KeyProvider, progress func(RotationProgress)) error {
+	dbFiles, err := filepath.Glob(filepath.Join(registry.dataDir, "*.qdb"))
+	if err != nil {
+		return err
+	}
+
+	registry.maintenance.Lock()
+	registry.lock.Lock()
+	registry.nextKeys = registry.keys.WithProvider(provider)
+	registry.pending = make(map[string]bool, len(dbFiles))
+	for _, dbFile := range dbFiles {
+		registry.pending[strings.TrimSuffix(filepath.Base(dbFile), ".qdb")] = true
+	}
+	// Collections opened for a first write that has not succeeded yet have nothing to rotate, and
+	// are opened again under the new key
+	for name, db := range registry.open {
+		if !registry.onDisk(name) {
+			db.retire()
+			delete(registry.open, name)
+		}
+	}
+	registry.lock.Unlock()
+	registry.maintenance.Unlock()
+
+	state := RotationProgress{Total: len(dbFiles)}
+	for _, dbFile := range dbFiles {
+		state.Current = filepath.Base(dbFile)
+
+		rotated, err := registry.rotateCollection(strings.TrimSuffix(state.Current, ".qdb"), dbFile)
+		if err != nil {
+			return fmt.Errorf("failed to rotate '%s': %w", dbFile, err)
+		}
+		if rotated {
+			state.Rotated++
+		} else {
+			state.Skipped++
+		}
+
+		if progress != nil {
+			progress(state)
+		}
+	}
+
+	registry.maintenance.Lock()
+	defer registry.maintenance.Unlock()
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.keys.SetProvider(provider)
+	for _, db := range registry.open {
+		db.useKeys(registry.keys)
+	}
+	registry.nextKeys, registry.pending = nil, nil
+	return nil
+}
+
+// RotateStoredKey moves every collection of the registry to a new random master key kept by the
+// KeyStore the master key comes from, the way RotateKeys does. The new key is staged in the store
+// first, so a rotation cut short is resumed with the same key, either by running it again or by
+// ResumeKeyRotation on the next start, and it becomes the current key of the store once every
+// collection is under it.
+func (registry *Registry) RotateStoredKey(progress func(RotationProgress)) error {
+	store, ok := registry.keys.Provider().(KeyStore)
+	if !ok {
+		return ErrKeyNotStored
+	}
+
+	staged, err := store.StageKey()
+	if err != nil {
+		return fmt.Errorf("could not stage a new master key: %w", err)
+	}
+	if err := registry.RotateKeys(staged, progress); err != nil {
+		return err
+	}
+	if err := store.PromoteKey(); err != nil {
+		return fmt.Errorf("every collection is under the new master key, but it could not be stored: %w", err)
+	}
+
+	// The store now holds the key the registry switched to, and is where it is read from again
+	registry.keys.SetProvider(store)
+	return nil
+}
+
+// ResumeKeyRotation finishes a rotation to a stored master key that was interrupted, e.g. by a
+// restart, by moving the collections in dataDir that are not under the staged key yet to it and
+// making it the current key. It reports whether there was a rotation to finish, and must run
+// before any collection is opened.
+func ResumeKeyRotation(dataDir string, keys *Keyring, progress func(RotationProgress)) (bool, error) {
+	store, ok := keys.Provider().(KeyStore)
+	if !ok {
+		return false, nil
+	}
+
+	staged, ok, err := store.StagedKey()
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if err := RotateKeys(dataDir, keys, keys.WithProvider(staged), progress); err != nil {
+		return true, err
+	}
+	if err := store.PromoteKey(); err != nil {
+		return true, err
+	}
+
+	keys.SetProvider(store)
+	return true, nil
+}
+
+// rotateCollection moves a single collection to the new key of a running rotation, and opens it
+// again under that key if it was open
+func (registry *Registry) rotateCollection(name, filename string) (bool, error) {
+	registry.maintenance.Lock()
+	defer registry.maintenance.Unlock()
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	// The files are rewritten underneath the open collection, so it must not checkpoint over them
+	db, open := registry.open[name]
+	if open {
+		db.retire()
+		delete(registry.open, name)
+	}
+
+	rotated, err := rotateFile(filename, registry.keys, registry.nextKeys)
+	if err == nil {
+		delete(registry.pending, name)
+	}
+
+	if open {
+		if _, loadErr := registry.load(name); loadErr != nil {
+			return false, errors.Join(err, loadErr)
+		}
+	}
+	return rotated, err
+}
+
+// rotateFile moves a single collection to newKeys. Only the data key in the header of the .qdb and
+// .bak files is rewrapped, so the documents and write-ahead log are left untouched. Files from
+// before envelope encryption are re-encrypted as a whole instead. It returns false when the
+// collection was already under newKeys.
+func rotateFile(filename string, oldKeys, newKeys *Keyring) (bool, error) {
+	lock := fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+
+	if !isEnvelopeFile(data) {
+		return true, reencryptFile(filename, oldKeys, newKeys)
+	}
+
+	rewrapped, err := rewrapFile(data, oldKeys, newKeys)
+	if err != nil {
+		return false, err
+	}
+	rotated := rewrapped != nil
+	if rotated {
+		if err := util.WriteFileAtomic(filename, rewrapped, 0644, ""); err != nil {
+			return false, err
+		}
+		data = rewrapped
+	}
+
+	backup := filename + ".bak"
+	backupData, err := os.ReadFile(backup)
+	if os.IsNotExist(err) {
+		return rotated, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !isEnvelopeFile(backupData) {
+		// The backup predates envelope encryption and is still sealed with a key derived from the
+		// old master key, so the current generation takes its place
+		return true, util.WriteFileAtomic(backup, data, 0644, "")
+	}
+
+	rewrapped, err = rewrapFile(backupData, oldKeys, newKeys)
+	if err != nil {
+		return false, err
+	}
+	if rewrapped == nil {
+		return rotated, nil
+	}
+
+	return true, util.WriteFileAtomic(backup, rewrapped, 0644, "")
+}
+
+// reencryptFile folds the write-ahead log of a collection from before envelope encryption into a
+// current format file under newKeys. The caller must hold the file lock.
+func reencryptFile(filename string, oldKeys, newKeys *Keyring) error {
+	db := &Database{filename: filename, keys: oldKeys}
+	documents, err := db.readDocuments()
+	if err != nil {
+		return err
+	}
+
+	db.keys = newKeys
+
+	// Checkpoint twice so that the .bak generation is not left behind under the old key either
+	for i := 0; i < 2; i++ {
+		if err := db.checkpoint(documents); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
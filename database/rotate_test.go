@@ -0,0 +1,122 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRotateStoredKey(t *testing.T) {
+	tests := []struct {
+		name string
+		// rotate moves the collections of a registry whose master key comes from keyFile to a new
+		// key, the way a rotation may get there, before the server starts again
+		rotate func(t *testing.T, registry *Registry, keyFile string)
+	}{
+		{
+			name: "online rotation",
+			rotate: func(t *testing.T, registry *Registry, keyFile string) {
+				if err := registry.RotateStoredKey(nil); err != nil {
+					t.Fatalf("RotateStoredKey: %v", err)
+				}
+			},
+		},
+		{
+			name: "restart after the first collection",
+			rotate: func(t *testing.T, registry *Registry, keyFile string) {
+				staged, err := FileKey(keyFile).StageKey()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := registry.CloseAll(); err != nil {
+					t.Fatal(err)
+				}
+				newKeys := registry.keys.WithProvider(staged)
+				if _, err := rotateFile(registry.path("alpha"), registry.keys, newKeys); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "restart before promoting the key",
+			rotate: func(t *testing.T, registry *Registry, keyFile string) {
+				staged, err := FileKey(keyFile).StageKey()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := registry.RotateKeys(staged, nil); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	want := map[string]map[string]string{
+		"alpha": {"a": `{"v":1}`},
+		"beta":  {"b": `{"v":2}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			keyFile := filepath.Join(dir, "master.key")
+			if err := os.WriteFile(keyFile, []byte("old key\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			registry := NewRegistry(filepath.Join(dir, "data"), testKeys(""))
+			registry.keys.SetProvider(FileKey(keyFile))
+			if err := os.MkdirAll(registry.dataDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, documents := range want {
+				db, err := registry.Open(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for key, data := range documents {
+					if err := db.CreateDocument(key, json.RawMessage(data)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			test.rotate(t, registry, keyFile)
+
+			// The next start finishes what is left and reads the new key from the key file
+			keys := testKeys("")
+			keys.SetProvider(FileKey(keyFile))
+			if _, err := ResumeKeyRotation(registry.dataDir, keys, nil); err != nil {
+				t.Fatalf("ResumeKeyRotation: %v", err)
+			}
+
+			if key, err := FileKey(keyFile).MasterKey(); err != nil || string(key) == "old key" {
+				t.Errorf("key file holds %q (%v), want a new key", key, err)
+			}
+			if _, err := os.Stat(stagedKeyFile(keyFile)); !os.IsNotExist(err) {
+				t.Errorf("staged key is still there: %v", err)
+			}
+
+			restarted := NewRegistry(registry.dataDir, keys)
+			for name, documents := range want {
+				db, err := restarted.Get(name)
+				if err != nil {
+					t.Fatalf("Get(%s) after rotation: %v", name, err)
+				}
+				if got := mustDocuments(t, db); !reflect.DeepEqual(got, documents) {
+					t.Errorf("%s = %v, want %v", name, got, documents)
+				}
+			}
+		})
+	}
+}
+
+func TestRotateStoredKeyNeedsKeyStore(t *testing.T) {
+	registry := NewRegistry(t.TempDir(), testKeys("secret"))
+	if err := registry.RotateStoredKey(nil); !errors.Is(err, ErrKeyNotStored) {
+		t.Errorf("RotateStoredKey with a static key failed with %v, want %v", err, ErrKeyNotStored)
+	}
+}
@@ -0,0 +1,244 @@
+package database
+
+import (
+	"CyberDefenseEd/QuadDB/util"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrSchemaViolation = errors.New("document does not match the collection schema")
+	ErrSchemaNotFound  = errors.New("collection has no schema")
+)
+
+// maxReportedViolations caps the violations reported for a single document
+const maxReportedViolations = 100
+
+// SchemaError is returned for writes of documents that do not match the schema of a collection
+type SchemaError struct {
+	Key        string
+	Violations []SchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	first := e.Violations[0]
+	message := fmt.Sprintf("%v: '%s' at '%s' %s", ErrSchemaViolation, e.Key, first.InstancePath, first.Message)
+	if len(e.Violations) > 1 {
+		message += fmt.Sprintf(" (and %d more)", len(e.Violations)-1)
+	}
+	return message
+}
+
+func (e *SchemaError) Unwrap() error {
+	return ErrSchemaViolation
+}
+
+// collectionSchema is the JSON Schema documents of a collection must match
+type collectionSchema struct {
+	raw  json.RawMessage
+	root *schemaNode // nil for a stored schema that does not compile, which is not enforced
+}
+
+// newCollectionSchema compiles a schema, keeping it compacted for storage
+func newCollectionSchema(data []byte) (*collectionSchema, error) {
+	root, err := compileSchema(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	return &collectionSchema{raw: compacted.Bytes(), root: root}, nil
+}
+
+// violations returns the ways a document does not match the schema, the first of them if there
+// are many. The top-level expires_at is managed by the collection, which may add it to documents,
+// so schemas do not see it.
+func (schema *collectionSchema) violations(data json.RawMessage) []SchemaViolation {
+	document, err := decodeJSON(data)
+	if err != nil {
+		return []SchemaViolation{{Message: "is not valid JSON"}}
+	}
+	if object, ok := document.(map[string]interface{}); ok {
+		delete(object, ExpiresField)
+	}
+
+	violations := validateSchema(schema.root, document)
+	if len(violations) > maxReportedViolations {
+		violations = violations[:maxReportedViolations]
+	}
+	return violations
+}
+
+// checkSchema fails with a *SchemaError if record puts a document that does not match the schema
+// of the collection; the caller must hold docsLock
+func (db *Database) checkSchema(record walRecord) error {
+	if db.schema == nil || db.schema.root == nil {
+		return nil
+	}
+	if record.Op == walOpBatch {
+		for _, nested := range record.Records {
+			if err := db.checkSchema(nested); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if record.Op != walOpPut {
+		return nil
+	}
+	if violations := db.schema.violations(record.Data); len(violations) > 0 {
+		return &SchemaError{Key: record.Key, Violations: violations}
+	}
+	return nil
+}
+
+// Schema returns the JSON Schema of the collection, or nil if it has none
+func (db *Database) Schema() json.RawMessage {
+	db.docsLock.RLock()
+	defer db.docsLock.RUnlock()
+
+	if db.schema == nil {
+		return nil
+	}
+	return db.schema.raw
+}
+
+// SetSchema attaches a JSON Schema (draft 2020-12) to the collection, or replaces the one it has.
+// Every later write must match it; documents already stored are not checked, which
+// ValidateDocuments does.
+func (db *Database) SetSchema(data json.RawMessage) error {
+	schema, err := newCollectionSchema(data)
+	if err != nil {
+		return err
+	}
+
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return db.loadErr
+	}
+
+	previous := db.schema
+	db.schema = schema
+	if err := db.saveSettings(); err != nil {
+		db.schema = previous
+		return err
+	}
+	return nil
+}
+
+// RemoveSchema detaches the JSON Schema of the collection
+func (db *Database) RemoveSchema() error {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return db.loadErr
+	}
+	previous := db.schema
+	if previous == nil {
+		return ErrSchemaNotFound
+	}
+
+	db.schema = nil
+	if err := db.saveSettings(); err != nil {
+		db.schema = previous
+		return err
+	}
+	return nil
+}
+
+// InvalidDocument is a stored document that does not match a schema
+type InvalidDocument struct {
+	Id         string            `json:"id"`
+	Violations []SchemaViolation `json:"errors"`
+}
+
+// SchemaReport is the outcome of checking the stored documents of a collection against a schema
+type SchemaReport struct {
+	Checked   int               `json:"checked"`
+	Invalid   int               `json:"invalid"`
+	Documents []InvalidDocument `json:"documents"` // The first invalid documents, ordered by key
+}
+
+// ValidateDocuments checks the stored documents against a schema, or against the schema of the
+// collection if data is empty, and reports up to limit of those that do not match it, or all of
+// them if limit is 0. Checking a schema before attaching it shows which documents it would reject.
+func (db *Database) ValidateDocuments(data json.RawMessage, limit int) (SchemaReport, error) {
+	var schema *collectionSchema
+	if len(data) > 0 {
+		var err error
+		if schema, err = newCollectionSchema(data); err != nil {
+			return SchemaReport{}, err
+		}
+	}
+
+	db.docsLock.RLock()
+	defer db.docsLock.RUnlock()
+
+	if db.loadErr != nil {
+		return SchemaReport{}, db.loadErr
+	}
+	if schema == nil {
+		if schema = db.schema; schema == nil {
+			return SchemaReport{}, ErrSchemaNotFound
+		}
+		if schema.root == nil {
+			return SchemaReport{}, fmt.Errorf("%w: the schema of the collection does not compile", ErrInvalidSchema)
+		}
+	}
+
+	documents := db.liveDocuments()
+	keys := make([]string, 0, len(documents))
+	for key := range documents {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	report := SchemaReport{Documents: []InvalidDocument{}}
+	for _, key := range keys {
+		report.Checked++
+		violations := schema.violations(documents[key])
+		if len(violations) == 0 {
+			continue
+		}
+
+		report.Invalid++
+		if limit == 0 || len(report.Documents) < limit {
+			report.Documents = append(report.Documents, InvalidDocument{Id: key, Violations: violations})
+		}
+	}
+	return report, nil
+}
+
+// loadSchema compiles the schema stored in a database file. A schema that no longer compiles is
+// kept, so it is not lost, but not enforced.
+func (db *Database) loadSchema(data json.RawMessage) {
+	db.schema = nil
+	if len(data) == 0 {
+		return
+	}
+
+	schema, err := newCollectionSchema(data)
+	if err != nil {
+		util.Warn(fmt.Sprintf("Not enforcing the schema of '%s': %v", db.filename, err))
+		schema = &collectionSchema{raw: data}
+	}
+	db.schema = schema
+}
+
+// schemaData returns the schema to store in the database file; the caller must hold docsLock
+func (db *Database) schemaData() json.RawMessage {
+	if db.schema == nil {
+		return nil
+	}
+	return db.schema.raw
+}
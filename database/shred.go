@@ -0,0 +1,103 @@
+package database
+
+import (
+	"CyberDefenseEd/QuadDB/util"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrShredded is returned by a Database whose collection has been shredded
+var ErrShredded = errors.New("collection has been shredded")
+
+// Shred destroys the data key of the collection and removes its files. The header holding the
+// wrapped data key is overwritten in place before the .qdb and .bak files are removed, so the key
+// cannot be recovered from the disk. Copies of the files taken earlier still carry the wrapped key
+// until the master key is rotated.
+func (db *Database) Shred() error {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	lock := fileLock(db.filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := shredFiles(db.filename); err != nil {
+		return err
+	}
+
+	// Forget everything so this instance cannot write the collection back
+	db.dataKey = nil
+	db.wrappedKey = nil
+	db.documents = make(map[string]json.RawMessage)
+	db.revisions = make(map[string]uint64)
+	db.expiries = make(map[string]time.Time)
+	db.schema = nil
+	db.loadErr = ErrShredded
+
+	db.indexLock.Lock()
+	db.indexes = make(map[string]*declaredIndex)
+	db.textIndex = nil
+	db.indexLock.Unlock()
+
+	return nil
+}
+
+// shredFiles destroys the headers of a collection's .qdb file and backup, then removes them along
+// with its write-ahead log and text index. The caller must hold the file lock of filename.
+func shredFiles(filename string) error {
+	for _, path := range []string{filename, filename + ".bak"} {
+		if err := destroyHeader(path); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range []string{filename + ".wal", filename + ".fts", filename + ".bak", filename} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return util.SyncDir(filepath.Dir(filename))
+}
+
+// destroyHeader overwrites the header of a current format .qdb file with random bytes
+func destroyHeader(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if !isEnvelopeFile(data) {
+		// Older formats derive their key from the master key and store nothing worth destroying
+		return nil
+	}
+
+	_, _, offset, err := decodeHeader(data)
+	if err != nil {
+		// Without a readable header there is no wrapped key left to find either
+		return nil
+	}
+
+	noise := make([]byte, offset)
+	if _, err := rand.Read(noise); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt(noise, 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidCursor is returned for pagination cursors that were not issued for the same sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// SortField orders query results by the value at a dotted path
+type SortField struct {
+	Path       string
+	Descending bool
+}
+
+// ParseSort parses a comma-separated sort order such as "severity:-1,created", where ":1" or no
+// direction sorts ascending and ":-1" descending
+func ParseSort(text string) ([]SortField, error) {
+	var fields []SortField
+	if strings.TrimSpace(text) == "" {
+		return fields, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(text, ",") {
+		path, direction, _ := strings.Cut(strings.TrimSpace(part), ":")
+		field := SortField{Path: path}
+		switch direction {
+		case "", "1":
+		case "-1":
+			field.Descending = true
+		default:
+			return nil, fmt.Errorf("%w: sort direction of '%s' must be 1 or -1", ErrInvalidQuery, path)
+		}
+		if err := validatePath(path); err != nil {
+			return nil, err
+		}
+		if seen[path] {
+			return nil, fmt.Errorf("%w: '%s' is sorted on more than once", ErrInvalidQuery, path)
+		}
+		seen[path] = true
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// formatSort writes a sort order the way ParseSort reads it
+func formatSort(fields []SortField) string {
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		parts[i] = field.Path + ":1"
+		if field.Descending {
+			parts[i] = field.Path + ":-1"
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// validatePath checks that a dotted path names a field
+func validatePath(path string) error {
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" || strings.HasPrefix(segment, "$") {
+			return fmt.Errorf("%w: '%s' is not a field path", ErrInvalidQuery, path)
+		}
+	}
+	return nil
+}
+
+// sortPosition is where a document falls in a sort order: its sort values, then its key
+type sortPosition struct {
+	values []indexValue
+	key    string
+}
+
+// sortValues returns the values a decoded document is sorted by. A path holding an array sorts by
+// its smallest element ascending and its largest descending, and a missing path sorts as null.
+func sortValues(document interface{}, fields []SortField) []indexValue {
+	values := make([]indexValue, len(fields))
+	for i, field := range fields {
+		values[i] = indexValue{kind: kindNull}
+		for j, value := range pathValues(document, strings.Split(field.Path, "."), false) {
+			order := value.compare(values[i])
+			if j == 0 || (order < 0 && !field.Descending) || (order > 0 && field.Descending) {
+				values[i] = value
+			}
+		}
+	}
+	return values
+}
+
+// comparePositions orders two documents by fields, in the same order as indexValue.compare, and
+// by key when the values are equal
+func comparePositions(a, b sortPosition, fields []SortField) int {
+	for i, field := range fields {
+		order := a.values[i].compare(b.values[i])
+		if field.Descending {
+			order = -order
+		}
+		if order != 0 {
+			return order
+		}
+	}
+	return strings.Compare(a.key, b.key)
+}
+
+// sortPositions sorts positions by fields
+func sortPositions(positions []sortPosition, fields []SortField) {
+	sort.Slice(positions, func(i, j int) bool {
+		return comparePositions(positions[i], positions[j], fields) < 0
+	})
+}
+
+// pageCursor is the decoded form of a cursor: the sort order it was issued for and the position of
+// the last document returned
+type pageCursor struct {
+	Sort   string        `json:"s"`
+	Values []interface{} `json:"v"`
+	Key    string        `json:"k"`
+}
+
+// encodeCursor returns an opaque cursor for the page that follows position. Cursors hold the
+// position itself rather than an offset, so documents written in between do not shift the pages.
+func encodeCursor(position sortPosition, fields []SortField) string {
+	cursor := pageCursor{Sort: formatSort(fields), Values: make([]interface{}, len(position.values)), Key: position.key}
+	for i, value := range position.values {
+		switch value.kind {
+		case kindBool:
+			cursor.Values[i] = value.boolean
+		case kindNumber:
+			cursor.Values[i] = json.Number(value.String())
+		case kindString:
+			cursor.Values[i] = value.text
+		}
+	}
+
+	data, err := encodeJSON(cursor)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reads a cursor issued by encodeCursor for the same sort order
+func decodeCursor(text string, fields []SortField) (sortPosition, error) {
+	data, err := base64.RawURLEncoding.DecodeString(text)
+	if err != nil {
+		return sortPosition{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	decoded, err := decodeJSON(data)
+	if err != nil {
+		return sortPosition{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	object, _ := decoded.(map[string]interface{})
+	sortOrder, _ := object["s"].(string)
+	values, _ := object["v"].([]interface{})
+	key, ok := object["k"].(string)
+	if !ok || sortOrder != formatSort(fields) || len(values) != len(fields) {
+		return sortPosition{}, fmt.Errorf("%w: the cursor was issued for another sort order", ErrInvalidCursor)
+	}
+
+	position := sortPosition{values: make([]indexValue, len(values)), key: key}
+	for i, value := range values {
+		if position.values[i], ok = newIndexValue(value); !ok {
+			return sortPosition{}, fmt.Errorf("%w: the cursor holds a value that cannot be sorted", ErrInvalidCursor)
+		}
+	}
+	return position, nil
+}
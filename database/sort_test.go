@@ -0,0 +1,226 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    []SortField
+		wantErr bool
+	}{
+		{text: "", want: []SortField{}},
+		{text: "severity:-1,created", want: []SortField{{"severity", true}, {"created", false}}},
+		{text: " owner.team:1 , name ", want: []SortField{{"owner.team", false}, {"name", false}}},
+		{text: "severity:2", wantErr: true},
+		{text: "severity,severity:-1", wantErr: true},
+		{text: "$where", wantErr: true},
+		{text: "owner..team", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseSort(test.text)
+		if test.wantErr {
+			if !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("ParseSort(%q) failed with %v, want %v", test.text, err, ErrInvalidQuery)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSort(%q): %v", test.text, err)
+			continue
+		}
+		if len(got) != len(test.want) || (len(got) > 0 && !reflect.DeepEqual(got, test.want)) {
+			t.Errorf("ParseSort(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	fields := []SortField{{"a", false}, {"b", true}, {"c", false}, {"d", true}}
+	document, err := decodeJSON([]byte(`{"a":null,"b":true,"c":-2.5e3,"d":"Ünïcode, \"quoted\""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	position := sortPosition{values: sortValues(document, fields), key: "doc/1"}
+
+	cursor := encodeCursor(position, fields)
+	decoded, err := decodeCursor(cursor, fields)
+	if err != nil {
+		t.Fatalf("decodeCursor: %v", err)
+	}
+	if decoded.key != position.key || comparePositions(decoded, position, fields) != 0 {
+		t.Errorf("cursor decoded to %+v, want %+v", decoded, position)
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+		fields []SortField
+	}{
+		{"another sort order", cursor, []SortField{{"a", false}, {"b", false}, {"c", false}, {"d", true}}},
+		{"fewer sort fields", cursor, fields[:3]},
+		{"not base64", "not a cursor!", fields},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte("{")), fields},
+		{"value that cannot be sorted", base64.RawURLEncoding.EncodeToString([]byte(`{"s":"a:1","v":[{"x":1}],"k":"doc"}`)), fields[:1]},
+		{"no key", base64.RawURLEncoding.EncodeToString([]byte(`{"s":"a:1","v":[1]}`)), fields[:1]},
+	}
+	for _, test := range tests {
+		if _, err := decodeCursor(test.cursor, test.fields); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%s: decodeCursor failed with %v, want %v", test.name, err, ErrInvalidCursor)
+		}
+	}
+}
+
+// sortDocuments have severities of every kind, ties and arrays, which sort by their smallest
+// element ascending and their largest descending
+var sortDocuments = map[string]string{
+	"k01": `{"severity":3}`,
+	"k02": `{"severity":1}`,
+	"k03": `{"severity":3}`,
+	"k04": `{"severity":2}`,
+	"k05": `{"severity":null}`,
+	"k06": `{"title":"no severity"}`,
+	"k07": `{"severity":"high"}`,
+	"k08": `{"severity":[1,5]}`,
+	"k09": `{"severity":true}`,
+	"k10": `{"severity":3.0}`,
+	"k11": `{"severity":2.0}`,
+	"k12": `{"severity":[0,"low"]}`,
+}
+
+// findPages walks every page of a query with the given page size and returns the keys of each page
+func findPages(t *testing.T, db *Database, options FindOptions, between func(page int)) [][]string {
+	t.Helper()
+
+	query, err := ParseQuery([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pages [][]string
+	for {
+		result, err := db.Find(query, options)
+		if err != nil {
+			t.Fatalf("Find: %v", err)
+		}
+		page := []string{}
+		for _, document := range result.Documents {
+			page = append(page, document.Id)
+		}
+		pages = append(pages, page)
+
+		if result.NextCursor == "" {
+			return pages
+		}
+		if len(pages) > 20 {
+			t.Fatalf("the cursor never reached the last page: %v", pages)
+		}
+		if between != nil {
+			between(len(pages))
+		}
+		options.Cursor = result.NextCursor
+	}
+}
+
+func TestFindPages(t *testing.T) {
+	tests := []struct {
+		name  string
+		sort  string
+		want  [][]string
+		write func(t *testing.T, db *Database, page int) // Changes the collection after a page
+	}{
+		{
+			name: "descending",
+			sort: "severity:-1",
+			want: [][]string{{"k12", "k07", "k08"}, {"k01", "k03", "k10"}, {"k04", "k11", "k02"}, {"k09", "k05", "k06"}},
+		},
+		{
+			name: "ascending",
+			sort: "severity",
+			want: [][]string{{"k05", "k06", "k09"}, {"k12", "k02", "k08"}, {"k04", "k11", "k01"}, {"k03", "k10", "k07"}},
+		},
+		{
+			name: "by key",
+			want: [][]string{{"k01", "k02", "k03"}, {"k04", "k05", "k06"}, {"k07", "k08", "k09"}, {"k10", "k11", "k12"}},
+		},
+		{
+			// Documents written before the cursor's position do not shift the pages, and those
+			// written after it still come up
+			name: "writes between pages",
+			sort: "severity:-1",
+			write: func(t *testing.T, db *Database, page int) {
+				if page != 1 {
+					return
+				}
+				for key, data := range map[string]string{"k00": `{"severity":4}`, "k13": `{"severity":"zzz"}`} {
+					if err := db.CreateDocument(key, json.RawMessage(data)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := db.DeleteDocument("k01"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: [][]string{{"k12", "k07", "k08"}, {"k00", "k03", "k10"}, {"k04", "k11", "k02"}, {"k09", "k05", "k06"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := LoadDB(filepath.Join(t.TempDir(), "alerts.qdb"), testKeys("secret"))
+			for key, data := range sortDocuments {
+				if err := db.CreateDocument(key, json.RawMessage(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sortOrder, err := ParseSort(test.sort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var between func(page int)
+			if test.write != nil {
+				between = func(page int) { test.write(t, db, page) }
+			}
+
+			got := findPages(t, db, FindOptions{Sort: sortOrder, Limit: 3}, between)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("pages = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFindCursorForAnotherSort(t *testing.T) {
+	db := LoadDB(filepath.Join(t.TempDir(), "alerts.qdb"), testKeys("secret"))
+	for key, data := range sortDocuments {
+		if err := db.CreateDocument(key, json.RawMessage(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	query, err := ParseQuery([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	descending := []SortField{{"severity", true}}
+	result, err := db.Find(query, FindOptions{Sort: descending, Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != len(sortDocuments) || result.NextCursor == "" {
+		t.Fatalf("first page has a total of %d and cursor %q", result.Total, result.NextCursor)
+	}
+
+	_, err = db.Find(query, FindOptions{Sort: []SortField{{"severity", false}}, Cursor: result.NextCursor, Limit: 5})
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Find with the cursor of another sort order failed with %v, want %v", err, ErrInvalidCursor)
+	}
+}
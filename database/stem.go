@@ -0,0 +1,178 @@
+package database
+
+import "strings"
+
+// stemRule replaces a suffix when the measure of the stem in front of it is above a minimum
+type stemRule struct {
+	suffix, replacement string
+}
+
+// Suffix rules of steps 2, 3 and 4 of the Porter stemmer. A suffix is listed before any shorter one
+// it ends with, so the longest matching suffix wins.
+var (
+	stemStep2 = []stemRule{
+		{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"}, {"izer", "ize"},
+		{"bli", "ble"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"},
+		{"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"},
+		{"fulness", "ful"}, {"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+		{"logi", "log"},
+	}
+	stemStep3 = []stemRule{
+		{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"}, {"ical", "ic"}, {"ful", ""},
+		{"ness", ""},
+	}
+	stemStep4 = []stemRule{
+		{"ement", ""}, {"ance", ""}, {"ence", ""}, {"able", ""}, {"ible", ""}, {"ment", ""},
+		{"ant", ""}, {"ent", ""}, {"ion", ""}, {"ism", ""}, {"ate", ""}, {"iti", ""}, {"ous", ""},
+		{"ive", ""}, {"ize", ""}, {"al", ""}, {"er", ""}, {"ic", ""}, {"ou", ""},
+	}
+)
+
+// stem reduces an English word to its stem with the Porter stemming algorithm, so that "phishing",
+// "phished" and "phish" are indexed alike. Words that are not lowercase ASCII letters are kept as
+// they are.
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+
+	// Step 1a: plurals
+	switch {
+	case strings.HasSuffix(word, "sses"), strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ss"):
+	case strings.HasSuffix(word, "s"):
+		word = word[:len(word)-1]
+	}
+
+	// Step 1b: past tenses and gerunds
+	trimmed := false
+	switch {
+	case strings.HasSuffix(word, "eed"):
+		if stemMeasure(word[:len(word)-3]) > 0 {
+			word = word[:len(word)-1]
+		}
+	case strings.HasSuffix(word, "ed") && stemHasVowel(word[:len(word)-2]):
+		word, trimmed = word[:len(word)-2], true
+	case strings.HasSuffix(word, "ing") && stemHasVowel(word[:len(word)-3]):
+		word, trimmed = word[:len(word)-3], true
+	}
+	if trimmed {
+		switch {
+		case strings.HasSuffix(word, "at"), strings.HasSuffix(word, "bl"), strings.HasSuffix(word, "iz"):
+			word += "e"
+		case stemDoubleConsonant(word) && !strings.ContainsAny(word[len(word)-1:], "lsz"):
+			word = word[:len(word)-1]
+		case stemMeasure(word) == 1 && stemCVC(word):
+			word += "e"
+		}
+	}
+
+	// Step 1c: a final y after a vowel
+	if strings.HasSuffix(word, "y") && stemHasVowel(word[:len(word)-1]) {
+		word = word[:len(word)-1] + "i"
+	}
+
+	// Steps 2 to 4: derivational suffixes
+	word = applyStemRules(word, stemStep2, 0)
+	word = applyStemRules(word, stemStep3, 0)
+	if strings.HasSuffix(word, "ion") {
+		// ion is only removed after an s or a t
+		stemmed := word[:len(word)-3]
+		if stemMeasure(stemmed) > 1 && (strings.HasSuffix(stemmed, "s") || strings.HasSuffix(stemmed, "t")) {
+			word = stemmed
+		}
+	} else {
+		word = applyStemRules(word, stemStep4, 1)
+	}
+
+	// Step 5: a final e and a double l
+	if strings.HasSuffix(word, "e") {
+		stemmed := word[:len(word)-1]
+		if measure := stemMeasure(stemmed); measure > 1 || (measure == 1 && !stemCVC(stemmed)) {
+			word = stemmed
+		}
+	}
+	if stemMeasure(word) > 1 && stemDoubleConsonant(word) && strings.HasSuffix(word, "l") {
+		word = word[:len(word)-1]
+	}
+
+	return word
+}
+
+// applyStemRules replaces the longest suffix in rules if the measure of the stem in front of it is
+// above minMeasure. Once a suffix matches, no shorter one is tried.
+func applyStemRules(word string, rules []stemRule, minMeasure int) string {
+	for _, rule := range rules {
+		if !strings.HasSuffix(word, rule.suffix) {
+			continue
+		}
+		stemmed := word[:len(word)-len(rule.suffix)]
+		if stemMeasure(stemmed) > minMeasure {
+			return stemmed + rule.replacement
+		}
+		return word
+	}
+	return word
+}
+
+// stemConsonant reports whether the letter at i is a consonant; y is one unless it follows a consonant
+func stemConsonant(word string, i int) bool {
+	switch word[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !stemConsonant(word, i-1)
+	}
+	return true
+}
+
+// stemMeasure counts the vowel-consonant sequences of a stem
+func stemMeasure(word string) int {
+	measure := 0
+	i := 0
+	for i < len(word) && stemConsonant(word, i) {
+		i++
+	}
+	for i < len(word) {
+		for i < len(word) && !stemConsonant(word, i) {
+			i++
+		}
+		if i == len(word) {
+			break
+		}
+		for i < len(word) && stemConsonant(word, i) {
+			i++
+		}
+		measure++
+	}
+	return measure
+}
+
+// stemHasVowel reports whether a stem contains a vowel
+func stemHasVowel(word string) bool {
+	for i := range word {
+		if !stemConsonant(word, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// stemDoubleConsonant reports whether a word ends in the same consonant twice
+func stemDoubleConsonant(word string) bool {
+	n := len(word)
+	return n >= 2 && word[n-1] == word[n-2] && stemConsonant(word, n-1)
+}
+
+// stemCVC reports whether a word ends in consonant, vowel, consonant, where the last is not w, x or y
+func stemCVC(word string) bool {
+	n := len(word)
+	return n >= 3 && stemConsonant(word, n-3) && !stemConsonant(word, n-2) && stemConsonant(word, n-1) &&
+		!strings.ContainsAny(word[n-1:], "wxy")
+}
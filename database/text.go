@@ -0,0 +1,451 @@
+package database
+
+import (
+	"CyberDefenseEd/QuadDB/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// BM25 parameters: how quickly repeating a term stops adding to a score, and how much longer
+// documents are penalized
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// textAAD binds a text index file to its purpose, so it cannot be passed off as another file
+var textAAD = []byte("QuadDB text index")
+
+// stopWords are common English words that say nothing about what a document is about
+var stopWords = map[string]bool{}
+
+func init() {
+	for _, word := range strings.Fields(`a about above after again against all am an and any are as at
+		be because been before being below between both but by can could did do does doing down during
+		each few for from further had has have having he her here hers herself him himself his how i if
+		in into is it its itself just me more most my myself no nor not now of off on once only or other
+		our ours ourselves out over own same she should so some such than that the their theirs them
+		themselves then there these they this those through to too under until up very was we were what
+		when where which while who whom why will with would you your yours yourself yourselves`) {
+		stopWords[word] = true
+	}
+}
+
+// TextIndexSpec declares the full-text index of a collection
+type TextIndexSpec struct {
+	Fields []string `msgpack:"fields" json:"fields"` // Dotted paths whose strings are indexed, or every string of the document if empty
+}
+
+// TextResult is a document found by a text search, along with how well it matches
+type TextResult struct {
+	Id    string          `json:"id"`
+	Data  json.RawMessage `json:"data"`
+	Score float64         `json:"score"`
+}
+
+// textIndex is an inverted index from terms to the documents holding them. It is stored in a file
+// next to the .qdb file, sealed with the collection's data key.
+type textIndex struct {
+	Spec     TextIndexSpec             `msgpack:"spec"`
+	Postings map[string]map[string]int `msgpack:"postings"` // Documents holding each term, and how often
+	Lengths  map[string]int            `msgpack:"lengths"`  // Number of terms in each document
+	Hashes   map[string]uint64         `msgpack:"hashes"`   // Hash of each document as it was indexed
+	Total    int                       `msgpack:"total"`    // Number of terms in all documents
+}
+
+// newTextIndex returns an empty text index
+func newTextIndex(spec TextIndexSpec) *textIndex {
+	return &textIndex{
+		Spec:     spec,
+		Postings: make(map[string]map[string]int),
+		Lengths:  make(map[string]int),
+		Hashes:   make(map[string]uint64),
+	}
+}
+
+// tokenize splits text into lowercase words, leaves out stop words and stems the rest
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		if !stopWords[word] {
+			terms = append(terms, stem(word))
+		}
+	}
+	return terms
+}
+
+// collectStrings appends every string in a value, looking into arrays and objects
+func collectStrings(value interface{}, texts []string) []string {
+	switch value := value.(type) {
+	case string:
+		return append(texts, value)
+	case []interface{}:
+		for _, element := range value {
+			texts = collectStrings(element, texts)
+		}
+	case map[string]interface{}:
+		for _, member := range value {
+			texts = collectStrings(member, texts)
+		}
+	}
+	return texts
+}
+
+// documentHash identifies the contents of a document, so an index entry can be checked against it
+func documentHash(data json.RawMessage) uint64 {
+	hash := fnv.New64a()
+	hash.Write(data)
+	return hash.Sum64()
+}
+
+// terms returns the terms of the indexed strings of a document
+func (index *textIndex) terms(data json.RawMessage) []string {
+	document, ok := decodedDocument(data)
+	if !ok {
+		return nil
+	}
+
+	var texts []string
+	if len(index.Spec.Fields) == 0 {
+		texts = collectStrings(document, nil)
+	}
+	for _, field := range index.Spec.Fields {
+		for _, value := range lookupPath(document, strings.Split(field, ".")) {
+			texts = collectStrings(value, texts)
+		}
+	}
+
+	var terms []string
+	for _, text := range texts {
+		terms = append(terms, tokenize(text)...)
+	}
+	return terms
+}
+
+// touches reports whether the index covers any of the given top-level fields
+func (index *textIndex) touches(fields []string) bool {
+	if len(index.Spec.Fields) == 0 {
+		return true
+	}
+	for _, path := range index.Spec.Fields {
+		for _, field := range fields {
+			if strings.SplitN(path, ".", 2)[0] == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// add indexes a document that is not in the index
+func (index *textIndex) add(key string, data json.RawMessage) {
+	terms := index.terms(data)
+	for _, term := range terms {
+		if index.Postings[term] == nil {
+			index.Postings[term] = make(map[string]int)
+		}
+		index.Postings[term][key]++
+	}
+	index.Lengths[key] = len(terms)
+	index.Hashes[key] = documentHash(data)
+	index.Total += len(terms)
+}
+
+// remove drops a document from the index. data is the document as it was indexed, if known; without
+// it every term has to be looked through for the document.
+func (index *textIndex) remove(key string, data json.RawMessage) {
+	length, indexed := index.Lengths[key]
+	if !indexed {
+		return
+	}
+
+	drop := func(term string) {
+		postings := index.Postings[term]
+		delete(postings, key)
+		if len(postings) == 0 {
+			delete(index.Postings, term)
+		}
+	}
+	switch {
+	case length == 0:
+	case data != nil && documentHash(data) == index.Hashes[key]:
+		for _, term := range index.terms(data) {
+			drop(term)
+		}
+	default:
+		for term, postings := range index.Postings {
+			if _, ok := postings[key]; ok {
+				drop(term)
+			}
+		}
+	}
+
+	delete(index.Lengths, key)
+	delete(index.Hashes, key)
+	index.Total -= length
+}
+
+// sync brings the index in line with documents, reindexing only the documents that changed since
+// it was built
+func (index *textIndex) sync(documents map[string]json.RawMessage) {
+	for key := range index.Lengths {
+		if _, exists := documents[key]; !exists {
+			index.remove(key, nil)
+		}
+	}
+	for key, data := range documents {
+		if hash, indexed := index.Hashes[key]; !indexed || hash != documentHash(data) {
+			index.remove(key, nil)
+			index.add(key, data)
+		}
+	}
+}
+
+// search scores the documents holding any term of the query with BM25, best first
+func (index *textIndex) search(query string) []TextResult {
+	count := float64(len(index.Lengths))
+	if count == 0 {
+		return nil
+	}
+	averageLength := float64(index.Total) / count
+
+	scores := make(map[string]float64)
+	seen := make(map[string]bool)
+	for _, term := range tokenize(query) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+
+		postings := index.Postings[term]
+		matching := float64(len(postings))
+		idf := math.Log(1 + (count-matching+0.5)/(matching+0.5))
+		for key, frequency := range postings {
+			tf := float64(frequency)
+			length := float64(index.Lengths[key])
+			scores[key] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*length/averageLength))
+		}
+	}
+
+	results := make([]TextResult, 0, len(scores))
+	for key, score := range scores {
+		results = append(results, TextResult{Id: key, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Id < results[j].Id
+	})
+	return results
+}
+
+// textPath returns the path of the text index file that sits next to the database file
+func (db *Database) textPath() string {
+	return db.filename + ".fts"
+}
+
+// saveTextIndex writes the text index file, or removes it if the collection has no text index.
+// It is written after every checkpoint; entries for changes logged since are picked up again by
+// sync when the collection is opened. The caller must hold the file lock.
+func (db *Database) saveTextIndex() error {
+	if db.textIndex == nil {
+		if err := os.Remove(db.textPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := msgpack.Marshal(db.textIndex)
+	if err != nil {
+		return err
+	}
+	compressedData, err := util.Compress(data)
+	if err != nil {
+		return err
+	}
+	sealed, err := encrypt(db.dataKey, compressedData, textAAD)
+	if err != nil {
+		return err
+	}
+
+	return util.WriteFileAtomic(db.textPath(), sealed, 0644, "")
+}
+
+// loadTextIndex reads the text index file of a collection that declares a text index and brings it
+// up to date with the documents. An index that is missing, unreadable or for other fields is built
+// again from scratch.
+func (db *Database) loadTextIndex(spec TextIndexSpec) {
+	index, err := db.readTextIndex()
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			util.Warn(fmt.Sprintf("Rebuilding text index of '%s': %v", db.filename, err))
+		}
+		index = newTextIndex(spec)
+	}
+	if strings.Join(index.Spec.Fields, "\x00") != strings.Join(spec.Fields, "\x00") {
+		index = newTextIndex(spec)
+	}
+
+	index.sync(db.documents)
+	db.textIndex = index
+}
+
+// readTextIndex decrypts and decodes the text index file
+func (db *Database) readTextIndex() (*textIndex, error) {
+	sealed, err := os.ReadFile(db.textPath())
+	if err != nil {
+		return nil, err
+	}
+	if db.dataKey == nil {
+		return nil, errors.New("collection has no data key")
+	}
+
+	compressedData, err := decrypt(db.dataKey, sealed, textAAD)
+	if err != nil {
+		return nil, err
+	}
+	data, err := util.Decompress(compressedData)
+	if err != nil {
+		return nil, err
+	}
+
+	index := newTextIndex(TextIndexSpec{})
+	if err := msgpack.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// TextIndex returns the text index declared on the collection, or nil if there is none
+func (db *Database) TextIndex() *TextIndexSpec {
+	db.indexLock.RLock()
+	defer db.indexLock.RUnlock()
+
+	return db.textIndexSpec()
+}
+
+// textIndexSpec returns the declared text index; the caller must hold docsLock or indexLock
+func (db *Database) textIndexSpec() *TextIndexSpec {
+	if db.textIndex == nil {
+		return nil
+	}
+	spec := db.textIndex.Spec
+	return &spec
+}
+
+// CreateTextIndex declares the text index of the collection and builds it from the documents
+func (db *Database) CreateTextIndex(spec TextIndexSpec) error {
+	for _, field := range spec.Fields {
+		for _, segment := range strings.Split(field, ".") {
+			if segment == "" || strings.HasPrefix(segment, "$") {
+				return fmt.Errorf("%w: '%s' is not a field path", ErrInvalidIndex, field)
+			}
+		}
+	}
+
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return db.loadErr
+	}
+	if db.textIndex != nil {
+		return fmt.Errorf("%w: the collection already has a text index", ErrIndexExists)
+	}
+
+	index := newTextIndex(spec)
+	index.sync(db.documents)
+
+	db.indexLock.Lock()
+	db.textIndex = index
+	db.indexLock.Unlock()
+
+	if err := db.saveSettings(); err != nil {
+		db.indexLock.Lock()
+		db.textIndex = nil
+		db.indexLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// DropTextIndex removes the text index of the collection
+func (db *Database) DropTextIndex() error {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return db.loadErr
+	}
+	index := db.textIndex
+	if index == nil {
+		return fmt.Errorf("%w: the collection has no text index", ErrIndexNotFound)
+	}
+
+	db.indexLock.Lock()
+	db.textIndex = nil
+	db.indexLock.Unlock()
+
+	if err := db.saveSettings(); err != nil {
+		db.indexLock.Lock()
+		db.textIndex = index
+		db.indexLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// SearchText returns the documents matching a free text query, best first, and how many matched
+// in all. Documents match if they hold any of the query's words after stemming, and are ranked
+// with BM25. limit caps the number of results, unless it is 0.
+func (db *Database) SearchText(query string, limit int) ([]TextResult, int, error) {
+	db.docsLock.RLock()
+	defer db.docsLock.RUnlock()
+
+	if db.loadErr != nil {
+		return nil, 0, db.loadErr
+	}
+	if len(tokenize(query)) == 0 {
+		return nil, 0, fmt.Errorf("%w: the query has no words to search for", ErrInvalidQuery)
+	}
+
+	db.indexLock.RLock()
+	defer db.indexLock.RUnlock()
+
+	if db.textIndex == nil {
+		return nil, 0, fmt.Errorf("%w: the collection has no text index", ErrIndexNotFound)
+	}
+
+	results := db.textIndex.search(query)
+	live := results[:0]
+	now := time.Now()
+	for _, result := range results {
+		if !db.expired(result.Id, now) {
+			live = append(live, result)
+		}
+	}
+	results = live
+	total := len(results)
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	for i := range results {
+		results[i].Data = db.documents[results[i].Id]
+	}
+	return results, total, nil
+}
@@ -0,0 +1,271 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestStem runs examples from the paper describing the Porter stemmer, one or more per rule
+func TestStem(t *testing.T) {
+	tests := map[string]string{
+		// Step 1a
+		"caresses": "caress", "ponies": "poni", "ties": "ti", "caress": "caress", "cats": "cat",
+		// Step 1b
+		"feed": "feed", "agreed": "agre", "plastered": "plaster", "bled": "bled", "motoring": "motor",
+		"sing": "sing", "conflated": "conflat", "troubled": "troubl", "sized": "size", "hopping": "hop",
+		"tanned": "tan", "falling": "fall", "hissing": "hiss", "fizzed": "fizz", "failing": "fail",
+		"filing": "file",
+		// Step 1c
+		"happy": "happi", "sky": "sky",
+		// Step 2
+		"relational": "relat", "conditional": "condit", "rational": "ration", "valenci": "valenc",
+		"digitizer": "digit", "conformabli": "conform", "radicalli": "radic", "differentli": "differ",
+		"vileli": "vile", "analogousli": "analog", "vietnamization": "vietnam", "predication": "predic",
+		"operator": "oper", "feudalism": "feudal", "decisiveness": "decis", "hopefulness": "hope",
+		"callousness": "callous", "formaliti": "formal", "sensitiviti": "sensit", "sensibiliti": "sensibl",
+		// Step 3
+		"triplicate": "triplic", "formative": "form", "formalize": "formal", "electriciti": "electr",
+		"electrical": "electr", "hopeful": "hope", "goodness": "good",
+		// Step 4
+		"revival": "reviv", "allowance": "allow", "inference": "infer", "airliner": "airlin",
+		"gyroscopic": "gyroscop", "adjustable": "adjust", "defensible": "defens", "irritant": "irrit",
+		"replacement": "replac", "adjustment": "adjust", "dependent": "depend", "adoption": "adopt",
+		"homologou": "homolog", "communism": "commun", "activate": "activ", "angulariti": "angular",
+		"homologous": "homolog", "effective": "effect", "bowdlerize": "bowdler",
+		// Step 5
+		"probate": "probat", "rate": "rate", "cease": "ceas", "controll": "control", "roll": "roll",
+		// Words that are not lowercase ASCII are kept
+		"naïve": "naïve", "2fa": "2fa",
+	}
+
+	for word, want := range tests {
+		if got := stem(word); got != want {
+			t.Errorf("stem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Phishing e-mails were reported", []string{"phish", "e", "mail", "report"}},
+		{"The user and the admin", []string{"user", "admin"}},
+		{"CVE-2024-3094, in xz!", []string{"cve", "2024", "3094", "xz"}},
+		{"of the and", []string{}},
+	}
+
+	for _, test := range tests {
+		if got := tokenize(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+// textDocuments are alerts searched by the tests below
+var textDocuments = map[string]string{
+	"a1": `{"title":"Phishing email","body":"A phishing email was reported by finance"}`,
+	"a2": `{"title":"Phished account","body":"The account was phished and used to send spam"}`,
+	"a3": `{"title":"Malware","body":"Malware found on a laptop after a phishing campaign, malware removed"}`,
+	"a4": `{"title":"Disk full","body":"The disk of the backup server is full"}`,
+	"a5": `{"title":"Spam","body":"Spam spam spam"}`,
+	"a6": `{"title":"Login","body":"Failed logins from an unknown country","tags":["phishing"]}`,
+}
+
+// textCollection returns a collection holding textDocuments with a text index over fields
+func textCollection(t *testing.T, fields ...string) *Database {
+	t.Helper()
+
+	db := LoadDB(filepath.Join(t.TempDir(), "alerts.qdb"), testKeys("secret"))
+	for key, data := range textDocuments {
+		if err := db.CreateDocument(key, json.RawMessage(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CreateTextIndex(TextIndexSpec{Fields: fields}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// bm25 scores a document by hand, given for each query term how often it occurs in the document
+// and in how many documents, along with the length of the document and the collection's statistics
+func bm25(frequencies, matching []int, length, documents, totalLength int) float64 {
+	averageLength := float64(totalLength) / float64(documents)
+	score := 0.0
+	for i, frequency := range frequencies {
+		idf := math.Log(1 + (float64(documents-matching[i])+0.5)/(float64(matching[i])+0.5))
+		tf := float64(frequency)
+		score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(length)/averageLength))
+	}
+	return score
+}
+
+func TestSearchText(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+		query  string
+		limit  int
+		want   []string // keys of the results in order
+		total  int
+	}{
+		{"stemmed words match each other", []string{"title", "body"}, "phishing", 0, []string{"a1", "a2", "a3"}, 3},
+		{"any word matches", []string{"title", "body"}, "disk spam", 0, []string{"a4", "a5", "a2"}, 3},
+		{"stop words are ignored", []string{"title", "body"}, "the malware", 0, []string{"a3"}, 1},
+		{"limit keeps the best", []string{"title", "body"}, "phished", 2, []string{"a1", "a2"}, 3},
+		{"only indexed fields are searched", []string{"title"}, "phishing", 0, []string{"a1", "a2"}, 2},
+		{"every string without fields", nil, "phishing", 0, []string{"a1", "a2", "a6", "a3"}, 4},
+		{"no match", []string{"title", "body"}, "ransomware", 0, []string{}, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := textCollection(t, test.fields...)
+
+			results, total, err := db.SearchText(test.query, test.limit)
+			if err != nil {
+				t.Fatalf("SearchText: %v", err)
+			}
+			got := []string{}
+			for _, result := range results {
+				got = append(got, result.Id)
+				if string(result.Data) != textDocuments[result.Id] {
+					t.Errorf("%s came back as %s", result.Id, result.Data)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) || total != test.total {
+				t.Errorf("SearchText(%q) = %v of %d, want %v of %d", test.query, got, total, test.want, test.total)
+			}
+		})
+	}
+}
+
+func TestSearchTextScores(t *testing.T) {
+	db := textCollection(t, "title", "body")
+
+	// The terms of each document after tokenizing: a1 has 6, a2 7, a3 8, a4 6, a5 4 and a6 5
+	const documents, totalLength = 6, 36
+
+	results, _, err := db.SearchText("spam malware", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// spam is in a2 once and in a5 four times; malware is in a3 three times
+	want := map[string]float64{
+		"a5": bm25([]int{4}, []int{2}, 4, documents, totalLength),
+		"a3": bm25([]int{3}, []int{1}, 8, documents, totalLength),
+		"a2": bm25([]int{1}, []int{2}, 7, documents, totalLength),
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, result := range results {
+		if math.Abs(result.Score-want[result.Id]) > 1e-9 {
+			t.Errorf("%s scored %v, want %v", result.Id, result.Score, want[result.Id])
+		}
+		if i > 0 && result.Score > results[i-1].Score {
+			t.Errorf("%s scored more than %s before it", result.Id, results[i-1].Id)
+		}
+	}
+}
+
+func TestSearchTextErrors(t *testing.T) {
+	db := LoadDB(filepath.Join(t.TempDir(), "alerts.qdb"), testKeys("secret"))
+	if err := db.CreateDocument("a1", json.RawMessage(textDocuments["a1"])); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := db.SearchText("phishing", 0); !errors.Is(err, ErrIndexNotFound) {
+		t.Errorf("search without a text index failed with %v, want %v", err, ErrIndexNotFound)
+	}
+	if err := db.CreateTextIndex(TextIndexSpec{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.SearchText("the of ...", 0); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("search without words failed with %v, want %v", err, ErrInvalidQuery)
+	}
+	if err := db.CreateTextIndex(TextIndexSpec{}); !errors.Is(err, ErrIndexExists) {
+		t.Errorf("second text index failed with %v, want %v", err, ErrIndexExists)
+	}
+	if err := db.CreateTextIndex(TextIndexSpec{Fields: []string{"a..b"}}); err == nil {
+		t.Error("text index over an invalid path was created")
+	}
+}
+
+func TestTextIndexSyncOnLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		// change alters the files of the collection after its .qdb.fts file was written
+		change func(t *testing.T, db *Database)
+	}{
+		{"intact index file", func(t *testing.T, db *Database) {}},
+		{
+			name: "changes logged after the index file",
+			change: func(t *testing.T, db *Database) {
+				if _, err := db.UpdateDocument("a4", json.RawMessage(`{"title":"Phishing","body":"Phishing kit on the backup server"}`)); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.DeleteDocument("a1"); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.CreateDocument("a7", json.RawMessage(`{"title":"Phishing test","body":"Quarterly phishing test"}`)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "missing index file",
+			change: func(t *testing.T, db *Database) {
+				if err := os.Remove(db.textPath()); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "unreadable index file",
+			change: func(t *testing.T, db *Database) {
+				data := readFile(t, db.textPath())
+				data[len(data)-1] ^= 0xff
+				if err := os.WriteFile(db.textPath(), data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := textCollection(t, "title", "body")
+
+			// Closing checkpoints the collection, which writes the index file
+			if err := db.close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(db.textPath()); err != nil {
+				t.Fatalf("no text index file after a checkpoint: %v", err)
+			}
+			db = LoadDB(db.filename, db.keys)
+			test.change(t, db)
+
+			reloaded := LoadDB(db.filename, db.keys)
+			if reloaded.loadErr != nil {
+				t.Fatalf("LoadDB: %v", reloaded.loadErr)
+			}
+
+			// The index matches one built from scratch over the documents as they are now
+			want := newTextIndex(TextIndexSpec{Fields: []string{"title", "body"}})
+			want.sync(reloaded.documents)
+			if !reflect.DeepEqual(reloaded.textIndex, want) {
+				t.Errorf("loaded text index differs from one built from the documents:\n%+v\nwant\n%+v", reloaded.textIndex, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package database
+
+import (
+	"CyberDefenseEd/QuadDB/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidExpiry = errors.New("invalid expires_at")
+	ErrInvalidTTL    = errors.New("invalid TTL")
+)
+
+// ExpiresField is the top-level field of a document that holds when it expires
+const ExpiresField = "expires_at"
+
+// DefaultReapInterval is how often expired documents are removed when no interval is configured
+const DefaultReapInterval = time.Minute
+
+// expiryLayout is how default expiries are written into documents
+const expiryLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// parseExpiry reads the value of an expires_at field: an RFC 3339 time, a Unix time in seconds, or
+// null for a document that never expires. set is false for null.
+func parseExpiry(value interface{}) (expiry time.Time, set bool, err error) {
+	switch value := value.(type) {
+	case nil:
+		return time.Time{}, false, nil
+	case string:
+		expiry, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("%w: '%s' is not an RFC 3339 time", ErrInvalidExpiry, value)
+		}
+		return expiry, true, nil
+	case json.Number:
+		seconds, err := value.Float64()
+		if err != nil || math.Abs(seconds) > 1<<53 {
+			return time.Time{}, false, fmt.Errorf("%w: %s is not a Unix time", ErrInvalidExpiry, value)
+		}
+		whole := math.Floor(seconds)
+		return time.Unix(int64(whole), int64((seconds-whole)*1e9)), true, nil
+	default:
+		return time.Time{}, false, fmt.Errorf("%w: must be an RFC 3339 time, a Unix time in seconds or null", ErrInvalidExpiry)
+	}
+}
+
+// documentExpiry returns when a document expires; set is false for documents that do not. A value
+// that cannot be read as a time is ignored, as it is never let in by a write.
+func documentExpiry(data json.RawMessage) (expiry time.Time, set bool) {
+	document, ok := decodedDocument(data)
+	object, isObject := document.(map[string]interface{})
+	if !ok || !isObject {
+		return time.Time{}, false
+	}
+
+	expiry, set, err := parseExpiry(object[ExpiresField])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return expiry, set
+}
+
+// prepareWrite readies a write of documents sent by a client, which unlike replays and rollbacks
+// must follow the settings of the collection: documents get the default expiry and must match the
+// schema. earlier holds the documents written before record in the same batch, nil for those it
+// deletes. The caller must hold docsLock.
+func (db *Database) prepareWrite(record *walRecord, earlier map[string]json.RawMessage) error {
+	if err := db.stampExpiry(record, earlier); err != nil {
+		return err
+	}
+	return db.checkSchema(*record)
+}
+
+// stampExpiry checks the expires_at of the documents record puts. Those without one keep the
+// expiry of the version they replace, or get the default expiry of the collection if they are
+// new, so updating a document never extends its life. A null expires_at keeps a document from
+// expiring.
+func (db *Database) stampExpiry(record *walRecord, earlier map[string]json.RawMessage) error {
+	if record.Op == walOpBatch {
+		written := make(map[string]json.RawMessage, len(earlier)+len(record.Records))
+		for key, data := range earlier {
+			written[key] = data
+		}
+		for i := range record.Records {
+			nested := &record.Records[i]
+			if err := db.stampExpiry(nested, written); err != nil {
+				return err
+			}
+			written[nested.Key] = nested.Data
+		}
+		return nil
+	}
+	if record.Op != walOpPut {
+		return nil
+	}
+
+	document, ok := decodedDocument(record.Data)
+	object, isObject := document.(map[string]interface{})
+	if !ok || !isObject {
+		return nil
+	}
+
+	if value, present := object[ExpiresField]; present {
+		if _, _, err := parseExpiry(value); err != nil {
+			return fmt.Errorf("document '%s': %w", record.Key, err)
+		}
+		return nil
+	}
+
+	previous, replaced := db.replacedObject(record.Key, earlier)
+	switch value, present := previous[ExpiresField]; {
+	case replaced && present:
+		object[ExpiresField] = value
+	case !replaced && db.ttl > 0:
+		object[ExpiresField] = time.Now().Add(db.ttl).UTC().Format(expiryLayout)
+	default:
+		return nil
+	}
+
+	data, err := encodeJSON(object)
+	if err != nil {
+		return err
+	}
+	record.Data = data
+	return nil
+}
+
+// replacedObject returns the document a write of key replaces, if it replaces one: the version
+// written earlier in the same batch, or else the stored one unless it has expired. The document is
+// nil if it is not an object. The caller must hold docsLock.
+func (db *Database) replacedObject(key string, earlier map[string]json.RawMessage) (map[string]interface{}, bool) {
+	data, pending := earlier[key]
+	if !pending {
+		var exists bool
+		if data, exists = db.document(key); !exists {
+			return nil, false
+		}
+	}
+	if data == nil {
+		return nil, false
+	}
+
+	document, _ := decodedDocument(data)
+	object, _ := document.(map[string]interface{})
+	return object, true
+}
+
+// trackExpiries records when the documents written by record expire; the caller must hold docsLock
+func (db *Database) trackExpiries(record walRecord) {
+	switch record.Op {
+	case walOpPut:
+		if expiry, set := documentExpiry(record.Data); set {
+			db.expiries[record.Key] = expiry
+		} else {
+			delete(db.expiries, record.Key)
+		}
+	case walOpDelete:
+		delete(db.expiries, record.Key)
+	case walOpBatch:
+		for _, nested := range record.Records {
+			db.trackExpiries(nested)
+		}
+	}
+}
+
+// loadExpiries records when every loaded document expires
+func (db *Database) loadExpiries() {
+	db.expiries = make(map[string]time.Time)
+	for key, data := range db.documents {
+		if expiry, set := documentExpiry(data); set {
+			db.expiries[key] = expiry
+		}
+	}
+}
+
+// expired reports whether a document has expired by now, whether or not the reaper has removed it
+// yet; the caller must hold docsLock
+func (db *Database) expired(key string, now time.Time) bool {
+	expiry, set := db.expiries[key]
+	return set && !now.Before(expiry)
+}
+
+// document returns a document that has not expired; the caller must hold docsLock
+func (db *Database) document(key string) (json.RawMessage, bool) {
+	data, exists := db.documents[key]
+	if !exists || db.expired(key, time.Now()) {
+		return nil, false
+	}
+	return data, true
+}
+
+// liveDocuments returns the documents that have not expired; the caller must hold docsLock
+func (db *Database) liveDocuments() map[string]json.RawMessage {
+	if len(db.expiries) == 0 {
+		return db.documents
+	}
+
+	now := time.Now()
+	documents := make(map[string]json.RawMessage, len(db.documents))
+	for key, data := range db.documents {
+		if !db.expired(key, now) {
+			documents[key] = data
+		}
+	}
+	return documents
+}
+
+// TTL returns how long documents created without an expires_at live, or 0 if they do not expire
+func (db *Database) TTL() time.Duration {
+	db.docsLock.RLock()
+	defer db.docsLock.RUnlock()
+
+	return db.ttl
+}
+
+// SetTTL sets how long documents created from now on without an expires_at live, and 0 removes the
+// default. Documents already stored keep the expiry they were written with.
+func (db *Database) SetTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		return fmt.Errorf("%w: %s is negative", ErrInvalidTTL, ttl)
+	}
+
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return db.loadErr
+	}
+
+	previous := db.ttl
+	db.ttl = ttl
+	if err := db.saveSettings(); err != nil {
+		db.ttl = previous
+		return err
+	}
+	return nil
+}
+
+// RemoveExpired deletes the documents that have expired, along with their index entries, and
+// returns how many it deleted
+func (db *Database) RemoveExpired() (int, error) {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return 0, db.loadErr
+	}
+
+	now := time.Now()
+	var keys []string
+	for key := range db.expiries {
+		if db.expired(key, now) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	sort.Strings(keys)
+
+	records := make([]walRecord, len(keys))
+	for i, key := range keys {
+		records[i] = walRecord{Op: walOpDelete, Key: key}
+	}
+	if err := db.writeBatch(records); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// StartReaper removes expired documents from every collection every interval, or every
+// DefaultReapInterval if it is 0, until stop is called
+func (registry *Registry) StartReaper(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultReapInterval
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				registry.reap()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// reap removes expired documents from every collection, opening those that are not open yet
+func (registry *Registry) reap() {
+	for _, name := range registry.Names() {
+		// Like API writes, wait out a key rotation rewriting the collection instead of racing it
+		release := registry.Hold()
+		removed, err := registry.removeExpired(name)
+		release()
+		switch {
+		case errors.Is(err, ErrCollectionNotFound), errors.Is(err, ErrClosed), errors.Is(err, ErrShredded):
+		case err != nil:
+			util.Warn(fmt.Sprintf("Failed to remove expired documents from '%s': %v", name, err))
+		case removed > 0:
+			util.Info(fmt.Sprintf("Removed %d expired documents from '%s'", removed, name))
+		}
+	}
+}
+
+// removeExpired removes the expired documents of the collection called name
+func (registry *Registry) removeExpired(name string) (int, error) {
+	db, err := registry.Get(name)
+	if err != nil {
+		return 0, err
+	}
+	return db.RemoveExpired()
+}
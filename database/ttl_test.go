@@ -0,0 +1,354 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// expiryDocuments expire in every way there is, or never
+var expiryDocuments = map[string]string{
+	"past":       `{"kind":"session","expires_at":"2020-01-01T00:00:00Z"}`,
+	"past-unix":  `{"kind":"session","expires_at":1577836800}`,
+	"future":     `{"kind":"session","expires_at":"2099-01-01T00:00:00Z"}`,
+	"never":      `{"kind":"session","expires_at":null}`,
+	"no-expiry":  `{"kind":"session"}`,
+	"not-object": `["expires_at"]`,
+}
+
+// expiresAt returns the expires_at field of a stored document, and whether it has one
+func expiresAt(t *testing.T, db *Database, key string) (interface{}, bool) {
+	t.Helper()
+
+	data, err := db.ReadDocument(key)
+	if err != nil {
+		t.Fatalf("ReadDocument(%s): %v", key, err)
+	}
+	document, err := decodeJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, present := document.(map[string]interface{})[ExpiresField]
+	return value, present
+}
+
+func TestParseExpiry(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		set     bool
+		wantErr bool
+	}{
+		{`null`, time.Time{}, false, false},
+		{`"2025-06-01T12:00:00Z"`, time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC), true, false},
+		{`"2025-06-01T14:00:00.5+02:00"`, time.Date(2025, 6, 1, 12, 0, 0, 5e8, time.UTC), true, false},
+		{`1748779200`, time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC), true, false},
+		{`1748779200.25`, time.Date(2025, 6, 1, 12, 0, 0, 25e7, time.UTC), true, false},
+		{`"2025-06-01"`, time.Time{}, false, true},
+		{`"tomorrow"`, time.Time{}, false, true},
+		{`true`, time.Time{}, false, true},
+		{`{"at":1}`, time.Time{}, false, true},
+		{`1e300`, time.Time{}, false, true},
+	}
+
+	for _, test := range tests {
+		value, err := decodeJSON([]byte(test.value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, set, err := parseExpiry(value)
+		if test.wantErr {
+			if !errors.Is(err, ErrInvalidExpiry) {
+				t.Errorf("parseExpiry(%s) failed with %v, want %v", test.value, err, ErrInvalidExpiry)
+			}
+			continue
+		}
+		if err != nil || set != test.set || !got.Equal(test.want) {
+			t.Errorf("parseExpiry(%s) = %v, %v, %v, want %v, %v", test.value, got, set, err, test.want, test.set)
+		}
+	}
+}
+
+func TestExpiredDocumentsAreHidden(t *testing.T) {
+	db := LoadDB(filepath.Join(t.TempDir(), "sessions.qdb"), testKeys("secret"))
+	if _, err := db.CreateIndex(IndexSpec{Fields: []string{"kind"}, CaseSensitive: true}); err != nil {
+		t.Fatal(err)
+	}
+	for key, data := range expiryDocuments {
+		if err := db.CreateDocument(key, json.RawMessage(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	live := []string{"future", "never", "no-expiry", "not-object"}
+
+	// Until the reaper runs the expired documents are still stored, but nothing reads them
+	for _, key := range []string{"past", "past-unix"} {
+		if _, exists := db.documents[key]; !exists {
+			t.Fatalf("%s was removed before the reaper ran", key)
+		}
+		if _, err := db.ReadDocument(key); !errors.Is(err, ErrDocumentNotFound) {
+			t.Errorf("reading %s failed with %v, want %v", key, err, ErrDocumentNotFound)
+		}
+		if _, err := db.UpdateDocument(key, json.RawMessage(`{}`)); !errors.Is(err, ErrDocumentNotFound) {
+			t.Errorf("updating %s failed with %v, want %v", key, err, ErrDocumentNotFound)
+		}
+	}
+	if count, err := db.CountDocuments(); err != nil || count != len(live) {
+		t.Errorf("CountDocuments = %d, %v, want %d", count, err, len(live))
+	}
+	if got := findPages(t, db, FindOptions{}, nil); !reflect.DeepEqual(got, [][]string{live}) {
+		t.Errorf("Find returned %v, want %v", got, live)
+	}
+
+	query, err := ParseQuery([]byte(`{"kind":"session"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.Find(query, FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 3 || !reflect.DeepEqual(result.Plan.Indexes, []string{"kind"}) {
+		t.Errorf("indexed Find found %d documents with %v, want 3 with the kind index", result.Total, result.Plan.Indexes)
+	}
+
+	// An expired document's key can be taken again
+	if err := db.CreateDocument("past", json.RawMessage(`{"kind":"token"}`)); err != nil {
+		t.Errorf("creating over an expired document: %v", err)
+	}
+
+	removed, err := db.RemoveExpired()
+	if err != nil || removed != 1 {
+		t.Fatalf("RemoveExpired = %d, %v, want 1", removed, err)
+	}
+	if _, exists := db.documents["past-unix"]; exists {
+		t.Error("RemoveExpired left the expired document stored")
+	}
+	result, err = db.Find(query, FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Plan.Examined != 3 {
+		t.Errorf("the kind index still has %d entries for sessions, want 3", result.Plan.Examined)
+	}
+}
+
+func TestStampExpiry(t *testing.T) {
+	const ttl = time.Hour
+	db := LoadDB(filepath.Join(t.TempDir(), "sessions.qdb"), testKeys("secret"))
+	if err := db.SetTTL(ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	if err := db.CreateDocument("s1", json.RawMessage(`{"user":"alice"}`)); err != nil {
+		t.Fatal(err)
+	}
+	stamped, _ := expiresAt(t, db, "s1")
+	expiry, set, err := parseExpiry(stamped)
+	if err != nil || !set || expiry.Before(before.Add(ttl).Truncate(time.Millisecond)) || expiry.After(time.Now().Add(ttl)) {
+		t.Fatalf("created document expires at %v, want an hour from now", stamped)
+	}
+	// Expiries are stamped to the millisecond, so a renewed one would differ from here on
+	time.Sleep(2 * time.Millisecond)
+
+	// Writes that leave expires_at out keep the expiry; only one that sets it changes it
+	writes := []struct {
+		name  string
+		write func() error
+		want  interface{} // nil for the stamped expiry
+	}{
+		{"update", func() error {
+			_, err := db.UpdateDocument("s1", json.RawMessage(`{"user":"alice","seen":1}`))
+			return err
+		}, nil},
+		{"patch removing it", func() error {
+			patch, err := NewJSONPatch([]byte(`[{"op":"remove","path":"/expires_at"}]`))
+			if err != nil {
+				return err
+			}
+			_, err = db.PatchDocument("s1", patch, 0)
+			return err
+		}, nil},
+		{"bulk replace", func() error {
+			_, err := db.BulkWrite([]BulkOp{{Op: BulkReplace, Key: "s1", Data: json.RawMessage(`{"user":"alice"}`)}}, true)
+			return err
+		}, nil},
+		{"transaction", func() error {
+			tx := db.Begin()
+			if err := tx.Update("s1", json.RawMessage(`{"user":"alice","seen":2}`)); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}, nil},
+		{"update setting it", func() error {
+			_, err := db.UpdateDocument("s1", json.RawMessage(`{"user":"alice","expires_at":"2099-01-01T00:00:00Z"}`))
+			return err
+		}, "2099-01-01T00:00:00Z"},
+		{"update after setting it", func() error {
+			_, err := db.UpdateDocument("s1", json.RawMessage(`{"user":"alice"}`))
+			return err
+		}, "2099-01-01T00:00:00Z"},
+	}
+	for _, test := range writes {
+		if err := test.write(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		want := test.want
+		if want == nil {
+			want = stamped
+		}
+		if got, _ := expiresAt(t, db, "s1"); got != want {
+			t.Errorf("after the %s the document expires at %v, want %v", test.name, got, want)
+		}
+	}
+
+	// A null expires_at sticks too
+	if _, err := db.UpdateDocument("s1", json.RawMessage(`{"expires_at":null}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.UpdateDocument("s1", json.RawMessage(`{"user":"alice"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if value, present := expiresAt(t, db, "s1"); !present || value != nil {
+		t.Errorf("after an update the document expires at %v, want null", value)
+	}
+
+	// Documents stored before the collection had a TTL do not get one when they are updated
+	if err := db.SetTTL(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateDocument("old", json.RawMessage(`{"user":"bob"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTTL(ttl); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.UpdateDocument("old", json.RawMessage(`{"user":"bob","seen":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if value, present := expiresAt(t, db, "old"); present {
+		t.Errorf("updating a document without an expiry gave it %v", value)
+	}
+
+	// Replacing an expired document creates it afresh
+	if err := db.CreateDocument("gone", json.RawMessage(`{"expires_at":"2020-01-01T00:00:00Z"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateDocument("gone", json.RawMessage(`{"user":"carol"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := expiresAt(t, db, "gone"); value == "2020-01-01T00:00:00Z" || value == nil {
+		t.Errorf("document created over an expired one expires at %v, want a new expiry", value)
+	}
+
+	if err := db.CreateDocument("bad", json.RawMessage(`{"expires_at":"soon"}`)); !errors.Is(err, ErrInvalidExpiry) {
+		t.Errorf("writing an invalid expires_at failed with %v, want %v", err, ErrInvalidExpiry)
+	}
+}
+
+func TestStampExpiryInBatches(t *testing.T) {
+	db := LoadDB(filepath.Join(t.TempDir(), "sessions.qdb"), testKeys("secret"))
+	if err := db.SetTTL(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write later in the same batch keeps the expiry given by an earlier one, and one after a
+	// delete creates the document again
+	results, err := db.BulkWrite([]BulkOp{
+		{Op: BulkInsert, Key: "b1", Data: json.RawMessage(`{"expires_at":"2099-01-01T00:00:00Z"}`)},
+		{Op: BulkUpsert, Key: "b1", Data: json.RawMessage(`{"step":2}`)},
+		{Op: BulkInsert, Key: "b2", Data: json.RawMessage(`{"expires_at":"2099-01-01T00:00:00Z"}`)},
+		{Op: BulkDelete, Key: "b2"},
+		{Op: BulkUpsert, Key: "b2", Data: json.RawMessage(`{"step":3}`)},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Fatalf("%s: %v", result.Key, result.Err)
+		}
+	}
+	if value, _ := expiresAt(t, db, "b1"); value != "2099-01-01T00:00:00Z" {
+		t.Errorf("b1 expires at %v, want the expiry it was inserted with", value)
+	}
+	if value, _ := expiresAt(t, db, "b2"); value == "2099-01-01T00:00:00Z" || value == nil {
+		t.Errorf("b2 expires at %v, want the default expiry", value)
+	}
+
+	tx := db.Begin()
+	if _, err := tx.Create("t1", json.RawMessage(`{"expires_at":"2098-01-01T00:00:00Z"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Update("t1", json.RawMessage(`{"step":2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := expiresAt(t, db, "t1"); value != "2098-01-01T00:00:00Z" {
+		t.Errorf("t1 expires at %v, want the expiry it was created with", value)
+	}
+}
+
+func TestReaper(t *testing.T) {
+	dir := t.TempDir()
+	registry := NewRegistry(dir, testKeys("secret"))
+
+	// One collection stays open and the other is only on disk, as after a restart
+	for _, name := range []string{"open", "closed"} {
+		createCollection(t, registry, name, expiryDocuments)
+	}
+	if err := registry.Close("closed"); err != nil {
+		t.Fatal(err)
+	}
+
+	registry.reap()
+
+	for _, name := range []string{"open", "closed"} {
+		db, err := registry.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.docsLock.RLock()
+		_, past := db.documents["past"]
+		_, pastUnix := db.documents["past-unix"]
+		stored := len(db.documents)
+		db.docsLock.RUnlock()
+		if past || pastUnix || stored != len(expiryDocuments)-2 {
+			t.Errorf("%s holds %d documents after the reaper ran, want %d", name, stored, len(expiryDocuments)-2)
+		}
+	}
+
+	// The reaper runs on its own, and stops when told to
+	if err := registry.Close("closed"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := registry.Get("open")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateDocument("soon", json.RawMessage(`{"expires_at":"2020-01-01T00:00:00Z"}`)); err != nil {
+		t.Fatal(err)
+	}
+	stop := registry.StartReaper(10 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.docsLock.RLock()
+		_, exists := db.documents["soon"]
+		db.docsLock.RUnlock()
+		if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the reaper never removed the expired document")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	stop()
+}
@@ -0,0 +1,500 @@
+package database
+
+import (
+	"CyberDefenseEd/QuadDB/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	txOpCreate = "create"
+	txOpUpdate = "update"
+	txOpDelete = "delete"
+
+	// intentSuffix is the extension of the file a transaction over several collections is written
+	// to before it is applied
+	intentSuffix = ".qtx"
+)
+
+// ErrTxDone is returned when a transaction is used after it was committed or rolled back
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// txOp is a write queued in a transaction
+type txOp struct {
+	db   *Database
+	op   string
+	key  string
+	data json.RawMessage
+}
+
+// txState is shared by every collection taking part in a transaction
+type txState struct {
+	lock sync.Mutex
+	ops  []txOp
+	done bool
+}
+
+// Tx is a set of creates, updates and deletes over one or more collections that is applied all
+// together or not at all. Writes are queued until Commit and checked against the documents as they
+// are at that point, so nothing is visible to readers before the whole transaction is.
+type Tx struct {
+	db    *Database
+	state *txState
+}
+
+// txIntent lists the writes of a transaction over several collections. It is written before any of
+// them are applied, so a transaction interrupted halfway is completed when the collections are next
+// opened. Each collection's writes are sealed with its own data key.
+type txIntent struct {
+	ID          string            `msgpack:"id"`
+	Collections map[string][]byte `msgpack:"collections"`
+}
+
+// Begin starts a transaction on the collection. Other collections take part through Join.
+func (db *Database) Begin() *Tx {
+	return &Tx{db: db, state: &txState{}}
+}
+
+// Join returns the same transaction for writes to another collection. Committing or rolling back
+// through either one commits or rolls back the writes to both.
+func (tx *Tx) Join(db *Database) *Tx {
+	return &Tx{db: db, state: tx.state}
+}
+
+// queue adds a write to the transaction
+func (tx *Tx) queue(op txOp) error {
+	tx.state.lock.Lock()
+	defer tx.state.lock.Unlock()
+
+	if tx.state.done {
+		return ErrTxDone
+	}
+	tx.state.ops = append(tx.state.ops, op)
+	return nil
+}
+
+// Create queues a new document and returns its key, which is a new UUID if key is empty
+func (tx *Tx) Create(key string, data json.RawMessage) (string, error) {
+	if key == "" {
+		key = uuid.New().String()
+	}
+	if !json.Valid(data) {
+		return "", fmt.Errorf("document '%s' is not valid JSON", key)
+	}
+
+	return key, tx.queue(txOp{db: tx.db, op: txOpCreate, key: key, data: data})
+}
+
+// Update queues replacing an existing document
+func (tx *Tx) Update(key string, data json.RawMessage) error {
+	if !json.Valid(data) {
+		return fmt.Errorf("document '%s' is not valid JSON", key)
+	}
+
+	return tx.queue(txOp{db: tx.db, op: txOpUpdate, key: key, data: data})
+}
+
+// Delete queues removing an existing document
+func (tx *Tx) Delete(key string) error {
+	return tx.queue(txOp{db: tx.db, op: txOpDelete, key: key})
+}
+
+// Rollback discards the queued writes
+func (tx *Tx) Rollback() error {
+	tx.state.lock.Lock()
+	defer tx.state.lock.Unlock()
+
+	if tx.state.done {
+		return ErrTxDone
+	}
+	tx.state.done = true
+	tx.state.ops = nil
+	return nil
+}
+
+// Commit applies the queued writes and their index updates. If any write conflicts with the
+// documents, such as creating a key that exists or updating one that does not, or cannot be
+// persisted, none of them are applied.
+func (tx *Tx) Commit() error {
+	tx.state.lock.Lock()
+	defer tx.state.lock.Unlock()
+
+	if tx.state.done {
+		return ErrTxDone
+	}
+	tx.state.done = true
+	ops := tx.state.ops
+	tx.state.ops = nil
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	// Lock the collections in the same order every time, so concurrent transactions cannot deadlock
+	dbs := txCollections(ops)
+	for _, db := range dbs {
+		db.docsLock.Lock()
+		defer db.docsLock.Unlock()
+	}
+
+	batches, err := prepareTx(ops)
+	if err != nil {
+		return err
+	}
+
+	// Check expiries, schemas and unique indexes up front, so a transaction over several collections
+	// is not recorded only to be rolled back
+	for _, db := range dbs {
+		batch := walRecord{Op: walOpBatch, Records: batches[db]}
+		if err := db.prepareWrite(&batch, nil); err != nil {
+			return err
+		}
+		if err := db.checkUnique(batch); err != nil {
+			return err
+		}
+	}
+
+	if len(dbs) == 1 {
+		err = dbs[0].writeBatch(batches[dbs[0]])
+	} else {
+		err = commitIntent(dbs, batches)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		if op.op == txOpCreate {
+			LastUsedDB = op.key
+		}
+	}
+	LastUpdateTime = time.Now()
+	return nil
+}
+
+// txCollections returns the collections a transaction writes to, ordered by file name
+func txCollections(ops []txOp) []*Database {
+	seen := make(map[*Database]bool)
+	var dbs []*Database
+	for _, op := range ops {
+		if !seen[op.db] {
+			seen[op.db] = true
+			dbs = append(dbs, op.db)
+		}
+	}
+
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i].filename < dbs[j].filename
+	})
+	return dbs
+}
+
+// prepareTx checks every write against the documents and the writes queued before it, and turns
+// them into log records per collection. The caller must hold docsLock of every collection.
+func prepareTx(ops []txOp) (map[*Database][]walRecord, error) {
+	batches := make(map[*Database][]walRecord)
+	pending := make(map[*Database]map[string]bool)
+
+	for i, op := range ops {
+		if op.db.loadErr != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, op.db.loadErr)
+		}
+		if pending[op.db] == nil {
+			pending[op.db] = make(map[string]bool)
+		}
+
+		exists, queued := pending[op.db][op.key]
+		if !queued {
+			_, exists = op.db.document(op.key)
+		}
+
+		record := walRecord{Op: walOpPut, Key: op.key, Data: op.data}
+		switch op.op {
+		case txOpCreate:
+			if exists {
+				return nil, fmt.Errorf("operation %d: %w: '%s'", i, ErrDocumentExists, op.key)
+			}
+		case txOpUpdate, txOpDelete:
+			if !exists {
+				return nil, fmt.Errorf("operation %d: %w: '%s'", i, ErrDocumentNotFound, op.key)
+			}
+			if op.op == txOpDelete {
+				record = walRecord{Op: walOpDelete, Key: op.key}
+			}
+		}
+
+		pending[op.db][op.key] = record.Op == walOpPut
+		batches[op.db] = append(batches[op.db], record)
+	}
+
+	return batches, nil
+}
+
+// writeBatch persists records as a single log record, so they survive a crash all together or not
+// at all, and updates the index to match. The caller must hold docsLock.
+func (db *Database) writeBatch(records []walRecord) error {
+	batch := walRecord{Op: walOpBatch, Records: records}
+
+	previous := db.undoRecord(batch)
+	if err := db.write(batch); err != nil {
+		return err
+	}
+
+	db.indexLock.Lock()
+	defer db.indexLock.Unlock()
+
+	for _, record := range previous.Records {
+		if record.Op == walOpPut {
+			db.unindexDocument(record.Key, record.Data)
+		}
+		if data, exists := db.documents[record.Key]; exists {
+			// Documents that are not JSON objects have no fields to index
+			_ = db.indexDocument(record.Key, data)
+		}
+	}
+
+	return nil
+}
+
+// commitIntent applies a transaction over several collections. The writes are first recorded in an
+// intent file and then applied to each collection in turn. If one of them fails, the collections
+// written so far are rolled back; if even that fails, the collections are taken offline and the
+// transaction is completed from the intent file when they are next opened.
+// The caller must hold docsLock of every collection.
+func commitIntent(dbs []*Database, batches map[*Database][]walRecord) error {
+	// The intent records the revisions the writes commit at, so recovery can tell the collections
+	// the transaction already reached from the ones it did not
+	for _, db := range dbs {
+		db.stampRevisions(&walRecord{Op: walOpBatch, Records: batches[db]})
+	}
+
+	path, err := writeIntent(dbs, batches)
+	if err != nil {
+		return fmt.Errorf("could not record transaction: %w", err)
+	}
+
+	var undos []walRecord
+	for i, db := range dbs {
+		undo := db.undoRecord(walRecord{Op: walOpBatch, Records: batches[db]})
+
+		if err := db.writeBatch(batches[db]); err != nil {
+			var rollbackErrs []error
+			for j := i - 1; j >= 0; j-- {
+				if rollbackErr := dbs[j].writeBatch(undos[j].Records); rollbackErr != nil {
+					rollbackErrs = append(rollbackErrs, rollbackErr)
+				}
+			}
+			if len(rollbackErrs) > 0 {
+				return takeOffline(dbs, path, fmt.Errorf("%w, and rolling back failed: %w", err, errors.Join(rollbackErrs...)))
+			}
+
+			if removeErr := removeIntent(path); removeErr != nil {
+				return takeOffline(dbs, path, removeErr)
+			}
+			return err
+		}
+
+		undos = append(undos, undo)
+	}
+
+	if err := removeIntent(path); err != nil {
+		return takeOffline(dbs, path, err)
+	}
+	return nil
+}
+
+// takeOffline stops serving the collections of a transaction that is left half applied, so nothing
+// is written to them before the transaction is completed from its intent file on the next start.
+// The caller must hold docsLock of every collection.
+func takeOffline(dbs []*Database, path string, err error) error {
+	err = fmt.Errorf("transaction '%s' is incomplete and its collections are offline until the next start: %w", path, err)
+	util.Error(err.Error())
+
+	for _, db := range dbs {
+		db.loadErr = err
+	}
+	return err
+}
+
+// collectionName returns the name of the collection stored in the database file
+func (db *Database) collectionName() string {
+	return strings.TrimSuffix(filepath.Base(db.filename), ".qdb")
+}
+
+// intentAAD binds the sealed writes of a transaction to the transaction and the collection
+func intentAAD(id, collection string) []byte {
+	return []byte("QuadDB transaction " + id + " " + collection)
+}
+
+// writeIntent writes the intent file of a transaction into the data directory and returns its path.
+// The caller must hold docsLock of every collection.
+func writeIntent(dbs []*Database, batches map[*Database][]walRecord) (string, error) {
+	intent := txIntent{ID: uuid.New().String(), Collections: make(map[string][]byte, len(dbs))}
+
+	for _, db := range dbs {
+		if db.loadErr != nil {
+			return "", db.loadErr
+		}
+
+		// Collections that have no data key yet get one, so their writes can be sealed with it
+		if db.wrappedKey == nil {
+			lock := fileLock(db.filename)
+			lock.Lock()
+			err := db.checkpoint(db.documents)
+			lock.Unlock()
+			if err != nil {
+				return "", err
+			}
+		}
+
+		payload, err := msgpack.Marshal(batches[db])
+		if err != nil {
+			return "", err
+		}
+
+		sealed, err := encrypt(db.dataKey, payload, intentAAD(intent.ID, db.collectionName()))
+		if err != nil {
+			return "", err
+		}
+		intent.Collections[db.collectionName()] = sealed
+	}
+
+	data, err := msgpack.Marshal(intent)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(filepath.Dir(dbs[0].filename), "tx-"+intent.ID+intentSuffix)
+	if err := util.WriteFileAtomic(path, data, 0600, ""); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// removeIntent deletes the intent file of a transaction that was applied or rolled back in full
+func removeIntent(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return util.SyncDir(filepath.Dir(path))
+}
+
+// recoverTransactions completes every transaction whose intent file is still in the data directory.
+// Collections the transaction already reached are left as they are, and the rest are given the
+// writes at the revisions they were recorded with. The caller must hold the registry lock.
+func (registry *Registry) recoverTransactions() error {
+	paths, err := filepath.Glob(filepath.Join(registry.dataDir, "*"+intentSuffix))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, path := range paths {
+		if err := registry.recoverTransaction(path); err != nil {
+			errs = append(errs, fmt.Errorf("could not complete transaction '%s': %w", path, err))
+			continue
+		}
+		util.Warn(fmt.Sprintf("Completed interrupted transaction '%s'", path))
+	}
+
+	return errors.Join(errs...)
+}
+
+// recoverTransaction replays the writes of one intent file and removes it. The caller must hold
+// the registry lock.
+func (registry *Registry) recoverTransaction(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var intent txIntent
+	if err := msgpack.Unmarshal(data, &intent); err != nil {
+		return err
+	}
+
+	for name, sealed := range intent.Collections {
+		if err := ValidateCollectionName(name); err != nil {
+			return err
+		}
+
+		db, open := registry.open[name]
+		if !open {
+			db, err = registry.load(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := db.replayIntent(intent.ID, sealed); err != nil {
+			return fmt.Errorf("collection '%s': %w", name, err)
+		}
+	}
+
+	return removeIntent(path)
+}
+
+// replayIntent applies the writes an intent file holds for the collection, unless it already holds them
+func (db *Database) replayIntent(id string, sealed []byte) error {
+	db.docsLock.Lock()
+	defer db.docsLock.Unlock()
+
+	if db.loadErr != nil {
+		return db.loadErr
+	}
+
+	payload, err := decrypt(db.dataKey, sealed, intentAAD(id, db.collectionName()))
+	if err != nil {
+		return err
+	}
+
+	var records []walRecord
+	if err := msgpack.Unmarshal(payload, &records); err != nil {
+		return err
+	}
+
+	if db.holdsBatch(records) {
+		return nil
+	}
+	return db.writeBatch(records)
+}
+
+// holdsBatch reports whether the documents are already as a batch of an intent file leaves them:
+// every document it puts last is at the revision recorded for it, and every one it deletes last is
+// gone. A collection is written a batch at a time, so it holds either all of it or none of it.
+// Intents from before revisions were recorded are always replayed. The caller must hold docsLock.
+func (db *Database) holdsBatch(records []walRecord) bool {
+	last := make(map[string]walRecord, len(records))
+	for _, record := range records {
+		if record.Op == walOpPut && record.Rev == 0 {
+			return false
+		}
+		last[record.Key] = record
+	}
+
+	for key, record := range last {
+		_, exists := db.documents[key]
+		switch record.Op {
+		case walOpPut:
+			if !exists || db.revision(key) != record.Rev {
+				return false
+			}
+		case walOpDelete:
+			if exists {
+				return false
+			}
+		}
+	}
+	return true
+}
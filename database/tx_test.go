@@ -0,0 +1,161 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// crashCommit commits a transaction as Commit does over several collections, but stops after its
+// writes are applied to the first applied collections, as a crash would, leaving the intent file
+// behind. It returns the revision each document the transaction puts is recorded at.
+func crashCommit(t *testing.T, tx *Tx, applied int) map[string]map[string]uint64 {
+	t.Helper()
+
+	ops := tx.state.ops
+	dbs := txCollections(ops)
+	for _, db := range dbs {
+		db.docsLock.Lock()
+		defer db.docsLock.Unlock()
+	}
+
+	batches, err := prepareTx(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revisions := make(map[string]map[string]uint64)
+	for _, db := range dbs {
+		db.stampRevisions(&walRecord{Op: walOpBatch, Records: batches[db]})
+		revisions[db.collectionName()] = make(map[string]uint64)
+		for _, record := range batches[db] {
+			if record.Op == walOpPut {
+				revisions[db.collectionName()][record.Key] = record.Rev
+			}
+		}
+	}
+
+	if _, err := writeIntent(dbs, batches); err != nil {
+		t.Fatal(err)
+	}
+	for _, db := range dbs[:applied] {
+		if err := db.writeBatch(batches[db]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return revisions
+}
+
+// readFile returns the contents of a file, failing the test if it cannot be read
+func readFile(t *testing.T, filename string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRecoverTransaction(t *testing.T) {
+	tests := []struct {
+		name    string
+		applied int // collections the transaction reached before the crash
+	}{
+		{"no collection applied", 0},
+		{"half applied", 1},
+		{"fully applied", 2},
+	}
+
+	want := map[string]map[string]string{
+		"accounts": {"alice": `{"balance":70}`, "carol": `{"balance":5}`},
+		"ledger":   {"entry-1": `{"amount":30,"to":"bob"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			keys := testKeys("secret")
+			registry := NewRegistry(dir, keys)
+
+			accounts, err := registry.Open("accounts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ledger, err := registry.Open("ledger")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, data := range map[string]string{"alice": `{"balance":100}`, "bob": `{"balance":0}`} {
+				if err := accounts.CreateDocument(key, json.RawMessage(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ledger.CreateDocument("entry-0", json.RawMessage(`{"amount":0}`)); err != nil {
+				t.Fatal(err)
+			}
+
+			tx := accounts.Begin()
+			if err := tx.Update("alice", json.RawMessage(`{"balance":70}`)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Delete("bob"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Create("carol", json.RawMessage(`{"balance":5}`)); err != nil {
+				t.Fatal(err)
+			}
+			joined := tx.Join(ledger)
+			if err := joined.Delete("entry-0"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := joined.Create("entry-1", json.RawMessage(`{"amount":30,"to":"bob"}`)); err != nil {
+				t.Fatal(err)
+			}
+
+			revisions := crashCommit(t, tx, test.applied)
+
+			// Collections are written in order of their file names
+			reached := make(map[string][]byte)
+			for _, name := range []string{"accounts", "ledger"}[:test.applied] {
+				reached[name] = readFile(t, filepath.Join(dir, name+".qdb.wal"))
+			}
+
+			// The next start completes the transaction from its intent file
+			restarted := NewRegistry(dir, keys)
+			if err := restarted.OpenAll(); err != nil {
+				t.Fatal(err)
+			}
+			if intents, _ := filepath.Glob(filepath.Join(dir, "*"+intentSuffix)); len(intents) != 0 {
+				t.Errorf("intent files left after recovery: %v", intents)
+			}
+			for name, log := range reached {
+				if !bytes.Equal(readFile(t, filepath.Join(dir, name+".qdb.wal")), log) {
+					t.Errorf("%s was written again although the transaction had reached it", name)
+				}
+			}
+
+			for name, documents := range want {
+				db, err := restarted.Get(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := mustDocuments(t, db); !reflect.DeepEqual(got, documents) {
+					t.Errorf("%s = %v, want %v", name, got, documents)
+				}
+
+				// Collections the transaction already reached keep the revisions, and so the ETags,
+				// clients were given
+				for key, revision := range revisions[name] {
+					if _, got, err := db.ReadDocumentRevision(key); err != nil || got != revision {
+						t.Errorf("%s/%s is at revision %d (%v), want %d", name, key, got, err, revision)
+					}
+				}
+			}
+		})
+	}
+}
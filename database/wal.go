@@ -0,0 +1,296 @@
+package database
+
+import (
+	"CyberDefenseEd/QuadDB/util"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// walVersion is the current log layout, whose header carries the generation of the .qdb file it
+	// extends; version 1 logs hold AES-CBC records for legacy files
+	walVersion       = 2
+	walLegacyVersion = 1
+
+	// walCheckpointSize is the log size after which the log is folded back into the .qdb file
+	walCheckpointSize = 4 << 20
+
+	walOpPut    = "put"
+	walOpDelete = "del"
+	walOpBatch  = "batch"
+)
+
+// walMagic prefixes every write-ahead log file, followed by a single version byte and the generation
+var walMagic = []byte("QWAL")
+
+// walRecord is a single mutation stored in the write-ahead log
+type walRecord struct {
+	Op      string          `msgpack:"op"`
+	Key     string          `msgpack:"key"`
+	Data    json.RawMessage `msgpack:"data,omitempty"`
+	Rev     uint64          `msgpack:"rev,omitempty"`     // Revision a put gives the document; older records leave it out
+	Records []walRecord     `msgpack:"records,omitempty"` // Mutations of a batch, which are logged as one record
+}
+
+// fileLocks serializes access to a collection's .qdb and .wal files across Database instances
+var fileLocks sync.Map
+
+func fileLock(filename string) *sync.Mutex {
+	lock, _ := fileLocks.LoadOrStore(filename, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// lockFiles takes the file locks of several collections in order of their file names, so callers
+// locking the same files cannot deadlock, and returns a function that releases them
+func lockFiles(filenames ...string) (unlock func()) {
+	sorted := append([]string{}, filenames...)
+	sort.Strings(sorted)
+
+	var locks []*sync.Mutex
+	for i, filename := range sorted {
+		if i > 0 && filename == sorted[i-1] {
+			continue
+		}
+		lock := fileLock(filename)
+		lock.Lock()
+		locks = append(locks, lock)
+	}
+
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// walPath returns the path of the write-ahead log that sits next to the database file
+func (db *Database) walPath() string {
+	return db.filename + ".wal"
+}
+
+// commit persists a mutation that has already been applied to the in-memory documents by appending
+// it to the write-ahead log. The log is folded back into the .qdb file once it grows past
+// walCheckpointSize, or straight away when the collection has no usable .qdb file yet so that it
+// is picked up (or repaired) on the next start. Files from before envelope encryption are migrated
+// the same way. The caller must hold docsLock.
+func (db *Database) commit(record walRecord) error {
+	lock := fileLock(db.filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := os.Stat(db.filename); os.IsNotExist(err) || db.fromBackup || db.wrappedKey == nil {
+		return db.checkpoint(db.documents)
+	}
+
+	size, err := db.appendWAL(record)
+	if err != nil {
+		return err
+	}
+
+	if size >= walCheckpointSize {
+		return db.checkpoint(db.documents)
+	}
+
+	return nil
+}
+
+// checkpoint rewrites the database file from documents and empties the write-ahead log.
+// The caller must hold the file lock.
+func (db *Database) checkpoint(documents map[string]json.RawMessage) error {
+	if err := db.saveDocuments(documents); err != nil {
+		return err
+	}
+
+	err := os.Remove(db.walPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// walHeader returns the log header for the current generation, which also authenticates every record
+func (db *Database) walHeader() []byte {
+	header := append([]byte{}, walMagic...)
+	header = append(header, walVersion)
+	return binary.LittleEndian.AppendUint64(header, db.generation)
+}
+
+// appendWAL encrypts a record and appends it to the log, returning the size of the log afterwards.
+// Each record is framed as a little-endian length and CRC-32 of the encrypted payload.
+func (db *Database) appendWAL(record walRecord) (int64, error) {
+	header := db.walHeader()
+
+	payload, err := msgpack.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+
+	encryptedPayload, err := encrypt(db.dataKey, payload, header)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(db.walPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var frame []byte
+	if info.Size() == 0 {
+		frame = append(frame, header...)
+	} else {
+		existing := make([]byte, len(header))
+		if _, err := file.ReadAt(existing, 0); err != nil || !bytes.Equal(existing, header) {
+			return 0, fmt.Errorf("write-ahead log '%s' does not belong to generation %d of the database file", db.walPath(), db.generation)
+		}
+	}
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(encryptedPayload)))
+	frame = binary.LittleEndian.AppendUint32(frame, crc32.ChecksumIEEE(encryptedPayload))
+	frame = append(frame, encryptedPayload...)
+
+	if _, err := file.Write(frame); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+
+	return info.Size() + int64(len(frame)), nil
+}
+
+// replayWAL applies every intact record in the write-ahead log to documents. A torn record at the
+// end of the log, left behind by a crash halfway through an append, is truncated away, but a
+// damaged record with more of the log after it fails the load. A log left over from an earlier
+// generation, which happens when a crash hits between a checkpoint and the log being removed, is
+// already part of the .qdb file and is discarded. Over documents recovered from the .bak file, only
+// a log of the backup's own generation is replayed; any other fails the load, as the changes
+// between the two generations are in neither.
+// The caller must hold the file lock.
+func (db *Database) replayWAL(documents map[string]json.RawMessage) error {
+	data, err := os.ReadFile(db.walPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if len(data) <= len(walMagic) {
+		// The header itself was torn, so no record can have made it to disk
+		return os.Truncate(db.walPath(), 0)
+	}
+	if !bytes.Equal(data[:len(walMagic)], walMagic) {
+		return fmt.Errorf("invalid write-ahead log header in '%s'", db.walPath())
+	}
+
+	var header []byte
+	var stale bool
+	generation := "a legacy file"
+	switch data[len(walMagic)] {
+	case walLegacyVersion:
+		header = data[:len(walMagic)+1]
+		stale = !db.legacy
+	case walVersion:
+		headerSize := len(walMagic) + 1 + 8
+		if len(data) < headerSize {
+			return os.Truncate(db.walPath(), 0)
+		}
+		header = data[:headerSize]
+		logGeneration := binary.LittleEndian.Uint64(header[len(walMagic)+1:])
+		stale = db.legacy || logGeneration != db.generation
+		generation = fmt.Sprintf("generation %d", logGeneration)
+	default:
+		return fmt.Errorf("unsupported write-ahead log version %d in '%s'", data[len(walMagic)], db.walPath())
+	}
+
+	if stale && db.fromBackup {
+		return fmt.Errorf("%w: write-ahead log '%s' extends %s of the database file, but only generation %d could be recovered from '%s'; move the log aside to open the collection without the changes since then", ErrCorrupted, db.walPath(), generation, db.generation, db.backupPath())
+	}
+	if stale {
+		util.Warn(fmt.Sprintf("Discarding stale write-ahead log '%s', it is already part of '%s'", db.walPath(), db.filename))
+		return os.Remove(db.walPath())
+	}
+
+	offset := len(header)
+	for offset+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[offset : offset+4]))
+		checksum := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
+		if offset+8+size > len(data) {
+			break
+		}
+
+		encryptedPayload := data[offset+8 : offset+8+size]
+		if crc32.ChecksumIEEE(encryptedPayload) != checksum {
+			// Only the last record can have been torn by a crash; dropping a damaged one from the
+			// middle would silently drop every record after it too
+			if offset+8+size < len(data) {
+				return fmt.Errorf("%w: record at offset %d of write-ahead log '%s' fails its checksum with %d more bytes of log after it", ErrCorrupted, offset, db.walPath(), len(data)-offset-8-size)
+			}
+			break
+		}
+
+		var payload []byte
+		if header[len(walMagic)] == walLegacyVersion {
+			payload, err = decryptLegacy(db.dataKey, encryptedPayload)
+		} else {
+			payload, err = decrypt(db.dataKey, encryptedPayload, header)
+		}
+		if err != nil {
+			return err
+		}
+
+		var record walRecord
+		if err := msgpack.Unmarshal(payload, &record); err != nil {
+			return err
+		}
+		applyWALRecord(documents, db.revisions, record)
+
+		offset += 8 + size
+	}
+
+	if offset < len(data) {
+		util.Warn(fmt.Sprintf("Discarding %d bytes of torn write-ahead log in '%s'", len(data)-offset, db.walPath()))
+		return os.Truncate(db.walPath(), int64(offset))
+	}
+
+	return nil
+}
+
+// applyWALRecord replays a single logged mutation onto documents and their revisions. Puts logged
+// before revisions existed move the document on by one revision.
+func applyWALRecord(documents map[string]json.RawMessage, revisions map[string]uint64, record walRecord) {
+	switch record.Op {
+	case walOpPut:
+		revision := record.Rev
+		if revision == 0 {
+			revision = 1
+			if _, exists := documents[record.Key]; exists {
+				revision = max(revisions[record.Key], 1) + 1
+			}
+		}
+		documents[record.Key] = record.Data
+		revisions[record.Key] = revision
+	case walOpDelete:
+		delete(documents, record.Key)
+		delete(revisions, record.Key)
+	case walOpBatch:
+		for _, nested := range record.Records {
+			applyWALRecord(documents, revisions, nested)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// testKeys returns a keyring for key with Argon2id costs low enough for tests
+func testKeys(key string) *Keyring {
+	return NewKeyring(StaticKey(key), KDFParams{Time: 1, Memory: 64, Threads: 1})
+}
+
+// mustDocuments returns the documents of db, failing the test if they cannot be read
+func mustDocuments(t *testing.T, db *Database) map[string]string {
+	t.Helper()
+
+	documents, err := db.LoadDocuments()
+	if err != nil {
+		t.Fatalf("LoadDocuments: %v", err)
+	}
+
+	contents := make(map[string]string, len(documents))
+	for key, data := range documents {
+		contents[key] = string(data)
+	}
+	return contents
+}
+
+func TestReplayWAL(t *testing.T) {
+	tests := []struct {
+		name string
+		// crash leaves the files of the collection as a crash would, given the database and the
+		// contents its log had before it was checkpointed
+		crash func(t *testing.T, db *Database, log []byte)
+		want  map[string]string
+	}{
+		{
+			name:  "intact log",
+			crash: func(t *testing.T, db *Database, log []byte) {},
+			want:  map[string]string{"a": `{"v":1}`, "b": `{"v":2}`, "c": `{"v":3}`},
+		},
+		{
+			name: "torn last record",
+			crash: func(t *testing.T, db *Database, log []byte) {
+				if err := os.Truncate(db.walPath(), int64(len(log)-3)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"a": `{"v":1}`, "b": `{"v":2}`},
+		},
+		{
+			name: "torn record header",
+			crash: func(t *testing.T, db *Database, log []byte) {
+				torn := append(append([]byte{}, log...), 0x20, 0x00, 0x00)
+				if err := os.WriteFile(db.walPath(), torn, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"a": `{"v":1}`, "b": `{"v":2}`, "c": `{"v":3}`},
+		},
+		{
+			name: "bad checksum on the last record",
+			crash: func(t *testing.T, db *Database, log []byte) {
+				corrupted := append([]byte{}, log...)
+				corrupted[len(corrupted)-1] ^= 0xff
+				if err := os.WriteFile(db.walPath(), corrupted, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"a": `{"v":1}`, "b": `{"v":2}`},
+		},
+		{
+			// A crash between a checkpoint and removing the log leaves a log of the previous
+			// generation, whose records must not be replayed over later writes
+			name: "stale generation",
+			crash: func(t *testing.T, db *Database, log []byte) {
+				if err := db.close(); err != nil {
+					t.Fatal(err)
+				}
+
+				reopened := LoadDB(db.filename, db.keys)
+				if _, err := reopened.UpdateDocument("c", json.RawMessage(`{"v":4}`)); err != nil {
+					t.Fatal(err)
+				}
+				if err := reopened.close(); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.WriteFile(db.walPath(), log, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"a": `{"v":1}`, "b": `{"v":2}`, "c": `{"v":4}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys := testKeys("secret")
+			filename := filepath.Join(t.TempDir(), "events.qdb")
+
+			// The first write creates the .qdb file and the rest go to the log
+			db := LoadDB(filename, keys)
+			for _, document := range []Document{{"a", json.RawMessage(`{"v":1}`)}, {"b", json.RawMessage(`{"v":2}`)}, {"c", json.RawMessage(`{"v":3}`)}} {
+				if err := db.CreateDocument(document.Id, document.Data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			log, err := os.ReadFile(db.walPath())
+			if err != nil {
+				t.Fatalf("no write-ahead log after writes: %v", err)
+			}
+
+			test.crash(t, db, log)
+
+			reloaded := LoadDB(filename, keys)
+			if reloaded.loadErr != nil {
+				t.Fatalf("LoadDB: %v", reloaded.loadErr)
+			}
+			if got := mustDocuments(t, reloaded); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("documents = %v, want %v", got, test.want)
+			}
+
+			// Whatever was discarded is gone from disk, so the log takes new records again
+			if err := reloaded.CreateDocument("d", json.RawMessage(`{"v":5}`)); err != nil {
+				t.Fatalf("write after replay: %v", err)
+			}
+			test.want["d"] = `{"v":5}`
+			if got := mustDocuments(t, LoadDB(filename, keys)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("documents after another write = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWritesDoNotRereadFiles(t *testing.T) {
+	keys := testKeys("secret")
+	filename := filepath.Join(t.TempDir(), "events.qdb")
+
+	db := LoadDB(filename, keys)
+	for _, key := range []string{"a", "b"} {
+		if err := db.CreateDocument(key, json.RawMessage(`{"v":1}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once loaded, documents are served from memory and writes only append to the log, so neither
+	// needs the .qdb file to be readable, nor the log to be replayed again
+	if err := os.WriteFile(filename, []byte("not a database"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	log, err := os.ReadFile(db.walPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.CreateDocument("c", json.RawMessage(`{"v":1}`)); err != nil {
+		t.Errorf("create: %v", err)
+	}
+	if _, err := db.UpdateDocument("a", json.RawMessage(`{"v":2}`)); err != nil {
+		t.Errorf("update: %v", err)
+	}
+	if err := db.DeleteDocument("b"); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+
+	want := map[string]string{"a": `{"v":2}`, "c": `{"v":1}`}
+	if got := mustDocuments(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("documents = %v, want %v", got, want)
+	}
+
+	appended, err := os.ReadFile(db.walPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(appended, log) || len(appended) == len(log) {
+		t.Errorf("writes did not append to the log: %d bytes before, %d after", len(log), len(appended))
+	}
+}
+
+func TestConcurrentCreate(t *testing.T) {
+	keys := testKeys("secret")
+	filename := filepath.Join(t.TempDir(), "events.qdb")
+	db := LoadDB(filename, keys)
+
+	// The existence check and the write happen under one lock, so exactly one create wins
+	const writers = 16
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- db.CreateDocument("same", json.RawMessage(fmt.Sprintf(`{"writer":%d}`, i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrDocumentExists):
+			t.Errorf("create failed with %v, want %v", err, ErrDocumentExists)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d creates of the same key succeeded, want 1", created)
+	}
+
+	reloaded := LoadDB(filename, keys)
+	if _, revision, err := reloaded.ReadDocumentRevision("same"); err != nil || revision != 1 {
+		t.Errorf("reloaded document is at revision %d (%v), want 1", revision, err)
+	}
+}
+
+func TestReplayWALOverBackup(t *testing.T) {
+	tests := []struct {
+		name string
+		// crash damages the files of a collection whose .qdb file is at generation 2, with a backup
+		// of generation 1 and a log of generation 2 holding two records
+		crash   func(t *testing.T, filename string)
+		want    map[string]string
+		wantErr error
+	}{
+		{
+			// A crash between moving the .qdb file to the backup and renaming the next generation
+			// into place leaves a backup of the same generation as the log
+			name: "backup of the log's generation",
+			crash: func(t *testing.T, filename string) {
+				if err := os.Rename(filename, filename+".bak"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"a": `{"v":1}`, "b": `{"v":2}`, "c": `{"v":4}`, "d": `{"v":5}`},
+		},
+		{
+			name: "backup of an older generation",
+			crash: func(t *testing.T, filename string) {
+				data := readFile(t, filename)
+				data[len(data)-1] ^= 0xff
+				if err := os.WriteFile(filename, data, 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrCorrupted,
+		},
+		{
+			name: "damaged record before the last one",
+			crash: func(t *testing.T, filename string) {
+				// Flip the first byte of the first record's payload, after the log and frame headers
+				data := readFile(t, filename+".wal")
+				data[len(walMagic)+1+8+8] ^= 0xff
+				if err := os.WriteFile(filename+".wal", data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrCorrupted,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys := testKeys("secret")
+			filename := filepath.Join(t.TempDir(), "events.qdb")
+
+			db := LoadDB(filename, keys)
+			for _, document := range []Document{{"a", json.RawMessage(`{"v":1}`)}, {"b", json.RawMessage(`{"v":2}`)}, {"c", json.RawMessage(`{"v":3}`)}} {
+				if err := db.CreateDocument(document.Id, document.Data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.close(); err != nil {
+				t.Fatal(err)
+			}
+			db = LoadDB(filename, keys)
+			if _, err := db.UpdateDocument("c", json.RawMessage(`{"v":4}`)); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.CreateDocument("d", json.RawMessage(`{"v":5}`)); err != nil {
+				t.Fatal(err)
+			}
+
+			test.crash(t, filename)
+			log := readFile(t, filename+".wal")
+
+			reloaded := LoadDB(filename, keys)
+			if test.wantErr != nil {
+				if !errors.Is(reloaded.loadErr, test.wantErr) {
+					t.Fatalf("LoadDB failed with %v, want %v", reloaded.loadErr, test.wantErr)
+				}
+				if !bytes.Equal(readFile(t, filename+".wal"), log) {
+					t.Error("the log was changed by a load that failed")
+				}
+				return
+			}
+
+			if reloaded.loadErr != nil {
+				t.Fatalf("LoadDB: %v", reloaded.loadErr)
+			}
+			if got := mustDocuments(t, reloaded); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("documents = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
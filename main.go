@@ -1,46 +1,54 @@
 package main
 
 import (
+	"CyberDefenseEd/QuadDB/auth"
+	"CyberDefenseEd/QuadDB/database"
 	"CyberDefenseEd/QuadDB/routes"
 	"CyberDefenseEd/QuadDB/types"
 	"CyberDefenseEd/QuadDB/util"
-	"crypto/sha256"
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/term"
 	"gopkg.in/yaml.v3"
 )
 
 func main() {
-	var config types.Config
-	configFile := "./config/config.yaml"
-	if _, err := os.Stat(configFile); err == nil {
-		data, err := os.ReadFile(configFile)
-		if err != nil {
-			util.Error("Error reading config file:", err)
+	config, ok := loadConfig()
+	if !ok {
+		return
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate-key":
+			rotateKeyCommand(config, os.Args[2:])
 			return
-		}
-		err = yaml.Unmarshal(data, &config)
-		if err != nil {
-			util.Error("Error parsing config file:", err)
+		case "user":
+			userCommand(config, os.Args[2:])
 			return
 		}
-		util.Info("Found a valid config file, defaulting to that!")
-	} else {
-		config.Port = 9010
-		config.DataDir = "./data"
-		config.AESKey = ""
 	}
 
 	port := flag.Int("port", config.Port, "Port number")
 	dataDir := flag.String("data-dir", config.DataDir, "Directory to store data files")
 	aesKey := flag.String("aes-key", config.AESKey, "AES encryption key")
+	keyFile := flag.String("key-file", config.KeyFile, "File holding the master encryption key")
+	keyEnv := flag.String("key-env", config.KeyEnv, "Environment variable holding the master encryption key")
+	kmsDir := flag.String("kms-dir", config.KMSDir, "Local KMS directory that generates and keeps the master key")
 	generateAESKey := flag.Bool("generate-aes-key", false, "Generate a new AES key")
 	flag.Parse()
 
-	if *aesKey == "" {
+	provider := keyProvider(*aesKey, *keyFile, *keyEnv, *kmsDir)
+	if provider == nil {
 		util.Error("We need an AES key to encrypt our database!")
 		os.Exit(0)
 	}
@@ -61,23 +69,57 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Hash the AES key using SHA-256 to allow all strings as keys
-	hash := sha256.New()
-	hash.Write([]byte(*aesKey))
-	aesKeyBytes := hash.Sum(nil)
-
-	util.Info(fmt.Sprintf("Using key hash - %x", aesKeyBytes))
-
-	if len(aesKeyBytes) != 16 && len(aesKeyBytes) != 24 && len(aesKeyBytes) != 32 {
-		util.Error("Invalid AES key length. Key must be 16, 24, or 32 bytes long.", aesKey)
-		return
+	if _, err := provider.MasterKey(); err != nil {
+		util.Error(fmt.Sprintf("Could not load the master key: %v", err))
+		os.Exit(1)
 	}
 
+	// Every collection has its own data key, wrapped with a key derived from the master key
+	keys := database.NewKeyring(provider, kdfParams(config))
+
 	err := os.MkdirAll(*dataDir, 0755)
 	if err != nil {
 		panic(err)
 	}
 
+	// An online key rotation cut short by a restart is finished before any collection is opened
+	resumed, err := database.ResumeKeyRotation(*dataDir, keys, func(progress database.RotationProgress) {
+		util.Info(fmt.Sprintf("[%d/%d] Finished %s", progress.Rotated+progress.Skipped, progress.Total, progress.Current))
+	})
+	if err != nil {
+		util.Error(fmt.Sprintf("Could not finish the interrupted key rotation: %v", err))
+		os.Exit(1)
+	}
+	if resumed {
+		util.Info("Finished the interrupted key rotation, the new master key is stored and in use")
+	}
+
+	tokens, err := loadTokens(config)
+	if err != nil {
+		util.Error(fmt.Sprintf("Could not load API tokens: %v", err))
+		os.Exit(1)
+	}
+
+	users, err := auth.LoadUsers(config.UsersFile)
+	if err != nil {
+		util.Error(fmt.Sprintf("Could not load dashboard users: %v", err))
+		os.Exit(1)
+	}
+	if len(users.List()) == 0 {
+		util.Warn("No dashboard users yet, add one with `quaddb user add <name> --role admin`")
+	}
+
+	sessions, err := auth.NewSessionManager(config.SessionSecret, config.SessionTTL)
+	if err != nil {
+		util.Error(fmt.Sprintf("Could not set up dashboard sessions: %v", err))
+		os.Exit(1)
+	}
+	if config.SessionSecret == "" {
+		util.Warn("No session_secret configured, dashboard logins will not survive a restart")
+	}
+
+	authConfig := routes.AuthConfig{Tokens: tokens, Users: users, Sessions: sessions}
+
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 
@@ -93,14 +135,156 @@ func main() {
 
 	router.Static("/assets", "./dashboard/assets")
 
+	// One Database per collection, shared by every request
+	registry := database.NewRegistry(*dataDir, keys)
+	stopReaper := registry.StartReaper(config.ReapInterval)
+
 	util.Info("Creating routes...")
-	routes.SetupRoutes(router, *dataDir, aesKeyBytes)
-	routes.SetupDashboardRoutes(router, *dataDir, aesKeyBytes)
+	routes.SetupRoutes(router, registry, authConfig, config.CORSOrigins)
+	routes.SetupDashboardRoutes(router, registry, authConfig)
 	routes.RegisterSwaggerRoutes(router)
 
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", *port),
+		Handler: router,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("Error running server: %v\n", err)
+			os.Exit(1)
+		}
+	}()
 	util.Info(fmt.Sprintf("Quad-Server Started - 127.0.0.1:%d", *port))
-	if err := router.Run(fmt.Sprintf(":%d", *port)); err != nil {
-		fmt.Printf("Error running server: %v\n", err)
-		return
+
+	shutdown(server, registry, stopReaper)
+}
+
+// shutdown waits for an interrupt, then lets in-flight requests finish, stops the reaper and closes
+// every collection
+func shutdown(server *http.Server, registry *database.Registry, stopReaper func()) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	util.Info("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		util.Warn(fmt.Sprintf("Some requests did not finish in time: %v", err))
+	}
+	stopReaper()
+	if err := registry.CloseAll(); err != nil {
+		util.Error(fmt.Sprintf("Failed to close collections: %v", err))
 	}
 }
+
+// loadConfig reads ./config/config.yaml, falling back to defaults when it does not exist
+func loadConfig() (types.Config, bool) {
+	var config types.Config
+	configFile := "./config/config.yaml"
+	if _, err := os.Stat(configFile); err == nil {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			util.Error("Error reading config file:", err)
+			return config, false
+		}
+		err = yaml.Unmarshal(data, &config)
+		if err != nil {
+			util.Error("Error parsing config file:", err)
+			return config, false
+		}
+		util.Info("Found a valid config file, defaulting to that!")
+	} else {
+		config.Port = 9010
+		config.DataDir = "./data"
+		config.AESKey = ""
+	}
+
+	if config.UsersFile == "" {
+		config.UsersFile = "./config/users.json"
+	}
+	if config.TokensFile == "" {
+		config.TokensFile = "./config/tokens.json"
+	}
+
+	return config, true
+}
+
+// kdfParams returns the Argon2id cost configured for deriving collection keys
+func kdfParams(config types.Config) database.KDFParams {
+	return database.KDFParams{
+		Time:    config.KDF.Time,
+		Memory:  config.KDF.MemoryKiB,
+		Threads: config.KDF.Threads,
+	}
+}
+
+// keyProvider picks where the master key comes from, in order of precedence
+func keyProvider(aesKey, keyFile, keyEnv, kmsDir string) database.KeyProvider {
+	switch {
+	case aesKey != "":
+		return database.StaticKey(aesKey)
+	case keyFile != "":
+		return database.FileKey(keyFile)
+	case keyEnv != "":
+		return database.EnvKey(keyEnv)
+	case kmsDir != "":
+		return database.LocalKMS(kmsDir)
+	}
+	return nil
+}
+
+// loadTokens reads the API tokens, creating an admin token on first start so the API can be reached at all
+func loadTokens(config types.Config) (*auth.TokenStore, error) {
+	tokens, err := auth.LoadTokens(config.TokensFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if tokens.Empty() {
+		secret, token, err := tokens.Create("bootstrap admin", []auth.Scope{{Collection: auth.AnyCollection, Verbs: []string{auth.VerbAdmin}}})
+		if err != nil {
+			return nil, err
+		}
+		if err := revealBootstrapToken(config, secret); err != nil {
+			// Nobody could use a token whose secret was lost, so try again on the next start
+			if revokeErr := tokens.Revoke(token.ID); revokeErr != nil {
+				util.Error(fmt.Sprintf("Failed to revoke the admin token nobody was given: %v", revokeErr))
+			}
+			return nil, err
+		}
+	}
+
+	return tokens, nil
+}
+
+// revealBootstrapToken hands the secret of the admin token created on first start to the operator,
+// on the terminal if the server runs on one and otherwise in a file only its user can read. The
+// secret never goes to the log, which may be collected by anyone who can read the server's output.
+func revealBootstrapToken(config types.Config, secret string) error {
+	if term.IsTerminal(int(os.Stdout.Fd())) {
+		fmt.Printf("\nNo API tokens found, created an admin token: %s\nIt will not be shown again, use it to create scoped tokens via /api/v1/admin/tokens.\n\n", secret)
+		return nil
+	}
+
+	path := filepath.Join(filepath.Dir(config.TokensFile), "admin.token")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, secret); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	util.Info(fmt.Sprintf("No API tokens found, created an admin token and wrote it to %s. Read it, then delete the file; use the token to create scoped tokens via /api/v1/admin/tokens.", path))
+	return nil
+}
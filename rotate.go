@@ -0,0 +1,47 @@
+package main
+
+import (
+	"CyberDefenseEd/QuadDB/database"
+	"CyberDefenseEd/QuadDB/types"
+	"CyberDefenseEd/QuadDB/util"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// rotateKeyCommand implements `quaddb rotate-key`, moving every collection to a new master key.
+// It must not run while a server is using the same data directory; use the admin API for online rotation.
+func rotateKeyCommand(config types.Config, args []string) {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	dataDir := flags.String("data-dir", config.DataDir, "Directory to store data files")
+	oldKey := flags.String("old", "", "Current AES encryption key (defaults to the configured key source)")
+	newKey := flags.String("new", "", "New AES encryption key")
+	newKeyFile := flags.String("new-key-file", "", "File holding the new master encryption key")
+	flags.Parse(args)
+
+	if *oldKey == "" {
+		*oldKey = config.AESKey
+	}
+	oldProvider := keyProvider(*oldKey, config.KeyFile, config.KeyEnv, config.KMSDir)
+	newProvider := keyProvider(*newKey, *newKeyFile, "", "")
+	if oldProvider == nil || newProvider == nil {
+		util.Error("Both the old and the new key are required!")
+		os.Exit(1)
+	}
+
+	oldKeys := database.NewKeyring(oldProvider, kdfParams(config))
+	newKeys := oldKeys.WithProvider(newProvider)
+
+	var result database.RotationProgress
+	err := database.RotateKeys(*dataDir, oldKeys, newKeys, func(progress database.RotationProgress) {
+		result = progress
+		util.Info(fmt.Sprintf("[%d/%d] Finished %s", progress.Rotated+progress.Skipped, progress.Total, progress.Current))
+	})
+	if err != nil {
+		util.Error(fmt.Sprintf("Key rotation failed: %v", err))
+		util.Info("Collections rotated so far stay on the new key; run the same command again to resume.")
+		os.Exit(1)
+	}
+
+	util.Info(fmt.Sprintf("Rotated %d collections (%d were already on the new key). Update your key config before starting the server!", result.Rotated, result.Skipped))
+}
@@ -0,0 +1,167 @@
+package routes
+
+import (
+	"CyberDefenseEd/QuadDB/auth"
+	"CyberDefenseEd/QuadDB/database"
+	"CyberDefenseEd/QuadDB/util"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maintenanceMiddleware holds the registry's maintenance lock shared for the whole request. A key
+// rotation takes it exclusively while it rewrites one collection at a time, so requests wait for at
+// most one collection instead of racing the rewrite.
+func maintenanceMiddleware(registry *database.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		release := registry.Hold()
+		defer release()
+		c.Next()
+	}
+}
+
+// rotationJob tracks the most recent online key rotation
+type rotationJob struct {
+	lock     sync.Mutex
+	running  bool
+	progress database.RotationProgress
+	started  time.Time
+	finished time.Time
+	err      error
+}
+
+func (job *rotationJob) status() gin.H {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	status := gin.H{
+		"running":  job.running,
+		"progress": job.progress,
+	}
+	if !job.started.IsZero() {
+		status["started"] = job.started.Format(time.RFC3339)
+	}
+	if !job.finished.IsZero() {
+		status["finished"] = job.finished.Format(time.RFC3339)
+	}
+	if job.err != nil {
+		status["error"] = job.err.Error()
+	}
+
+	return status
+}
+
+// setupAdminRoutes registers the administrative endpoints
+func setupAdminRoutes(admin *gin.RouterGroup, registry *database.Registry, tokens *auth.TokenStore) {
+	job := &rotationJob{}
+
+	admin.GET("/tokens", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"tokens": tokens.List()})
+	})
+
+	admin.POST("/tokens", func(c *gin.Context) {
+		var request struct {
+			Name   string       `json:"name" binding:"required"`
+			Scopes []auth.Scope `json:"scopes" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		secret, token, err := tokens.Create(request.Name, request.Scopes)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Created API token '%s' (%s)", token.Name, token.ID))
+		c.JSON(http.StatusCreated, gin.H{"token": secret, "details": token, "message": "Store this token now, it cannot be shown again"})
+	})
+
+	admin.DELETE("/tokens/:id", func(c *gin.Context) {
+		err := tokens.Revoke(c.Param("id"))
+		if errors.Is(err, auth.ErrTokenNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Revoked API token %s", c.Param("id")))
+		c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+	})
+
+	admin.GET("/rotate-key", func(c *gin.Context) {
+		c.JSON(http.StatusOK, job.status())
+	})
+
+	// The new master key is generated and stored by the key source itself, so no key material is
+	// sent over HTTP and the server restarts with the key the collections were moved to
+	admin.POST("/rotate-key", func(c *gin.Context) {
+		if _, ok := registry.Keys().Provider().(database.KeyStore); !ok {
+			c.JSON(http.StatusConflict, gin.H{"error": "Online key rotation needs the master key to come from key_file or kms_dir, where the new key can be stored; stop the server and use `quaddb rotate-key` instead"})
+			return
+		}
+
+		job.lock.Lock()
+		if job.running {
+			job.lock.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": "A key rotation is already running"})
+			return
+		}
+		job.running = true
+		job.progress = database.RotationProgress{}
+		job.started = time.Now()
+		job.finished = time.Time{}
+		job.err = nil
+		job.lock.Unlock()
+
+		go func() {
+			util.Info("Key rotation started")
+			err := registry.RotateStoredKey(func(progress database.RotationProgress) {
+				job.lock.Lock()
+				job.progress = progress
+				job.lock.Unlock()
+				util.Info(fmt.Sprintf("[%d/%d] Finished %s", progress.Rotated+progress.Skipped, progress.Total, progress.Current))
+			})
+			if err != nil {
+				util.Error(fmt.Sprintf("Key rotation failed: %v", err))
+				util.Info("Collections rotated so far stay on the new key, which is kept staged; start the rotation again or restart the server to finish it")
+			} else {
+				util.Info("Key rotation finished, the new master key is stored and in use")
+			}
+
+			job.lock.Lock()
+			job.running = false
+			job.finished = time.Now()
+			job.err = err
+			job.lock.Unlock()
+		}()
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "Key rotation started, poll GET /api/v1/admin/rotate-key for progress"})
+	})
+
+	admin.POST("/shred/:db", func(c *gin.Context) {
+		startTime := time.Now()
+
+		// Admin routes skip the maintenance lock, so wait for a key rotation to let go of the files
+		release := registry.Hold()
+		defer release()
+
+		name := c.Param("db")
+		if err := registry.Shred(name); err != nil {
+			c.JSON(collectionManagementStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Shredded collection '%s'", name))
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "message": "Collection shredded successfully"})
+	})
+}
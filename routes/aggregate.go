@@ -0,0 +1,51 @@
+package routes
+
+import (
+	"CyberDefenseEd/QuadDB/auth"
+	"CyberDefenseEd/QuadDB/database"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupAggregateRoutes registers the endpoint that runs aggregation pipelines over a collection
+func setupAggregateRoutes(api *gin.RouterGroup, registry *database.Registry) {
+	api.POST("/docs/:db/aggregate", authorize(auth.VerbRead), func(c *gin.Context) {
+		startTime := time.Now()
+
+		var request struct {
+			Pipeline json.RawMessage `json:"pipeline"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		pipeline, err := database.ParsePipeline(request.Pipeline)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		db, err := registry.Get(c.Param("db"))
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		results, plan, err := db.Aggregate(pipeline)
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"_resp":   time.Since(startTime).String(),
+			"_num":    len(results),
+			"_plan":   plan,
+			"results": results,
+		})
+	})
+}
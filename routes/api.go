@@ -3,12 +3,14 @@
 package routes
 
 import (
+	"CyberDefenseEd/QuadDB/auth"
 	"CyberDefenseEd/QuadDB/database"
 	"CyberDefenseEd/QuadDB/util"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -17,38 +19,146 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRoutes(router *gin.Engine, dataDir string, aesKey []byte) {
-	databases := make(map[string]*database.Database)
+// apiCors allows cross-origin calls to the API. The API authenticates with a token header rather
+// than cookies, so credentials are only allowed for origins that are listed explicitly.
+func apiCors(origins []string) gin.HandlerFunc {
+	config := cors.Config{
+		AllowMethods:  []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:  []string{"Origin", "Content-Type", "Accept", "Authorization", "X-API-Key", "If-Match", csrfHeader},
+		ExposeHeaders: []string{"Content-Length", "ETag"},
+		MaxAge:        12 * time.Hour,
+	}
+
+	if len(origins) == 0 || slices.Contains(origins, "*") {
+		config.AllowAllOrigins = true
+	} else {
+		config.AllowOrigins = origins
+		config.AllowCredentials = true
+	}
+
+	return cors.New(config)
+}
+
+// collectionStatus maps an error from opening a collection to an HTTP status
+func collectionStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrInvalidCollectionName):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrCollectionNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// documentStatus maps an error from reading or writing a document to an HTTP status
+func documentStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrDocumentNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrDocumentExists), errors.Is(err, database.ErrUniqueViolation):
+		return http.StatusConflict
+	case errors.Is(err, database.ErrRevisionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, database.ErrSchemaViolation), errors.Is(err, database.ErrInvalidExpiry):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrPatchFailed):
+		return http.StatusUnprocessableEntity
+	default:
+		return collectionStatus(err)
+	}
+}
+
+// documentError is the response body for an error from reading or writing a document; a document
+// that does not match the collection schema lists every violation under "errors"
+func documentError(err error) gin.H {
+	body := gin.H{"error": err.Error()}
+	var schemaErr *database.SchemaError
+	if errors.As(err, &schemaErr) {
+		body["errors"] = schemaErr.Violations
+	}
+	return body
+}
+
+// etag formats a document revision as a strong entity tag
+func etag(revision uint64) string {
+	return fmt.Sprintf(`"%d"`, revision)
+}
+
+// ifMatchRevision returns the revision the If-Match header of a PUT or DELETE requires the document
+// to be at, or 0 when there is no header or it is "*". ok is false when none of the listed entity
+// tags is the document's current revision.
+func ifMatchRevision(c *gin.Context, db *database.Database, key string) (revision uint64, ok bool, err error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return 0, true, nil
+	}
 
-	dbFiles, err := filepath.Glob(filepath.Join(dataDir, "*.qdb"))
+	_, current, err := db.ReadDocumentRevision(key)
 	if err != nil {
-		util.Error("Failed to index qdb files.")
+		return 0, false, err
 	}
 
-	for _, dbFile := range dbFiles {
-		dbName := strings.TrimSuffix(filepath.Base(dbFile), ".qdb")
-		db := database.LoadDB(dbFile, aesKey)
-		databases[dbName] = db
-		util.Info(fmt.Sprintf("Imported Database - %s.qdb", dbName))
+	// Weak tags never match, as If-Match uses the strong comparison
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == etag(current) {
+			return current, true, nil
+		}
 	}
+	return 0, false, nil
+}
+
+// validCollectionName rejects requests whose :db parameter breaks the collection naming policy
+func validCollectionName(c *gin.Context) {
+	if name := c.Param("db"); name != "" {
+		if err := database.ValidateCollectionName(name); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.Next()
+}
+
+func SetupRoutes(router *gin.Engine, registry *database.Registry, authConfig AuthConfig, corsOrigins []string) {
+	if err := registry.OpenAll(); err != nil {
+		util.Error(fmt.Sprintf("Failed to index qdb files: %v", err))
+	}
+
+	corsMiddleware := apiCors(corsOrigins)
+
+	// Admin routes skip the maintenance lock so rotation progress can be polled while it runs
+	admin := router.Group("/api/v1/admin")
+	admin.Use(corsMiddleware, authenticate(authConfig), authorize(auth.VerbAdmin))
+	setupAdminRoutes(admin, registry, authConfig.Tokens)
 
 	api := router.Group("/api/v1")
-	api.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+	api.Use(corsMiddleware)
+	api.Use(authenticate(authConfig))
+	api.Use(validCollectionName)
+	api.Use(maintenanceMiddleware(registry))
+
+	setupCollectionRoutes(api, registry)
+	setupTxRoutes(api, registry)
+	setupBulkRoutes(api, registry)
+	setupQueryRoutes(api, registry)
+	setupAggregateRoutes(api, registry)
+	setupSchemaRoutes(api, registry)
 
 	{
-		api.GET("/docs/:db", func(c *gin.Context) {
+		api.GET("/docs/:db", authorize(auth.VerbRead), func(c *gin.Context) {
 			startTime := time.Now()
 
-			dbName := c.Param("db")
-			dbFile := filepath.Join(dataDir, dbName+".qdb")
-			db := database.LoadDB(dbFile, aesKey)
+			db, err := registry.Get(c.Param("db"))
+			if err != nil {
+				c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+
+			options, err := findOptions(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
 
 			page := c.DefaultQuery("page", "1")
 			size := c.Query("size")
@@ -69,56 +179,55 @@ func SetupRoutes(router *gin.Engine, dataDir string, aesKey []byte) {
 			if offset <= 0 {
 				offset = 1
 			}
-			offset = (offset - 1) * pageSize
-
-			documents, err := db.LoadDocumentsPaginated(offset, pageSize)
-			if err != nil {
-				c.JSON(http.StatusNotFound, gin.H{"error": "Database not found"})
+			if offset > 1 && options.Cursor != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "page and cursor cannot be combined"})
 				return
 			}
+			options.Skip = (offset - 1) * pageSize
+			options.Limit = pageSize
 
-			var allDocuments []database.Document
-			for key, data := range documents {
-				document := database.Document{
-					Id:   key,
-					Data: data,
-				}
-				allDocuments = append(allDocuments, document)
+			result, err := db.Find(database.AllDocuments(), options)
+			if err != nil {
+				c.JSON(findStatus(err), gin.H{"error": err.Error()})
+				return
 			}
 
-			endTime := time.Now()
-			elapsedTime := endTime.Sub(startTime)
-
-			c.JSON(http.StatusOK, gin.H{"_resp": elapsedTime.String(), "_num": len(allDocuments), "documents": allDocuments})
+			c.JSON(http.StatusOK, findResponse(startTime, result))
 		})
 
-		api.POST("/docs/:db", func(c *gin.Context) {
+		api.POST("/docs/:db", authorize(auth.VerbWrite), func(c *gin.Context) {
 			startTime := time.Now()
 
-			dbName := c.Param("db")
-			dbFile := filepath.Join(dataDir, dbName+".qdb")
-			db := database.LoadDB(dbFile, aesKey)
-
 			var documents []database.Document
 			if err := c.ShouldBindJSON(&documents); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 
+			db, err := registry.Open(c.Param("db"))
+			if err != nil {
+				c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+
+			// Create every document or none of them
+			tx := db.Begin()
 			for _, document := range documents {
 				if document.Data == nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": "Data field is required"})
 					return
 				}
 
-				err := db.CreateDocument(document.Id, document.Data)
-				if err != nil {
+				if _, err := tx.Create(document.Id, document.Data); err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 					return
 				}
 			}
 
-			databases[dbName] = database.LoadDB(dbFile, aesKey)
+			if err := tx.Commit(); err != nil {
+				c.JSON(documentStatus(err), documentError(err))
+				return
+			}
 
 			endTime := time.Now()
 			elapsedTime := endTime.Sub(startTime)
@@ -126,66 +235,71 @@ func SetupRoutes(router *gin.Engine, dataDir string, aesKey []byte) {
 			c.JSON(http.StatusCreated, gin.H{"_resp": elapsedTime.String(), "message": "Documents created successfully"})
 		})
 
-		api.GET("/docs/:db/search", func(c *gin.Context) {
+		api.GET("/docs/:db/search", authorize(auth.VerbRead), func(c *gin.Context) {
 			startTime := time.Now()
 
-			dbName := c.Param("db")
-			db := databases[dbName] // Use the loaded database
-
-			// Extract query parameters
-			queryParams := c.Request.URL.Query()
+			db, err := registry.Get(c.Param("db"))
+			if err != nil {
+				c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+				return
+			}
 
-			if len(queryParams) == 0 {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "At least one field-value pair is required"})
+			options, err := findOptions(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
+			if limit := c.Query("limit"); limit != "" {
+				options.Limit, err = strconv.Atoi(limit)
+				if err != nil || options.Limit < 0 {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a number that is not negative"})
+					return
+				}
+			}
 
+			// Every other query parameter is a field to match
 			fieldValues := make(map[string]string)
-			for field, values := range queryParams {
+			for field, values := range c.Request.URL.Query() {
+				switch field {
+				case "sort", "fields", "cursor", "limit":
+					continue
+				}
 				if len(values) > 0 {
 					fieldValues[field] = values[0] // Only consider the first value for each field
 				}
 			}
 
-			matchingDocuments, err := db.FetchDocumentsByFieldValues(fieldValues)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			if len(fieldValues) == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "At least one field-value pair is required"})
 				return
 			}
 
-			var allDocuments []database.Document
-			for key, data := range matchingDocuments {
-				document := database.Document{
-					Id:   key,
-					Data: data,
-				}
-				allDocuments = append(allDocuments, document)
+			result, err := db.Find(database.NewSearchQuery(fieldValues), options)
+			if err != nil {
+				c.JSON(findStatus(err), gin.H{"error": err.Error()})
+				return
 			}
 
-			elapsedTime := time.Since(startTime)
-
-			c.JSON(http.StatusOK, gin.H{
-				"_resp":     elapsedTime.String(),
-				"_num":      len(allDocuments),
-				"documents": allDocuments,
-			})
+			c.JSON(http.StatusOK, findResponse(startTime, result))
 		})
 
-		api.GET("/docs/:db/:key", func(c *gin.Context) {
+		api.GET("/docs/:db/:key", authorize(auth.VerbRead), func(c *gin.Context) {
 			startTime := time.Now()
 
-			dbName := c.Param("db")
-			dbFile := filepath.Join(dataDir, dbName+".qdb")
-			db := database.LoadDB(dbFile, aesKey)
+			db, err := registry.Get(c.Param("db"))
+			if err != nil {
+				c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+				return
+			}
 
 			key := c.Param("key")
-			data, err := db.ReadDocument(key)
+			data, revision, err := db.ReadDocumentRevision(key)
 			if err != nil {
-				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				c.JSON(documentStatus(err), documentError(err))
 				return
 			}
 
-			database.LastReadRecord = data
+			c.Header("ETag", etag(revision))
 
 			endTime := time.Now()
 			elapsedTime := endTime.Sub(startTime)
@@ -193,12 +307,14 @@ func SetupRoutes(router *gin.Engine, dataDir string, aesKey []byte) {
 			c.JSON(http.StatusOK, gin.H{"_resp": elapsedTime.String(), "data": data})
 		})
 
-		api.PUT("/docs/:db/:key", func(c *gin.Context) {
+		api.PUT("/docs/:db/:key", authorize(auth.VerbWrite), func(c *gin.Context) {
 			startTime := time.Now()
 
-			dbName := c.Param("db")
-			dbFile := filepath.Join(dataDir, dbName+".qdb")
-			db := database.LoadDB(dbFile, aesKey)
+			db, err := registry.Get(c.Param("db"))
+			if err != nil {
+				c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+				return
+			}
 
 			key := c.Param("key")
 			var newData json.RawMessage
@@ -207,29 +323,113 @@ func SetupRoutes(router *gin.Engine, dataDir string, aesKey []byte) {
 				return
 			}
 
-			err := db.UpdateDocument(key, newData)
+			revision, ok, err := ifMatchRevision(c, db, key)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(documentStatus(err), documentError(err))
+				return
+			}
+			if !ok {
+				c.JSON(http.StatusPreconditionFailed, gin.H{"error": fmt.Sprintf("Document '%s' has changed since it was read", key)})
 				return
 			}
 
+			if revision == 0 {
+				revision, err = db.UpdateDocument(key, newData)
+			} else {
+				revision, err = db.CompareAndSwap(key, revision, newData)
+			}
+			if err != nil {
+				c.JSON(documentStatus(err), documentError(err))
+				return
+			}
+
+			c.Header("ETag", etag(revision))
+
 			endTime := time.Now()
 			elapsedTime := endTime.Sub(startTime)
 
 			c.JSON(http.StatusOK, gin.H{"_resp": elapsedTime.String(), "message": "Document updated successfully"})
 		})
 
-		api.DELETE("/docs/:db/:key", func(c *gin.Context) {
+		api.PATCH("/docs/:db/:key", authorize(auth.VerbWrite), func(c *gin.Context) {
 			startTime := time.Now()
 
-			dbName := c.Param("db")
-			dbFile := filepath.Join(dataDir, dbName+".qdb")
-			db := database.LoadDB(dbFile, aesKey)
+			db, err := registry.Get(c.Param("db"))
+			if err != nil {
+				c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+
+			body, err := c.GetRawData()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			var patch database.Patch
+			switch c.ContentType() {
+			case "application/merge-patch+json":
+				patch, err = database.NewMergePatch(body)
+			case "application/json-patch+json":
+				patch, err = database.NewJSONPatch(body)
+			default:
+				c.Header("Accept-Patch", "application/merge-patch+json, application/json-patch+json")
+				c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Send a merge patch as application/merge-patch+json or a JSON Patch as application/json-patch+json"})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
 
 			key := c.Param("key")
-			err := db.DeleteDocument(key)
+			revision, ok, err := ifMatchRevision(c, db, key)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(documentStatus(err), documentError(err))
+				return
+			}
+			if !ok {
+				c.JSON(http.StatusPreconditionFailed, gin.H{"error": fmt.Sprintf("Document '%s' has changed since it was read", key)})
+				return
+			}
+
+			revision, err = db.PatchDocument(key, patch, revision)
+			if err != nil {
+				c.JSON(documentStatus(err), documentError(err))
+				return
+			}
+
+			c.Header("ETag", etag(revision))
+			c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "message": "Document patched successfully"})
+		})
+
+		api.DELETE("/docs/:db/:key", authorize(auth.VerbWrite), func(c *gin.Context) {
+			startTime := time.Now()
+
+			db, err := registry.Get(c.Param("db"))
+			if err != nil {
+				c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+
+			key := c.Param("key")
+			revision, ok, err := ifMatchRevision(c, db, key)
+			if err != nil {
+				c.JSON(documentStatus(err), documentError(err))
+				return
+			}
+			if !ok {
+				c.JSON(http.StatusPreconditionFailed, gin.H{"error": fmt.Sprintf("Document '%s' has changed since it was read", key)})
+				return
+			}
+
+			if revision == 0 {
+				err = db.DeleteDocument(key)
+			} else {
+				err = db.CompareAndDelete(key, revision)
+			}
+			if err != nil {
+				c.JSON(documentStatus(err), documentError(err))
 				return
 			}
 
@@ -239,21 +439,35 @@ func SetupRoutes(router *gin.Engine, dataDir string, aesKey []byte) {
 			c.JSON(http.StatusOK, gin.H{"_resp": elapsedTime.String(), "message": "Document deleted successfully"})
 		})
 
-		api.GET("/docs/updates", func(c *gin.Context) {
+		// Only reports when the last write happened: the collection and document it touched may
+		// be ones the token cannot read
+		updates := func(c *gin.Context) {
 			adminInfo := gin.H{
-				"last_used_db":      database.LastUsedDB,
 				"last_update_time":  database.LastUpdateTime.Format(time.RFC3339),
 				"last_added_record": database.LastAddedRecord,
-				"last_read_record":  database.LastReadRecord,
 			}
 
 			c.JSON(http.StatusOK, adminInfo)
-		})
+		}
 
-		api.GET("/docs/collections", func(c *gin.Context) {
+		collections := func(c *gin.Context) {
 			collections := make(map[string]int)
 
-			for dbName, db := range databases {
+			for _, dbName := range registry.Names() {
+				// Only list the collections the token can read
+				if !requestAllows(c, dbName, auth.VerbRead) {
+					continue
+				}
+
+				db, err := registry.Get(dbName)
+				if errors.Is(err, database.ErrCollectionNotFound) {
+					continue
+				}
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+
 				count, err := db.CountDocuments()
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -263,7 +477,15 @@ func SetupRoutes(router *gin.Engine, dataDir string, aesKey []byte) {
 			}
 
 			c.JSON(http.StatusOK, collections)
-		})
+		}
+
+		api.GET("/updates", authorize(auth.VerbRead), updates)
+		api.GET("/collections", collections)
+
+		// Deprecated paths from before collections had their own routes. They cannot shadow a
+		// collection because "updates" and "collections" are reserved names.
+		api.GET("/docs/updates", authorize(auth.VerbRead), updates)
+		api.GET("/docs/collections", collections)
 
 		router.GET("/ping", func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{"message": "pong"})
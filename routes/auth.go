@@ -0,0 +1,115 @@
+package routes
+
+import (
+	"CyberDefenseEd/QuadDB/auth"
+	"CyberDefenseEd/QuadDB/util"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiTokenKey is the context key under which the authenticated API token is stored
+const apiTokenKey = "apiToken"
+
+// AuthConfig holds what API and dashboard requests are authenticated against
+type AuthConfig struct {
+	Tokens   *auth.TokenStore
+	Users    *auth.UserStore
+	Sessions *auth.SessionManager
+}
+
+// sessionToken grants a logged in dashboard user the access of their role
+func sessionToken(user auth.User) *auth.Token {
+	return &auth.Token{
+		ID:     "session:" + user.Username,
+		Name:   user.Username,
+		Scopes: user.Scopes(),
+	}
+}
+
+// requestToken returns the API token sent as "Authorization: Bearer <token>" or "X-API-Key: <token>"
+func requestToken(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); header != "" {
+		if scheme, token, ok := strings.Cut(header, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return c.GetHeader("X-API-Key")
+}
+
+// rejectRequest logs a failed authentication or authorization attempt and aborts the request
+func rejectRequest(c *gin.Context, status int, reason string) {
+	util.Warn(fmt.Sprintf("Rejected %s %s from %s: %s", c.Request.Method, c.Request.URL.Path, c.ClientIP(), reason))
+	c.AbortWithStatusJSON(status, gin.H{"error": reason})
+}
+
+// authenticate requires a valid API token, or a dashboard session, on every request
+func authenticate(authConfig AuthConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Let CORS preflights through, browsers never send credentials with them
+		if c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+
+		secret := requestToken(c)
+		if secret == "" {
+			if session, user, ok := currentSession(c, authConfig); ok {
+				// Cookies are sent with cross-site requests too, so the dashboard proves itself with its CSRF token
+				if !isSafeMethod(c.Request.Method) && !authConfig.Sessions.CheckCSRF(session, c.GetHeader(csrfHeader)) {
+					rejectRequest(c, http.StatusForbidden, "Missing or invalid CSRF token")
+					return
+				}
+
+				c.Set(apiTokenKey, sessionToken(user))
+				c.Next()
+				return
+			}
+		}
+
+		if secret == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="quaddb"`)
+			rejectRequest(c, http.StatusUnauthorized, "API token required")
+			return
+		}
+
+		token, ok := authConfig.Tokens.Authenticate(secret)
+		if !ok {
+			c.Header("WWW-Authenticate", `Bearer realm="quaddb", error="invalid_token"`)
+			rejectRequest(c, http.StatusUnauthorized, "Invalid API token")
+			return
+		}
+
+		c.Set(apiTokenKey, token)
+		c.Next()
+	}
+}
+
+// authorize requires the authenticated token to grant verb on the collection in the :db parameter,
+// or on every collection for routes that do not name one
+func authorize(verb string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		collection := c.Param("db")
+		if collection == "" {
+			collection = auth.AnyCollection
+		}
+
+		if !requestAllows(c, collection, verb) {
+			rejectRequest(c, http.StatusForbidden, fmt.Sprintf("Token does not grant %s on '%s'", verb, collection))
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// requestAllows reports whether the request's token grants verb on collection
+func requestAllows(c *gin.Context, collection, verb string) bool {
+	value, exists := c.Get(apiTokenKey)
+	if !exists {
+		return false
+	}
+	return value.(*auth.Token).Allows(collection, verb)
+}
@@ -0,0 +1,131 @@
+package routes
+
+import (
+	"CyberDefenseEd/QuadDB/auth"
+	"CyberDefenseEd/QuadDB/database"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bulkOperation is a single write of a POST /api/v1/docs/:db/bulk request
+type bulkOperation struct {
+	Op       string          `json:"op"`
+	Key      string          `json:"key"`
+	Data     json.RawMessage `json:"data"`
+	Revision uint64          `json:"revision"`
+}
+
+// bulkItemResult reports the outcome of a single bulk operation
+type bulkItemResult struct {
+	Index    int                        `json:"index"`
+	Status   int                        `json:"status"`
+	Key      string                     `json:"key"`
+	Revision uint64                     `json:"revision,omitempty"`
+	Error    string                     `json:"error,omitempty"`
+	Errors   []database.SchemaViolation `json:"errors,omitempty"`
+}
+
+// setupBulkRoutes registers the endpoint that mixes inserts, upserts, replaces and deletes in one request
+func setupBulkRoutes(api *gin.RouterGroup, registry *database.Registry) {
+	api.POST("/docs/:db/bulk", authorize(auth.VerbWrite), func(c *gin.Context) {
+		startTime := time.Now()
+
+		var request struct {
+			Ordered    *bool           `json:"ordered"`
+			Operations []bulkOperation `json:"operations"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(request.Operations) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "At least one operation is required"})
+			return
+		}
+
+		// Operations run in order and stop at the first failure unless asked otherwise, like Mongo's bulkWrite
+		ordered := request.Ordered == nil || *request.Ordered
+
+		ops := make([]database.BulkOp, len(request.Operations))
+		for i, operation := range request.Operations {
+			switch operation.Op {
+			case database.BulkInsert, database.BulkUpsert, database.BulkReplace:
+				if operation.Data == nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("operation %d: data field is required", i)})
+					return
+				}
+			case database.BulkDelete:
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("operation %d: unknown op '%s', expected insert, upsert, replace or delete", i, operation.Op)})
+				return
+			}
+			if (operation.Op == database.BulkReplace || operation.Op == database.BulkDelete) && operation.Key == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("operation %d: key field is required", i)})
+				return
+			}
+
+			ops[i] = database.BulkOp{Op: operation.Op, Key: operation.Key, Data: operation.Data, Revision: operation.Revision}
+		}
+
+		db, err := registry.Open(c.Param("db"))
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		results, err := db.BulkWrite(ops, ordered)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		counts := map[string]int{"inserted": 0, "upserted": 0, "replaced": 0, "deleted": 0, "failed": 0}
+		items := make([]bulkItemResult, len(results))
+		for i, result := range results {
+			item := bulkItemResult{Index: i, Status: http.StatusOK, Key: result.Key, Revision: result.Revision}
+
+			switch {
+			case result.Err != nil:
+				item.Status = documentStatus(result.Err)
+				item.Error = result.Err.Error()
+				var schemaErr *database.SchemaError
+				if errors.As(result.Err, &schemaErr) {
+					item.Errors = schemaErr.Violations
+				}
+				counts["failed"]++
+			case ops[i].Op == database.BulkInsert:
+				item.Status = http.StatusCreated
+				counts["inserted"]++
+			case ops[i].Op == database.BulkUpsert:
+				if result.Created {
+					item.Status = http.StatusCreated
+				}
+				counts["upserted"]++
+			case ops[i].Op == database.BulkReplace:
+				counts["replaced"]++
+			case ops[i].Op == database.BulkDelete:
+				counts["deleted"]++
+			}
+			items[i] = item
+		}
+
+		// Report partial success as a multi-status, so clients do not mistake it for a full one
+		status := http.StatusOK
+		if counts["failed"] > 0 {
+			status = http.StatusMultiStatus
+		}
+
+		c.JSON(status, gin.H{
+			"_resp":   time.Since(startTime).String(),
+			"ordered": ordered,
+			"counts":  counts,
+			"skipped": len(ops) - len(results),
+			"results": items,
+		})
+	})
+}
@@ -0,0 +1,326 @@
+package routes
+
+import (
+	"CyberDefenseEd/QuadDB/auth"
+	"CyberDefenseEd/QuadDB/database"
+	"CyberDefenseEd/QuadDB/util"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// collectionManagementStatus maps an error from creating, dropping or renaming a collection to an HTTP status
+func collectionManagementStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrInvalidCollectionName):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrCollectionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrCollectionExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// indexStatus maps an error from creating or dropping an index to an HTTP status
+func indexStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrInvalidIndex):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrIndexNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrIndexExists), errors.Is(err, database.ErrUniqueViolation):
+		return http.StatusConflict
+	default:
+		return collectionStatus(err)
+	}
+}
+
+// setupCollectionRoutes registers the endpoints that create, drop, rename and describe collections
+// and manage their indexes, text index and default TTL
+func setupCollectionRoutes(api *gin.RouterGroup, registry *database.Registry) {
+	api.GET("/collections/:db", authorize(auth.VerbRead), func(c *gin.Context) {
+		startTime := time.Now()
+
+		info, err := registry.Describe(c.Param("db"))
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "collection": info})
+	})
+
+	api.PUT("/collections/:db", authorize(auth.VerbAdmin), func(c *gin.Context) {
+		startTime := time.Now()
+
+		name := c.Param("db")
+		if _, err := registry.Create(name); err != nil {
+			c.JSON(collectionManagementStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Created collection '%s'", name))
+		c.JSON(http.StatusCreated, gin.H{"_resp": time.Since(startTime).String(), "message": "Collection created successfully"})
+	})
+
+	api.DELETE("/collections/:db", authorize(auth.VerbAdmin), func(c *gin.Context) {
+		startTime := time.Now()
+
+		name := c.Param("db")
+		if err := registry.Drop(name); err != nil {
+			c.JSON(collectionManagementStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Dropped collection '%s'", name))
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "message": "Collection dropped successfully"})
+	})
+
+	api.POST("/collections/:db/rename", authorize(auth.VerbAdmin), func(c *gin.Context) {
+		startTime := time.Now()
+
+		var request struct {
+			Name string `json:"name" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// The token must also be allowed to manage the collection under its new name
+		if !requestAllows(c, request.Name, auth.VerbAdmin) {
+			rejectRequest(c, http.StatusForbidden, fmt.Sprintf("Token does not grant %s on '%s'", auth.VerbAdmin, request.Name))
+			return
+		}
+
+		name := c.Param("db")
+		if err := registry.Rename(name, request.Name); err != nil {
+			c.JSON(collectionManagementStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Renamed collection '%s' to '%s'", name, request.Name))
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "message": "Collection renamed successfully"})
+	})
+
+	api.GET("/collections/:db/indexes", authorize(auth.VerbRead), func(c *gin.Context) {
+		startTime := time.Now()
+
+		db, err := registry.Get(c.Param("db"))
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "indexes": db.Indexes()})
+	})
+
+	api.POST("/collections/:db/indexes", authorize(auth.VerbAdmin), func(c *gin.Context) {
+		startTime := time.Now()
+
+		var request struct {
+			Name          string   `json:"name"`
+			Field         string   `json:"field"`
+			Fields        []string `json:"fields"`
+			Unique        bool     `json:"unique"`
+			Sparse        bool     `json:"sparse"`
+			CaseSensitive *bool    `json:"case_sensitive"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// A single field may be given on its own, and strings are compared as they are unless asked otherwise
+		fields := request.Fields
+		if request.Field != "" {
+			fields = append([]string{request.Field}, fields...)
+		}
+		spec := database.IndexSpec{
+			Name:          request.Name,
+			Fields:        fields,
+			Unique:        request.Unique,
+			Sparse:        request.Sparse,
+			CaseSensitive: request.CaseSensitive == nil || *request.CaseSensitive,
+		}
+
+		name := c.Param("db")
+		db, err := registry.Get(name)
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		spec, err = db.CreateIndex(spec)
+		if err != nil {
+			c.JSON(indexStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Created index '%s' on collection '%s'", spec.Name, name))
+		c.JSON(http.StatusCreated, gin.H{"_resp": time.Since(startTime).String(), "message": "Index created successfully", "index": spec})
+	})
+
+	api.DELETE("/collections/:db/indexes/:index", authorize(auth.VerbAdmin), func(c *gin.Context) {
+		startTime := time.Now()
+
+		name := c.Param("db")
+		db, err := registry.Get(name)
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := db.DropIndex(c.Param("index")); err != nil {
+			c.JSON(indexStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Dropped index '%s' from collection '%s'", c.Param("index"), name))
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "message": "Index dropped successfully"})
+	})
+
+	api.GET("/collections/:db/text-index", authorize(auth.VerbRead), func(c *gin.Context) {
+		startTime := time.Now()
+
+		db, err := registry.Get(c.Param("db"))
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		spec := db.TextIndex()
+		if spec == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "The collection has no text index"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "text_index": spec})
+	})
+
+	api.POST("/collections/:db/text-index", authorize(auth.VerbAdmin), func(c *gin.Context) {
+		startTime := time.Now()
+
+		// Without fields, every string in a document is indexed
+		var spec database.TextIndexSpec
+		if err := c.ShouldBindJSON(&spec); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if spec.Fields == nil {
+			spec.Fields = []string{}
+		}
+
+		name := c.Param("db")
+		db, err := registry.Get(name)
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := db.CreateTextIndex(spec); err != nil {
+			c.JSON(indexStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Created text index on collection '%s'", name))
+		c.JSON(http.StatusCreated, gin.H{"_resp": time.Since(startTime).String(), "message": "Text index created successfully", "text_index": spec})
+	})
+
+	api.DELETE("/collections/:db/text-index", authorize(auth.VerbAdmin), func(c *gin.Context) {
+		startTime := time.Now()
+
+		name := c.Param("db")
+		db, err := registry.Get(name)
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := db.DropTextIndex(); err != nil {
+			c.JSON(indexStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Dropped text index from collection '%s'", name))
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "message": "Text index dropped successfully"})
+	})
+
+	api.GET("/collections/:db/ttl", authorize(auth.VerbRead), func(c *gin.Context) {
+		startTime := time.Now()
+
+		db, err := registry.Get(c.Param("db"))
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		ttl := db.TTL()
+		if ttl == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "The collection has no default TTL"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "ttl": ttl.String()})
+	})
+
+	api.PUT("/collections/:db/ttl", authorize(auth.VerbAdmin), func(c *gin.Context) {
+		startTime := time.Now()
+
+		var request struct {
+			TTL string `json:"ttl" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ttl, err := time.ParseDuration(request.TTL)
+		if err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be a positive duration such as 30m or 24h"})
+			return
+		}
+
+		name := c.Param("db")
+		db, err := registry.Get(name)
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := db.SetTTL(ttl); err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Set the default TTL of collection '%s' to %s", name, ttl))
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "message": "Default TTL set successfully", "ttl": ttl.String()})
+	})
+
+	api.DELETE("/collections/:db/ttl", authorize(auth.VerbAdmin), func(c *gin.Context) {
+		startTime := time.Now()
+
+		name := c.Param("db")
+		db, err := registry.Get(name)
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if db.TTL() == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "The collection has no default TTL"})
+			return
+		}
+		if err := db.SetTTL(0); err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Removed the default TTL of collection '%s'", name))
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "message": "Default TTL removed successfully"})
+	})
+}
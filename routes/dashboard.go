@@ -1,91 +1,223 @@
 package routes
 
 import (
-	"encoding/json"
+	"CyberDefenseEd/QuadDB/auth"
+	"CyberDefenseEd/QuadDB/database"
+	"CyberDefenseEd/QuadDB/util"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
 	"net/http"
-	"os"
-	"text/template"
+	"strconv"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 )
 
-var users map[string]string
-
-func init() {
-	users = make(map[string]string)
-	file, err := os.Open("./config/users.json")
-	if err != nil {
-		panic(err)
-	}
-	defer file.Close()
+const (
+	sessionCookie    = "qdb_session"
+	loginCSRFCookie  = "qdb_login_csrf"
+	csrfField        = "csrf_token"
+	csrfHeader       = "X-CSRF-Token"
+	loginMaxFailures = 5
+	loginLockout     = 15 * time.Minute
+)
 
-	if err := json.NewDecoder(file).Decode(&users); err != nil {
-		panic(err)
-	}
-}
+var loginLimiter = auth.NewLoginLimiter(loginMaxFailures, loginLockout)
 
-func RenderTemplate(w http.ResponseWriter, templateName string, title string, data interface{}) {
+func RenderTemplate(c *gin.Context, templateName string, title string, data interface{}) {
 	tmpl, err := template.ParseFiles(
 		"./dashboard/templates/base.html",
 		"./dashboard/templates/pages/"+templateName,
 	)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(c.Writer, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	err = tmpl.Execute(w, map[string]interface{}{
+	err = tmpl.Execute(c.Writer, map[string]interface{}{
 		"title": title,
 		"data":  data,
+		"user":  c.GetString("authenticatedUser"),
+		"role":  c.GetString("role"),
+		"csrf":  c.GetString("csrfToken"),
 	})
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func authMiddleware(c *gin.Context) {
-	// if _, exists := c.Get("authenticatedUser"); !exists {
-	// 	c.Redirect(http.StatusFound, "/login")
-	// 	c.Abort()
-	// 	return
-	// }
-	c.Next()
+// currentSession returns the dashboard session carried by the request's cookie and its user, if the
+// session is valid and the user still exists with the password and role they logged in with
+func currentSession(c *gin.Context, authConfig AuthConfig) (auth.Session, auth.User, bool) {
+	value, err := c.Cookie(sessionCookie)
+	if err != nil {
+		return auth.Session{}, auth.User{}, false
+	}
+
+	session, err := authConfig.Sessions.Verify(value)
+	if err != nil {
+		return auth.Session{}, auth.User{}, false
+	}
+
+	user, exists := authConfig.Users.Get(session.User)
+	if !exists || !authConfig.Sessions.Current(session, user) {
+		return auth.Session{}, auth.User{}, false
+	}
+
+	return session, user, true
 }
 
-func loginHandler(c *gin.Context) {
-	if c.Request.Method == http.MethodGet {
-		RenderTemplate(c.Writer, "login.html", "Login", nil)
-		return
+// isSafeMethod reports whether a request cannot change anything and so needs no CSRF token
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// setCookie sets an HttpOnly cookie, marked Secure when the request came in over TLS
+func setCookie(c *gin.Context, name, value string, maxAge int, sameSite http.SameSite) {
+	c.SetSameSite(sameSite)
+	c.SetCookie(name, value, maxAge, "/", "", c.Request.TLS != nil, true)
+}
+
+func authMiddleware(authConfig AuthConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, user, ok := currentSession(c, authConfig)
+		if !ok {
+			c.Redirect(http.StatusFound, "/login")
+			c.Abort()
+			return
+		}
+
+		if !isSafeMethod(c.Request.Method) {
+			token := c.PostForm(csrfField)
+			if token == "" {
+				token = c.GetHeader(csrfHeader)
+			}
+			if !authConfig.Sessions.CheckCSRF(session, token) {
+				util.Warn(fmt.Sprintf("Rejected %s %s from %s: missing or invalid CSRF token", c.Request.Method, c.Request.URL.Path, c.ClientIP()))
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+		}
+
+		c.Set("authenticatedUser", session.User)
+		c.Set("role", user.Role)
+		c.Set("session", session)
+		c.Set("csrfToken", authConfig.Sessions.CSRFToken(session))
+		c.Next()
 	}
+}
 
-	var creds struct {
-		Username string `form:"username" json:"username" binding:"required"`
-		Password string `form:"password" json:"password" binding:"required"`
+// requireRole only lets dashboard users with the given role through. It must run after authMiddleware.
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("role") != role {
+			util.Warn(fmt.Sprintf("Rejected %s %s from '%s': requires the %s role", c.Request.Method, c.Request.URL.Path, c.GetString("authenticatedUser"), role))
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("This page requires the %s role", role)})
+			return
+		}
+		c.Next()
 	}
+}
 
-	if err := c.ShouldBind(&creds); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+// renderLogin shows the login form with a fresh anti-forgery token and an optional error
+func renderLogin(c *gin.Context, status int, message string) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	token := hex.EncodeToString(random)
 
-	hashedPassword, exists := users[creds.Username]
-	if !exists || bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(creds.Password)) != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
-		return
+	setCookie(c, loginCSRFCookie, token, int(time.Hour.Seconds()), http.SameSiteStrictMode)
+	c.Set("csrfToken", token)
+	c.Status(status)
+	RenderTemplate(c, "login.html", "Login", gin.H{"error": message})
+}
+
+func loginHandler(authConfig AuthConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet {
+			if _, _, ok := currentSession(c, authConfig); ok {
+				c.Redirect(http.StatusFound, "/")
+				return
+			}
+			renderLogin(c, http.StatusOK, "")
+			return
+		}
+
+		expected, err := c.Cookie(loginCSRFCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(expected), []byte(c.PostForm(csrfField))) != 1 {
+			util.Warn(fmt.Sprintf("Rejected login from %s: missing or invalid CSRF token", c.ClientIP()))
+			renderLogin(c, http.StatusForbidden, "Your login form expired, please try again")
+			return
+		}
+
+		var creds struct {
+			Username string `form:"username" json:"username" binding:"required"`
+			Password string `form:"password" json:"password" binding:"required"`
+		}
+
+		if err := c.ShouldBind(&creds); err != nil {
+			renderLogin(c, http.StatusBadRequest, "Username and password are required")
+			return
+		}
+
+		// Failures count against the address and username together, so guessing from one address
+		// cannot lock the account out for everyone else
+		limitKey := fmt.Sprintf("%s %q", c.ClientIP(), creds.Username)
+		if blocked, wait := loginLimiter.Blocked(limitKey); blocked {
+			util.Warn(fmt.Sprintf("Rejected login for '%s' from %s: too many failed attempts", creds.Username, c.ClientIP()))
+			c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			renderLogin(c, http.StatusTooManyRequests, "Too many failed logins, please try again later")
+			return
+		}
+
+		if _, ok := authConfig.Users.Authenticate(creds.Username, creds.Password); !ok {
+			loginLimiter.Fail(limitKey)
+			util.Warn(fmt.Sprintf("Failed login for '%s' from %s", creds.Username, c.ClientIP()))
+			renderLogin(c, http.StatusUnauthorized, "Invalid username or password")
+			return
+		}
+		loginLimiter.Reset(limitKey)
+
+		// The session is stamped with the stored credentials, so changing them logs the user out
+		user, exists := authConfig.Users.Get(creds.Username)
+		if !exists {
+			renderLogin(c, http.StatusUnauthorized, "Invalid username or password")
+			return
+		}
+		value, _, err := authConfig.Sessions.Issue(user)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		setCookie(c, loginCSRFCookie, "", -1, http.SameSiteStrictMode)
+		setCookie(c, sessionCookie, value, int(authConfig.Sessions.TTL().Seconds()), http.SameSiteLaxMode)
+		util.Info(fmt.Sprintf("User '%s' logged in from %s", creds.Username, c.ClientIP()))
+		c.Redirect(http.StatusFound, "/")
 	}
+}
+
+func logoutHandler(sessions *auth.SessionManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if session, exists := c.Get("session"); exists {
+			sessions.Revoke(session.(auth.Session))
+		}
 
-	c.Set("authenticatedUser", creds.Username)
-	c.Redirect(http.StatusFound, "/")
+		setCookie(c, sessionCookie, "", -1, http.SameSiteLaxMode)
+		c.Redirect(http.StatusSeeOther, "/login")
+	}
 }
 
-func SetupDashboardRoutes(router *gin.Engine, dataDir string, aesKey []byte) {
+func SetupDashboardRoutes(router *gin.Engine, registry *database.Registry, authConfig AuthConfig) {
 	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Accept"},
 		ExposeHeaders:    []string{"Content-Length"},
@@ -96,10 +228,16 @@ func SetupDashboardRoutes(router *gin.Engine, dataDir string, aesKey []byte) {
 		MaxAge: 12 * time.Hour,
 	}))
 
-	router.GET("/login", loginHandler)
-	router.POST("/login", loginHandler)
+	sessions := authConfig.Sessions
+
+	router.GET("/login", loginHandler(authConfig))
+	router.POST("/login", loginHandler(authConfig))
+	router.POST("/logout", authMiddleware(authConfig), logoutHandler(sessions))
 
-	router.GET("/", authMiddleware, func(c *gin.Context) {
-		RenderTemplate(c.Writer, "home.html", "Dashboard", gin.H{})
+	router.GET("/", authMiddleware(authConfig), func(c *gin.Context) {
+		RenderTemplate(c, "home.html", "Dashboard", gin.H{})
 	})
+
+	users := router.Group("/users", authMiddleware(authConfig), requireRole(auth.RoleAdmin))
+	setupUserRoutes(users, authConfig.Users)
 }
@@ -0,0 +1,167 @@
+package routes
+
+import (
+	"CyberDefenseEd/QuadDB/auth"
+	"CyberDefenseEd/QuadDB/database"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// findStatus maps an error from running a query to an HTTP status
+func findStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrInvalidQuery), errors.Is(err, database.ErrInvalidCursor):
+		return http.StatusBadRequest
+	default:
+		return collectionStatus(err)
+	}
+}
+
+// findOptions reads the sort, fields and cursor query parameters shared by the endpoints that list
+// documents: sort=severity:-1,created orders them, fields=title,owner.team picks what is returned
+// of each (or fields=-body leaves it out), and cursor continues after the page that returned it
+func findOptions(c *gin.Context) (database.FindOptions, error) {
+	sortOrder, err := database.ParseSort(c.Query("sort"))
+	if err != nil {
+		return database.FindOptions{}, err
+	}
+
+	var fields []string
+	for _, field := range strings.Split(c.Query("fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	return database.FindOptions{Sort: sortOrder, Fields: fields, Cursor: c.Query("cursor")}, nil
+}
+
+// findResponse formats a page of query results, with a null next_cursor on the last page
+func findResponse(startTime time.Time, result database.FindResult) gin.H {
+	documents := result.Documents
+	if documents == nil {
+		documents = []database.Document{}
+	}
+	var nextCursor interface{}
+	if result.NextCursor != "" {
+		nextCursor = result.NextCursor
+	}
+
+	return gin.H{
+		"_resp":       time.Since(startTime).String(),
+		"_num":        len(documents),
+		"_total":      result.Total,
+		"documents":   documents,
+		"next_cursor": nextCursor,
+	}
+}
+
+// setupQueryRoutes registers the endpoints that find documents with a JSON query filter and with
+// the full-text index
+func setupQueryRoutes(api *gin.RouterGroup, registry *database.Registry) {
+	api.POST("/docs/:db/query", authorize(auth.VerbRead), func(c *gin.Context) {
+		startTime := time.Now()
+
+		var request struct {
+			Filter json.RawMessage `json:"filter"`
+			Sort   string          `json:"sort"`
+			Fields []string        `json:"fields"`
+			Cursor string          `json:"cursor"`
+			Limit  int             `json:"limit"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if request.Limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must not be negative"})
+			return
+		}
+
+		// An empty filter matches every document
+		filter := request.Filter
+		if len(filter) == 0 || string(filter) == "null" {
+			filter = json.RawMessage("{}")
+		}
+
+		query, err := database.ParseQuery(filter)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		sortOrder, err := database.ParseSort(request.Sort)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		db, err := registry.Get(c.Param("db"))
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		result, err := db.Find(query, database.FindOptions{
+			Sort:   sortOrder,
+			Fields: request.Fields,
+			Cursor: request.Cursor,
+			Limit:  request.Limit,
+		})
+		if err != nil {
+			c.JSON(findStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		response := findResponse(startTime, result)
+		response["_plan"] = result.Plan
+		c.JSON(http.StatusOK, response)
+	})
+
+	// Under /collections, since a GET below /docs/:db would shadow the document called "text"
+	api.GET("/collections/:db/text", authorize(auth.VerbRead), func(c *gin.Context) {
+		startTime := time.Now()
+
+		limit := 10
+		if value := c.Query("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a number that is not negative"})
+				return
+			}
+			limit = parsed
+		}
+
+		db, err := registry.Get(c.Param("db"))
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		results, total, err := db.SearchText(c.Query("q"), limit)
+		if err != nil {
+			switch {
+			case errors.Is(err, database.ErrInvalidQuery):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			case errors.Is(err, database.ErrIndexNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			default:
+				c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"_resp":     time.Since(startTime).String(),
+			"_num":      len(results),
+			"_total":    total,
+			"documents": results,
+		})
+	})
+}
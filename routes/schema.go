@@ -0,0 +1,129 @@
+package routes
+
+import (
+	"CyberDefenseEd/QuadDB/auth"
+	"CyberDefenseEd/QuadDB/database"
+	"CyberDefenseEd/QuadDB/util"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// schemaStatus maps an error from managing the schema of a collection to an HTTP status
+func schemaStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrInvalidSchema):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrSchemaNotFound):
+		return http.StatusNotFound
+	default:
+		return collectionStatus(err)
+	}
+}
+
+// setupSchemaRoutes registers the endpoints that attach a JSON Schema to a collection and check the
+// documents it already holds against one
+func setupSchemaRoutes(api *gin.RouterGroup, registry *database.Registry) {
+	api.GET("/collections/:db/schema", authorize(auth.VerbRead), func(c *gin.Context) {
+		startTime := time.Now()
+
+		db, err := registry.Get(c.Param("db"))
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		schema := db.Schema()
+		if schema == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "The collection has no schema"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "schema": schema})
+	})
+
+	api.PUT("/collections/:db/schema", authorize(auth.VerbAdmin), func(c *gin.Context) {
+		startTime := time.Now()
+
+		data, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		name := c.Param("db")
+		db, err := registry.Get(name)
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := db.SetSchema(data); err != nil {
+			c.JSON(schemaStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Set the schema of collection '%s'", name))
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "message": "Schema set successfully", "schema": db.Schema()})
+	})
+
+	api.DELETE("/collections/:db/schema", authorize(auth.VerbAdmin), func(c *gin.Context) {
+		startTime := time.Now()
+
+		name := c.Param("db")
+		db, err := registry.Get(name)
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := db.RemoveSchema(); err != nil {
+			c.JSON(schemaStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		util.Info(fmt.Sprintf("Removed the schema of collection '%s'", name))
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "message": "Schema removed successfully"})
+	})
+
+	// Without a body the stored documents are checked against the schema of the collection; with
+	// one, against that schema, to see what it would reject before setting it
+	api.POST("/collections/:db/schema/validate", authorize(auth.VerbRead), func(c *gin.Context) {
+		startTime := time.Now()
+
+		limit := 100
+		if value := c.Query("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a number that is not negative"})
+				return
+			}
+			limit = parsed
+		}
+
+		data, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		db, err := registry.Get(c.Param("db"))
+		if err != nil {
+			c.JSON(collectionStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		report, err := db.ValidateDocuments(bytes.TrimSpace(data), limit)
+		if err != nil {
+			c.JSON(schemaStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "_num": len(report.Documents), "report": report})
+	})
+}
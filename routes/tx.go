@@ -0,0 +1,116 @@
+package routes
+
+import (
+	"CyberDefenseEd/QuadDB/auth"
+	"CyberDefenseEd/QuadDB/database"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// txOperation is a single write of a POST /api/v1/tx request
+type txOperation struct {
+	Op         string          `json:"op"`
+	Collection string          `json:"collection"`
+	Key        string          `json:"key"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// setupTxRoutes registers the endpoint that applies writes over several collections all together
+func setupTxRoutes(api *gin.RouterGroup, registry *database.Registry) {
+	api.POST("/tx", func(c *gin.Context) {
+		startTime := time.Now()
+
+		var request struct {
+			Operations []txOperation `json:"operations"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(request.Operations) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "At least one operation is required"})
+			return
+		}
+
+		// Check every operation before touching any collection
+		for i, operation := range request.Operations {
+			switch operation.Op {
+			case "create", "update":
+				if operation.Data == nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("operation %d: data field is required", i)})
+					return
+				}
+			case "delete":
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("operation %d: unknown op '%s', expected create, update or delete", i, operation.Op)})
+				return
+			}
+			if operation.Op != "create" && operation.Key == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("operation %d: key field is required", i)})
+				return
+			}
+			if err := database.ValidateCollectionName(operation.Collection); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("operation %d: %v", i, err)})
+				return
+			}
+			if !requestAllows(c, operation.Collection, auth.VerbWrite) {
+				rejectRequest(c, http.StatusForbidden, fmt.Sprintf("Token does not grant %s on '%s'", auth.VerbWrite, operation.Collection))
+				return
+			}
+		}
+
+		var tx *database.Tx
+		joined := make(map[string]*database.Tx)
+		keys := make([]string, len(request.Operations))
+
+		for i, operation := range request.Operations {
+			collectionTx, ok := joined[operation.Collection]
+			if !ok {
+				// Creates may start a collection, like POST /docs/:db; the others need it to exist
+				open := registry.Get
+				if operation.Op == "create" {
+					open = registry.Open
+				}
+
+				db, err := open(operation.Collection)
+				if err != nil {
+					c.JSON(collectionStatus(err), gin.H{"error": fmt.Sprintf("operation %d: %v", i, err)})
+					return
+				}
+
+				if tx == nil {
+					tx = db.Begin()
+					collectionTx = tx
+				} else {
+					collectionTx = tx.Join(db)
+				}
+				joined[operation.Collection] = collectionTx
+			}
+
+			var err error
+			switch operation.Op {
+			case "create":
+				keys[i], err = collectionTx.Create(operation.Key, operation.Data)
+			case "update":
+				keys[i], err = operation.Key, collectionTx.Update(operation.Key, operation.Data)
+			case "delete":
+				keys[i], err = operation.Key, collectionTx.Delete(operation.Key)
+			}
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("operation %d: %v", i, err)})
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(documentStatus(err), documentError(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"_resp": time.Since(startTime).String(), "message": "Transaction committed successfully", "keys": keys})
+	})
+}
@@ -0,0 +1,85 @@
+package routes
+
+import (
+	"CyberDefenseEd/QuadDB/auth"
+	"CyberDefenseEd/QuadDB/util"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// renderUsers shows the user management page with an optional outcome of the last action
+func renderUsers(c *gin.Context, users *auth.UserStore, status int, message string, err error) {
+	data := gin.H{
+		"users":   users.List(),
+		"roles":   []string{auth.RoleAdmin, auth.RoleReadWrite, auth.RoleReadOnly},
+		"message": message,
+	}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+
+	c.Status(status)
+	RenderTemplate(c, "users.html", "Users", data)
+}
+
+// userActionStatus maps a user store error to the status of the page showing it
+func userActionStatus(err error) int {
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, auth.ErrUserExists), errors.Is(err, auth.ErrLastAdmin):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// setupUserRoutes registers the dashboard pages for managing users. Access is limited by the group.
+func setupUserRoutes(group *gin.RouterGroup, users *auth.UserStore) {
+	// finish logs a successful action and shows the page again with its outcome
+	finish := func(c *gin.Context, err error, message string) {
+		if err != nil {
+			renderUsers(c, users, userActionStatus(err), "", err)
+			return
+		}
+		util.Info(fmt.Sprintf("%s (by '%s')", message, c.GetString("authenticatedUser")))
+		renderUsers(c, users, http.StatusOK, message, nil)
+	}
+
+	group.GET("", func(c *gin.Context) {
+		renderUsers(c, users, http.StatusOK, "", nil)
+	})
+
+	group.POST("", func(c *gin.Context) {
+		username := c.PostForm("username")
+		role := c.PostForm("role")
+
+		err := users.Add(username, c.PostForm("password"), role)
+		finish(c, err, fmt.Sprintf("Added user '%s' as %s", username, role))
+	})
+
+	group.POST("/:name/password", func(c *gin.Context) {
+		username := c.Param("name")
+
+		err := users.SetPassword(username, c.PostForm("password"))
+		finish(c, err, fmt.Sprintf("Changed the password of '%s'", username))
+	})
+
+	group.POST("/:name/role", func(c *gin.Context) {
+		username := c.Param("name")
+		role := c.PostForm("role")
+
+		err := users.SetRole(username, role)
+		finish(c, err, fmt.Sprintf("Changed the role of '%s' to %s", username, role))
+	})
+
+	group.POST("/:name/delete", func(c *gin.Context) {
+		username := c.Param("name")
+
+		err := users.Remove(username)
+		finish(c, err, fmt.Sprintf("Removed user '%s'", username))
+	})
+}
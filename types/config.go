@@ -1,8 +1,30 @@
 package types
 
+import "time"
+
 // Config structure for application configuration
 type Config struct {
-	Port    int    `yaml:"port"`
-	DataDir string `yaml:"data_dir"`
-	AESKey  string `yaml:"aes_key"`
+	Port    int       `yaml:"port"`
+	DataDir string    `yaml:"data_dir"`
+	AESKey  string    `yaml:"aes_key"`
+	KeyFile string    `yaml:"key_file"` // Read the master key from a file instead of aes_key
+	KeyEnv  string    `yaml:"key_env"`  // Read the master key from an environment variable instead of aes_key
+	KMSDir  string    `yaml:"kms_dir"`  // Let a local KMS directory generate and keep the master key
+	KDF     KDFConfig `yaml:"kdf"`
+
+	UsersFile   string   `yaml:"users_file"`   // Dashboard users, defaults to ./config/users.json
+	TokensFile  string   `yaml:"tokens_file"`  // API tokens, defaults to ./config/tokens.json
+	CORSOrigins []string `yaml:"cors_origins"` // Origins allowed to call the API with credentials
+
+	SessionSecret string        `yaml:"session_secret"` // Signs dashboard sessions, random on every start when empty
+	SessionTTL    time.Duration `yaml:"session_ttl"`    // How long a dashboard login lasts, 12h by default
+
+	ReapInterval time.Duration `yaml:"reap_interval"` // How often expired documents are removed, 1m by default
+}
+
+// KDFConfig holds the Argon2id cost used to derive collection keys from the AES key; zero values use the defaults
+type KDFConfig struct {
+	Time      uint32 `yaml:"time"`
+	MemoryKiB uint32 `yaml:"memory_kib"`
+	Threads   uint8  `yaml:"threads"`
 }
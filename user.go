@@ -0,0 +1,125 @@
+package main
+
+import (
+	"CyberDefenseEd/QuadDB/auth"
+	"CyberDefenseEd/QuadDB/types"
+	"CyberDefenseEd/QuadDB/util"
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const userUsage = `Usage:
+  quaddb user add <name> [--role admin|read-write|read-only] [--password <password>]
+  quaddb user remove <name>
+  quaddb user passwd <name> [--password <password>]
+  quaddb user role <name> <admin|read-write|read-only>
+  quaddb user list`
+
+// userCommand implements `quaddb user`, managing the dashboard users in the users file.
+// A running server picks up the changes without a restart.
+func userCommand(config types.Config, args []string) {
+	if len(args) == 0 {
+		fmt.Println(userUsage)
+		os.Exit(1)
+	}
+
+	flags := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+	role := flags.String("role", auth.RoleReadOnly, "Role of the new user: admin, read-write or read-only")
+	password := flags.String("password", "", "Password, prompted for when omitted")
+	flags.Parse(reorderFlags(args[1:]))
+
+	users, err := auth.LoadUsers(config.UsersFile)
+	if err != nil {
+		util.Error(fmt.Sprintf("Could not load users: %v", err))
+		os.Exit(1)
+	}
+
+	name := flags.Arg(0)
+	if args[0] != "list" && name == "" {
+		fmt.Println(userUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "add":
+		err = users.Add(name, readPassword(*password), *role)
+		if err == nil {
+			util.Info(fmt.Sprintf("Added user '%s' as %s", name, *role))
+		}
+	case "remove":
+		err = users.Remove(name)
+		if err == nil {
+			util.Info(fmt.Sprintf("Removed user '%s'", name))
+		}
+	case "passwd":
+		if _, exists := users.Get(name); !exists {
+			err = auth.ErrUserNotFound
+			break
+		}
+		err = users.SetPassword(name, readPassword(*password))
+		if err == nil {
+			util.Info(fmt.Sprintf("Changed the password of '%s'", name))
+		}
+	case "role":
+		err = users.SetRole(name, flags.Arg(1))
+		if err == nil {
+			util.Info(fmt.Sprintf("Changed the role of '%s' to %s", name, flags.Arg(1)))
+		}
+	case "list":
+		for _, user := range users.List() {
+			fmt.Printf("%-32s %s\n", user.Username, user.Role)
+		}
+	default:
+		fmt.Println(userUsage)
+		os.Exit(1)
+	}
+
+	if err != nil {
+		util.Error(fmt.Sprintf("%v", err))
+		os.Exit(1)
+	}
+}
+
+// reorderFlags moves flags in front of positional arguments, so `user add alice --role admin` parses
+func reorderFlags(args []string) []string {
+	var flags, positional []string
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			positional = append(positional, args[i])
+			continue
+		}
+		flags = append(flags, args[i])
+		if !strings.Contains(args[i], "=") && i+1 < len(args) {
+			flags = append(flags, args[i+1])
+			i++
+		}
+	}
+	return append(flags, positional...)
+}
+
+// readPassword returns password, or reads one line from stdin when it is empty. On a terminal the
+// line is not echoed; piped input is read as is, so scripts can still set passwords.
+func readPassword(password string) string {
+	if password != "" {
+		return password
+	}
+
+	fmt.Print("Password: ")
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		line, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			util.Error(fmt.Sprintf("Could not read the password: %v", err))
+			os.Exit(1)
+		}
+		return string(line)
+	}
+
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
@@ -1,11 +0,0 @@
-// ./util/data.go
-
-package util
-
-import "bytes"
-
-func PadData(data []byte, blockSize int) []byte {
-	padding := blockSize - (len(data) % blockSize)
-	padText := bytes.Repeat([]byte{byte(padding)}, padding)
-	return append(data, padText...)
-}
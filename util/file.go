@@ -0,0 +1,71 @@
+// ./util/file.go
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to a temporary file next to filename, syncs it and renames it into place,
+// so a crash leaves either the old or the new contents but never a partial file. When backup is not
+// empty the file being replaced is kept under that name.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode, backup string) error {
+	dir := filepath.Dir(filename)
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	// Clean up the temp file on any failure before the final rename
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(tmpName)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+
+	if backup != "" {
+		err := os.Rename(filename, backup)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmpName, filename); err != nil {
+		return err
+	}
+	committed = true
+
+	return SyncDir(dir)
+}
+
+// SyncDir flushes a directory entry so that renames and removals inside it survive a crash
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// Some platforms cannot sync directories; the rename itself has still happened
+	d.Sync()
+	return nil
+}